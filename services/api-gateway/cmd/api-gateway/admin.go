@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http"
+)
+
+// newAdminMux serves operational endpoints. It is bound to ADMIN_PORT, which
+// is not exposed through the Service or Ingress, so it needs no auth.
+func newAdminMux(store *configStore, m *gatewayMetrics) *http.ServeMux {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = m.registry.writeText(w)
+	})
+
+	mux.HandleFunc("/admin/upstreams", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{
+			"upstreams": store.runtime().table.snapshot(),
+		})
+	})
+
+	mux.HandleFunc("/admin/config", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, store.status())
+	})
+
+	return mux
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerHalfOpen:
+		return "half_open"
+	case breakerOpen:
+		return "open"
+	}
+	return "unknown"
+}
+
+var errBreakerOpen = errors.New("circuit breaker open")
+
+// circuitBreaker guards a single upstream. It opens after FailureThreshold
+// consecutive failures, rejects calls for OpenTimeout, then lets a limited
+// number of probes through (half-open) to decide whether to close again.
+type circuitBreaker struct {
+	name          string
+	cfg           breakerConfig
+	now           func() time.Time
+	onStateChange func(name string, from, to breakerState)
+
+	mu         sync.Mutex
+	state      breakerState
+	generation uint64
+	failures   int
+	openedAt   time.Time
+	inFlight   int
+	successes  int
+}
+
+type breakerSnapshot struct {
+	State    string     `json:"state"`
+	Failures int        `json:"consecutive_failures"`
+	OpenedAt *time.Time `json:"opened_at,omitempty"`
+}
+
+func newCircuitBreaker(name string, cfg breakerConfig, onStateChange func(string, breakerState, breakerState)) *circuitBreaker {
+	return &circuitBreaker{
+		name:          name,
+		cfg:           cfg,
+		now:           time.Now,
+		onStateChange: onStateChange,
+	}
+}
+
+// allow reports whether a call may proceed. The returned generation must be
+// passed back to record so results from before a state change are ignored.
+func (b *circuitBreaker) allow() (uint64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < time.Duration(b.cfg.OpenTimeout) {
+			return 0, errBreakerOpen
+		}
+		b.setState(breakerHalfOpen)
+		fallthrough
+	case breakerHalfOpen:
+		if b.inFlight >= b.cfg.HalfOpenRequests {
+			return 0, errBreakerOpen
+		}
+		b.inFlight++
+	}
+	return b.generation, nil
+}
+
+func (b *circuitBreaker) record(generation uint64, success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if generation != b.generation {
+		return
+	}
+
+	switch b.state {
+	case breakerClosed:
+		if success {
+			b.failures = 0
+			return
+		}
+		b.failures++
+		if b.failures >= b.cfg.FailureThreshold {
+			b.setState(breakerOpen)
+		}
+	case breakerHalfOpen:
+		b.inFlight--
+		if !success {
+			b.setState(breakerOpen)
+			return
+		}
+		b.successes++
+		if b.successes >= b.cfg.HalfOpenRequests {
+			b.setState(breakerClosed)
+		}
+	}
+}
+
+// release hands back a call allowed by allow that ended without saying
+// anything about the upstream, such as one the caller canceled.
+func (b *circuitBreaker) release(generation uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if generation == b.generation && b.state == breakerHalfOpen {
+		b.inFlight--
+	}
+}
+
+// retryAfter is how long a rejected caller should wait: what is left of the
+// open period, and at least a second while probes are in flight.
+func (b *circuitBreaker) retryAfter() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	d := time.Second
+	if b.state == breakerOpen {
+		d = max(d, time.Duration(b.cfg.OpenTimeout)-b.now().Sub(b.openedAt))
+	}
+	return d
+}
+
+func (b *circuitBreaker) currentState() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+func (b *circuitBreaker) snapshot() breakerSnapshot {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := breakerSnapshot{State: b.state.String(), Failures: b.failures}
+	if b.state != breakerClosed {
+		t := b.openedAt
+		s.OpenedAt = &t
+	}
+	return s
+}
+
+// setState must be called with b.mu held.
+func (b *circuitBreaker) setState(to breakerState) {
+	from := b.state
+	if from == to {
+		return
+	}
+
+	b.state = to
+	b.generation++
+	b.inFlight = 0
+	b.successes = 0
+	switch to {
+	case breakerOpen:
+		b.openedAt = b.now()
+	case breakerClosed:
+		b.failures = 0
+	}
+
+	if b.onStateChange != nil {
+		b.onStateChange(b.name, from, to)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestBreaker(now *time.Time) *circuitBreaker {
+	b := newCircuitBreaker("payments", breakerConfig{
+		FailureThreshold: 3,
+		OpenTimeout:      duration(10 * time.Second),
+		HalfOpenRequests: 1,
+	}, nil)
+	b.now = func() time.Time { return *now }
+	return b
+}
+
+func TestBreakerOpensAfterConsecutiveFailures(t *testing.T) {
+	now := time.Now()
+	b := newTestBreaker(&now)
+
+	for i := 0; i < 3; i++ {
+		gen, err := b.allow()
+		if err != nil {
+			t.Fatalf("attempt %d: unexpected rejection: %v", i, err)
+		}
+		b.record(gen, false)
+	}
+
+	if _, err := b.allow(); err != errBreakerOpen {
+		t.Fatalf("expected breaker to be open, got %v", err)
+	}
+}
+
+func TestBreakerSuccessResetsFailureCount(t *testing.T) {
+	now := time.Now()
+	b := newTestBreaker(&now)
+
+	for _, ok := range []bool{false, false, true, false, false} {
+		gen, _ := b.allow()
+		b.record(gen, ok)
+	}
+
+	if got := b.snapshot().State; got != "closed" {
+		t.Fatalf("expected closed, got %s", got)
+	}
+}
+
+func TestBreakerHalfOpenProbe(t *testing.T) {
+	now := time.Now()
+	b := newTestBreaker(&now)
+	for i := 0; i < 3; i++ {
+		gen, _ := b.allow()
+		b.record(gen, false)
+	}
+
+	now = now.Add(11 * time.Second)
+	gen, err := b.allow()
+	if err != nil {
+		t.Fatalf("expected probe to be allowed after open timeout, got %v", err)
+	}
+	if _, err := b.allow(); err != errBreakerOpen {
+		t.Fatalf("expected second concurrent probe to be rejected, got %v", err)
+	}
+
+	b.record(gen, true)
+	if got := b.snapshot().State; got != "closed" {
+		t.Fatalf("expected closed after successful probe, got %s", got)
+	}
+}
+
+func TestBreakerIgnoresStaleResults(t *testing.T) {
+	now := time.Now()
+	b := newTestBreaker(&now)
+
+	stale, _ := b.allow()
+	for i := 0; i < 3; i++ {
+		gen, _ := b.allow()
+		b.record(gen, false)
+	}
+	now = now.Add(11 * time.Second)
+	probe, _ := b.allow()
+
+	// a slow request started while closed must not close the breaker
+	b.record(stale, true)
+	if got := b.snapshot().State; got != "half_open" {
+		t.Fatalf("expected half_open, got %s", got)
+	}
+	b.record(probe, false)
+	if got := b.snapshot().State; got != "open" {
+		t.Fatalf("expected open after failed probe, got %s", got)
+	}
+}
+
+func TestBreakerReleaseFreesHalfOpenProbe(t *testing.T) {
+	now := time.Now()
+	b := newTestBreaker(&now)
+	for i := 0; i < 3; i++ {
+		gen, _ := b.allow()
+		b.record(gen, false)
+	}
+
+	now = now.Add(11 * time.Second)
+	gen, _ := b.allow()
+	b.release(gen)
+	if got := b.snapshot().State; got != "half_open" {
+		t.Fatalf("expected a released probe to leave the breaker half_open, got %s", got)
+	}
+	if _, err := b.allow(); err != nil {
+		t.Fatalf("expected another probe after release, got %v", err)
+	}
+}
+
+func TestBreakerRetryAfterIsTimeLeftOpen(t *testing.T) {
+	now := time.Now()
+	b := newTestBreaker(&now)
+	for i := 0; i < 3; i++ {
+		gen, _ := b.allow()
+		b.record(gen, false)
+	}
+
+	now = now.Add(4 * time.Second)
+	if got := b.retryAfter(); got != 6*time.Second {
+		t.Fatalf("expected 6s left open, got %s", got)
+	}
+	now = now.Add(7 * time.Second)
+	_, _ = b.allow()
+	if got := b.retryAfter(); got != time.Second {
+		t.Fatalf("expected 1s while half open, got %s", got)
+	}
+}
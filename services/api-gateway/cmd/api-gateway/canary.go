@@ -0,0 +1,99 @@
+package main
+
+import (
+	"hash/fnv"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// routeVersion is one upstream a route can send traffic to. Routes without
+// explicit versions have a single "default" version with weight 100.
+type routeVersion struct {
+	name         string
+	upstream     *upstream
+	weight       int
+	matchHeaders map[string]string
+}
+
+// pickVersion chooses the version for a request. Explicit header overrides
+// win; otherwise the caller's sub claim is hashed into a stable bucket so a
+// user keeps seeing the same version while weights are unchanged.
+// Anonymous requests are assigned at random.
+func pickVersion(rt *route, r *http.Request) *routeVersion {
+	if len(rt.versions) == 1 {
+		return rt.versions[0]
+	}
+
+	for _, v := range rt.versions {
+		if len(v.matchHeaders) > 0 && headersMatch(r, v.matchHeaders) {
+			return v
+		}
+	}
+
+	var bucket int
+	if sub := subjectFromContext(r); sub != "" {
+		bucket = stickyBucket(rt.cfg.Prefix, sub)
+	} else {
+		bucket = rand.IntN(100)
+	}
+
+	for _, v := range rt.versions {
+		if bucket < v.weight {
+			return v
+		}
+		bucket -= v.weight
+	}
+	return rt.versions[len(rt.versions)-1]
+}
+
+// stickyBucket maps a subject to [0,100). The route prefix is mixed in so
+// the same users are not always the canary cohort on every route.
+func stickyBucket(prefix, sub string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(prefix))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write([]byte(sub))
+	return int(h.Sum32() % 100)
+}
+
+func headersMatch(r *http.Request, want map[string]string) bool {
+	for k, v := range want {
+		if !strings.EqualFold(strings.TrimSpace(r.Header.Get(k)), v) {
+			return false
+		}
+	}
+	return true
+}
+
+func subjectFromContext(r *http.Request) string {
+	claims, _ := r.Context().Value(ctxKeyClaims{}).(jwt.MapClaims)
+	sub, _ := claims["sub"].(string)
+	return sub
+}
+
+// statusRecorder remembers the status code written to the client.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
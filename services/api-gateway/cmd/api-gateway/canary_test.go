@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func newCanaryRoute() *route {
+	return &route{
+		cfg: routeConfig{Prefix: "/v1/payments"},
+		versions: []*routeVersion{
+			{name: "stable", weight: 90},
+			{name: "canary", weight: 10, matchHeaders: map[string]string{"X-Canary": "true"}},
+		},
+	}
+}
+
+func requestAs(sub string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/v1/payments", nil)
+	if sub != "" {
+		r = r.WithContext(withClaims(context.Background(), jwt.MapClaims{"sub": sub}))
+	}
+	return r
+}
+
+func TestPickVersionHeaderOverride(t *testing.T) {
+	rt := newCanaryRoute()
+	r := requestAs("user-1")
+	r.Header.Set("X-Canary", "true")
+
+	if v := pickVersion(rt, r); v.name != "canary" {
+		t.Fatalf("expected override header to force canary, got %s", v.name)
+	}
+}
+
+func TestPickVersionIsStickyPerSubject(t *testing.T) {
+	rt := newCanaryRoute()
+	for i := 0; i < 50; i++ {
+		sub := "user-" + strconv.Itoa(i)
+		first := pickVersion(rt, requestAs(sub)).name
+		for j := 0; j < 5; j++ {
+			if got := pickVersion(rt, requestAs(sub)).name; got != first {
+				t.Fatalf("subject %s moved from %s to %s", sub, first, got)
+			}
+		}
+	}
+}
+
+func TestPickVersionFollowsWeights(t *testing.T) {
+	rt := newCanaryRoute()
+	canary := 0
+	const n = 10000
+	for i := 0; i < n; i++ {
+		if pickVersion(rt, requestAs("user-"+strconv.Itoa(i))).name == "canary" {
+			canary++
+		}
+	}
+	if canary < n*7/100 || canary > n*13/100 {
+		t.Fatalf("expected roughly 10%% canary traffic, got %d/%d", canary, n)
+	}
+}
+
+func TestRouteVersionWeightsMustAddUp(t *testing.T) {
+	gc := &gatewayConfig{
+		JWT:       jwtConfig{Issuer: "i", Audience: "a", PublicKey: "k"},
+		Upstreams: []upstreamConfig{{Name: "v1", Endpoints: []string{"http://v1"}}, {Name: "v2", Endpoints: []string{"http://v2"}}},
+		Routes: []routeConfig{{Prefix: "/v1/payments", Versions: []versionConfig{
+			{Name: "stable", Upstream: "v1", Weight: 80},
+			{Name: "canary", Upstream: "v2", Weight: 10},
+		}}},
+	}
+	gc.applyDefaults()
+	if err := gc.validate(); err == nil {
+		t.Fatal("expected weights adding up to 90 to be rejected")
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// gatewayRuntime is one validated, immutable generation of the dynamic
+// configuration. Requests pick up the current generation when they arrive
+// and keep using it until they finish, so a reload never disturbs requests
+// already in flight.
+type gatewayRuntime struct {
+	version  string
+	source   string
+	loadedAt time.Time
+	config   *gatewayConfig
+	auth     *jwtVerifier
+	table    *proxyTable
+}
+
+type jwtVerifier struct {
+	issuer   string
+	audience string
+	keys     keySource
+}
+
+type reloadFailure struct {
+	Version string    `json:"version"`
+	Error   string    `json:"error"`
+	At      time.Time `json:"at"`
+}
+
+// configStore owns the active gatewayRuntime and swaps it atomically when a
+// new configuration has been fully built and validated.
+type configStore struct {
+	metrics     *gatewayMetrics
+	health      *healthChecker
+	healthHTTP  *http.Client
+	jwtDefaults jwtConfig
+	// GATEWAY_IDENTITY_SECRET; process-level, so it survives reloads
+	identitySecret []byte
+
+	current atomic.Pointer[gatewayRuntime]
+
+	mu          sync.Mutex // serialises reloads
+	reloads     int
+	lastFailure *reloadFailure
+}
+
+func newConfigStore(jwtDefaults jwtConfig, m *gatewayMetrics, health *healthChecker) *configStore {
+	return &configStore{
+		metrics:     m,
+		health:      health,
+		healthHTTP:  &http.Client{},
+		jwtDefaults: jwtDefaults,
+	}
+}
+
+func (s *configStore) runtime() *gatewayRuntime {
+	return s.current.Load()
+}
+
+// load validates raw and, only if every part of it builds, makes it the
+// active configuration. On error the previous configuration stays active.
+func (s *configStore) load(raw []byte, source string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	version := configVersion(raw)
+	prev := s.current.Load()
+	if prev != nil && prev.version == version {
+		return nil
+	}
+
+	rt, err := s.build(raw, source, version, prev)
+	if err != nil {
+		s.lastFailure = &reloadFailure{Version: version, Error: err.Error(), At: time.Now().UTC()}
+		s.metrics.configReloads.inc("failure")
+		return err
+	}
+
+	s.current.Store(rt)
+	s.reloads++
+	s.lastFailure = nil
+	s.metrics.configReloads.inc("success")
+	s.metrics.configInfo.reset()
+	s.metrics.configInfo.set(1, version)
+	s.metrics.breakerState.reset()
+	for name, u := range rt.table.upstreams {
+		s.metrics.breakerState.set(float64(u.breaker.currentState()), name)
+	}
+	s.health.setDependencies(gatewayDependencies(rt.auth.keys, rt.config, s.healthHTTP))
+	return nil
+}
+
+func (s *configStore) build(raw []byte, source, version string, prev *gatewayRuntime) (*gatewayRuntime, error) {
+	gc, err := parseGatewayConfig(raw, s.jwtDefaults)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys keySource
+	if prev != nil && prev.config.JWT.PublicKey == gc.JWT.PublicKey && prev.config.JWT.JWKSURL == gc.JWT.JWKSURL {
+		// keep the JWKS cache warm across unrelated changes
+		keys = prev.auth.keys
+	} else if gc.JWT.JWKSURL != "" {
+		keys = newJWKSKeySource(gc.JWT.JWKSURL)
+	} else {
+		pub, err := parseRSAPublicKeyFromPEM(gc.JWT.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid jwt.public_key: %w", err)
+		}
+		keys = &staticKeySource{pub: pub}
+	}
+
+	auth := &jwtVerifier{issuer: gc.JWT.Issuer, audience: gc.JWT.Audience, keys: keys}
+
+	var prevTable *proxyTable
+	if prev != nil {
+		prevTable = prev.table
+	}
+	table, err := newProxyTable(auth, gc, s.metrics, prevTable)
+	if err != nil {
+		return nil, err
+	}
+	table.identitySecret = s.identitySecret
+
+	return &gatewayRuntime{
+		version:  version,
+		source:   source,
+		loadedAt: time.Now().UTC(),
+		config:   gc,
+		auth:     auth,
+		table:    table,
+	}, nil
+}
+
+// watchFile polls path and reloads when its content changes. Kubernetes
+// updates mounted ConfigMaps by swapping a symlink, which inotify-style
+// watchers on the file itself miss, so polling the content is the robust
+// option. SIGHUP forces an immediate check.
+func (s *configStore) watchFile(ctx context.Context, path string, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	var lastFailed string
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		case <-hup:
+			lastFailed = ""
+		}
+
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf(`{"msg":"config read failed","path":"%s","error":%q}`, path, err.Error())
+			continue
+		}
+
+		version := configVersion(raw)
+		if version == s.runtime().version || version == lastFailed {
+			continue
+		}
+
+		if err := s.load(raw, path); err != nil {
+			lastFailed = version
+			log.Printf(`{"msg":"config rejected, keeping previous","version":"%s","active":"%s","error":%q}`,
+				version, s.runtime().version, err.Error())
+			continue
+		}
+		lastFailed = ""
+		log.Printf(`{"msg":"config reloaded","version":"%s","path":"%s"}`, version, path)
+	}
+}
+
+// authMiddleware authenticates against whichever JWT settings are active
+// when the request arrives.
+func (s *configStore) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authMiddleware(s.runtime().auth, next).ServeHTTP(w, r)
+	})
+}
+
+func (s *configStore) status() map[string]any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rt := s.current.Load()
+	cfg := *rt.config
+	if cfg.JWT.PublicKey != "" {
+		cfg.JWT.PublicKey = "(set)"
+	}
+	return map[string]any{
+		"version":      rt.version,
+		"source":       rt.source,
+		"loaded_at":    rt.loadedAt,
+		"reloads":      s.reloads,
+		"last_failure": s.lastFailure,
+		"config":       cfg,
+	}
+}
+
+func configVersion(raw []byte) string {
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:6])
+}
+
+func sameUpstreamConfig(a, b upstreamConfig) bool {
+	return reflect.DeepEqual(a, b)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+)
+
+func testJWTDefaults(t *testing.T) jwtConfig {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	return jwtConfig{
+		Issuer:    "fintech-auth",
+		Audience:  "fintech-platform",
+		PublicKey: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+	}
+}
+
+func newTestStore(t *testing.T) *configStore {
+	m := newGatewayMetrics()
+	return newConfigStore(testJWTDefaults(t), m, newHealthChecker(time.Minute, time.Second, m))
+}
+
+const testConfigV1 = `{
+  "upstreams": [{"name": "payments", "endpoints": ["http://payments.local"]}],
+  "routes": [{"prefix": "/v1/payments", "upstream": "payments"}]
+}`
+
+const testConfigV2 = `{
+  "upstreams": [
+    {"name": "payments", "endpoints": ["http://payments.local"]},
+    {"name": "users", "endpoints": ["http://users.local"]}
+  ],
+  "routes": [
+    {"prefix": "/v1/payments", "upstream": "payments"},
+    {"prefix": "/v1/users", "upstream": "users"}
+  ]
+}`
+
+func TestConfigStoreRejectsInvalidConfigAndKeepsLastGood(t *testing.T) {
+	s := newTestStore(t)
+	if err := s.load([]byte(testConfigV1), "test"); err != nil {
+		t.Fatalf("initial load: %v", err)
+	}
+	good := s.runtime().version
+
+	bad := `{"routes": [{"prefix": "/v1/users", "upstream": "missing"}]}`
+	if err := s.load([]byte(bad), "test"); err == nil {
+		t.Fatal("expected config with unknown upstream to be rejected")
+	}
+
+	if s.runtime().version != good {
+		t.Fatalf("expected version %s to stay active, got %s", good, s.runtime().version)
+	}
+	if s.lastFailure == nil {
+		t.Fatal("expected the rejected version to be recorded")
+	}
+}
+
+func TestConfigStoreKeepsBreakerStateForUnchangedUpstreams(t *testing.T) {
+	s := newTestStore(t)
+	if err := s.load([]byte(testConfigV1), "test"); err != nil {
+		t.Fatalf("initial load: %v", err)
+	}
+	before := s.runtime().table.upstreams["payments"]
+
+	if err := s.load([]byte(testConfigV2), "test"); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	rt := s.runtime()
+
+	if rt.table.upstreams["payments"] != before {
+		t.Fatal("expected unchanged upstream to be carried over")
+	}
+	if rt.table.match("/v1/users/42") == nil {
+		t.Fatal("expected new route to be active after reload")
+	}
+}
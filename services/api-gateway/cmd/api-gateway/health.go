@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dependency is something the gateway needs in order to serve traffic.
+// Only critical dependencies affect /readyz; the rest are reported.
+type dependency struct {
+	name     string
+	kind     string
+	critical bool
+	check    func(ctx context.Context) error
+}
+
+type dependencyStatus struct {
+	Name      string     `json:"name"`
+	Type      string     `json:"type"`
+	Critical  bool       `json:"critical"`
+	Status    string     `json:"status"`
+	Error     string     `json:"error,omitempty"`
+	CheckedAt *time.Time `json:"checked_at,omitempty"`
+	LatencyMS int64      `json:"latency_ms"`
+}
+
+// healthChecker probes dependencies in the background so /readyz answers
+// from cached results and never blocks on a slow upstream.
+type healthChecker struct {
+	interval time.Duration
+	timeout  time.Duration
+	metrics  *gatewayMetrics
+
+	mu     sync.RWMutex
+	deps   []dependency
+	status map[string]dependencyStatus
+}
+
+func newHealthChecker(interval, timeout time.Duration, m *gatewayMetrics) *healthChecker {
+	return &healthChecker{
+		interval: interval,
+		timeout:  timeout,
+		metrics:  m,
+		status:   map[string]dependencyStatus{},
+	}
+}
+
+// setDependencies replaces the checked set. Results for dependencies that
+// are still present are kept so readiness doesn't flap on reconfiguration.
+func (h *healthChecker) setDependencies(deps []dependency) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	status := map[string]dependencyStatus{}
+	for _, d := range deps {
+		st, ok := h.status[d.name]
+		if !ok || st.Type != d.kind {
+			st = dependencyStatus{Name: d.name, Type: d.kind, Status: "unknown"}
+		}
+		st.Critical = d.critical
+		status[d.name] = st
+	}
+	h.deps = deps
+	h.status = status
+}
+
+func (h *healthChecker) run(ctx context.Context) {
+	h.checkAll(ctx)
+
+	t := time.NewTicker(h.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			h.checkAll(ctx)
+		}
+	}
+}
+
+func (h *healthChecker) checkAll(ctx context.Context) {
+	h.mu.RLock()
+	deps := append([]dependency(nil), h.deps...)
+	h.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, d := range deps {
+		wg.Add(1)
+		go func(d dependency) {
+			defer wg.Done()
+			h.checkOne(ctx, d)
+		}(d)
+	}
+	wg.Wait()
+}
+
+func (h *healthChecker) checkOne(ctx context.Context, d dependency) {
+	cctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := d.check(cctx)
+	now := time.Now()
+
+	st := dependencyStatus{
+		Name:      d.name,
+		Type:      d.kind,
+		Critical:  d.critical,
+		Status:    "up",
+		CheckedAt: &now,
+		LatencyMS: now.Sub(start).Milliseconds(),
+	}
+	up := 1.0
+	if err != nil {
+		st.Status = "down"
+		st.Error = err.Error()
+		up = 0
+	}
+
+	h.mu.Lock()
+	if _, ok := h.status[d.name]; ok {
+		h.status[d.name] = st
+	}
+	h.mu.Unlock()
+
+	h.metrics.dependencyUp.set(up, d.name, d.kind)
+}
+
+// report returns whether every critical dependency is up, along with the
+// status of all dependencies in check order.
+func (h *healthChecker) report() (bool, []dependencyStatus) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	ready := true
+	out := make([]dependencyStatus, 0, len(h.deps))
+	for _, d := range h.deps {
+		st := h.status[d.name]
+		if st.Critical && st.Status != "up" {
+			ready = false
+		}
+		out = append(out, st)
+	}
+	return ready, out
+}
+
+func (h *healthChecker) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	ready, deps := h.report()
+	status, code := "ready", http.StatusOK
+	if !ready {
+		status, code = "not_ready", http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, map[string]any{
+		"status":       status,
+		"dependencies": deps,
+	})
+}
+
+// gatewayDependencies lists the key source and every configured upstream.
+func gatewayDependencies(keys keySource, gc *gatewayConfig, client *http.Client) []dependency {
+	deps := []dependency{{
+		name:     "jwt-keys",
+		kind:     "key_source",
+		critical: true,
+		check:    keys.check,
+	}}
+
+	for _, uc := range gc.Upstreams {
+		uc := uc
+		deps = append(deps, dependency{
+			name:     uc.Name,
+			kind:     "upstream",
+			critical: uc.Critical,
+			check: func(ctx context.Context) error {
+				return checkUpstream(ctx, client, uc)
+			},
+		})
+	}
+	return deps
+}
+
+// checkUpstream succeeds when at least one endpoint answers its health path
+// with a 2xx, mirroring how the proxy fails over between endpoints.
+func checkUpstream(ctx context.Context, client *http.Client, uc upstreamConfig) error {
+	var errs []string
+	for _, raw := range uc.Endpoints {
+		target := strings.TrimSuffix(raw, "/") + uc.HealthPath
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+		resp.Body.Close()
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return nil
+		}
+		errs = append(errs, fmt.Sprintf("%s returned %d", target, resp.StatusCode))
+	}
+	return errors.New(strings.Join(errs, "; "))
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReadyzReflectsCriticalDependencies(t *testing.T) {
+	h := newHealthChecker(time.Minute, time.Second, newGatewayMetrics())
+	h.setDependencies([]dependency{
+		{name: "jwt-keys", kind: "key_source", critical: true, check: func(context.Context) error { return nil }},
+		{name: "user-service", kind: "upstream", critical: false, check: func(context.Context) error { return errors.New("down") }},
+	})
+
+	// nothing checked yet: critical dependency is unknown
+	rr := httptest.NewRecorder()
+	h.handleReadyz(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 before first check, got %d", rr.Code)
+	}
+
+	h.checkAll(context.Background())
+
+	rr = httptest.NewRecorder()
+	h.handleReadyz(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 with only a non-critical dependency down, got %d", rr.Code)
+	}
+
+	var body struct {
+		Status       string             `json:"status"`
+		Dependencies []dependencyStatus `json:"dependencies"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(body.Dependencies) != 2 || body.Dependencies[1].Status != "down" {
+		t.Fatalf("expected per-dependency status, got %+v", body.Dependencies)
+	}
+}
+
+func TestCheckUpstreamUsesHealthPath(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/readyz" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		http.Error(w, "db not ready", http.StatusServiceUnavailable)
+	}))
+	defer up.Close()
+
+	err := checkUpstream(context.Background(), up.Client(), upstreamConfig{
+		Name:       "payments-service",
+		Endpoints:  []string{up.URL},
+		HealthPath: "/readyz",
+	})
+	if err == nil {
+		t.Fatal("expected 503 from /readyz to fail the check")
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxIdempotencyKeyLen   = 255
+	maxIdempotentBodyBytes = 1 << 20
+
+	// defaults for how much the store may hold before new keys are refused
+	defaultIdempotencyMaxEntries = 100_000
+	defaultIdempotencyMaxBytes   = 256 << 20
+)
+
+// idempotencyStore remembers the first completed response for each
+// Idempotency-Key so retries get the original answer instead of a
+// "duplicate" error from the upstream. It is in-memory and per replica:
+// concurrent duplicates are only held back when they reach the same pod, so
+// the gateway must run as a single replica (or with session affinity) for
+// the guarantee to hold across all requests.
+//
+// Entries are only dropped once expired, never to make room, since that
+// would let a retry through twice. When the store holds maxEntries keys or
+// maxBytes of responses, new keys are refused until expired ones are swept.
+type idempotencyStore struct {
+	mu         sync.Mutex
+	entries    map[string]*idempotencyEntry
+	bytes      int
+	lastSweep  time.Time
+	maxEntries int
+	maxBytes   int
+	now        func() time.Time
+}
+
+type idempotencyEntry struct {
+	fingerprint string
+	expiresAt   time.Time
+	// done is closed once the first request finishes, whether or not its
+	// response was kept
+	done     chan struct{}
+	response *storedResponse
+}
+
+type storedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// size approximates the memory a stored response holds.
+func (r *storedResponse) size() int {
+	n := len(r.body)
+	for k, vv := range r.header {
+		n += len(k)
+		for _, v := range vv {
+			n += len(v)
+		}
+	}
+	return n
+}
+
+type beginResult int
+
+const (
+	beginAcquired beginResult = iota
+	beginReplay
+	beginInProgress
+	beginMismatch
+	beginFull
+)
+
+func newIdempotencyStore() *idempotencyStore {
+	return &idempotencyStore{
+		entries:    map[string]*idempotencyEntry{},
+		maxEntries: defaultIdempotencyMaxEntries,
+		maxBytes:   defaultIdempotencyMaxBytes,
+		now:        time.Now,
+	}
+}
+
+// begin claims key for a request with the given body fingerprint. If
+// another request holds the key, the caller gets that entry to wait on; a
+// new key is refused with beginFull while the store is at its limits.
+func (s *idempotencyStore) begin(key, fingerprint string, ttl time.Duration) (*idempotencyEntry, beginResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	e, ok := s.entries[key]
+	if ok && (e.response == nil || now.Before(e.expiresAt)) {
+		switch {
+		case e.fingerprint != fingerprint:
+			return e, beginMismatch
+		case e.response != nil:
+			return e, beginReplay
+		default:
+			return e, beginInProgress
+		}
+	}
+
+	if ok {
+		s.drop(key, e)
+	}
+	if s.full() {
+		// sweeping is a full scan, so do it at most once a second
+		if now.Sub(s.lastSweep) >= time.Second {
+			s.sweepLocked(now)
+		}
+		if s.full() {
+			return nil, beginFull
+		}
+	}
+
+	e = &idempotencyEntry{
+		fingerprint: fingerprint,
+		expiresAt:   now.Add(ttl),
+		done:        make(chan struct{}),
+	}
+	s.entries[key] = e
+	return e, beginAcquired
+}
+
+// finish stores resp for replay, or forgets the key when resp is nil so the
+// client can retry a request that did not complete.
+func (s *idempotencyStore) finish(key string, e *idempotencyEntry, resp *storedResponse) {
+	s.mu.Lock()
+	if resp == nil {
+		if s.entries[key] == e {
+			delete(s.entries, key)
+		}
+	} else {
+		// kept even past maxBytes: the request has already been sent
+		e.response = resp
+		s.bytes += resp.size()
+	}
+	s.mu.Unlock()
+	close(e.done)
+}
+
+// full must be called with s.mu held.
+func (s *idempotencyStore) full() bool {
+	return len(s.entries) >= s.maxEntries || s.bytes >= s.maxBytes
+}
+
+// drop must be called with s.mu held.
+func (s *idempotencyStore) drop(key string, e *idempotencyEntry) {
+	if e.response != nil {
+		s.bytes -= e.response.size()
+	}
+	delete(s.entries, key)
+}
+
+func (s *idempotencyStore) sweep() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweepLocked(s.now())
+}
+
+// sweepLocked must be called with s.mu held.
+func (s *idempotencyStore) sweepLocked(now time.Time) {
+	s.lastSweep = now
+	for k, e := range s.entries {
+		if e.response != nil && !now.Before(e.expiresAt) {
+			s.drop(k, e)
+		}
+	}
+}
+
+func (s *idempotencyStore) run(ctx context.Context, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			s.sweep()
+		}
+	}
+}
+
+// idempotent wraps next with Idempotency-Key handling for the route's
+// configured methods. Keys are scoped to the caller and route, so one user
+// can never replay another user's response.
+func (t *proxyTable) idempotent(rt *route, next http.Handler) http.Handler {
+	ic := rt.cfg.Idempotency
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ic.appliesTo(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := strings.TrimSpace(r.Header.Get("Idempotency-Key"))
+		if key == "" {
+			if ic.Required {
+				writeJSON(w, http.StatusBadRequest, map[string]any{"error": "idempotency_key_required"})
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLen {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"error": "idempotency_key_too_long"})
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxIdempotentBodyBytes+1))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"error": "invalid_body"})
+			return
+		}
+		if len(body) > maxIdempotentBodyBytes {
+			writeJSON(w, http.StatusRequestEntityTooLarge, map[string]any{"error": "body_too_large"})
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		scoped := rt.cfg.Prefix + "\x00" + subjectFromContext(r) + "\x00" + key
+		fp := requestFingerprint(r, body)
+
+		e, res := t.idem.begin(scoped, fp, time.Duration(ic.TTL))
+		if res == beginInProgress {
+			// a concurrent duplicate: wait for the first request rather than
+			// sending the same payment twice
+			select {
+			case <-e.done:
+			case <-r.Context().Done():
+				return
+			case <-time.After(time.Duration(rt.cfg.Timeout)):
+			}
+			e, res = t.idem.begin(scoped, fp, time.Duration(ic.TTL))
+		}
+
+		switch res {
+		case beginMismatch:
+			t.metrics.idempotency.inc(rt.cfg.Prefix, "mismatch")
+			writeJSON(w, http.StatusUnprocessableEntity, map[string]any{
+				"error":   "idempotency_key_reused",
+				"message": "Idempotency-Key was already used with a different request",
+			})
+			return
+		case beginInProgress:
+			t.metrics.idempotency.inc(rt.cfg.Prefix, "in_progress")
+			w.Header().Set("Retry-After", "1")
+			writeJSON(w, http.StatusConflict, map[string]any{"error": "idempotency_request_in_progress"})
+			return
+		case beginReplay:
+			t.metrics.idempotency.inc(rt.cfg.Prefix, "replayed")
+			replayResponse(w, e.response)
+			return
+		case beginFull:
+			t.metrics.idempotency.inc(rt.cfg.Prefix, "full")
+			w.Header().Set("Retry-After", "60")
+			writeJSON(w, http.StatusServiceUnavailable, map[string]any{"error": "idempotency_store_full"})
+			return
+		}
+
+		t.metrics.idempotency.inc(rt.cfg.Prefix, "new")
+		rec := &capturingWriter{ResponseWriter: w}
+		completed := false
+		defer func() {
+			// server errors and panics are not "completed": let the client retry
+			var stored *storedResponse
+			if completed && rec.status < 500 && !rec.overflow {
+				stored = &storedResponse{status: rec.status, header: replayableHeader(w.Header()), body: rec.buf.Bytes()}
+			}
+			t.idem.finish(scoped, e, stored)
+		}()
+
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		completed = true
+	})
+}
+
+func (ic idempotencyConfig) appliesTo(method string) bool {
+	if !ic.Enabled {
+		return false
+	}
+	for _, m := range ic.Methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestFingerprint identifies "the same request" for replay purposes.
+func requestFingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	_, _ = io.WriteString(h, r.Method+"\n"+r.URL.Path+"\n"+r.URL.RawQuery+"\n")
+	_, _ = h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// replayableHeader copies h without the CORS headers, which answer the
+// first caller's Origin. The cors middleware sets them again for each
+// request, replays included.
+func replayableHeader(h http.Header) http.Header {
+	out := h.Clone()
+	for k := range out {
+		if strings.HasPrefix(k, "Access-Control-") {
+			delete(out, k)
+		}
+	}
+	return out
+}
+
+func replayResponse(w http.ResponseWriter, resp *storedResponse) {
+	for k, vv := range resp.header {
+		w.Header()[k] = append([]string(nil), vv...)
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(resp.status)
+	_, _ = w.Write(resp.body)
+}
+
+// capturingWriter passes the response through while keeping a copy of it.
+type capturingWriter struct {
+	http.ResponseWriter
+	status   int
+	buf      bytes.Buffer
+	overflow bool
+}
+
+func (c *capturingWriter) WriteHeader(code int) {
+	if c.status == 0 {
+		c.status = code
+	}
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *capturingWriter) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	if !c.overflow {
+		if c.buf.Len()+len(b) > maxIdempotentBodyBytes {
+			c.overflow = true
+			c.buf.Reset()
+		} else {
+			c.buf.Write(b)
+		}
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+func (c *capturingWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newIdempotentTable(t *testing.T, upstreamURL string) *proxyTable {
+	t.Helper()
+	gc := &gatewayConfig{
+		Upstreams: []upstreamConfig{{Name: "payments", Endpoints: []string{upstreamURL}}},
+		Routes: []routeConfig{{
+			Prefix:      "/v1/payments",
+			Upstream:    "payments",
+			Public:      true,
+			Idempotency: idempotencyConfig{Enabled: true},
+		}},
+	}
+	gc.applyDefaults()
+	table, err := newProxyTable(nil, gc, newGatewayMetrics(), nil)
+	if err != nil {
+		t.Fatalf("newProxyTable: %v", err)
+	}
+	return table
+}
+
+func TestIdempotencyReplaysFirstResponse(t *testing.T) {
+	var calls atomic.Int32
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) > 1 {
+			http.Error(w, "duplicate ref", http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		_, _ = io.WriteString(w, `{"id":"p1"}`)
+	}))
+	defer up.Close()
+	table := newIdempotentTable(t, up.URL)
+	hdr := map[string]string{"Idempotency-Key": "abc"}
+
+	first := serve(table, http.MethodPost, "/v1/payments", `{"amount":100}`, hdr)
+	second := serve(table, http.MethodPost, "/v1/payments", `{"amount":100}`, hdr)
+
+	if second.Code != http.StatusCreated || second.Body.String() != first.Body.String() {
+		t.Fatalf("expected replay of 201 %q, got %d %q", first.Body.String(), second.Code, second.Body.String())
+	}
+	if second.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatal("expected replayed response to be marked")
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("expected a single upstream call, got %d", calls.Load())
+	}
+}
+
+func TestIdempotencyRejectsDifferentBodyForSameKey(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer up.Close()
+	table := newIdempotentTable(t, up.URL)
+	hdr := map[string]string{"Idempotency-Key": "abc"}
+
+	serve(table, http.MethodPost, "/v1/payments", `{"amount":100}`, hdr)
+	rr := serve(table, http.MethodPost, "/v1/payments", `{"amount":999}`, hdr)
+
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422, got %d", rr.Code)
+	}
+}
+
+func TestIdempotencyDoesNotKeepServerErrors(t *testing.T) {
+	var calls atomic.Int32
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer up.Close()
+	table := newIdempotentTable(t, up.URL)
+	hdr := map[string]string{"Idempotency-Key": "abc"}
+
+	serve(table, http.MethodPost, "/v1/payments", `{}`, hdr)
+	rr := serve(table, http.MethodPost, "/v1/payments", `{}`, hdr)
+
+	if rr.Code != http.StatusCreated || calls.Load() != 2 {
+		t.Fatalf("expected retry after a 500 to reach the upstream, got %d after %d calls", rr.Code, calls.Load())
+	}
+}
+
+func TestIdempotencyLocksConcurrentDuplicates(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		<-release
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer up.Close()
+	table := newIdempotentTable(t, up.URL)
+	hdr := map[string]string{"Idempotency-Key": "abc"}
+
+	var wg sync.WaitGroup
+	codes := make([]int, 5)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = serve(table, http.MethodPost, "/v1/payments", `{}`, hdr).Code
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls.Load() != 1 {
+		t.Fatalf("expected concurrent duplicates to reach the upstream once, got %d", calls.Load())
+	}
+	for _, c := range codes {
+		if c != http.StatusCreated {
+			t.Fatalf("expected every duplicate to get the original 201, got %v", codes)
+		}
+	}
+}
+
+func TestIdempotencyRefusesNewKeysWhenFull(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer up.Close()
+	table := newIdempotentTable(t, up.URL)
+	table.idem.maxEntries = 1
+
+	serve(table, http.MethodPost, "/v1/payments", `{}`, map[string]string{"Idempotency-Key": "k1"})
+	rr := serve(table, http.MethodPost, "/v1/payments", `{}`, map[string]string{"Idempotency-Key": "k2"})
+	if rr.Code != http.StatusServiceUnavailable || !strings.Contains(rr.Body.String(), "idempotency_store_full") {
+		t.Fatalf("expected 503 idempotency_store_full, got %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := serve(table, http.MethodPost, "/v1/payments", `{}`, map[string]string{"Idempotency-Key": "k1"}); rr.Code != http.StatusCreated {
+		t.Fatalf("expected the stored key to still replay, got %d", rr.Code)
+	}
+}
+
+func TestIdempotencyReplayUsesCallersOrigin(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer up.Close()
+	gc := &gatewayConfig{
+		Upstreams: []upstreamConfig{{Name: "payments", Endpoints: []string{up.URL}}},
+		Routes: []routeConfig{{
+			Prefix:      "/v1/payments",
+			Upstream:    "payments",
+			Public:      true,
+			Idempotency: idempotencyConfig{Enabled: true},
+			CORS:        corsConfig{AllowedOrigins: []string{"https://a.example", "https://b.example"}},
+		}},
+	}
+	gc.applyDefaults()
+	table, err := newProxyTable(nil, gc, newGatewayMetrics(), nil)
+	if err != nil {
+		t.Fatalf("newProxyTable: %v", err)
+	}
+
+	serve(table, http.MethodPost, "/v1/payments", `{}`, map[string]string{"Idempotency-Key": "abc", "Origin": "https://a.example"})
+	rr := serve(table, http.MethodPost, "/v1/payments", `{}`, map[string]string{"Idempotency-Key": "abc", "Origin": "https://b.example"})
+
+	if rr.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatal("expected a replay")
+	}
+	if got := rr.Header().Values("Access-Control-Allow-Origin"); len(got) != 1 || got[0] != "https://b.example" {
+		t.Fatalf("expected the replay to allow the second caller's origin, got %v", got)
+	}
+}
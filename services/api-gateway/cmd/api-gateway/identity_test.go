@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestProxySignsCallerIdentity(t *testing.T) {
+	got := make(chan http.Header, 1)
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := r.Header.Clone()
+		h.Set("X-Test-Path", r.URL.Path)
+		h.Set("X-Test-Method", r.Method)
+		got <- h
+	}))
+	defer up.Close()
+
+	table := newTestTable(t, up.URL, retryConfig{}, breakerConfig{})
+	table.identitySecret = []byte("s3cret")
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/payments/p1", nil)
+	req.Header.Set(headerAuthSubject, "someone-else")
+	req = req.WithContext(withClaims(context.Background(), jwt.MapClaims{
+		"sub":   "user-1",
+		"roles": []any{"user", "operator"},
+	}))
+	table.match(req.URL.Path).handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	h := <-got
+	if h.Get(headerAuthSubject) != "user-1" || h.Get(headerAuthRoles) != "operator,user" {
+		t.Fatalf("unexpected identity %q %q", h.Get(headerAuthSubject), h.Get(headerAuthRoles))
+	}
+	payload := identityPayload(h.Get(headerAuthTimestamp), h.Get("X-Test-Method"), h.Get("X-Test-Path"), "user-1", "operator,user")
+	if h.Get(headerAuthSignature) != identitySignature([]byte("s3cret"), payload) {
+		t.Fatal("signature does not verify")
+	}
+}
+
+func TestProxyStripsSpoofedIdentity(t *testing.T) {
+	got := make(chan http.Header, 1)
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- r.Header.Clone()
+	}))
+	defer up.Close()
+
+	table := newTestTable(t, up.URL, retryConfig{}, breakerConfig{})
+	table.identitySecret = []byte("s3cret")
+
+	// a public route has no verified claims
+	serve(table, http.MethodGet, "/v1/payments", "", map[string]string{
+		headerAuthSubject:   "admin",
+		headerAuthRoles:     "operator",
+		headerAuthTimestamp: "1",
+		headerAuthSignature: "00",
+	})
+	h := <-got
+	for _, k := range identityHeaders {
+		if h.Get(k) != "" {
+			t.Fatalf("%s was forwarded", k)
+		}
+	}
+}
+
+func TestClaimRolesSortsAndSkipsJunk(t *testing.T) {
+	roles := claimRoles(jwt.MapClaims{"roles": []any{"user", 7, "a,b", "admin", ""}})
+	if roles != "admin,user" {
+		t.Fatalf("got %q", roles)
+	}
+	if claimRoles(jwt.MapClaims{}) != "" {
+		t.Fatal("missing roles claim should render empty")
+	}
+}
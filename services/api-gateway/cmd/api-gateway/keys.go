@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// keySource resolves the RSA public keys used to verify access tokens.
+type keySource interface {
+	// key returns the verification key for a token's kid header (may be empty).
+	key(ctx context.Context, kid string) (*rsa.PublicKey, error)
+	// check reports whether the source can currently provide keys.
+	check(ctx context.Context) error
+	describe() string
+}
+
+// staticKeySource serves the single PEM key from JWT_PUBLIC_KEY.
+type staticKeySource struct {
+	pub *rsa.PublicKey
+}
+
+func (s *staticKeySource) key(context.Context, string) (*rsa.PublicKey, error) {
+	return s.pub, nil
+}
+
+func (s *staticKeySource) check(context.Context) error {
+	if s.pub == nil {
+		return errors.New("no public key loaded")
+	}
+	return nil
+}
+
+func (s *staticKeySource) describe() string { return "static" }
+
+// jwksKeySource fetches keys from a JWKS endpoint. Keys are refreshed by the
+// health checker and on demand when a token names an unknown kid, at most
+// once per minRefresh whether or not the last attempt worked. Concurrent
+// refreshes share one fetch.
+type jwksKeySource struct {
+	url        string
+	client     *http.Client
+	minRefresh time.Duration
+
+	mu          sync.Mutex
+	keys        map[string]*rsa.PublicKey
+	attemptedAt time.Time
+	inflight    *jwksFetch
+}
+
+type jwksFetch struct {
+	done chan struct{}
+	err  error
+}
+
+func newJWKSKeySource(url string) *jwksKeySource {
+	return &jwksKeySource{
+		url:        url,
+		client:     &http.Client{Timeout: 5 * time.Second},
+		minRefresh: 30 * time.Second,
+	}
+}
+
+func (s *jwksKeySource) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	s.mu.Lock()
+	k, ok := s.lookup(kid)
+	stale := time.Since(s.attemptedAt) >= s.minRefresh
+	s.mu.Unlock()
+	if ok {
+		return k, nil
+	}
+	if !stale {
+		return nil, fmt.Errorf("unknown kid %q", kid)
+	}
+
+	if err := s.refresh(ctx); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if k, ok := s.lookup(kid); ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown kid %q", kid)
+}
+
+// lookup must be called with s.mu held. A token without kid is accepted
+// only while the set holds exactly one key.
+func (s *jwksKeySource) lookup(kid string) (*rsa.PublicKey, bool) {
+	if kid == "" && len(s.keys) == 1 {
+		for _, k := range s.keys {
+			return k, true
+		}
+	}
+	k, ok := s.keys[kid]
+	return k, ok
+}
+
+func (s *jwksKeySource) check(ctx context.Context) error {
+	return s.refresh(ctx)
+}
+
+func (s *jwksKeySource) describe() string { return s.url }
+
+// refresh replaces the key set, or waits for a refresh already under way.
+// The fetch itself is not tied to ctx, so one caller going away does not
+// fail the others waiting on it; the client timeout bounds it instead.
+func (s *jwksKeySource) refresh(ctx context.Context) error {
+	s.mu.Lock()
+	if f := s.inflight; f != nil {
+		s.mu.Unlock()
+		select {
+		case <-f.done:
+			return f.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	f := &jwksFetch{done: make(chan struct{})}
+	s.inflight = f
+	s.mu.Unlock()
+
+	keys, err := s.fetch(context.WithoutCancel(ctx))
+
+	s.mu.Lock()
+	if err == nil {
+		s.keys = keys
+	}
+	s.attemptedAt = time.Now()
+	s.inflight = nil
+	s.mu.Unlock()
+
+	f.err = err
+	close(f.done)
+	return err
+}
+
+// fetch downloads the key set. Keys that cannot be used are logged and
+// skipped so one bad entry does not take the others down with it.
+func (s *jwksKeySource) fetch(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch jwks: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch jwks: status %d", resp.StatusCode)
+	}
+
+	var doc struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("decode jwks: %w", err)
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range doc.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		pub, err := rsaKeyFromJWK(k.N, k.E)
+		if err != nil {
+			log.Printf(`{"msg":"jwks key skipped","jwks":"%s","kid":%q,"error":%q}`, s.url, k.Kid, err.Error())
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("jwks contains no usable RSA signing keys")
+	}
+	return keys, nil
+}
+
+func rsaKeyFromJWK(n, e string) (*rsa.PublicKey, error) {
+	nb, err := base64.RawURLEncoding.DecodeString(n)
+	if err != nil {
+		return nil, fmt.Errorf("modulus: %w", err)
+	}
+	eb, err := base64.RawURLEncoding.DecodeString(e)
+	if err != nil {
+		return nil, fmt.Errorf("exponent: %w", err)
+	}
+	exp := new(big.Int).SetBytes(eb)
+	if !exp.IsInt64() || exp.Int64() < 3 || exp.Int64() > 1<<31-1 {
+		return nil, errors.New("exponent out of range")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(nb), E: int(exp.Int64())}, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestJWKSSkipsBadKeys(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := base64.RawURLEncoding.EncodeToString(key.N.Bytes())
+	e := base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes())
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"keys":[{"kty":"RSA","kid":"bad","n":"%s","e":"!!"},{"kty":"RSA","kid":"good","n":"%s","e":"%s"}]}`, n, n, e)
+	}))
+	defer srv.Close()
+
+	s := newJWKSKeySource(srv.URL)
+	if _, err := s.key(context.Background(), "good"); err != nil {
+		t.Fatalf("expected the good key despite a bad one, got %v", err)
+	}
+	if _, err := s.key(context.Background(), "bad"); err == nil {
+		t.Fatal("expected the bad key to be skipped")
+	}
+}
+
+func TestJWKSBacksOffAfterFailedRefresh(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	s := newJWKSKeySource(srv.URL)
+	for i := 0; i < 5; i++ {
+		if _, err := s.key(context.Background(), "k1"); err == nil {
+			t.Fatal("expected an error while jwks is down")
+		}
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("expected one fetch per refresh interval while jwks is down, got %d", calls.Load())
+	}
+}
@@ -18,13 +18,27 @@ import (
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
+// Config holds process-level settings read once at startup. Everything that
+// can change at runtime lives in gatewayConfig and is managed by configStore.
 type Config struct {
-	AppName      string
-	Environment  string
-	Port         string
-	JWTAudience  string
-	JWTIssuer    string
-	JWTPublicKey *rsa.PublicKey
+	AppName     string
+	Environment string
+	Port        string
+	AdminPort   string
+
+	// JWT_* variables; defaults for the reloadable jwt section
+	JWTDefaults jwtConfig
+
+	// GATEWAY_CONFIG_FILE wins over the inline GATEWAY_CONFIG when set
+	ConfigFile           string
+	ConfigInline         string
+	ConfigReloadInterval time.Duration
+
+	HealthCheckInterval time.Duration
+	HealthCheckTimeout  time.Duration
+
+	// signs the identity headers forwarded to upstreams
+	IdentitySecret []byte
 }
 
 type ctxKeyClaims struct{}
@@ -49,10 +63,40 @@ func main() {
 	defer func() { _ = shutdown(context.Background()) }()
 	// -------------------------------------
 
+	metrics := newGatewayMetrics()
+	health := newHealthChecker(cfg.HealthCheckInterval, cfg.HealthCheckTimeout, metrics)
+	store := newConfigStore(cfg.JWTDefaults, metrics, health)
+	store.identitySecret = cfg.IdentitySecret
+	if len(cfg.IdentitySecret) == 0 {
+		log.Printf(`{"msg":"GATEWAY_IDENTITY_SECRET not set, upstreams receive no caller identity"}`)
+	}
+
+	raw, source := []byte(cfg.ConfigInline), "env:GATEWAY_CONFIG"
+	if cfg.ConfigFile != "" {
+		raw, err = os.ReadFile(cfg.ConfigFile)
+		if err != nil {
+			log.Fatalf("gateway config error: %v", err)
+		}
+		source = cfg.ConfigFile
+	}
+	if err := store.load(raw, source); err != nil {
+		log.Fatalf("gateway config error: %v", err)
+	}
+	if cfg.ConfigFile != "" {
+		go store.watchFile(ctx, cfg.ConfigFile, cfg.ConfigReloadInterval)
+	}
+	// the idempotency store is shared by every config generation
+	go store.runtime().table.idem.run(ctx, time.Minute)
+
 	mux := http.NewServeMux()
 
-	// root endpoint (useful for scanners/load balancers)
+	// root endpoint (useful for scanners/load balancers); also the entry
+	// point for proxied routes, which have no fixed pattern
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if rt := store.runtime().table.match(r.URL.Path); rt != nil {
+			rt.handler.ServeHTTP(w, r)
+			return
+		}
 		writeJSON(w, http.StatusOK, map[string]any{
 			"service": cfg.AppName,
 			"env":     cfg.Environment,
@@ -68,11 +112,10 @@ func main() {
 		})
 	})
 
-	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
-		writeJSON(w, http.StatusOK, map[string]any{
-			"status": "ready",
-		})
-	})
+	// readiness reflects the last background check of critical dependencies
+	go health.run(ctx)
+
+	mux.HandleFunc("/readyz", health.handleReadyz)
 
 	// public endpoint
 	mux.HandleFunc("/v1/ping", func(w http.ResponseWriter, r *http.Request) {
@@ -84,7 +127,7 @@ func main() {
 	})
 
 	// protected endpoint
-	mux.Handle("/v1/me", authMiddleware(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	mux.Handle("/v1/me", store.authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		claims, _ := r.Context().Value(ctxKeyClaims{}).(jwt.MapClaims)
 		writeJSON(w, http.StatusOK, map[string]any{
 			"ok":     true,
@@ -94,15 +137,28 @@ func main() {
 
 	// Wrap inbound HTTP with OTel and keep your logging middleware
 	handler := otelhttp.NewHandler(mux, "api-gateway")
+	handler = store.securityHeaders(handler)
 	handler = loggingMiddleware(cfg, handler)
 
 	srv := &http.Server{
 		Addr:              ":" + cfg.Port,
 		Handler:           handler,
 		ReadHeaderTimeout: 5 * time.Second,
+		MaxHeaderBytes:    maxServerHeaderBytes,
 	}
 
-	log.Printf("starting %s (%s) on :%s", cfg.AppName, cfg.Environment, cfg.Port)
+	adminSrv := &http.Server{
+		Addr:              ":" + cfg.AdminPort,
+		Handler:           newAdminMux(store, metrics),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	go func() {
+		if err := adminSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("admin server error: %v", err)
+		}
+	}()
+
+	log.Printf("starting %s (%s) on :%s (admin :%s)", cfg.AppName, cfg.Environment, cfg.Port, cfg.AdminPort)
 	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Fatalf("server error: %v", err)
 	}
@@ -112,27 +168,43 @@ func loadConfig() (Config, error) {
 	app := getenv("APP_NAME", "api-gateway")
 	env := getenv("ENVIRONMENT", "prod")
 	port := getenv("PORT", "8080")
+	adminPort := getenv("ADMIN_PORT", "9090")
 
-	issuer := getenv("JWT_ISSUER", "fintech-auth")
-	aud := getenv("JWT_AUDIENCE", "fintech-platform")
-
-	pubKeyPEM := os.Getenv("JWT_PUBLIC_KEY")
-	if pubKeyPEM == "" {
-		return Config{}, fmt.Errorf("JWT_PUBLIC_KEY is required (PEM encoded RSA public key)")
+	jwtDefaults := jwtConfig{
+		Issuer:    getenv("JWT_ISSUER", "fintech-auth"),
+		Audience:  getenv("JWT_AUDIENCE", "fintech-platform"),
+		PublicKey: os.Getenv("JWT_PUBLIC_KEY"),
+		JWKSURL:   os.Getenv("JWT_JWKS_URL"),
 	}
 
-	pubKey, err := parseRSAPublicKeyFromPEM(pubKeyPEM)
-	if err != nil {
-		return Config{}, fmt.Errorf("invalid JWT_PUBLIC_KEY: %w", err)
+	reload, err := time.ParseDuration(getenv("CONFIG_RELOAD_INTERVAL", "5s"))
+	if err != nil || reload <= 0 {
+		return Config{}, fmt.Errorf("invalid CONFIG_RELOAD_INTERVAL")
+	}
+	interval, err := time.ParseDuration(getenv("HEALTH_CHECK_INTERVAL", "10s"))
+	if err != nil || interval <= 0 {
+		return Config{}, fmt.Errorf("invalid HEALTH_CHECK_INTERVAL")
+	}
+	timeout, err := time.ParseDuration(getenv("HEALTH_CHECK_TIMEOUT", "2s"))
+	if err != nil || timeout <= 0 {
+		return Config{}, fmt.Errorf("invalid HEALTH_CHECK_TIMEOUT")
 	}
 
 	return Config{
-		AppName:      app,
-		Environment:  env,
-		Port:         port,
-		JWTAudience:  aud,
-		JWTIssuer:    issuer,
-		JWTPublicKey: pubKey,
+		AppName:     app,
+		Environment: env,
+		Port:        port,
+		AdminPort:   adminPort,
+		JWTDefaults: jwtDefaults,
+
+		ConfigFile:           os.Getenv("GATEWAY_CONFIG_FILE"),
+		ConfigInline:         os.Getenv("GATEWAY_CONFIG"),
+		ConfigReloadInterval: reload,
+
+		HealthCheckInterval: interval,
+		HealthCheckTimeout:  timeout,
+
+		IdentitySecret: []byte(os.Getenv("GATEWAY_IDENTITY_SECRET")),
 	}, nil
 }
 
@@ -154,7 +226,7 @@ func parseRSAPublicKeyFromPEM(pemStr string) (*rsa.PublicKey, error) {
 	return pub, nil
 }
 
-func authMiddleware(cfg Config, next http.Handler) http.Handler {
+func authMiddleware(v *jwtVerifier, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		authz := r.Header.Get("Authorization")
 		if authz == "" || !strings.HasPrefix(strings.ToLower(authz), "bearer ") {
@@ -170,10 +242,11 @@ func authMiddleware(cfg Config, next http.Handler) http.Handler {
 			if t.Method.Alg() != jwt.SigningMethodRS256.Alg() {
 				return nil, fmt.Errorf("unexpected alg: %s", t.Method.Alg())
 			}
-			return cfg.JWTPublicKey, nil
+			kid, _ := t.Header["kid"].(string)
+			return v.keys.key(r.Context(), kid)
 		},
-			jwt.WithAudience(cfg.JWTAudience),
-			jwt.WithIssuer(cfg.JWTIssuer),
+			jwt.WithAudience(v.audience),
+			jwt.WithIssuer(v.issuer),
 			jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg()}),
 		)
 
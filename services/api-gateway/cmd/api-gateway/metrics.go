@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metricsRegistry is a minimal Prometheus text-format registry. The gateway
+// only needs counters and gauges with labels, which does not justify pulling
+// in the full client library.
+type metricsRegistry struct {
+	mu       sync.Mutex
+	families []*metricFamily
+}
+
+type metricFamily struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func (reg *metricsRegistry) counter(name, help string, labels ...string) *metricFamily {
+	return reg.register(name, help, "counter", labels)
+}
+
+func (reg *metricsRegistry) gauge(name, help string, labels ...string) *metricFamily {
+	return reg.register(name, help, "gauge", labels)
+}
+
+func (reg *metricsRegistry) register(name, help, kind string, labels []string) *metricFamily {
+	f := &metricFamily{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		values: map[string]float64{},
+	}
+	reg.mu.Lock()
+	reg.families = append(reg.families, f)
+	reg.mu.Unlock()
+	return f
+}
+
+func (f *metricFamily) inc(labelValues ...string) {
+	f.add(1, labelValues...)
+}
+
+func (f *metricFamily) add(v float64, labelValues ...string) {
+	key := f.key(labelValues)
+	f.mu.Lock()
+	f.values[key] += v
+	f.mu.Unlock()
+}
+
+func (f *metricFamily) set(v float64, labelValues ...string) {
+	key := f.key(labelValues)
+	f.mu.Lock()
+	f.values[key] = v
+	f.mu.Unlock()
+}
+
+// reset drops every series, e.g. for info metrics whose labels change.
+func (f *metricFamily) reset() {
+	f.mu.Lock()
+	f.values = map[string]float64{}
+	f.mu.Unlock()
+}
+
+// key renders the label set once, in exposition format, so writing the
+// registry out is just concatenation.
+func (f *metricFamily) key(labelValues []string) string {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s: expected %d label values, got %d", f.name, len(f.labels), len(labelValues)))
+	}
+	if len(f.labels) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, l := range f.labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(l)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabelValue(labelValues[i]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func (reg *metricsRegistry) writeText(w io.Writer) error {
+	reg.mu.Lock()
+	families := append([]*metricFamily(nil), reg.families...)
+	reg.mu.Unlock()
+
+	for _, f := range families {
+		f.mu.Lock()
+		keys := make([]string, 0, len(f.values))
+		for k := range f.values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		var b strings.Builder
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+		for _, k := range keys {
+			b.WriteString(f.name)
+			b.WriteString(k)
+			b.WriteByte(' ')
+			b.WriteString(strconv.FormatFloat(f.values[k], 'g', -1, 64))
+			b.WriteByte('\n')
+		}
+		f.mu.Unlock()
+
+		if _, err := io.WriteString(w, b.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func escapeLabelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// gatewayMetrics holds every metric the gateway exports on /metrics.
+type gatewayMetrics struct {
+	registry *metricsRegistry
+
+	upstreamRequests   *metricFamily
+	upstreamRetries    *metricFamily
+	breakerState       *metricFamily
+	breakerTransitions *metricFamily
+	breakerRejections  *metricFamily
+	outlierEjections   *metricFamily
+	dependencyUp       *metricFamily
+	configReloads      *metricFamily
+	configInfo         *metricFamily
+	routeRequests      *metricFamily
+	routeErrors        *metricFamily
+	idempotency        *metricFamily
+}
+
+func newGatewayMetrics() *gatewayMetrics {
+	reg := &metricsRegistry{}
+	return &gatewayMetrics{
+		registry: reg,
+		upstreamRequests: reg.counter("gateway_upstream_requests_total",
+			"Upstream attempts by outcome (HTTP status code or error).", "upstream", "code"),
+		upstreamRetries: reg.counter("gateway_upstream_retries_total",
+			"Retried upstream attempts.", "upstream"),
+		breakerState: reg.gauge("gateway_circuit_breaker_state",
+			"Circuit breaker state per upstream (0=closed, 1=half_open, 2=open).", "upstream"),
+		breakerTransitions: reg.counter("gateway_circuit_breaker_transitions_total",
+			"Circuit breaker state transitions.", "upstream", "to"),
+		breakerRejections: reg.counter("gateway_circuit_breaker_rejections_total",
+			"Requests rejected because the circuit breaker was open.", "upstream"),
+		outlierEjections: reg.counter("gateway_outlier_ejections_total",
+			"Upstream endpoints ejected after consecutive failures.", "upstream", "endpoint"),
+		dependencyUp: reg.gauge("gateway_dependency_up",
+			"Result of the last readiness check per dependency (1=up, 0=down).", "dependency", "type"),
+		configReloads: reg.counter("gateway_config_reloads_total",
+			"Configuration load attempts by result.", "result"),
+		configInfo: reg.gauge("gateway_config_info",
+			"Always 1; labelled with the active configuration version.", "version"),
+		routeRequests: reg.counter("gateway_route_requests_total",
+			"Proxied requests by route, traffic-split version and response code.", "route", "version", "code"),
+		routeErrors: reg.counter("gateway_route_errors_total",
+			"Proxied requests answered with a 5xx, by route and version.", "route", "version"),
+		idempotency: reg.counter("gateway_idempotency_requests_total",
+			"Requests with an Idempotency-Key by outcome (new, replayed, in_progress, mismatch, full).", "route", "result"),
+	}
+}
+
+func (m *gatewayMetrics) observeBreakerChange(upstream string, _, to breakerState) {
+	m.breakerState.set(float64(to), upstream)
+	m.breakerTransitions.inc(upstream, to.String())
+}
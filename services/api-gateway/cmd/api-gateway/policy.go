@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// securityHeaders adds hardening headers to every response unless the
+// handler (or upstream) already set them, and strips headers that leak the
+// upstream's software. Settings come from the active config generation.
+func (s *configStore) securityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sc := s.runtime().config.Security
+		next.ServeHTTP(&securityHeaderWriter{ResponseWriter: w, cfg: sc}, r)
+	})
+}
+
+type securityHeaderWriter struct {
+	http.ResponseWriter
+	cfg   securityConfig
+	wrote bool
+}
+
+func (s *securityHeaderWriter) WriteHeader(code int) {
+	if !s.wrote {
+		s.wrote = true
+		applySecurityHeaders(s.Header(), s.cfg)
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *securityHeaderWriter) Write(b []byte) (int, error) {
+	if !s.wrote {
+		s.WriteHeader(http.StatusOK)
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+func (s *securityHeaderWriter) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+func applySecurityHeaders(h http.Header, sc securityConfig) {
+	setDefault := func(k, v string) {
+		if h.Get(k) == "" {
+			h.Set(k, v)
+		}
+	}
+
+	if sc.HSTSMaxAge != nil && *sc.HSTSMaxAge > 0 {
+		setDefault("Strict-Transport-Security",
+			"max-age="+strconv.FormatInt(int64(time.Duration(*sc.HSTSMaxAge).Seconds()), 10)+"; includeSubDomains")
+	}
+	setDefault("X-Content-Type-Options", "nosniff")
+	setDefault("X-Frame-Options", "DENY")
+	setDefault("Referrer-Policy", "no-referrer")
+	setDefault("Permissions-Policy", "camera=(), microphone=(), geolocation=()")
+	setDefault("Cross-Origin-Resource-Policy", "same-origin")
+	setDefault("Cache-Control", "no-store")
+
+	if mt, _, _ := mime.ParseMediaType(h.Get("Content-Type")); mt == "text/html" {
+		setDefault("Content-Security-Policy", sc.ContentSecurityPolicy)
+	}
+
+	h.Del("Server")
+	h.Del("X-Powered-By")
+}
+
+// limitRequest enforces the route's header and body size limits before the
+// request is authenticated or forwarded.
+func limitRequest(rt *route, next http.Handler) http.Handler {
+	maxBody := rt.cfg.MaxBodyBytes
+	maxHeader := rt.cfg.MaxHeaderBytes
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if maxHeader > 0 && headerSize(r) > maxHeader {
+			writeJSON(w, http.StatusRequestHeaderFieldsTooLarge, map[string]any{
+				"error":     "headers_too_large",
+				"max_bytes": maxHeader,
+			})
+			return
+		}
+
+		if r.ContentLength > maxBody {
+			writeBodyTooLarge(w, maxBody)
+			return
+		}
+		if r.ContentLength < 0 && r.Body != nil && r.Body != http.NoBody {
+			// unknown length (chunked): read up to the limit so we can answer
+			// 413 before anything reaches the upstream
+			buf, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBody))
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				writeBodyTooLarge(w, maxBody)
+				return
+			}
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]any{"error": "invalid_body"})
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(buf))
+			r.ContentLength = int64(len(buf))
+		} else if r.Body != nil {
+			r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeBodyTooLarge(w http.ResponseWriter, max int64) {
+	w.Header().Set("Connection", "close")
+	writeJSON(w, http.StatusRequestEntityTooLarge, map[string]any{
+		"error":     "body_too_large",
+		"max_bytes": max,
+	})
+}
+
+func headerSize(r *http.Request) int {
+	n := len(r.Method) + len(r.RequestURI) + len(r.Proto) + 4
+	for k, vv := range r.Header {
+		for _, v := range vv {
+			n += len(k) + len(v) + 4
+		}
+	}
+	return n
+}
+
+// cors handles browser cross-origin requests for a route. Preflights are
+// answered by the gateway itself and never reach auth or the upstream.
+func (t *proxyTable) cors(rt *route, next http.Handler) http.Handler {
+	cc := rt.cfg.CORS
+	if len(cc.AllowedOrigins) == 0 {
+		return next
+	}
+
+	allowMethods := strings.Join(cc.AllowedMethods, ", ")
+	allowHeaders := strings.Join(cc.AllowedHeaders, ", ")
+	exposeHeaders := strings.Join(cc.ExposedHeaders, ", ")
+	maxAge := strconv.FormatInt(int64(time.Duration(cc.MaxAge).Seconds()), 10)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !cc.allowsOrigin(origin) {
+			if preflight {
+				writeJSON(w, http.StatusForbidden, map[string]any{"error": "cors_origin_not_allowed"})
+				return
+			}
+			// no CORS headers: the browser will refuse to expose the response
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h.Set("Access-Control-Allow-Origin", origin)
+		if cc.AllowCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if preflight {
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+			if !cc.allowsMethod(r.Header.Get("Access-Control-Request-Method")) {
+				writeJSON(w, http.StatusForbidden, map[string]any{"error": "cors_method_not_allowed"})
+				return
+			}
+			h.Set("Access-Control-Allow-Methods", allowMethods)
+			h.Set("Access-Control-Allow-Headers", allowHeaders)
+			h.Set("Access-Control-Max-Age", maxAge)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if exposeHeaders != "" {
+			h.Set("Access-Control-Expose-Headers", exposeHeaders)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (cc corsConfig) allowsOrigin(origin string) bool {
+	for _, o := range cc.AllowedOrigins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+		// "https://*.example.com" matches any subdomain, not the apex
+		if scheme, host, ok := strings.Cut(o, "://*."); ok {
+			if strings.HasPrefix(origin, scheme+"://") && strings.HasSuffix(strings.ToLower(origin), "."+strings.ToLower(host)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (cc corsConfig) allowsMethod(method string) bool {
+	for _, m := range cc.AllowedMethods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
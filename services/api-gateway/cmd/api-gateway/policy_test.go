@@ -0,0 +1,161 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newPolicyTable(t *testing.T, upstreamURL string, rc routeConfig) *proxyTable {
+	t.Helper()
+	rc.Prefix = "/v1/payments"
+	rc.Upstream = "payments"
+	rc.Public = true
+	gc := &gatewayConfig{
+		Upstreams: []upstreamConfig{{Name: "payments", Endpoints: []string{upstreamURL}}},
+		Routes:    []routeConfig{rc},
+	}
+	gc.applyDefaults()
+	table, err := newProxyTable(nil, gc, newGatewayMetrics(), nil)
+	if err != nil {
+		t.Fatalf("newProxyTable: %v", err)
+	}
+	return table
+}
+
+func TestCORSPreflightIsAnsweredByGateway(t *testing.T) {
+	var calls atomic.Int32
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	}))
+	defer up.Close()
+
+	table := newPolicyTable(t, up.URL, routeConfig{CORS: corsConfig{
+		AllowedOrigins:   []string{"https://*.example.com"},
+		AllowCredentials: true,
+	}})
+
+	rr := serve(table, http.MethodOptions, "/v1/payments", "", map[string]string{
+		"Origin":                        "https://app.example.com",
+		"Access-Control-Request-Method": "POST",
+	})
+	if rr.Code != http.StatusNoContent || calls.Load() != 0 {
+		t.Fatalf("expected 204 without reaching upstream, got %d after %d calls", rr.Code, calls.Load())
+	}
+	if rr.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" ||
+		rr.Header().Get("Access-Control-Allow-Credentials") != "true" ||
+		rr.Header().Get("Access-Control-Max-Age") != "600" {
+		t.Fatalf("unexpected preflight headers: %v", rr.Header())
+	}
+
+	rr = serve(table, http.MethodOptions, "/v1/payments", "", map[string]string{
+		"Origin":                        "https://evil.test",
+		"Access-Control-Request-Method": "POST",
+	})
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for disallowed origin, got %d", rr.Code)
+	}
+
+	// actual request: the upstream's own CORS headers must not leak through
+	rr = serve(table, http.MethodGet, "/v1/payments", "", map[string]string{"Origin": "https://app.example.com"})
+	if got := rr.Header().Values("Access-Control-Allow-Origin"); len(got) != 1 || got[0] != "https://app.example.com" {
+		t.Fatalf("expected gateway CORS origin only, got %v", got)
+	}
+}
+
+func TestCORSWildcardWithCredentialsIsRejected(t *testing.T) {
+	gc := &gatewayConfig{
+		Upstreams: []upstreamConfig{{Name: "payments", Endpoints: []string{"http://payments"}}},
+		Routes: []routeConfig{{Prefix: "/v1/payments", Upstream: "payments", CORS: corsConfig{
+			AllowedOrigins:   []string{"*"},
+			AllowCredentials: true,
+		}}},
+	}
+	gc.applyDefaults()
+	if err := validateCORS(gc.Routes[0]); err == nil {
+		t.Fatal("expected error for wildcard origin with credentials")
+	}
+}
+
+func TestRequestSizeLimits(t *testing.T) {
+	var calls atomic.Int32
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		_, _ = io.Copy(io.Discard, r.Body)
+	}))
+	defer up.Close()
+
+	table := newPolicyTable(t, up.URL, routeConfig{MaxBodyBytes: 16, MaxHeaderBytes: 512})
+
+	rr := serve(table, http.MethodPost, "/v1/payments", strings.Repeat("x", 17), nil)
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413 for declared length over limit, got %d", rr.Code)
+	}
+
+	// chunked body with no Content-Length
+	req := httptest.NewRequest(http.MethodPost, "/v1/payments", strings.NewReader(strings.Repeat("x", 64)))
+	req.ContentLength = -1
+	rr = httptest.NewRecorder()
+	table.match(req.URL.Path).handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413 for streamed body over limit, got %d", rr.Code)
+	}
+
+	rr = serve(table, http.MethodGet, "/v1/payments", "", map[string]string{"X-Big": strings.Repeat("y", 600)})
+	if rr.Code != http.StatusRequestHeaderFieldsTooLarge {
+		t.Fatalf("expected 431 for oversized headers, got %d", rr.Code)
+	}
+
+	if calls.Load() != 0 {
+		t.Fatalf("rejected requests reached the upstream %d times", calls.Load())
+	}
+	rr = serve(table, http.MethodPost, "/v1/payments", "small", nil)
+	if rr.Code != http.StatusOK || calls.Load() != 1 {
+		t.Fatalf("expected small request to pass, got %d", rr.Code)
+	}
+}
+
+func TestSecurityHeadersDefaults(t *testing.T) {
+	h := http.Header{}
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	h.Set("Server", "nginx/1.25")
+	h.Set("Cache-Control", "max-age=60")
+	maxAge := duration(time.Hour)
+	sc := securityConfig{HSTSMaxAge: &maxAge, ContentSecurityPolicy: "default-src 'none'"}
+
+	applySecurityHeaders(h, sc)
+
+	if h.Get("Strict-Transport-Security") != "max-age=3600; includeSubDomains" {
+		t.Fatalf("unexpected HSTS header %q", h.Get("Strict-Transport-Security"))
+	}
+	if h.Get("X-Content-Type-Options") != "nosniff" || h.Get("X-Frame-Options") != "DENY" {
+		t.Fatalf("missing hardening headers: %v", h)
+	}
+	if h.Get("Content-Security-Policy") != "default-src 'none'" {
+		t.Fatalf("expected CSP on HTML response, got %q", h.Get("Content-Security-Policy"))
+	}
+	if h.Get("Server") != "" {
+		t.Fatal("expected Server header to be stripped")
+	}
+	if h.Get("Cache-Control") != "max-age=60" {
+		t.Fatal("upstream Cache-Control must be kept")
+	}
+}
+
+func TestHSTSCanBeDisabled(t *testing.T) {
+	gc, err := parseGatewayConfig([]byte(`{"security": {"hsts_max_age": "0s"}}`), testJWTDefaults(t))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	h := http.Header{}
+	applySecurityHeaders(h, gc.Security)
+	if got := h.Get("Strict-Transport-Security"); got != "" {
+		t.Fatalf("expected no HSTS header with hsts_max_age 0s, got %q", got)
+	}
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// maxRetryBodyBytes caps how much of a request body is buffered so it can be
+// replayed on retry. Larger bodies are streamed once without retries.
+const maxRetryBodyBytes = 1 << 20
+
+// hop-by-hop headers are connection specific and must not be forwarded.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// proxyTable is the set of routes and upstreams built from a gatewayConfig.
+type proxyTable struct {
+	routes    []*route
+	upstreams map[string]*upstream
+	order     []string
+	transport http.RoundTripper
+	idem      *idempotencyStore
+	metrics   *gatewayMetrics
+	// signs the identity headers sent upstream; empty sends none
+	identitySecret []byte
+}
+
+type route struct {
+	cfg      routeConfig
+	versions []*routeVersion
+	handler  http.Handler
+}
+
+type upstream struct {
+	name      string
+	cfg       upstreamConfig
+	endpoints []*endpoint
+	breaker   *circuitBreaker
+	outlier   outlierConfig
+	next      atomic.Uint64
+}
+
+type endpoint struct {
+	url *url.URL
+
+	mu           sync.Mutex
+	failures     int
+	ejections    int
+	ejectedUntil time.Time
+}
+
+type upstreamSnapshot struct {
+	Name      string             `json:"name"`
+	Breaker   breakerSnapshot    `json:"breaker"`
+	Endpoints []endpointSnapshot `json:"endpoints"`
+}
+
+type endpointSnapshot struct {
+	URL                 string     `json:"url"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	EjectedUntil        *time.Time `json:"ejected_until,omitempty"`
+}
+
+// newProxyTable builds routes and upstreams for gc. Upstreams whose config is
+// unchanged from prev are carried over, keeping breaker and ejection state
+// across reloads.
+func newProxyTable(auth *jwtVerifier, gc *gatewayConfig, m *gatewayMetrics, prev *proxyTable) (*proxyTable, error) {
+	t := &proxyTable{
+		upstreams: map[string]*upstream{},
+		transport: otelhttp.NewTransport(http.DefaultTransport),
+		idem:      newIdempotencyStore(),
+		metrics:   m,
+	}
+	if prev != nil {
+		t.transport = prev.transport
+		t.idem = prev.idem
+	}
+
+	for _, uc := range gc.Upstreams {
+		if prev != nil {
+			if old, ok := prev.upstreams[uc.Name]; ok && sameUpstreamConfig(old.cfg, uc) {
+				t.upstreams[uc.Name] = old
+				t.order = append(t.order, uc.Name)
+				continue
+			}
+		}
+
+		u := &upstream{
+			name:    uc.Name,
+			cfg:     uc,
+			breaker: newCircuitBreaker(uc.Name, uc.Breaker, m.observeBreakerChange),
+			outlier: uc.Outlier,
+		}
+		for _, raw := range uc.Endpoints {
+			eu, err := parseEndpointURL(raw)
+			if err != nil {
+				return nil, err
+			}
+			u.endpoints = append(u.endpoints, &endpoint{url: eu})
+		}
+		t.upstreams[uc.Name] = u
+		t.order = append(t.order, uc.Name)
+	}
+
+	for _, rc := range gc.Routes {
+		rt := &route{cfg: rc}
+		if len(rc.Versions) == 0 {
+			rt.versions = []*routeVersion{{name: "default", upstream: t.upstreams[rc.Upstream], weight: 100}}
+		}
+		for _, vc := range rc.Versions {
+			rt.versions = append(rt.versions, &routeVersion{
+				name:         vc.Name,
+				upstream:     t.upstreams[vc.Upstream],
+				weight:       vc.Weight,
+				matchHeaders: vc.MatchHeaders,
+			})
+		}
+
+		var h http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			v := pickVersion(rt, r)
+			w.Header().Set("X-Gateway-Version", v.name)
+
+			rec := &statusRecorder{ResponseWriter: w}
+			t.forward(rec, r, rt, v.upstream)
+			if rec.status == 0 {
+				rec.status = http.StatusOK
+			}
+
+			t.metrics.routeRequests.inc(rt.cfg.Prefix, v.name, strconv.Itoa(rec.status))
+			if rec.status >= 500 {
+				t.metrics.routeErrors.inc(rt.cfg.Prefix, v.name)
+			}
+		})
+		h = t.idempotent(rt, h)
+		if !rc.Public {
+			h = authMiddleware(auth, h)
+		}
+		h = limitRequest(rt, h)
+		h = t.cors(rt, h)
+		rt.handler = h
+		t.routes = append(t.routes, rt)
+	}
+	sortRoutesLongestFirst(t.routes)
+
+	return t, nil
+}
+
+func (t *proxyTable) match(path string) *route {
+	for _, rt := range t.routes {
+		if matchesPrefix(path, rt.cfg.Prefix) {
+			return rt
+		}
+	}
+	return nil
+}
+
+func (t *proxyTable) snapshot() []upstreamSnapshot {
+	out := make([]upstreamSnapshot, 0, len(t.order))
+	for _, name := range t.order {
+		out = append(out, t.upstreams[name].snapshot())
+	}
+	return out
+}
+
+// forward proxies r to the route's upstream, retrying retryable failures when
+// the request is safe to replay and the breaker allows it.
+func (t *proxyTable) forward(w http.ResponseWriter, r *http.Request, rt *route, u *upstream) {
+	maxAttempts := rt.cfg.Retry.MaxAttempts
+	if !isReplayable(r) {
+		maxAttempts = 1
+	}
+
+	var body []byte
+	if maxAttempts > 1 && r.Body != nil && r.Body != http.NoBody {
+		buf, err := io.ReadAll(io.LimitReader(r.Body, maxRetryBodyBytes+1))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"error": "invalid_body"})
+			return
+		}
+		if len(buf) > maxRetryBodyBytes {
+			// too large to buffer: stream what we read plus the rest, once
+			r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(buf), r.Body))
+			maxAttempts = 1
+		} else {
+			body = buf
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(rt.cfg.Timeout))
+	defer cancel()
+
+	for attempt := 1; ; attempt++ {
+		gen, err := u.breaker.allow()
+		if err != nil {
+			t.metrics.breakerRejections.inc(u.name)
+			wait := u.breaker.retryAfter()
+			w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+			writeJSON(w, http.StatusServiceUnavailable, map[string]any{
+				"error":    "upstream_unavailable",
+				"upstream": u.name,
+			})
+			return
+		}
+
+		ep := u.pick(time.Now())
+		outReq := newOutboundRequest(ctx, r, rt, ep.url, body)
+		claims, _ := r.Context().Value(ctxKeyClaims{}).(jwt.MapClaims)
+		setIdentityHeaders(outReq, t.identitySecret, claims, time.Now())
+		resp, err := t.transport.RoundTrip(outReq)
+
+		if err != nil && errors.Is(r.Context().Err(), context.Canceled) {
+			// the caller went away, which says nothing about the upstream
+			u.breaker.release(gen)
+			t.metrics.upstreamRequests.inc(u.name, "canceled")
+			writeUpstreamError(w, u.name, err)
+			return
+		}
+
+		ok := err == nil && !isUpstreamFailure(resp.StatusCode)
+		u.breaker.record(gen, ok)
+		if ejected := u.report(ep, ok, time.Now()); ejected {
+			t.metrics.outlierEjections.inc(u.name, ep.url.Host)
+			log.Printf(`{"upstream":"%s","endpoint":"%s","msg":"endpoint ejected"}`, u.name, ep.url.Host)
+		}
+
+		code := "error"
+		if err == nil {
+			code = strconv.Itoa(resp.StatusCode)
+		}
+		t.metrics.upstreamRequests.inc(u.name, code)
+
+		if ok || attempt >= maxAttempts || ctx.Err() != nil {
+			if err != nil {
+				writeUpstreamError(w, u.name, err)
+				return
+			}
+			copyResponse(w, resp)
+			return
+		}
+
+		if resp != nil {
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+
+		t.metrics.upstreamRetries.inc(u.name)
+		select {
+		case <-time.After(backoffDelay(attempt, rt.cfg.Retry)):
+		case <-ctx.Done():
+			writeUpstreamError(w, u.name, ctx.Err())
+			return
+		}
+	}
+}
+
+// pick returns the next non-ejected endpoint in round-robin order. If every
+// endpoint is ejected it falls back to plain round robin rather than failing.
+func (u *upstream) pick(now time.Time) *endpoint {
+	n := uint64(len(u.endpoints))
+	start := u.next.Add(1)
+	for i := uint64(0); i < n; i++ {
+		ep := u.endpoints[(start+i)%n]
+		if !ep.isEjected(now) {
+			return ep
+		}
+	}
+	return u.endpoints[start%n]
+}
+
+// report records the result of a call to ep and reports whether it caused
+// the endpoint to be ejected.
+func (u *upstream) report(ep *endpoint, success bool, now time.Time) bool {
+	ep.mu.Lock()
+	if success {
+		ep.failures = 0
+		ep.mu.Unlock()
+		return false
+	}
+	ep.failures++
+	trip := ep.failures >= u.outlier.ConsecutiveFailures && !ep.ejectedUntil.After(now)
+	ep.mu.Unlock()
+
+	if !trip || !u.canEject(now) {
+		return false
+	}
+
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	ep.ejections++
+	ep.failures = 0
+	// back off harder on endpoints that keep getting ejected
+	mult := min(ep.ejections, 10)
+	ep.ejectedUntil = now.Add(time.Duration(u.outlier.EjectionTime) * time.Duration(mult))
+	return true
+}
+
+func (u *upstream) canEject(now time.Time) bool {
+	ejected := 0
+	for _, ep := range u.endpoints {
+		if ep.isEjected(now) {
+			ejected++
+		}
+	}
+	return (ejected+1)*100 <= u.outlier.MaxEjectionPercent*len(u.endpoints)
+}
+
+func (ep *endpoint) isEjected(now time.Time) bool {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	return ep.ejectedUntil.After(now)
+}
+
+func (u *upstream) snapshot() upstreamSnapshot {
+	s := upstreamSnapshot{Name: u.name, Breaker: u.breaker.snapshot()}
+	now := time.Now()
+	for _, ep := range u.endpoints {
+		ep.mu.Lock()
+		es := endpointSnapshot{URL: ep.url.String(), ConsecutiveFailures: ep.failures}
+		if ep.ejectedUntil.After(now) {
+			t := ep.ejectedUntil
+			es.EjectedUntil = &t
+		}
+		ep.mu.Unlock()
+		s.Endpoints = append(s.Endpoints, es)
+	}
+	return s
+}
+
+// isReplayable reports whether a request may be sent more than once: either
+// the method is idempotent or the client supplied an Idempotency-Key.
+func isReplayable(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete, http.MethodTrace:
+		return true
+	}
+	return strings.TrimSpace(r.Header.Get("Idempotency-Key")) != ""
+}
+
+// isUpstreamFailure reports whether a status code means the upstream itself
+// is unhealthy, as opposed to rejecting the request.
+func isUpstreamFailure(code int) bool {
+	return code == http.StatusBadGateway || code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout
+}
+
+// backoffDelay is exponential backoff with full jitter.
+func backoffDelay(attempt int, rc retryConfig) time.Duration {
+	d := time.Duration(rc.BaseBackoff) << (attempt - 1)
+	if d <= 0 || d > time.Duration(rc.MaxBackoff) {
+		d = time.Duration(rc.MaxBackoff)
+	}
+	if d <= 0 {
+		return 0
+	}
+	return rand.N(d)
+}
+
+func newOutboundRequest(ctx context.Context, r *http.Request, rt *route, target *url.URL, body []byte) *http.Request {
+	path := r.URL.Path
+	if rt.cfg.StripPrefix {
+		path = "/" + strings.TrimPrefix(strings.TrimPrefix(path, rt.cfg.Prefix), "/")
+	}
+
+	out := r.Clone(ctx)
+	out.RequestURI = ""
+	out.URL = &url.URL{
+		Scheme:   target.Scheme,
+		Host:     target.Host,
+		Path:     strings.TrimSuffix(target.Path, "/") + path,
+		RawQuery: r.URL.RawQuery,
+	}
+	out.Host = target.Host
+
+	if body != nil {
+		out.Body = io.NopCloser(bytes.NewReader(body))
+		out.ContentLength = int64(len(body))
+		out.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+
+	for _, h := range hopHeaders {
+		out.Header.Del(h)
+	}
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := r.Header.Get("X-Forwarded-For"); prior != "" {
+			ip = prior + ", " + ip
+		}
+		out.Header.Set("X-Forwarded-For", ip)
+	}
+	out.Header.Set("X-Forwarded-Host", r.Host)
+	if out.Header.Get("X-Forwarded-Proto") == "" {
+		proto := "http"
+		if r.TLS != nil {
+			proto = "https"
+		}
+		out.Header.Set("X-Forwarded-Proto", proto)
+	}
+	return out
+}
+
+func copyResponse(w http.ResponseWriter, resp *http.Response) {
+	defer resp.Body.Close()
+
+	for _, h := range hopHeaders {
+		resp.Header.Del(h)
+	}
+	// the gateway owns CORS for routes that configure it
+	gatewayCORS := w.Header().Get("Access-Control-Allow-Origin") != ""
+	for k, vv := range resp.Header {
+		if gatewayCORS && strings.HasPrefix(k, "Access-Control-") {
+			continue
+		}
+		for _, v := range vv {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, resp.Body)
+}
+
+func writeUpstreamError(w http.ResponseWriter, name string, err error) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		writeJSON(w, http.StatusGatewayTimeout, map[string]any{
+			"error":    "upstream_timeout",
+			"upstream": name,
+		})
+		return
+	}
+	writeJSON(w, http.StatusBadGateway, map[string]any{
+		"error":    "upstream_error",
+		"upstream": name,
+	})
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestTable(t *testing.T, upstreamURL string, retry retryConfig, breaker breakerConfig) *proxyTable {
+	t.Helper()
+	gc := &gatewayConfig{
+		JWT:       testJWTDefaults(t),
+		Upstreams: []upstreamConfig{{Name: "payments", Endpoints: []string{upstreamURL}, Breaker: breaker}},
+		Routes:    []routeConfig{{Prefix: "/v1/payments", Upstream: "payments", Public: true, Retry: retry}},
+	}
+	gc.applyDefaults()
+	if err := gc.validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	table, err := newProxyTable(nil, gc, newGatewayMetrics(), nil)
+	if err != nil {
+		t.Fatalf("newProxyTable: %v", err)
+	}
+	return table
+}
+
+func serve(table *proxyTable, method, path, body string, hdr map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	for k, v := range hdr {
+		req.Header.Set(k, v)
+	}
+	rr := httptest.NewRecorder()
+	table.match(req.URL.Path).handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestProxyRetriesIdempotentRequests(t *testing.T) {
+	var calls atomic.Int32
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer up.Close()
+
+	table := newTestTable(t, up.URL, retryConfig{MaxAttempts: 3, BaseBackoff: duration(time.Millisecond)}, breakerConfig{})
+
+	rr := serve(table, http.MethodGet, "/v1/payments", "", nil)
+	if rr.Code != http.StatusOK || calls.Load() != 3 {
+		t.Fatalf("expected 200 after 3 calls, got %d after %d", rr.Code, calls.Load())
+	}
+}
+
+func TestProxyRetriesPostOnlyWithIdempotencyKey(t *testing.T) {
+	var calls atomic.Int32
+	var lastBody atomic.Value
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		lastBody.Store(string(b))
+		calls.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer up.Close()
+
+	table := newTestTable(t, up.URL, retryConfig{MaxAttempts: 3, BaseBackoff: duration(time.Millisecond)}, breakerConfig{FailureThreshold: 100})
+
+	serve(table, http.MethodPost, "/v1/payments", `{"amount":1}`, nil)
+	if calls.Load() != 1 {
+		t.Fatalf("expected POST without Idempotency-Key to be sent once, got %d", calls.Load())
+	}
+
+	calls.Store(0)
+	serve(table, http.MethodPost, "/v1/payments", `{"amount":1}`, map[string]string{"Idempotency-Key": "k1"})
+	if calls.Load() != 3 {
+		t.Fatalf("expected 3 attempts with Idempotency-Key, got %d", calls.Load())
+	}
+	if lastBody.Load() != `{"amount":1}` {
+		t.Fatalf("body not replayed on retry, got %q", lastBody.Load())
+	}
+}
+
+func TestProxyOpenBreakerShortCircuits(t *testing.T) {
+	var calls atomic.Int32
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer up.Close()
+
+	table := newTestTable(t, up.URL, retryConfig{MaxAttempts: 1}, breakerConfig{FailureThreshold: 2, OpenTimeout: duration(time.Minute)})
+
+	for i := 0; i < 2; i++ {
+		serve(table, http.MethodGet, "/v1/payments", "", nil)
+	}
+	rr := serve(table, http.MethodGet, "/v1/payments", "", nil)
+
+	if rr.Code != http.StatusServiceUnavailable || !strings.Contains(rr.Body.String(), "upstream_unavailable") {
+		t.Fatalf("expected breaker rejection, got %d %s", rr.Code, rr.Body.String())
+	}
+	if calls.Load() != 2 {
+		t.Fatalf("expected upstream to be skipped while open, got %d calls", calls.Load())
+	}
+}
+
+func TestProxyCallerCancelDoesNotTripBreaker(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer up.Close()
+
+	table := newTestTable(t, up.URL, retryConfig{MaxAttempts: 1}, breakerConfig{FailureThreshold: 1, OpenTimeout: duration(time.Minute)})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest(http.MethodGet, "/v1/payments", nil).WithContext(ctx)
+	table.match(req.URL.Path).handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if got := table.upstreams["payments"].breaker.snapshot().State; got != "closed" {
+		t.Fatalf("expected a canceled caller not to open the breaker, got %s", got)
+	}
+}
+
+func TestMatchesPrefixOnSegmentBoundary(t *testing.T) {
+	if !matchesPrefix("/v1/payments/123", "/v1/payments") {
+		t.Fatal("expected sub path to match")
+	}
+	if matchesPrefix("/v1/paymentsx", "/v1/payments") {
+		t.Fatal("expected partial segment not to match")
+	}
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// gatewayConfig is the runtime-reloadable part of the gateway configuration:
+// token verification settings, the upstreams the gateway proxies to and the
+// routes that map request paths onto them. It is read as JSON from
+// GATEWAY_CONFIG_FILE (watched for changes) or the GATEWAY_CONFIG variable.
+type gatewayConfig struct {
+	JWT       jwtConfig        `json:"jwt"`
+	Security  securityConfig   `json:"security"`
+	Upstreams []upstreamConfig `json:"upstreams"`
+	Routes    []routeConfig    `json:"routes"`
+}
+
+// maxServerHeaderBytes is the hard cap enforced by net/http before any
+// handler runs; configured header limits must stay below it.
+const maxServerHeaderBytes = 64 << 10
+
+// securityConfig holds gateway-wide hardening defaults. The size limits can
+// be overridden per route.
+type securityConfig struct {
+	// Strict-Transport-Security max-age; unset means one year, "0s" disables
+	// the header
+	HSTSMaxAge *duration `json:"hsts_max_age"`
+	// sent with HTML responses that do not carry their own policy
+	ContentSecurityPolicy string `json:"content_security_policy"`
+	MaxBodyBytes          int64  `json:"max_body_bytes"`
+	MaxHeaderBytes        int    `json:"max_header_bytes"`
+}
+
+// jwtConfig fields left empty fall back to the JWT_* environment variables,
+// so keys can stay in a Secret while routes live in a ConfigMap.
+type jwtConfig struct {
+	Issuer    string `json:"issuer,omitempty"`
+	Audience  string `json:"audience,omitempty"`
+	PublicKey string `json:"public_key,omitempty"`
+	JWKSURL   string `json:"jwks_url,omitempty"`
+}
+
+type upstreamConfig struct {
+	Name      string   `json:"name"`
+	Endpoints []string `json:"endpoints"`
+	// path probed by the readiness checker, relative to each endpoint
+	HealthPath string `json:"health_path"`
+	// critical upstreams must be healthy for the gateway to report ready
+	Critical bool          `json:"critical"`
+	Breaker  breakerConfig `json:"breaker"`
+	Outlier  outlierConfig `json:"outlier"`
+}
+
+type routeConfig struct {
+	Prefix   string `json:"prefix"`
+	Upstream string `json:"upstream,omitempty"`
+	// Versions splits traffic across several upstreams; mutually exclusive
+	// with Upstream.
+	Versions    []versionConfig   `json:"versions,omitempty"`
+	StripPrefix bool              `json:"strip_prefix"`
+	Public      bool              `json:"public"`
+	Timeout     duration          `json:"timeout"`
+	Retry       retryConfig       `json:"retry"`
+	Idempotency idempotencyConfig `json:"idempotency"`
+	CORS        corsConfig        `json:"cors"`
+	// size limits; zero means the security section's default
+	MaxBodyBytes   int64 `json:"max_body_bytes"`
+	MaxHeaderBytes int   `json:"max_header_bytes"`
+}
+
+// corsConfig enables CORS for a route when AllowedOrigins is non-empty.
+// Origins are exact ("https://app.example.com"), a subdomain wildcard
+// ("https://*.example.com") or "*" (not allowed with credentials).
+type corsConfig struct {
+	AllowedOrigins   []string `json:"allowed_origins"`
+	AllowCredentials bool     `json:"allow_credentials"`
+	AllowedMethods   []string `json:"allowed_methods"`
+	AllowedHeaders   []string `json:"allowed_headers"`
+	ExposedHeaders   []string `json:"exposed_headers"`
+	// how long browsers may cache a preflight response
+	MaxAge duration `json:"max_age"`
+}
+
+type idempotencyConfig struct {
+	Enabled bool `json:"enabled"`
+	// reject requests without an Idempotency-Key instead of passing them on
+	Required bool     `json:"required"`
+	Methods  []string `json:"methods"`
+	// how long a completed response is kept for replay
+	TTL duration `json:"ttl"`
+}
+
+type versionConfig struct {
+	Name     string `json:"name"`
+	Upstream string `json:"upstream"`
+	// percentage of traffic; weights of a route must add up to 100
+	Weight int `json:"weight"`
+	// requests carrying all of these headers always get this version
+	MatchHeaders map[string]string `json:"match_headers,omitempty"`
+}
+
+type breakerConfig struct {
+	// consecutive failures before the breaker opens
+	FailureThreshold int `json:"failure_threshold"`
+	// how long the breaker stays open before letting probes through
+	OpenTimeout duration `json:"open_timeout"`
+	// concurrent probes allowed (and successes required) while half-open
+	HalfOpenRequests int `json:"half_open_requests"`
+}
+
+type outlierConfig struct {
+	ConsecutiveFailures int      `json:"consecutive_failures"`
+	EjectionTime        duration `json:"ejection_time"`
+	MaxEjectionPercent  int      `json:"max_ejection_percent"`
+}
+
+type retryConfig struct {
+	MaxAttempts int      `json:"max_attempts"`
+	BaseBackoff duration `json:"base_backoff"`
+	MaxBackoff  duration `json:"max_backoff"`
+}
+
+// duration is a time.Duration that reads from JSON strings like "250ms".
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"2s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func parseGatewayConfig(raw []byte, jwtDefaults jwtConfig) (*gatewayConfig, error) {
+	gc := &gatewayConfig{}
+	if len(strings.TrimSpace(string(raw))) > 0 {
+		dec := json.NewDecoder(strings.NewReader(string(raw)))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(gc); err != nil {
+			return nil, fmt.Errorf("decode: %w", err)
+		}
+	}
+
+	gc.applyJWTDefaults(jwtDefaults)
+	gc.applyDefaults()
+	if err := gc.validate(); err != nil {
+		return nil, err
+	}
+	return gc, nil
+}
+
+func (gc *gatewayConfig) applyJWTDefaults(def jwtConfig) {
+	if gc.JWT.Issuer == "" {
+		gc.JWT.Issuer = def.Issuer
+	}
+	if gc.JWT.Audience == "" {
+		gc.JWT.Audience = def.Audience
+	}
+	if gc.JWT.PublicKey == "" && gc.JWT.JWKSURL == "" {
+		gc.JWT.PublicKey = def.PublicKey
+		gc.JWT.JWKSURL = def.JWKSURL
+	}
+}
+
+func (gc *gatewayConfig) applyDefaults() {
+	if gc.Security.HSTSMaxAge == nil {
+		year := duration(365 * 24 * time.Hour)
+		gc.Security.HSTSMaxAge = &year
+	}
+	if gc.Security.ContentSecurityPolicy == "" {
+		gc.Security.ContentSecurityPolicy = "default-src 'none'; frame-ancestors 'none'"
+	}
+	if gc.Security.MaxBodyBytes == 0 {
+		gc.Security.MaxBodyBytes = 1 << 20
+	}
+	if gc.Security.MaxHeaderBytes == 0 {
+		gc.Security.MaxHeaderBytes = 32 << 10
+	}
+
+	for i := range gc.Upstreams {
+		u := &gc.Upstreams[i]
+		if u.HealthPath == "" {
+			u.HealthPath = "/readyz"
+		}
+		if u.Breaker.FailureThreshold == 0 {
+			u.Breaker.FailureThreshold = 5
+		}
+		if u.Breaker.OpenTimeout == 0 {
+			u.Breaker.OpenTimeout = duration(30 * time.Second)
+		}
+		if u.Breaker.HalfOpenRequests == 0 {
+			u.Breaker.HalfOpenRequests = 1
+		}
+		if u.Outlier.ConsecutiveFailures == 0 {
+			u.Outlier.ConsecutiveFailures = 5
+		}
+		if u.Outlier.EjectionTime == 0 {
+			u.Outlier.EjectionTime = duration(30 * time.Second)
+		}
+		if u.Outlier.MaxEjectionPercent == 0 {
+			u.Outlier.MaxEjectionPercent = 50
+		}
+	}
+
+	for i := range gc.Routes {
+		r := &gc.Routes[i]
+		if r.Timeout == 0 {
+			r.Timeout = duration(10 * time.Second)
+		}
+		if r.Retry.MaxAttempts == 0 {
+			r.Retry.MaxAttempts = 1
+		}
+		if r.Retry.BaseBackoff == 0 {
+			r.Retry.BaseBackoff = duration(50 * time.Millisecond)
+		}
+		if r.Retry.MaxBackoff == 0 {
+			r.Retry.MaxBackoff = duration(time.Second)
+		}
+		if len(r.Idempotency.Methods) == 0 {
+			r.Idempotency.Methods = []string{http.MethodPost}
+		}
+		if r.Idempotency.TTL == 0 {
+			r.Idempotency.TTL = duration(24 * time.Hour)
+		}
+		if r.MaxBodyBytes == 0 {
+			r.MaxBodyBytes = gc.Security.MaxBodyBytes
+		}
+		if r.MaxHeaderBytes == 0 {
+			r.MaxHeaderBytes = gc.Security.MaxHeaderBytes
+		}
+		if len(r.CORS.AllowedOrigins) > 0 {
+			if len(r.CORS.AllowedMethods) == 0 {
+				r.CORS.AllowedMethods = []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+			}
+			if len(r.CORS.AllowedHeaders) == 0 {
+				r.CORS.AllowedHeaders = []string{"Authorization", "Content-Type", "Idempotency-Key", "X-Canary"}
+			}
+			if len(r.CORS.ExposedHeaders) == 0 {
+				r.CORS.ExposedHeaders = []string{"Idempotent-Replayed", "X-Gateway-Version", "Retry-After"}
+			}
+			if r.CORS.MaxAge == 0 {
+				r.CORS.MaxAge = duration(10 * time.Minute)
+			}
+		}
+	}
+}
+
+func (gc *gatewayConfig) validate() error {
+	if gc.JWT.Issuer == "" || gc.JWT.Audience == "" {
+		return fmt.Errorf("jwt issuer and audience are required")
+	}
+	if gc.JWT.PublicKey == "" && gc.JWT.JWKSURL == "" {
+		return fmt.Errorf("jwt public_key (PEM encoded RSA public key) or jwks_url is required")
+	}
+	if gc.JWT.JWKSURL != "" {
+		if _, err := parseEndpointURL(gc.JWT.JWKSURL); err != nil {
+			return fmt.Errorf("jwt jwks_url: %w", err)
+		}
+	}
+
+	if (gc.Security.HSTSMaxAge != nil && *gc.Security.HSTSMaxAge < 0) || gc.Security.MaxBodyBytes < 0 || gc.Security.MaxHeaderBytes < 0 {
+		return fmt.Errorf("security settings must not be negative")
+	}
+	if gc.Security.MaxHeaderBytes > maxServerHeaderBytes {
+		return fmt.Errorf("security.max_header_bytes must not exceed %d", maxServerHeaderBytes)
+	}
+
+	upstreams := map[string]bool{}
+	for _, u := range gc.Upstreams {
+		if u.Name == "" {
+			return fmt.Errorf("upstream name is required")
+		}
+		if upstreams[u.Name] {
+			return fmt.Errorf("duplicate upstream %q", u.Name)
+		}
+		upstreams[u.Name] = true
+
+		if len(u.Endpoints) == 0 {
+			return fmt.Errorf("upstream %q: at least one endpoint is required", u.Name)
+		}
+		for _, e := range u.Endpoints {
+			if _, err := parseEndpointURL(e); err != nil {
+				return fmt.Errorf("upstream %q: %w", u.Name, err)
+			}
+		}
+		if !strings.HasPrefix(u.HealthPath, "/") {
+			return fmt.Errorf("upstream %q: health_path must start with /", u.Name)
+		}
+		if u.Breaker.FailureThreshold < 0 || u.Breaker.HalfOpenRequests < 0 || u.Breaker.OpenTimeout < 0 {
+			return fmt.Errorf("upstream %q: breaker settings must not be negative", u.Name)
+		}
+		if u.Outlier.MaxEjectionPercent < 0 || u.Outlier.MaxEjectionPercent > 100 {
+			return fmt.Errorf("upstream %q: max_ejection_percent must be between 0 and 100", u.Name)
+		}
+	}
+
+	prefixes := map[string]bool{}
+	for _, r := range gc.Routes {
+		if !strings.HasPrefix(r.Prefix, "/") {
+			return fmt.Errorf("route %q: prefix must start with /", r.Prefix)
+		}
+		if prefixes[r.Prefix] {
+			return fmt.Errorf("duplicate route prefix %q", r.Prefix)
+		}
+		prefixes[r.Prefix] = true
+
+		if err := validateRouteTargets(r, upstreams); err != nil {
+			return err
+		}
+		if r.Timeout < 0 {
+			return fmt.Errorf("route %q: timeout must not be negative", r.Prefix)
+		}
+		if r.Idempotency.TTL < 0 {
+			return fmt.Errorf("route %q: idempotency.ttl must not be negative", r.Prefix)
+		}
+		if r.Retry.MaxAttempts < 1 || r.Retry.MaxAttempts > 5 {
+			return fmt.Errorf("route %q: retry.max_attempts must be between 1 and 5", r.Prefix)
+		}
+		if r.MaxBodyBytes < 0 || r.MaxHeaderBytes < 0 || r.MaxHeaderBytes > maxServerHeaderBytes {
+			return fmt.Errorf("route %q: max_header_bytes must be between 0 and %d and max_body_bytes must not be negative", r.Prefix, maxServerHeaderBytes)
+		}
+		if err := validateCORS(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateRouteTargets(r routeConfig, upstreams map[string]bool) error {
+	if len(r.Versions) == 0 {
+		if !upstreams[r.Upstream] {
+			return fmt.Errorf("route %q: unknown upstream %q", r.Prefix, r.Upstream)
+		}
+		return nil
+	}
+	if r.Upstream != "" {
+		return fmt.Errorf("route %q: set either upstream or versions, not both", r.Prefix)
+	}
+
+	names := map[string]bool{}
+	total := 0
+	for _, v := range r.Versions {
+		if v.Name == "" || names[v.Name] {
+			return fmt.Errorf("route %q: version names must be unique and non-empty", r.Prefix)
+		}
+		names[v.Name] = true
+		if !upstreams[v.Upstream] {
+			return fmt.Errorf("route %q: version %q: unknown upstream %q", r.Prefix, v.Name, v.Upstream)
+		}
+		if v.Weight < 0 || v.Weight > 100 {
+			return fmt.Errorf("route %q: version %q: weight must be between 0 and 100", r.Prefix, v.Name)
+		}
+		total += v.Weight
+	}
+	if total != 100 {
+		return fmt.Errorf("route %q: version weights add up to %d, want 100", r.Prefix, total)
+	}
+	return nil
+}
+
+func validateCORS(r routeConfig) error {
+	for _, o := range r.CORS.AllowedOrigins {
+		if o == "*" {
+			if r.CORS.AllowCredentials {
+				return fmt.Errorf("route %q: cors allowed_origins \"*\" cannot be combined with allow_credentials", r.Prefix)
+			}
+			continue
+		}
+		u, err := url.Parse(strings.Replace(o, "://*.", "://", 1))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" {
+			return fmt.Errorf("route %q: invalid cors origin %q", r.Prefix, o)
+		}
+	}
+	if r.CORS.MaxAge < 0 {
+		return fmt.Errorf("route %q: cors max_age must not be negative", r.Prefix)
+	}
+	return nil
+}
+
+func parseEndpointURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint %q: %w", s, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint %q: must be an absolute http(s) URL", s)
+	}
+	return u, nil
+}
+
+// matchesPrefix reports whether path falls under prefix on a path segment
+// boundary, so "/v1/pay" does not capture "/v1/payments".
+func matchesPrefix(path, prefix string) bool {
+	if strings.HasSuffix(prefix, "/") {
+		return strings.HasPrefix(path, prefix)
+	}
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// sortRoutesLongestFirst orders routes so the most specific prefix wins.
+func sortRoutesLongestFirst(routes []*route) {
+	sort.SliceStable(routes, func(i, j int) bool {
+		return len(routes[i].cfg.Prefix) > len(routes[j].cfg.Prefix)
+	})
+}
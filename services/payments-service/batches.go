@@ -0,0 +1,979 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Batch statuses. A batch is validated on upload and does nothing until it
+// is approved; the worker then moves it to processing and, once no row is
+// left to pay, to completed or completed_with_errors.
+const (
+	batchValidated           = "validated"
+	batchApproved            = "approved"
+	batchProcessing          = "processing"
+	batchCompleted           = "completed"
+	batchCompletedWithErrors = "completed_with_errors"
+	batchCanceled            = "canceled"
+)
+
+// Row statuses. Valid rows are the ones still to pay; duplicate rows have
+// a ref that already has a payment and are never paid again.
+const (
+	batchRowValid     = "valid"
+	batchRowInvalid   = "invalid"
+	batchRowDuplicate = "duplicate"
+	batchRowSucceeded = "succeeded"
+	batchRowFailed    = "failed"
+	batchRowCanceled  = "canceled"
+)
+
+var (
+	errInvalidBatchFile = errors.New("invalid batch file")
+	errBatchNotFound    = errors.New("batch not found")
+	errBatchState       = errors.New("batch cannot do that in its current status")
+)
+
+// maxBatchFileBytes and maxBatchRows bound an uploaded batch.
+const (
+	maxBatchFileBytes = 16 << 20
+	maxBatchRows      = 10000
+)
+
+// batchChunkSize is how many rows a worker claims at a time, for
+// batchLease; paying one row may take up to batchRowTimeout.
+const (
+	batchChunkSize  = 50
+	batchLease      = 5 * time.Minute
+	batchRowTimeout = 30 * time.Second
+)
+
+// batchLine is one row of an uploaded file, before it is stored.
+type batchLine struct {
+	line       int // CSV line number, or 1-based index in a JSON array
+	req        createPaymentRequest
+	err        string
+	existingID string // payment already created with the row's ref
+}
+
+func (l batchLine) status() string {
+	switch {
+	case l.err != "":
+		return batchRowInvalid
+	case l.existingID != "":
+		return batchRowDuplicate
+	}
+	return batchRowValid
+}
+
+// batchFormat picks the file format from the format parameter, falling
+// back to the request's Content-Type.
+func batchFormat(param, contentType string) (string, error) {
+	if param == "" {
+		mt, _, _ := mime.ParseMediaType(contentType)
+		param = map[string]string{"text/csv": "csv", "application/json": "json"}[mt]
+	}
+	if param != "csv" && param != "json" {
+		return "", fmt.Errorf("%w: format must be csv or json", errInvalidBatchFile)
+	}
+	return param, nil
+}
+
+// parseBatchFile reads the rows of a batch. Problems with the file as a
+// whole are errors; problems with a single row are recorded on the row so
+// the whole file can be reported at once.
+func parseBatchFile(format string, r io.Reader) ([]batchLine, error) {
+	var lines []batchLine
+	var err error
+	if format == "csv" {
+		lines, err = parseBatchCSV(r)
+	} else {
+		lines, err = parseBatchJSON(r)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("%w: no rows", errInvalidBatchFile)
+	}
+	return lines, nil
+}
+
+var batchCSVColumns = []string{"user_id", "amount", "amount_decimal", "currency", "ref", "payment_method", "country"}
+
+func parseBatchCSV(r io.Reader) ([]batchLine, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+	cr.FieldsPerRecord = -1
+
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%w: missing header: %v", errInvalidBatchFile, err)
+	}
+	col := map[string]int{}
+	for i, h := range header {
+		name := strings.ToLower(strings.TrimSpace(strings.TrimPrefix(h, "\ufeff")))
+		known := false
+		for _, c := range batchCSVColumns {
+			known = known || c == name
+		}
+		if !known {
+			return nil, fmt.Errorf("%w: unknown column %q, want %s", errInvalidBatchFile, h, strings.Join(batchCSVColumns, ", "))
+		}
+		col[name] = i
+	}
+	_, hasCur := col["currency"]
+	_, hasRef := col["ref"]
+	_, hasMinor := col["amount"]
+	_, hasDec := col["amount_decimal"]
+	if !hasCur || !hasRef || (!hasMinor && !hasDec) {
+		return nil, fmt.Errorf("%w: header needs currency, ref and amount or amount_decimal", errInvalidBatchFile)
+	}
+
+	var out []batchLine
+	for {
+		rec, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return out, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errInvalidBatchFile, err)
+		}
+		if len(out) == maxBatchRows {
+			return nil, fmt.Errorf("%w: more than %d rows", errInvalidBatchFile, maxBatchRows)
+		}
+		lineNo, _ := cr.FieldPos(0)
+
+		field := func(name string) string {
+			if i, ok := col[name]; ok && i < len(rec) {
+				return strings.TrimSpace(rec[i])
+			}
+			return ""
+		}
+		l := batchLine{line: lineNo, req: createPaymentRequest{
+			UserID:        field("user_id"),
+			AmountDecimal: field("amount_decimal"),
+			Currency:      field("currency"),
+			Ref:           field("ref"),
+			PaymentMethod: field("payment_method"),
+			Country:       field("country"),
+		}}
+		if s := field("amount"); s != "" {
+			if l.req.Amount, err = strconv.ParseInt(s, 10, 64); err != nil {
+				l.err = "amount must be a whole number of minor units"
+			}
+		}
+		out = append(out, l)
+	}
+}
+
+// parseBatchJSON reads an array of payment requests, as sent to POST
+// /v1/payments.
+func parseBatchJSON(r io.Reader) ([]batchLine, error) {
+	var raw []json.RawMessage
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("%w: want a JSON array of payments: %v", errInvalidBatchFile, err)
+	}
+	if len(raw) > maxBatchRows {
+		return nil, fmt.Errorf("%w: more than %d rows", errInvalidBatchFile, maxBatchRows)
+	}
+
+	out := make([]batchLine, len(raw))
+	for i, msg := range raw {
+		out[i].line = i + 1
+		dec := json.NewDecoder(bytes.NewReader(msg))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&out[i].req); err != nil {
+			out[i].err = "invalid row: " + err.Error()
+		}
+	}
+	return out, nil
+}
+
+// validateBatchLines applies the rules of POST /v1/payments to every row:
+// user_id defaults to the caller, who may only pay as themselves unless
+// they are an operator. A ref may appear only once per user in a file.
+func validateBatchLines(lines []batchLine, caller principal) {
+	seen := map[[2]string]int{}
+	for i := range lines {
+		l := &lines[i]
+		if l.err != "" {
+			continue
+		}
+		if strings.TrimSpace(l.req.UserID) == "" {
+			l.req.UserID = caller.Subject
+		}
+		if strings.TrimSpace(l.req.FXQuoteID) != "" {
+			// quotes expire long before a batch is approved
+			l.err = "fx_quote_id is not supported in batches"
+			continue
+		}
+		if err := l.req.normalize(); err != nil {
+			l.err = err.Error()
+			continue
+		}
+		if !caller.mayActFor(l.req.UserID) {
+			l.err = "user_id does not match the authenticated user"
+			continue
+		}
+		key := [2]string{l.req.UserID, l.req.Ref}
+		if first, ok := seen[key]; ok {
+			l.err = fmt.Sprintf("ref %q repeats line %d", l.req.Ref, first)
+			continue
+		}
+		seen[key] = l.line
+	}
+}
+
+// markUsedRefs flags rows whose ref already has a payment, which is what a
+// resubmitted file looks like.
+func markUsedRefs(ctx context.Context, db *sql.DB, lines []batchLine) error {
+	var users, refs []string
+	for _, l := range lines {
+		if l.err == "" {
+			users = append(users, l.req.UserID)
+			refs = append(refs, l.req.Ref)
+		}
+	}
+	if len(refs) == 0 {
+		return nil
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT p.user_id, p.ref, p.id::text
+		FROM payments p
+		JOIN unnest($1::text[], $2::text[]) AS r(user_id, ref) ON p.user_id = r.user_id AND p.ref = r.ref
+	`, users, refs)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	used := map[[2]string]string{}
+	for rows.Next() {
+		var user, ref, id string
+		if err := rows.Scan(&user, &ref, &id); err != nil {
+			return err
+		}
+		used[[2]string{user, ref}] = id
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for i := range lines {
+		if lines[i].err == "" {
+			lines[i].existingID = used[[2]string{lines[i].req.UserID, lines[i].req.Ref}]
+		}
+	}
+	return nil
+}
+
+type paymentBatch struct {
+	ID          string     `json:"id"`
+	UserID      string     `json:"user_id"`
+	Name        string     `json:"name,omitempty"`
+	Format      string     `json:"format"`
+	Status      string     `json:"status"`
+	RowCount    int        `json:"row_count"`
+	SkipInvalid bool       `json:"skip_invalid"`
+	ApprovedBy  string     `json:"approved_by,omitempty"`
+	ApprovedAt  *time.Time `json:"approved_at,omitempty"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	// rows per status; only on single-batch reads
+	RowCounts map[string]int `json:"row_counts,omitempty"`
+}
+
+const batchColumns = `id::text, user_id, COALESCE(name, ''), format, status, row_count, skip_invalid,
+	COALESCE(approved_by, ''), approved_at, started_at, completed_at, created_at, updated_at`
+
+func scanBatch(row rowScanner, b *paymentBatch) error {
+	var approvedAt, startedAt, completedAt sql.NullTime
+	if err := row.Scan(&b.ID, &b.UserID, &b.Name, &b.Format, &b.Status, &b.RowCount, &b.SkipInvalid,
+		&b.ApprovedBy, &approvedAt, &startedAt, &completedAt, &b.CreatedAt, &b.UpdatedAt); err != nil {
+		return err
+	}
+	b.ApprovedAt, b.StartedAt, b.CompletedAt = nil, nil, nil
+	if approvedAt.Valid {
+		b.ApprovedAt = &approvedAt.Time
+	}
+	if startedAt.Valid {
+		b.StartedAt = &startedAt.Time
+	}
+	if completedAt.Valid {
+		b.CompletedAt = &completedAt.Time
+	}
+	return nil
+}
+
+type batchRow struct {
+	Line          int    `json:"line"`
+	UserID        string `json:"user_id"`
+	Amount        int64  `json:"amount"`
+	AmountDecimal string `json:"amount_decimal,omitempty"`
+	Currency      string `json:"currency"`
+	Ref           string `json:"ref"`
+	PaymentMethod string `json:"payment_method,omitempty"`
+	Country       string `json:"country,omitempty"`
+	Status        string `json:"status"`
+	Error         string `json:"error,omitempty"`
+	PaymentID     string `json:"payment_id,omitempty"`
+	// current status of the payment, which may move on after the row is done
+	PaymentStatus string `json:"payment_status,omitempty"`
+}
+
+// handleBatches serves:
+//
+//	POST /v1/batches?format=csv|json&name=
+//	GET  /v1/batches?user_id=&status=
+//	GET  /v1/batches/{id}                       batch plus row counts
+//	GET  /v1/batches/{id}/rows?status=&after=&limit=
+//	POST /v1/batches/{id}/{approve|cancel}
+func (st *appState) handleBatches(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/batches"), "/")
+	if rest == "" {
+		switch r.Method {
+		case http.MethodPost:
+			st.createBatch(w, r)
+		case http.MethodGet:
+			st.listBatches(w, r)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	id, action, _ := strings.Cut(rest, "/")
+	b, err := st.loadBatch(ctx, id)
+	if errors.Is(err, errBatchNotFound) || (err == nil && !callerFrom(ctx).mayActFor(b.UserID)) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		if b.RowCounts, err = batchRowCounts(ctx, st.db, b.ID); err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, b)
+	case action == "rows" && r.Method == http.MethodGet:
+		st.listBatchRows(ctx, w, r, b.ID)
+	case action == "approve" || action == "cancel":
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var body struct {
+			SkipInvalid bool `json:"skip_invalid"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		if action == "approve" {
+			b, err = st.approveBatch(ctx, b, callerFrom(ctx).Subject, body.SkipInvalid)
+		} else {
+			b, err = st.cancelBatch(ctx, b)
+		}
+		if errors.Is(err, errBatchState) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf(`{"msg":"batch %s","batch_id":%q,"by":%q}`, b.Status, b.ID, callerFrom(ctx).Subject)
+		writeJSON(w, http.StatusOK, b)
+	case action == "" || action == "rows":
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+// createBatch validates an uploaded file and stores it with every row. It
+// answers 201 even when rows are invalid; their errors are in the response
+// and the batch cannot be approved until they are fixed or skipped.
+func (st *appState) createBatch(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	format, err := batchFormat(q.Get("format"), r.Header.Get("Content-Type"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	lines, err := parseBatchFile(format, http.MaxBytesReader(w, r.Body, maxBatchFileBytes))
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		http.Error(w, "batch file too large", http.StatusRequestEntityTooLarge)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 60*time.Second)
+	defer cancel()
+
+	caller := callerFrom(ctx)
+	validateBatchLines(lines, caller)
+	if err := markUsedRefs(ctx, st.db, lines); err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+
+	b, err := st.insertBatch(ctx, caller.Subject, strings.TrimSpace(q.Get("name")), format, lines)
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+
+	type rowError struct {
+		Line  int    `json:"line"`
+		Error string `json:"error"`
+	}
+	errs := []rowError{}
+	for _, l := range lines {
+		if l.err != "" && len(errs) < 100 {
+			errs = append(errs, rowError{Line: l.line, Error: l.err})
+		}
+	}
+	log.Printf(`{"msg":"batch uploaded","batch_id":%q,"rows":%d,"invalid":%d,"duplicate":%d}`,
+		b.ID, b.RowCount, b.RowCounts[batchRowInvalid], b.RowCounts[batchRowDuplicate])
+	writeJSON(w, http.StatusCreated, map[string]any{"batch": b, "errors": errs})
+}
+
+func (st *appState) insertBatch(ctx context.Context, owner, name, format string, lines []batchLine) (paymentBatch, error) {
+	var b paymentBatch
+
+	n := len(lines)
+	nums, amounts := make([]int64, n), make([]int64, n)
+	users, currencies, refs := make([]string, n), make([]string, n), make([]string, n)
+	methods, countries, statuses := make([]string, n), make([]string, n), make([]string, n)
+	errs, existing := make([]string, n), make([]string, n)
+	counts := map[string]int{}
+	for i, l := range lines {
+		nums[i], amounts[i] = int64(l.line), l.req.Amount
+		users[i], currencies[i], refs[i] = strings.TrimSpace(l.req.UserID), l.req.Currency, l.req.Ref
+		methods[i], countries[i], statuses[i] = l.req.PaymentMethod, l.req.Country, l.status()
+		errs[i], existing[i] = l.err, l.existingID
+		counts[statuses[i]]++
+	}
+
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return b, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	err = scanBatch(tx.QueryRowContext(ctx, `
+		INSERT INTO payment_batches(user_id, name, format, status, row_count)
+		VALUES ($1, NULLIF($2, ''), $3, $4, $5)
+		RETURNING `+batchColumns,
+		owner, name, format, batchValidated, n), &b)
+	if err != nil {
+		return b, err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO payment_batch_rows(batch_id, line, user_id, amount, currency, ref, payment_method, country,
+			status, error, payment_id)
+		SELECT $1::uuid, r.line, r.user_id, r.amount, r.currency, r.ref, NULLIF(r.payment_method, ''),
+			NULLIF(r.country, ''), r.status, NULLIF(r.error, ''), NULLIF(r.payment_id, '')::uuid
+		FROM unnest($2::bigint[], $3::text[], $4::bigint[], $5::text[], $6::text[], $7::text[], $8::text[],
+			$9::text[], $10::text[], $11::text[])
+			AS r(line, user_id, amount, currency, ref, payment_method, country, status, error, payment_id)
+	`, b.ID, nums, users, amounts, currencies, refs, methods, countries, statuses, errs, existing); err != nil {
+		return b, err
+	}
+	b.RowCounts = counts
+	return b, tx.Commit()
+}
+
+func (st *appState) listBatches(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	userID := strings.TrimSpace(r.URL.Query().Get("user_id"))
+	if caller := callerFrom(ctx); !caller.Operator {
+		if userID != "" && userID != caller.Subject {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		userID = caller.Subject
+	}
+
+	rows, err := st.db.QueryContext(ctx, `
+		SELECT `+batchColumns+`
+		FROM payment_batches
+		WHERE ($1 = '' OR user_id = $1) AND ($2 = '' OR status = $2)
+		ORDER BY created_at DESC
+		LIMIT 200
+	`, userID, r.URL.Query().Get("status"))
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	out := []paymentBatch{}
+	for rows.Next() {
+		var b paymentBatch
+		if err := scanBatch(rows, &b); err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		out = append(out, b)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// listBatchRows pages through a batch's rows in file order; after is the
+// last line of the previous page.
+func (st *appState) listBatchRows(ctx context.Context, w http.ResponseWriter, r *http.Request, batchID string) {
+	q := r.URL.Query()
+	after, limit := 0, 500
+	var err error
+	if s := q.Get("after"); s != "" {
+		if after, err = strconv.Atoi(s); err != nil {
+			http.Error(w, "after must be a line number", http.StatusBadRequest)
+			return
+		}
+	}
+	if s := q.Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 || limit > 1000 {
+			http.Error(w, "limit must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+	}
+
+	rows, err := st.db.QueryContext(ctx, `
+		SELECT r.line, r.user_id, r.amount, r.currency, r.ref, COALESCE(r.payment_method, ''), COALESCE(r.country, ''),
+		       r.status, COALESCE(r.error, ''), COALESCE(r.payment_id::text, ''), COALESCE(p.status, '')
+		FROM payment_batch_rows r
+		LEFT JOIN payments p ON p.id = r.payment_id
+		WHERE r.batch_id = $1::uuid AND r.line > $2 AND ($3 = '' OR r.status = $3)
+		ORDER BY r.line
+		LIMIT $4
+	`, batchID, after, q.Get("status"), limit)
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	out := []batchRow{}
+	for rows.Next() {
+		var row batchRow
+		if err := rows.Scan(&row.Line, &row.UserID, &row.Amount, &row.Currency, &row.Ref, &row.PaymentMethod,
+			&row.Country, &row.Status, &row.Error, &row.PaymentID, &row.PaymentStatus); err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		if row.Status != batchRowInvalid {
+			row.AmountDecimal = formatAmount(row.Amount, row.Currency)
+		}
+		out = append(out, row)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+
+	page := map[string]any{"data": out}
+	if len(out) == limit {
+		page["next_after"] = out[len(out)-1].Line
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+func (st *appState) loadBatch(ctx context.Context, id string) (paymentBatch, error) {
+	var b paymentBatch
+	if !isUUID(id) {
+		return b, errBatchNotFound
+	}
+	err := scanBatch(st.db.QueryRowContext(ctx, `
+		SELECT `+batchColumns+` FROM payment_batches WHERE id = $1::uuid
+	`, id), &b)
+	if errors.Is(err, sql.ErrNoRows) {
+		return b, errBatchNotFound
+	}
+	return b, err
+}
+
+func batchRowCounts(ctx context.Context, db *sql.DB, batchID string) (map[string]int, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT status, count(*) FROM payment_batch_rows WHERE batch_id = $1::uuid GROUP BY status
+	`, batchID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := map[string]int{}
+	for rows.Next() {
+		var status string
+		var n int
+		if err := rows.Scan(&status, &n); err != nil {
+			return nil, err
+		}
+		out[status] = n
+	}
+	return out, rows.Err()
+}
+
+// approveBatch releases a validated batch to the worker. Invalid rows
+// block approval unless skipInvalid is set, in which case they are left
+// unpaid.
+func (st *appState) approveBatch(ctx context.Context, b paymentBatch, by string, skipInvalid bool) (paymentBatch, error) {
+	if b.Status != batchValidated {
+		return b, fmt.Errorf("%w: %s is %s", errBatchState, b.ID, b.Status)
+	}
+	counts, err := batchRowCounts(ctx, st.db, b.ID)
+	if err != nil {
+		return b, err
+	}
+	if n := counts[batchRowInvalid]; n > 0 && !skipInvalid {
+		return b, fmt.Errorf("%w: %d rows are invalid; upload a corrected file or approve with skip_invalid", errBatchState, n)
+	}
+	if counts[batchRowValid] == 0 {
+		return b, fmt.Errorf("%w: %s has no rows to pay", errBatchState, b.ID)
+	}
+
+	err = scanBatch(st.db.QueryRowContext(ctx, `
+		UPDATE payment_batches
+		SET status = $2, skip_invalid = $3, approved_by = NULLIF($4, ''), approved_at = now(), updated_at = now()
+		WHERE id = $1::uuid AND status = $5
+		RETURNING `+batchColumns,
+		b.ID, batchApproved, skipInvalid, by, batchValidated), &b)
+	if errors.Is(err, sql.ErrNoRows) {
+		return b, fmt.Errorf("%w: %s changed concurrently", errBatchState, b.ID)
+	}
+	b.RowCounts = counts
+	return b, err
+}
+
+// cancelBatch stops a batch that has not finished. Rows a worker has
+// leased, at most one chunk, are still paid; the rest are
+// canceled.
+func (st *appState) cancelBatch(ctx context.Context, b paymentBatch) (paymentBatch, error) {
+	if b.Status != batchValidated && b.Status != batchApproved && b.Status != batchProcessing {
+		return b, fmt.Errorf("%w: %s is %s", errBatchState, b.ID, b.Status)
+	}
+
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return b, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	err = scanBatch(tx.QueryRowContext(ctx, `
+		UPDATE payment_batches
+		SET status = $2, completed_at = now(), updated_at = now()
+		WHERE id = $1::uuid AND status = $3
+		RETURNING `+batchColumns,
+		b.ID, batchCanceled, b.Status), &b)
+	if errors.Is(err, sql.ErrNoRows) {
+		return b, fmt.Errorf("%w: %s changed concurrently", errBatchState, b.ID)
+	}
+	if err != nil {
+		return b, err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE payment_batch_rows
+		SET status = $2, updated_at = now()
+		WHERE id IN (
+			SELECT id FROM payment_batch_rows
+			WHERE batch_id = $1::uuid AND status = $3 AND (locked_until IS NULL OR locked_until < now())
+			FOR UPDATE SKIP LOCKED
+		)
+	`, b.ID, batchRowCanceled, batchRowValid); err != nil {
+		return b, err
+	}
+	return b, tx.Commit()
+}
+
+// runBatchWorker pays the rows of approved batches. Every replica runs it;
+// rows are leased with FOR UPDATE SKIP LOCKED, so replicas share the work
+// without paying a row twice.
+func (st *appState) runBatchWorker(ctx context.Context, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if err := st.processBatches(ctx); err != nil {
+			log.Printf(`{"msg":"batch worker failed","error":%q}`, err.Error())
+		}
+	}
+}
+
+func (st *appState) processBatches(ctx context.Context) error {
+	if _, err := st.db.ExecContext(ctx, `
+		UPDATE payment_batches SET status = $2, started_at = now(), updated_at = now() WHERE status = $1
+	`, batchApproved, batchProcessing); err != nil {
+		return err
+	}
+
+	for ctx.Err() == nil {
+		n, err := st.processBatchChunk(ctx)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+	}
+
+	rows, err := st.db.QueryContext(ctx, `
+		UPDATE payment_batches b
+		SET status = CASE WHEN EXISTS (
+				SELECT 1 FROM payment_batch_rows r WHERE r.batch_id = b.id AND r.status = $3
+			) THEN $4 ELSE $5 END,
+			completed_at = now(), updated_at = now()
+		WHERE b.status = $1
+		  AND NOT EXISTS (SELECT 1 FROM payment_batch_rows r WHERE r.batch_id = b.id AND r.status = $2)
+		RETURNING b.id::text, b.status
+	`, batchProcessing, batchRowValid, batchRowFailed, batchCompletedWithErrors, batchCompleted)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, status string
+		if err := rows.Scan(&id, &status); err != nil {
+			return err
+		}
+		log.Printf(`{"msg":"batch finished","batch_id":%q,"status":%q}`, id, status)
+	}
+	return rows.Err()
+}
+
+type claimedBatchRow struct {
+	id      int64
+	batchID string
+	// set when an earlier round created the payment but did not get to
+	// record the row's outcome
+	paymentID string
+	req       createPaymentRequest
+}
+
+// processBatchChunk leases up to batchChunkSize rows and pays them one at
+// a time, recording each outcome in its own short transaction, so a paid
+// row stays recorded whatever happens to the rest of the chunk. A row is
+// only started while the lease still covers it. The worker stops at the
+// first error that is not the row's fault, releasing that row and the
+// ones after it for the next round, and returns how many rows it finished.
+func (st *appState) processBatchChunk(ctx context.Context) (int, error) {
+	leaseEnd := time.Now().Add(batchLease)
+	claimed, err := st.claimBatchRows(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, c := range claimed {
+		if ctx.Err() != nil || time.Until(leaseEnd) < 2*batchRowTimeout {
+			st.releaseBatchRows(ctx, claimed[i:])
+			return i, nil
+		}
+		status, paymentID, reason, err := st.payBatchRow(ctx, c)
+		if err == nil {
+			err = st.recordBatchRow(ctx, c.id, status, paymentID, reason)
+		}
+		if err != nil {
+			st.releaseBatchRows(ctx, claimed[i:])
+			return i, fmt.Errorf("batch %s row %d: %w", c.batchID, c.id, err)
+		}
+	}
+	return len(claimed), nil
+}
+
+// claimBatchRows leases the next valid rows of processing batches for
+// batchLease, oldest approval first.
+func (st *appState) claimBatchRows(ctx context.Context) ([]claimedBatchRow, error) {
+	rows, err := st.db.QueryContext(ctx, `
+		WITH due AS (
+			SELECT r.id FROM payment_batch_rows r
+			JOIN payment_batches b ON b.id = r.batch_id
+			WHERE b.status = $1 AND r.status = $2
+			  AND (r.locked_until IS NULL OR r.locked_until < now())
+			ORDER BY b.approved_at, r.batch_id, r.line
+			LIMIT $3
+			FOR UPDATE OF r SKIP LOCKED
+		)
+		UPDATE payment_batch_rows r SET locked_until = now() + make_interval(secs => $4)
+		FROM due
+		WHERE r.id = due.id
+		RETURNING r.id, r.batch_id::text, COALESCE(r.payment_id::text, ''), r.user_id, r.amount, r.currency, r.ref,
+		          COALESCE(r.payment_method, ''), COALESCE(r.country, '')
+	`, batchProcessing, batchRowValid, batchChunkSize, batchLease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []claimedBatchRow
+	for rows.Next() {
+		var c claimedBatchRow
+		if err := rows.Scan(&c.id, &c.batchID, &c.paymentID, &c.req.UserID, &c.req.Amount, &c.req.Currency, &c.req.Ref,
+			&c.req.PaymentMethod, &c.req.Country); err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// RETURNING does not keep the subquery's order; ids follow file order
+	sort.Slice(out, func(i, j int) bool { return out[i].id < out[j].id })
+	return out, nil
+}
+
+// recordBatchRow stores a row's outcome and ends its lease. It is not tied
+// to ctx: once a row has been paid its outcome must be kept even if the
+// worker is shutting down.
+func (st *appState) recordBatchRow(ctx context.Context, id int64, status, paymentID, reason string) error {
+	rctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+	_, err := st.db.ExecContext(rctx, `
+		UPDATE payment_batch_rows
+		SET status = $2, payment_id = COALESCE(NULLIF($3, '')::uuid, payment_id), error = NULLIF($4, ''),
+		    locked_until = NULL, updated_at = now()
+		WHERE id = $1
+	`, id, status, paymentID, reason)
+	return err
+}
+
+// releaseBatchRows ends the lease of rows the worker did not get to, so
+// the next round can take them straight away.
+func (st *appState) releaseBatchRows(ctx context.Context, rows []claimedBatchRow) {
+	ids := make([]int64, 0, len(rows))
+	for _, c := range rows {
+		ids = append(ids, c.id)
+	}
+	rctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+	if _, err := st.db.ExecContext(rctx, `
+		UPDATE payment_batch_rows SET locked_until = NULL WHERE id = ANY($1) AND status = $2
+	`, ids, batchRowValid); err != nil {
+		// the lease runs out on its own
+		log.Printf(`{"msg":"batch rows not released","error":%q}`, err.Error())
+	}
+}
+
+// payBatchRow creates one row's payment and reports the row's outcome.
+// The payment is linked to the row as soon as it exists, so a row retried
+// after a crash resumes its own payment. Payments refused by limits or
+// fraud screening fail the row; a ref that already has a payment links
+// the row to that payment instead. Any other error is returned and the row
+// is retried later.
+func (st *appState) payBatchRow(ctx context.Context, c claimedBatchRow) (status, paymentID, reason string, err error) {
+	rctx, cancel := context.WithTimeout(ctx, batchRowTimeout)
+	defer cancel()
+
+	var p payment
+	if c.paymentID != "" {
+		if p, err = st.loadPayment(rctx, c.paymentID); err != nil {
+			return "", "", "", err
+		}
+	} else {
+		p, err = st.insertPayment(rctx, c.req)
+		var exceeded errLimitExceeded
+		var blocked errPaymentBlocked
+		switch {
+		case errors.Is(err, errDuplicateRef):
+			if p, err = st.paymentByRef(rctx, c.req.UserID, c.req.Ref); err != nil {
+				return "", "", "", err
+			}
+			return batchRowDuplicate, p.ID, "ref already has a payment", nil
+		case errors.As(err, &exceeded), errors.As(err, &blocked):
+			return batchRowFailed, "", err.Error(), nil
+		case err != nil:
+			return "", "", "", err
+		}
+		if _, err := st.db.ExecContext(rctx, `
+			UPDATE payment_batch_rows SET payment_id = $2::uuid, updated_at = now() WHERE id = $1
+		`, c.id, p.ID); err != nil {
+			return "", "", "", err
+		}
+	}
+
+	p = st.collectPayment(rctx, p, "batch payment")
+	if p.Status == statusFailed {
+		return batchRowFailed, p.ID, "payment failed", nil
+	}
+	return batchRowSucceeded, p.ID, "", nil
+}
+
+const batchesSchema = `
+	CREATE TABLE IF NOT EXISTS payment_batches (
+		id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+		user_id text NOT NULL,
+		name text,
+		format text NOT NULL,
+		status text NOT NULL,
+		row_count int NOT NULL,
+		skip_invalid boolean NOT NULL DEFAULT false,
+		approved_by text,
+		approved_at timestamptz,
+		started_at timestamptz,
+		completed_at timestamptz,
+		created_at timestamptz NOT NULL DEFAULT now(),
+		updated_at timestamptz NOT NULL DEFAULT now()
+	);
+
+	CREATE INDEX IF NOT EXISTS payment_batches_user_idx ON payment_batches(user_id, created_at DESC);
+	CREATE INDEX IF NOT EXISTS payment_batches_active_idx ON payment_batches(status) WHERE status IN ('approved', 'processing');
+
+	CREATE TABLE IF NOT EXISTS payment_batch_rows (
+		id bigserial PRIMARY KEY,
+		batch_id uuid NOT NULL REFERENCES payment_batches(id),
+		line int NOT NULL,
+		user_id text NOT NULL,
+		amount bigint NOT NULL,
+		currency text NOT NULL,
+		ref text NOT NULL,
+		payment_method text,
+		country text,
+		status text NOT NULL,
+		error text,
+		payment_id uuid REFERENCES payments(id),
+		updated_at timestamptz NOT NULL DEFAULT now(),
+		UNIQUE (batch_id, line)
+	);
+
+	ALTER TABLE payment_batch_rows ADD COLUMN IF NOT EXISTS locked_until timestamptz;
+
+	CREATE INDEX IF NOT EXISTS payment_batch_rows_todo_idx ON payment_batch_rows(batch_id, line) WHERE status = 'valid';
+`
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseBatchCSVReportsRowErrors(t *testing.T) {
+	file := "\ufeffuser_id,amount_decimal,currency,ref\n" +
+		",1200.50,eur,pay-1\n" +
+		"\n" +
+		"u1,12.345,EUR,pay-2\n" +
+		"u2,10.00,EUR,pay-3\n" +
+		"u1,5.00,EUR,pay-1\n" +
+		"u1,5.00,XXX,pay-4\n"
+	lines, err := parseBatchFile("csv", strings.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	validateBatchLines(lines, principal{Subject: "u1"})
+
+	want := []struct {
+		line   int
+		status string
+		errHas string
+	}{
+		{2, batchRowValid, ""},
+		{4, batchRowInvalid, "decimal"},
+		{5, batchRowInvalid, "authenticated user"},
+		{6, batchRowInvalid, "repeats line 2"},
+		{7, batchRowInvalid, "XXX"},
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("got %d lines, want %d", len(lines), len(want))
+	}
+	for i, w := range want {
+		l := lines[i]
+		if l.line != w.line || l.status() != w.status || !strings.Contains(l.err, w.errHas) {
+			t.Fatalf("line %d: got line=%d status=%s err=%q", i, l.line, l.status(), l.err)
+		}
+	}
+	if lines[0].req.UserID != "u1" || lines[0].req.Amount != 120050 || lines[0].req.Currency != "EUR" {
+		t.Fatalf("row not normalized: %+v", lines[0].req)
+	}
+}
+
+func TestParseBatchJSON(t *testing.T) {
+	file := `[{"user_id":"u1","amount":500,"currency":"EUR","ref":"a"},
+		{"user_id":"u2","amount":500,"currency":"EUR","ref":"a"},
+		{"amount":"5","currency":"EUR","ref":"b"},
+		{"amount":500,"currency":"EUR","ref":"c","iban":"DE00"}]`
+	lines, err := parseBatchFile("json", strings.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// operators may pay for anyone
+	validateBatchLines(lines, principal{Operator: true})
+	got := []string{}
+	for _, l := range lines {
+		got = append(got, l.status())
+	}
+	if strings.Join(got, ",") != "valid,valid,invalid,invalid" {
+		t.Fatalf("statuses %v", got)
+	}
+}
+
+func TestParseBatchFileRejectsBadFiles(t *testing.T) {
+	cases := map[string]string{
+		"csv":  "user_id,amount,currency\nu1,100,EUR\n",
+		"json": `{"rows": []}`,
+	}
+	for format, file := range cases {
+		if _, err := parseBatchFile(format, strings.NewReader(file)); !errors.Is(err, errInvalidBatchFile) {
+			t.Fatalf("%s: got %v", format, err)
+		}
+	}
+	if _, err := parseBatchFile("csv", strings.NewReader("amount,currency,ref,iban\n")); err == nil || !strings.Contains(err.Error(), "iban") {
+		t.Fatalf("unknown column accepted: %v", err)
+	}
+	if _, err := parseBatchFile("json", strings.NewReader("[]")); !errors.Is(err, errInvalidBatchFile) {
+		t.Fatalf("empty batch accepted: %v", err)
+	}
+	big := "amount,currency,ref\n" + strings.Repeat("100,EUR,r\n", maxBatchRows+1)
+	if _, err := parseBatchFile("csv", strings.NewReader(big)); !errors.Is(err, errInvalidBatchFile) {
+		t.Fatalf("oversized batch accepted: %v", err)
+	}
+}
+
+func TestBatchFormat(t *testing.T) {
+	for _, c := range []struct{ param, ct, want string }{
+		{"", "text/csv; charset=utf-8", "csv"},
+		{"", "application/json", "json"},
+		{"csv", "application/octet-stream", "csv"},
+	} {
+		if got, err := batchFormat(c.param, c.ct); err != nil || got != c.want {
+			t.Fatalf("%+v: got %q, %v", c, got, err)
+		}
+	}
+	if _, err := batchFormat("", "application/xml"); err == nil {
+		t.Fatal("xml accepted")
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// BlobStore keeps uploaded files, such as dispute evidence, outside the
+// database. Keys are relative slash-separated paths chosen by the service.
+type BlobStore interface {
+	// Put stores r under key and returns its size and SHA-256. Putting an
+	// existing key replaces it.
+	Put(ctx context.Context, key string, r io.Reader) (size int64, sum string, err error)
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+var (
+	errBlobNotFound   = errors.New("blob not found")
+	errInvalidBlobKey = errors.New("invalid blob key")
+)
+
+// newBlobStoreFromEnv picks the store named by BLOB_STORE. "local" keeps
+// files under BLOB_STORE_DIR, which should be a persistent volume; without
+// a directory there is no store and uploads are refused.
+func newBlobStoreFromEnv() (BlobStore, error) {
+	switch kind := getenv("BLOB_STORE", "local"); kind {
+	case "local":
+		dir := os.Getenv("BLOB_STORE_DIR")
+		if dir == "" {
+			return nil, nil
+		}
+		return newLocalBlobStore(dir)
+	default:
+		return nil, fmt.Errorf("unknown BLOB_STORE %q (want local)", kind)
+	}
+}
+
+// localBlobStore keeps blobs as files under root. A blob is written to a
+// temporary file and renamed into place, so a reader never sees half of
+// one.
+type localBlobStore struct {
+	root string
+}
+
+func newLocalBlobStore(root string) (*localBlobStore, error) {
+	if err := os.MkdirAll(root, 0o750); err != nil {
+		return nil, fmt.Errorf("BLOB_STORE_DIR: %w", err)
+	}
+	return &localBlobStore{root: root}, nil
+}
+
+var blobKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+(/[A-Za-z0-9_.-]+)*$`)
+
+// path maps key onto a file under root, refusing anything that could
+// escape it.
+func (s *localBlobStore) path(key string) (string, error) {
+	if !blobKeyPattern.MatchString(key) {
+		return "", fmt.Errorf("%w: %q", errInvalidBlobKey, key)
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "." || part == ".." {
+			return "", fmt.Errorf("%w: %q", errInvalidBlobKey, key)
+		}
+	}
+	return filepath.Join(s.root, filepath.FromSlash(key)), nil
+}
+
+func (s *localBlobStore) Put(_ context.Context, key string, r io.Reader) (int64, string, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return 0, "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o750); err != nil {
+		return 0, "", err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return 0, "", err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), r)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (s *localBlobStore) Open(_ context.Context, key string) (io.ReadCloser, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", errBlobNotFound, key)
+	}
+	return f, err
+}
+
+func (s *localBlobStore) Delete(_ context.Context, key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestLocalBlobStore(t *testing.T) {
+	ctx := context.Background()
+	s, err := newLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const body = "delivery confirmation"
+	size, sum, err := s.Put(ctx, "disputes/d1/e1", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := sha256.Sum256([]byte(body))
+	if size != int64(len(body)) || sum != hex.EncodeToString(want[:]) {
+		t.Fatalf("put returned %d, %s", size, sum)
+	}
+
+	f, err := s.Open(ctx, "disputes/d1/e1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(f)
+	_ = f.Close()
+	if string(got) != body {
+		t.Fatalf("read back %q", got)
+	}
+
+	if err := s.Delete(ctx, "disputes/d1/e1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Open(ctx, "disputes/d1/e1"); !errors.Is(err, errBlobNotFound) {
+		t.Fatalf("after delete: got %v", err)
+	}
+	if err := s.Delete(ctx, "disputes/d1/e1"); err != nil {
+		t.Fatalf("deleting twice: %v", err)
+	}
+
+	for _, key := range []string{"../etc/passwd", "disputes/../../x", "/abs", "disputes//x", "disputes/./x", ""} {
+		if _, _, err := s.Put(ctx, key, strings.NewReader("x")); !errors.Is(err, errInvalidBlobKey) {
+			t.Errorf("%q: got %v, want errInvalidBlobKey", key, err)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errInvalidRule = errors.New("invalid schedule rule")
+
+// scheduleRule produces the fire times of a schedule.
+type scheduleRule interface {
+	// next returns the first fire time strictly after after, or the zero
+	// time if there is none within the search horizon.
+	next(start, after time.Time) time.Time
+}
+
+// parseScheduleRule reads a rule as stored on a schedule: kind "cron"
+// with a five-field expression, or kind "interval" with a count and unit
+// such as "1mo" or "2w".
+func parseScheduleRule(kind, expr string) (scheduleRule, error) {
+	switch kind {
+	case "cron":
+		return parseCron(expr)
+	case "interval":
+		return parseInterval(expr)
+	}
+	return nil, fmt.Errorf("%w: unknown kind %q", errInvalidRule, kind)
+}
+
+// cronSpec is a standard five-field cron expression (minute hour
+// day-of-month month day-of-week), evaluated in the schedule's time zone.
+// Fields take *, numbers, ranges (a-b), lists (a,b) and steps (*/n, a-b/n).
+// Like Vixie cron, when both day fields are restricted a day matching
+// either one fires.
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+	domStar, dowStar              bool
+}
+
+var cronMacros = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+	"@yearly":  "0 0 1 1 *",
+}
+
+func parseCron(expr string) (*cronSpec, error) {
+	expr = strings.TrimSpace(expr)
+	if m, ok := cronMacros[expr]; ok {
+		expr = m
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("%w: cron %q needs 5 fields", errInvalidRule, expr)
+	}
+
+	c := &cronSpec{domStar: fields[2] == "*", dowStar: fields[4] == "*"}
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	dest := [5]*uint64{&c.minute, &c.hour, &c.dom, &c.month, &c.dow}
+	for i, f := range fields {
+		bits, err := parseCronField(f, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("%w: cron %q: %v", errInvalidRule, expr, err)
+		}
+		*dest[i] = bits
+	}
+	// 7 is another name for Sunday
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	return c, nil
+}
+
+func parseCronField(f string, lo, hi int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(f, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepStr)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("bad step %q", part)
+			}
+			step = n
+		}
+
+		from, to := lo, hi
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if from, err = strconv.Atoi(a); err != nil {
+				return 0, fmt.Errorf("bad value %q", part)
+			}
+			to = from
+			if isRange {
+				if to, err = strconv.Atoi(b); err != nil {
+					return 0, fmt.Errorf("bad value %q", part)
+				}
+			} else if hasStep {
+				to = hi
+			}
+		}
+		if from < lo || to > hi || from > to {
+			return 0, fmt.Errorf("%q is outside %d-%d", part, lo, hi)
+		}
+		for v := from; v <= to; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+func (c *cronSpec) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<t.Day()) != 0
+	dow := c.dow&(1<<int(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// next walks forward field by field, from months down to minutes, so it
+// takes a handful of steps rather than one per minute. Wall-clock times
+// skipped by a DST change are normalized forward by time.Date.
+func (c *cronSpec) next(_, after time.Time) time.Time {
+	loc := after.Location()
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	horizon := t.AddDate(5, 0, 0)
+
+wrap:
+	for t.Before(horizon) {
+		for c.month&(1<<int(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			if !t.Before(horizon) {
+				return time.Time{}
+			}
+		}
+		for !c.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			if t.Day() == 1 {
+				continue wrap
+			}
+		}
+		for c.hour&(1<<t.Hour()) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			if t.Hour() == 0 {
+				continue wrap
+			}
+		}
+		for c.minute&(1<<t.Minute()) == 0 {
+			t = t.Truncate(time.Minute).Add(time.Minute)
+			if t.Minute() == 0 {
+				continue wrap
+			}
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// intervalRule fires every n units from the schedule's start. Months and
+// years are calendar units: a schedule starting on the 31st fires on the
+// last day of shorter months and returns to the 31st afterwards.
+type intervalRule struct {
+	n    int
+	unit string
+}
+
+var intervalPattern = regexp.MustCompile(`^([1-9][0-9]{0,3})(h|d|w|mo|y)$`)
+
+func parseInterval(expr string) (intervalRule, error) {
+	m := intervalPattern.FindStringSubmatch(strings.TrimSpace(expr))
+	if m == nil {
+		return intervalRule{}, fmt.Errorf("%w: interval %q, want a count and one of h, d, w, mo, y", errInvalidRule, expr)
+	}
+	n, _ := strconv.Atoi(m[1])
+	return intervalRule{n: n, unit: m[2]}, nil
+}
+
+// fire returns the k-th fire time (k = 0 is start).
+func (r intervalRule) fire(start time.Time, k int) time.Time {
+	switch r.unit {
+	case "h":
+		return start.Add(time.Duration(k*r.n) * time.Hour)
+	case "d":
+		return start.AddDate(0, 0, k*r.n)
+	case "w":
+		return start.AddDate(0, 0, 7*k*r.n)
+	case "mo":
+		return addMonthsClamped(start, k*r.n)
+	default:
+		return addMonthsClamped(start, 12*k*r.n)
+	}
+}
+
+func (r intervalRule) approx() time.Duration {
+	unit := map[string]time.Duration{
+		"h": time.Hour, "d": 24 * time.Hour, "w": 7 * 24 * time.Hour,
+		"mo": 28 * 24 * time.Hour, "y": 365 * 24 * time.Hour,
+	}[r.unit]
+	return time.Duration(r.n) * unit
+}
+
+func (r intervalRule) next(start, after time.Time) time.Time {
+	if after.Before(start) {
+		return start
+	}
+	// jump close to after, then step; approx never overshoots because it
+	// uses the shortest length of each unit
+	k := int(after.Sub(start) / r.approx())
+	if k > 0 {
+		k--
+	}
+	for {
+		if t := r.fire(start, k); t.After(after) {
+			return t
+		}
+		k++
+	}
+}
+
+// addMonthsClamped adds months to t, keeping its day of month where it
+// exists and using the month's last day where it does not.
+func addMonthsClamped(t time.Time, months int) time.Time {
+	y, m, d := t.Date()
+	first := time.Date(y, m+time.Month(months), 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+	last := first.AddDate(0, 1, -1).Day()
+	return first.AddDate(0, 0, min(d, last)-1)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("no tzdata")
+	}
+	cases := []struct {
+		expr  string
+		after time.Time
+		want  time.Time
+	}{
+		{"0 9 1 * *", time.Date(2026, 1, 15, 10, 0, 0, 0, time.UTC), time.Date(2026, 2, 1, 9, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2026, 1, 1, 10, 7, 30, 0, time.UTC), time.Date(2026, 1, 1, 10, 15, 0, 0, time.UTC)},
+		{"0 0 * * 1-5", time.Date(2026, 1, 2, 12, 0, 0, 0, time.UTC), time.Date(2026, 1, 5, 0, 0, 0, 0, time.UTC)}, // Fri -> Mon
+		{"0 0 29 2 *", time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2026, 12, 31, 23, 59, 0, 0, time.UTC), time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+		// both day fields restricted: the 13th or any Friday
+		{"0 0 13 * 5", time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, 2, 6, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, 1, 4, 0, 0, 0, 0, time.UTC)},
+		// 09:00 Berlin time is 08:00 UTC in winter and 07:00 UTC in summer
+		{"0 9 1 * *", time.Date(2026, 3, 2, 0, 0, 0, 0, berlin), time.Date(2026, 4, 1, 9, 0, 0, 0, berlin)},
+	}
+	for _, c := range cases {
+		spec, err := parseCron(c.expr)
+		if err != nil {
+			t.Fatalf("%s: %v", c.expr, err)
+		}
+		if got := spec.next(time.Time{}, c.after); !got.Equal(c.want) {
+			t.Fatalf("%s after %s: got %s, want %s", c.expr, c.after, got, c.want)
+		}
+	}
+}
+
+func TestParseCronRejects(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		if _, err := parseCron(expr); err == nil {
+			t.Fatalf("%q was accepted", expr)
+		}
+	}
+}
+
+func TestIntervalNextClampsMonthEnds(t *testing.T) {
+	r, err := parseInterval("1mo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2026, 1, 31, 9, 0, 0, 0, time.UTC)
+	want := []time.Time{
+		time.Date(2026, 2, 28, 9, 0, 0, 0, time.UTC),
+		time.Date(2026, 3, 31, 9, 0, 0, 0, time.UTC),
+		time.Date(2026, 4, 30, 9, 0, 0, 0, time.UTC),
+	}
+	after := start
+	for _, w := range want {
+		got := r.next(start, after)
+		if !got.Equal(w) {
+			t.Fatalf("after %s: got %s, want %s", after, got, w)
+		}
+		after = got
+	}
+
+	if got := r.next(start, start.Add(-time.Nanosecond)); !got.Equal(start) {
+		t.Fatalf("first fire: got %s", got)
+	}
+	h, _ := parseInterval("6h")
+	if got := h.next(start, start.AddDate(1, 0, 0)); !got.Equal(start.AddDate(1, 0, 0).Add(6 * time.Hour)) {
+		t.Fatalf("far jump: got %s", got)
+	}
+	for _, bad := range []string{"", "0d", "1m", "1.5h", "-1d", "12345d"} {
+		if _, err := parseInterval(bad); err == nil {
+			t.Fatalf("%q was accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// currencyInfo describes an ISO 4217 currency. Amounts are always stored in
+// minor units (cents, fils, ...); Exponent is the number of minor-unit
+// digits, e.g. 2 for EUR, 0 for JPY, 3 for KWD.
+type currencyInfo struct {
+	Code     string
+	Exponent int
+	// accepted payment amounts in minor units; zero means the default
+	MinAmount int64
+	MaxAmount int64
+}
+
+// defaultMaxMajorUnits caps a single payment at one million major units
+// unless a currency sets its own maximum.
+const defaultMaxMajorUnits = 1_000_000
+
+// currencies is the set of ISO 4217 currencies the service accepts.
+var currencies = map[string]currencyInfo{}
+
+func init() {
+	for _, c := range []currencyInfo{
+		{Code: "AED", Exponent: 2},
+		{Code: "AUD", Exponent: 2},
+		{Code: "BHD", Exponent: 3},
+		{Code: "BRL", Exponent: 2},
+		{Code: "CAD", Exponent: 2},
+		{Code: "CHF", Exponent: 2},
+		{Code: "CLP", Exponent: 0},
+		{Code: "CNY", Exponent: 2},
+		{Code: "CZK", Exponent: 2},
+		{Code: "DKK", Exponent: 2},
+		{Code: "EUR", Exponent: 2},
+		{Code: "GBP", Exponent: 2},
+		{Code: "GHS", Exponent: 2},
+		{Code: "HKD", Exponent: 2},
+		{Code: "HUF", Exponent: 2},
+		{Code: "IDR", Exponent: 2, MaxAmount: 10_000_000_000_00},
+		{Code: "ILS", Exponent: 2},
+		{Code: "INR", Exponent: 2},
+		{Code: "ISK", Exponent: 0},
+		{Code: "JOD", Exponent: 3},
+		{Code: "JPY", Exponent: 0, MinAmount: 50, MaxAmount: 100_000_000},
+		{Code: "KES", Exponent: 2},
+		{Code: "KRW", Exponent: 0, MaxAmount: 1_000_000_000},
+		{Code: "KWD", Exponent: 3},
+		{Code: "MAD", Exponent: 2},
+		{Code: "MXN", Exponent: 2},
+		{Code: "MYR", Exponent: 2},
+		{Code: "NGN", Exponent: 2, MaxAmount: 1_000_000_000_00},
+		{Code: "NOK", Exponent: 2},
+		{Code: "NZD", Exponent: 2},
+		{Code: "OMR", Exponent: 3},
+		{Code: "PHP", Exponent: 2},
+		{Code: "PLN", Exponent: 2},
+		{Code: "RON", Exponent: 2},
+		{Code: "SAR", Exponent: 2},
+		{Code: "SEK", Exponent: 2},
+		{Code: "SGD", Exponent: 2},
+		{Code: "THB", Exponent: 2},
+		{Code: "TND", Exponent: 3},
+		{Code: "TRY", Exponent: 2},
+		{Code: "UGX", Exponent: 0, MaxAmount: 10_000_000_000},
+		{Code: "USD", Exponent: 2, MinAmount: 50},
+		{Code: "VND", Exponent: 0, MaxAmount: 100_000_000_000},
+		{Code: "XAF", Exponent: 0},
+		{Code: "XOF", Exponent: 0},
+		{Code: "ZAR", Exponent: 2},
+	} {
+		if c.MinAmount == 0 {
+			c.MinAmount = 1
+		}
+		if c.MaxAmount == 0 {
+			c.MaxAmount = defaultMaxMajorUnits * pow10(c.Exponent)
+		}
+		currencies[c.Code] = c
+	}
+}
+
+var (
+	errUnknownCurrency = errors.New("unsupported currency")
+	errInvalidAmount   = errors.New("invalid amount")
+)
+
+func lookupCurrency(code string) (currencyInfo, error) {
+	c, ok := currencies[strings.ToUpper(strings.TrimSpace(code))]
+	if !ok {
+		return currencyInfo{}, fmt.Errorf("%w: %q", errUnknownCurrency, code)
+	}
+	return c, nil
+}
+
+// checkAmount validates a minor-unit amount against the currency's limits.
+func (c currencyInfo) checkAmount(minor int64) error {
+	if minor < c.MinAmount || minor > c.MaxAmount {
+		return fmt.Errorf("%w: %s amount must be between %s and %s", errInvalidAmount,
+			c.Code, formatMinorUnits(c.MinAmount, c.Exponent), formatMinorUnits(c.MaxAmount, c.Exponent))
+	}
+	return nil
+}
+
+// resolveAmount combines the two ways a client can send an amount: minor
+// units, a decimal string, or both as long as they agree.
+func (c currencyInfo) resolveAmount(minor int64, decimal string) (int64, error) {
+	decimal = strings.TrimSpace(decimal)
+	if decimal == "" {
+		return minor, nil
+	}
+	parsed, err := parseDecimalAmount(decimal, c.Exponent)
+	if err != nil {
+		return 0, err
+	}
+	if minor != 0 && minor != parsed {
+		return 0, fmt.Errorf("%w: amount and amount_decimal disagree", errInvalidAmount)
+	}
+	return parsed, nil
+}
+
+// parseDecimalAmount converts a non-negative decimal string such as
+// "12.34" into minor units for a currency with exp minor digits. More
+// fractional digits than the currency has are rejected rather than rounded.
+func parseDecimalAmount(s string, exp int) (int64, error) {
+	whole, frac, hasFrac := strings.Cut(s, ".")
+	if whole == "" || (hasFrac && frac == "") || !allDigits(whole) || !allDigits(frac) {
+		return 0, fmt.Errorf("%w: %q is not a decimal number", errInvalidAmount, s)
+	}
+	if len(frac) > exp {
+		return 0, fmt.Errorf("%w: %q has more than %d decimal places", errInvalidAmount, s, exp)
+	}
+	frac += strings.Repeat("0", exp-len(frac))
+
+	var v int64
+	for _, ch := range whole + frac {
+		d := int64(ch - '0')
+		if v > (math.MaxInt64-d)/10 {
+			return 0, fmt.Errorf("%w: %q is too large", errInvalidAmount, s)
+		}
+		v = v*10 + d
+	}
+	return v, nil
+}
+
+// formatMinorUnits renders a minor-unit amount as a decimal string with
+// exactly exp fractional digits.
+func formatMinorUnits(minor int64, exp int) string {
+	sign := ""
+	if minor < 0 {
+		sign = "-"
+	}
+	digits := strings.TrimPrefix(fmt.Sprintf("%d", minor), "-")
+	if exp == 0 {
+		return sign + digits
+	}
+	if len(digits) <= exp {
+		digits = strings.Repeat("0", exp-len(digits)+1) + digits
+	}
+	return sign + digits[:len(digits)-exp] + "." + digits[len(digits)-exp:]
+}
+
+// formatAmount renders minor in currency code, or "" for a currency that is
+// not in the registry (rows written before validation existed).
+func formatAmount(minor int64, code string) string {
+	c, ok := currencies[code]
+	if !ok {
+		return ""
+	}
+	return formatMinorUnits(minor, c.Exponent)
+}
+
+func allDigits(s string) bool {
+	for _, ch := range s {
+		if ch < '0' || ch > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func pow10(n int) int64 {
+	v := int64(1)
+	for i := 0; i < n; i++ {
+		v *= 10
+	}
+	return v
+}
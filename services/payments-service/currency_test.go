@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseDecimalAmount(t *testing.T) {
+	cases := []struct {
+		in   string
+		exp  int
+		want int64
+		ok   bool
+	}{
+		{"12.34", 2, 1234, true},
+		{"12.3", 2, 1230, true},
+		{"12", 2, 1200, true},
+		{"0.01", 2, 1, true},
+		{"1500", 0, 1500, true},
+		{"1.005", 3, 1005, true},
+		{"12.345", 2, 0, false},
+		{"1.5", 0, 0, false},
+		{"-1.00", 2, 0, false},
+		{"1e3", 2, 0, false},
+		{".5", 2, 0, false},
+		{"5.", 2, 0, false},
+		{"", 2, 0, false},
+		{"92233720368547758.08", 2, 0, false},
+	}
+	for _, c := range cases {
+		got, err := parseDecimalAmount(c.in, c.exp)
+		if c.ok && (err != nil || got != c.want) {
+			t.Errorf("parseDecimalAmount(%q, %d) = %d, %v; want %d", c.in, c.exp, got, err, c.want)
+		}
+		if !c.ok && !errors.Is(err, errInvalidAmount) {
+			t.Errorf("parseDecimalAmount(%q, %d) = %d, %v; want errInvalidAmount", c.in, c.exp, got, err)
+		}
+	}
+}
+
+func TestFormatMinorUnitsRoundTrips(t *testing.T) {
+	cases := []struct {
+		minor int64
+		exp   int
+		want  string
+	}{
+		{1234, 2, "12.34"},
+		{5, 2, "0.05"},
+		{0, 2, "0.00"},
+		{1500, 0, "1500"},
+		{1005, 3, "1.005"},
+		{-250, 2, "-2.50"},
+	}
+	for _, c := range cases {
+		got := formatMinorUnits(c.minor, c.exp)
+		if got != c.want {
+			t.Errorf("formatMinorUnits(%d, %d) = %q, want %q", c.minor, c.exp, got, c.want)
+		}
+		if c.minor >= 0 {
+			if back, err := parseDecimalAmount(got, c.exp); err != nil || back != c.minor {
+				t.Errorf("round trip of %q gave %d, %v", got, back, err)
+			}
+		}
+	}
+}
+
+func TestCreatePaymentRequestNormalize(t *testing.T) {
+	req := createPaymentRequest{UserID: " u1 ", AmountDecimal: "1500", Currency: "jpy", Ref: "r1"}
+	if err := req.normalize(); err != nil {
+		t.Fatalf("normalize: %v", err)
+	}
+	if req.Amount != 1500 || req.Currency != "JPY" || req.UserID != "u1" {
+		t.Fatalf("unexpected normalized request %+v", req)
+	}
+
+	bad := createPaymentRequest{UserID: "u1", Amount: 100, Currency: "XYZ", Ref: "r1"}
+	if err := bad.normalize(); !errors.Is(err, errUnknownCurrency) {
+		t.Fatalf("expected errUnknownCurrency, got %v", err)
+	}
+
+	// below the JPY minimum
+	low := createPaymentRequest{UserID: "u1", Amount: 10, Currency: "JPY", Ref: "r1"}
+	if err := low.normalize(); !errors.Is(err, errInvalidAmount) {
+		t.Fatalf("expected errInvalidAmount, got %v", err)
+	}
+
+	mismatch := createPaymentRequest{UserID: "u1", Amount: 1000, AmountDecimal: "10.01", Currency: "EUR", Ref: "r1"}
+	if err := mismatch.normalize(); !errors.Is(err, errInvalidAmount) {
+		t.Fatalf("expected errInvalidAmount for disagreeing amounts, got %v", err)
+	}
+
+	kwd := createPaymentRequest{UserID: "u1", AmountDecimal: "1.250", Currency: "KWD", Ref: "r1"}
+	if err := kwd.normalize(); err != nil || kwd.Amount != 1250 {
+		t.Fatalf("expected 1250 fils, got %d, %v", kwd.Amount, err)
+	}
+}
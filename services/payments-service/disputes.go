@@ -0,0 +1,939 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Dispute statuses. A dispute is opened when the provider reports a
+// chargeback, may be asked for evidence, is submitted with that evidence
+// and ends won or lost.
+const (
+	disputeOpened           = "opened"
+	disputeEvidenceRequired = "evidence_required"
+	disputeSubmitted        = "submitted"
+	disputeWon              = "won"
+	disputeLost             = "lost"
+)
+
+// disputeTransitions lists the statuses each dispute status may move to.
+// won and lost are terminal. A dispute can be won without evidence when the
+// cardholder withdraws it.
+var disputeTransitions = map[string][]string{
+	disputeOpened:           {disputeEvidenceRequired, disputeSubmitted, disputeWon, disputeLost},
+	disputeEvidenceRequired: {disputeSubmitted, disputeWon, disputeLost},
+	disputeSubmitted:        {disputeWon, disputeLost},
+}
+
+// disputeActions maps POST /v1/disputes/{id}/{action} onto the target status.
+var disputeActions = map[string]string{
+	"require-evidence": disputeEvidenceRequired,
+	"submit":           disputeSubmitted,
+	"win":              disputeWon,
+	"lose":             disputeLost,
+}
+
+// disputeReasonCodes are the network-neutral reasons a dispute is opened
+// with.
+var disputeReasonCodes = map[string]bool{
+	"fraud":                true,
+	"not_received":         true,
+	"not_as_described":     true,
+	"duplicate":            true,
+	"credit_not_processed": true,
+	"canceled_recurring":   true,
+	"unrecognized":         true,
+	"general":              true,
+}
+
+// evidenceContentTypes are the file types accepted as evidence, by their
+// sniffed content type.
+var evidenceContentTypes = map[string]bool{
+	"application/pdf": true,
+	"image/png":       true,
+	"image/jpeg":      true,
+	"text/plain":      true,
+}
+
+const (
+	defaultEvidenceWindow = 7 * 24 * time.Hour
+	maxEvidenceBytes      = 10 << 20
+)
+
+var (
+	errDisputeNotFound   = errors.New("dispute not found")
+	errEvidenceNotFound  = errors.New("evidence not found")
+	errNotDisputable     = errors.New("payment is not disputable")
+	errDisputeExceeds    = errors.New("dispute exceeds remaining amount")
+	errDisputeActive     = errors.New("payment already has an open dispute")
+	errDisputeClosed     = errors.New("dispute no longer accepts evidence")
+	errNoEvidence        = errors.New("dispute has no evidence to submit")
+	errEvidenceType      = errors.New("unsupported evidence file type")
+	errEvidenceDisabled  = errors.New("evidence storage is not configured")
+	errInvalidDisputeReq = errors.New("invalid dispute request")
+)
+
+func canTransitionDispute(from, to string) bool {
+	for _, s := range disputeTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// disputeOpen reports whether a dispute is still waiting for evidence.
+func disputeOpen(status string) bool {
+	return status == disputeOpened || status == disputeEvidenceRequired
+}
+
+type dispute struct {
+	ID            string `json:"id"`
+	PaymentID     string `json:"payment_id"`
+	UserID        string `json:"user_id"`
+	Amount        int64  `json:"amount"`
+	AmountDecimal string `json:"amount_decimal,omitempty"`
+	Currency      string `json:"currency"`
+	// what losing the dispute takes from the user's balance; differs from
+	// Amount for FX payments
+	ReservedAmount   int64     `json:"reserved_amount"`
+	ReservedCurrency string    `json:"reserved_currency"`
+	ReasonCode       string    `json:"reason_code"`
+	Status           string    `json:"status"`
+	EvidenceDueAt    time.Time `json:"evidence_due_at"`
+	// set while the dispute waits for evidence and the deadline has passed
+	Overdue        bool       `json:"overdue,omitempty"`
+	ProviderCaseID string     `json:"provider_case_id,omitempty"`
+	Note           string     `json:"note,omitempty"`
+	Version        int64      `json:"version"`
+	ClosedAt       *time.Time `json:"closed_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+const disputeColumns = `id::text, payment_id::text, user_id, amount, currency, reserved_amount, reserved_currency,
+	reason_code, status, evidence_due_at, COALESCE(provider_case_id, ''), COALESCE(note, ''), version,
+	closed_at, created_at, updated_at`
+
+func scanDispute(row rowScanner, d *dispute) error {
+	var closedAt sql.NullTime
+	if err := row.Scan(&d.ID, &d.PaymentID, &d.UserID, &d.Amount, &d.Currency, &d.ReservedAmount, &d.ReservedCurrency,
+		&d.ReasonCode, &d.Status, &d.EvidenceDueAt, &d.ProviderCaseID, &d.Note, &d.Version,
+		&closedAt, &d.CreatedAt, &d.UpdatedAt); err != nil {
+		return err
+	}
+	d.ClosedAt = nil
+	if closedAt.Valid {
+		d.ClosedAt = &closedAt.Time
+	}
+	d.AmountDecimal = formatAmount(d.Amount, d.Currency)
+	d.Overdue = disputeOpen(d.Status) && time.Now().After(d.EvidenceDueAt)
+	return nil
+}
+
+type disputeEvidence struct {
+	ID          string    `json:"id"`
+	DisputeID   string    `json:"dispute_id"`
+	FileName    string    `json:"file_name"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	SHA256      string    `json:"sha256"`
+	UploadedBy  string    `json:"uploaded_by,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+
+	blobKey string
+}
+
+const evidenceColumns = `id::text, dispute_id::text, file_name, content_type, size, sha256, COALESCE(uploaded_by, ''),
+	created_at, blob_key`
+
+func scanEvidence(row rowScanner, e *disputeEvidence) error {
+	return row.Scan(&e.ID, &e.DisputeID, &e.FileName, &e.ContentType, &e.Size, &e.SHA256, &e.UploadedBy,
+		&e.CreatedAt, &e.blobKey)
+}
+
+type disputeEvent struct {
+	ID         int64     `json:"id"`
+	FromStatus string    `json:"from_status,omitempty"`
+	ToStatus   string    `json:"to_status"`
+	Reason     string    `json:"reason,omitempty"`
+	Actor      string    `json:"actor,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type openDisputeRequest struct {
+	PaymentID  string `json:"payment_id"`
+	ReasonCode string `json:"reason_code"`
+	// zero disputes whatever is left of the payment; amount_decimal may be
+	// sent instead
+	Amount        int64  `json:"amount"`
+	AmountDecimal string `json:"amount_decimal"`
+	// defaults to DISPUTE_EVIDENCE_WINDOW from now
+	EvidenceDueAt  *time.Time `json:"evidence_due_at"`
+	ProviderCaseID string     `json:"provider_case_id"`
+	Note           string     `json:"note"`
+}
+
+// normalize trims and validates req in place and fills in the evidence
+// deadline. The amount is checked against the payment later.
+func (req *openDisputeRequest) normalize(now time.Time, window time.Duration) error {
+	req.PaymentID = strings.TrimSpace(req.PaymentID)
+	req.ReasonCode = strings.ToLower(strings.TrimSpace(req.ReasonCode))
+	req.ProviderCaseID = strings.TrimSpace(req.ProviderCaseID)
+	req.Note = strings.TrimSpace(req.Note)
+
+	if !isUUID(req.PaymentID) {
+		return fmt.Errorf("%w: payment_id must be a payment id", errInvalidDisputeReq)
+	}
+	if !disputeReasonCodes[req.ReasonCode] {
+		return fmt.Errorf("%w: unknown reason_code %q", errInvalidDisputeReq, req.ReasonCode)
+	}
+	if req.Amount < 0 {
+		return fmt.Errorf("%w: amount must not be negative", errInvalidDisputeReq)
+	}
+	if req.EvidenceDueAt == nil {
+		due := now.Add(window)
+		req.EvidenceDueAt = &due
+	}
+	if !req.EvidenceDueAt.After(now) {
+		return fmt.Errorf("%w: evidence_due_at must be in the future", errInvalidDisputeReq)
+	}
+	return nil
+}
+
+// disputeAmount decides how much a new dispute may take from p. Refunds
+// and earlier disputes count against the captured amount, so a payment can
+// never be given back twice.
+func disputeAmount(p payment, requested int64) (int64, error) {
+	if p.Status != statusCaptured && p.Status != statusSettled {
+		return 0, fmt.Errorf("%w: status is %s", errNotDisputable, p.Status)
+	}
+	remaining := p.CapturedAmount - p.RefundedAmount - p.DisputedAmount
+	if requested == 0 {
+		requested = remaining
+	}
+	if requested <= 0 || requested > remaining {
+		return 0, fmt.Errorf("%w: %d remaining", errDisputeExceeds, remaining)
+	}
+	return requested, nil
+}
+
+// lostDisputeEntry takes a lost dispute back out of the user's account.
+func lostDisputeEntry(p payment, d dispute) *journalEntry {
+	e := reversalEntry(p, "dispute_lost", d.Amount)
+	e.DisputeID = d.ID
+	return e
+}
+
+type disputeTransitionRequest struct {
+	Reason string `json:"reason"`
+	Note   string `json:"note"`
+	// require-evidence only: moves the evidence deadline
+	EvidenceDueAt *time.Time `json:"evidence_due_at"`
+}
+
+// handleDisputes serves:
+//
+//	POST /v1/disputes                                operator
+//	GET  /v1/disputes?status=&user_id=&payment_id=
+//	GET  /v1/disputes/deadlines?within=
+//	GET  /v1/disputes/{id}                           dispute plus evidence and events
+//	POST /v1/disputes/{id}/evidence?file_name=
+//	GET  /v1/disputes/{id}/evidence/{evidence_id}
+//	POST /v1/disputes/{id}/{require-evidence|submit|win|lose}   operator
+func (st *appState) handleDisputes(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/disputes"), "/")
+	caller := callerFrom(r.Context())
+
+	switch {
+	case rest == "" && r.Method == http.MethodPost:
+		if !caller.Operator {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		st.openDispute(w, r)
+		return
+	case rest == "" && r.Method == http.MethodGet:
+		st.listDisputes(w, r)
+		return
+	case rest == "deadlines" && r.Method == http.MethodGet:
+		st.listDisputeDeadlines(w, r)
+		return
+	case rest == "" || rest == "deadlines":
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	id, sub, _ := strings.Cut(rest, "/")
+	d, err := loadDispute(ctx, st.db, id)
+	if err == nil && !caller.mayActFor(d.UserID) {
+		err = errDisputeNotFound
+	}
+	if err != nil {
+		writeDisputeError(w, err)
+		return
+	}
+
+	switch {
+	case sub == "" && r.Method == http.MethodGet:
+		st.getDispute(ctx, w, d)
+	case sub == "evidence" && r.Method == http.MethodPost:
+		st.uploadEvidence(w, r, d)
+	case strings.HasPrefix(sub, "evidence/") && r.Method == http.MethodGet:
+		st.downloadEvidence(ctx, w, d, strings.TrimPrefix(sub, "evidence/"))
+	case disputeActions[sub] != "":
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !caller.Operator {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		var req disputeTransitionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		d, err = st.transitionDispute(ctx, d.ID, disputeActions[sub], caller.Subject, req)
+		if err != nil {
+			writeDisputeError(w, err)
+			return
+		}
+		log.Printf(`{"msg":"dispute %s","dispute_id":%q,"payment_id":%q,"by":%q}`, d.Status, d.ID, d.PaymentID, caller.Subject)
+		writeJSON(w, http.StatusOK, d)
+	case sub == "" || sub == "evidence" || strings.HasPrefix(sub, "evidence/"):
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func writeDisputeError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.Is(err, errDisputeNotFound), errors.Is(err, errEvidenceNotFound),
+		errors.Is(err, errPaymentNotFound), errors.Is(err, errBlobNotFound):
+		http.Error(w, "not found", http.StatusNotFound)
+	case errors.As(err, &tooLarge):
+		http.Error(w, "evidence file too large", http.StatusRequestEntityTooLarge)
+	case errors.Is(err, errInvalidDisputeReq), errors.Is(err, errUnknownCurrency), errors.Is(err, errInvalidAmount):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, errEvidenceType):
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+	case errors.Is(err, errDisputeExceeds):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	case errors.Is(err, errNotDisputable), errors.Is(err, errDisputeActive), errors.Is(err, errDisputeClosed),
+		errors.Is(err, errNoEvidence), errors.Is(err, errInvalidTransition), errors.Is(err, errVersionConflict):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, errEvidenceDisabled):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		http.Error(w, "db error", http.StatusInternalServerError)
+	}
+}
+
+func (st *appState) openDispute(w http.ResponseWriter, r *http.Request) {
+	var req openDisputeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if err := req.normalize(time.Now(), st.evidenceWindow); err != nil {
+		writeDisputeError(w, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	d, err := st.insertDispute(ctx, req, callerFrom(ctx).Subject)
+	if err != nil {
+		writeDisputeError(w, err)
+		return
+	}
+	log.Printf(`{"msg":"dispute opened","dispute_id":%q,"payment_id":%q,"reason_code":%q}`, d.ID, d.PaymentID, d.ReasonCode)
+	writeJSON(w, http.StatusCreated, d)
+}
+
+// insertDispute opens a dispute against a payment and adds its amount to
+// the payment's disputed_amount while holding the payment row lock. A
+// payment has at most one dispute that is not yet decided.
+func (st *appState) insertDispute(ctx context.Context, req openDisputeRequest, by string) (dispute, error) {
+	var d dispute
+
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return d, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var p payment
+	err = scanPayment(tx.QueryRowContext(ctx, `
+		SELECT `+paymentColumns+`
+		FROM payments
+		WHERE id = $1::uuid
+		FOR UPDATE
+	`, req.PaymentID), &p)
+	if errors.Is(err, sql.ErrNoRows) {
+		return d, errPaymentNotFound
+	}
+	if err != nil {
+		return d, err
+	}
+
+	var active int
+	if err := tx.QueryRowContext(ctx, `
+		SELECT count(*) FROM disputes WHERE payment_id = $1::uuid AND status IN ($2, $3, $4)
+	`, p.ID, disputeOpened, disputeEvidenceRequired, disputeSubmitted).Scan(&active); err != nil {
+		return d, err
+	}
+	if active > 0 {
+		return d, errDisputeActive
+	}
+
+	if req.AmountDecimal != "" {
+		cur, err := lookupCurrency(p.Currency)
+		if err != nil {
+			return d, err
+		}
+		if req.Amount, err = cur.resolveAmount(req.Amount, req.AmountDecimal); err != nil {
+			return d, err
+		}
+	}
+	amount, err := disputeAmount(p, req.Amount)
+	if err != nil {
+		return d, err
+	}
+	reserved, reservedCurrency := reversalDebit(p, amount)
+
+	err = scanDispute(tx.QueryRowContext(ctx, `
+		INSERT INTO disputes(payment_id, user_id, amount, currency, reserved_amount, reserved_currency,
+			reason_code, status, evidence_due_at, provider_case_id, note)
+		VALUES ($1::uuid, $2, $3, $4, $5, $6, $7, $8, $9, NULLIF($10, ''), NULLIF($11, ''))
+		RETURNING `+disputeColumns,
+		p.ID, p.UserID, amount, p.Currency, reserved, reservedCurrency,
+		req.ReasonCode, disputeOpened, *req.EvidenceDueAt, req.ProviderCaseID, req.Note), &d)
+	if err != nil {
+		return d, err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE payments
+		SET disputed_amount = disputed_amount + $2, version = version + 1, updated_at = now()
+		WHERE id = $1::uuid
+	`, p.ID, amount); err != nil {
+		return d, err
+	}
+	if err := recordDisputeEvent(ctx, tx, d.ID, "", disputeOpened, req.ReasonCode, by); err != nil {
+		return d, err
+	}
+	if err := enqueueEvent(ctx, tx, p.ID, p.UserID, "dispute."+disputeOpened, d); err != nil {
+		return d, err
+	}
+	return d, tx.Commit()
+}
+
+// transitionDispute moves a dispute to status to. Winning gives the
+// disputed amount back to the payment; losing posts the reversal to the
+// ledger. Both happen in the transaction that changes the dispute.
+func (st *appState) transitionDispute(ctx context.Context, id, to, by string, req disputeTransitionRequest) (dispute, error) {
+	var d dispute
+
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return d, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// lock order is payment then dispute, the same as insertDispute
+	var p payment
+	err = scanPayment(tx.QueryRowContext(ctx, `
+		SELECT `+paymentColumns+`
+		FROM payments
+		WHERE id = (SELECT payment_id FROM disputes WHERE id = $1::uuid)
+		FOR UPDATE
+	`, id), &p)
+	if errors.Is(err, sql.ErrNoRows) {
+		return d, errDisputeNotFound
+	}
+	if err != nil {
+		return d, err
+	}
+	err = scanDispute(tx.QueryRowContext(ctx, `
+		SELECT `+disputeColumns+` FROM disputes WHERE id = $1::uuid FOR UPDATE
+	`, id), &d)
+	if errors.Is(err, sql.ErrNoRows) {
+		return d, errDisputeNotFound
+	}
+	if err != nil {
+		return d, err
+	}
+
+	from := d.Status
+	if from == to && to != disputeEvidenceRequired {
+		return d, nil
+	}
+	if from != to && !canTransitionDispute(from, to) {
+		return d, fmt.Errorf("%w: %s -> %s", errInvalidTransition, from, to)
+	}
+	if to == disputeSubmitted {
+		var n int
+		if err := tx.QueryRowContext(ctx, `SELECT count(*) FROM dispute_evidence WHERE dispute_id = $1::uuid`, id).Scan(&n); err != nil {
+			return d, err
+		}
+		if n == 0 {
+			return d, errNoEvidence
+		}
+	}
+	if req.EvidenceDueAt != nil && to != disputeEvidenceRequired {
+		return d, fmt.Errorf("%w: evidence_due_at can only be set with require-evidence", errInvalidDisputeReq)
+	}
+
+	err = scanDispute(tx.QueryRowContext(ctx, `
+		UPDATE disputes
+		SET status = $2, evidence_due_at = COALESCE($3, evidence_due_at), note = COALESCE(NULLIF($4, ''), note),
+			closed_at = CASE WHEN $2 IN ($6, $7) THEN now() END,
+			version = version + 1, updated_at = now()
+		WHERE id = $1::uuid AND version = $5
+		RETURNING `+disputeColumns,
+		id, to, req.EvidenceDueAt, strings.TrimSpace(req.Note), d.Version, disputeWon, disputeLost), &d)
+	if errors.Is(err, sql.ErrNoRows) {
+		return d, errVersionConflict
+	}
+	if err != nil {
+		return d, err
+	}
+
+	switch to {
+	case disputeWon:
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE payments
+			SET disputed_amount = disputed_amount - $2, version = version + 1, updated_at = now()
+			WHERE id = $1::uuid
+		`, p.ID, d.Amount); err != nil {
+			return d, err
+		}
+	case disputeLost:
+		if err := postEntry(ctx, tx, lostDisputeEntry(p, d)); err != nil {
+			return d, err
+		}
+	}
+	if err := recordDisputeEvent(ctx, tx, id, from, to, strings.TrimSpace(req.Reason), by); err != nil {
+		return d, err
+	}
+	if err := enqueueEvent(ctx, tx, p.ID, p.UserID, "dispute."+to, d); err != nil {
+		return d, err
+	}
+	return d, tx.Commit()
+}
+
+func recordDisputeEvent(ctx context.Context, tx *sql.Tx, disputeID, from, to, reason, actor string) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO dispute_events(dispute_id, from_status, to_status, reason, actor)
+		VALUES ($1::uuid, NULLIF($2, ''), $3, NULLIF($4, ''), NULLIF($5, ''))
+	`, disputeID, from, to, reason, actor)
+	return err
+}
+
+func loadDispute(ctx context.Context, db *sql.DB, id string) (dispute, error) {
+	var d dispute
+	if !isUUID(id) {
+		return d, errDisputeNotFound
+	}
+	err := scanDispute(db.QueryRowContext(ctx, `
+		SELECT `+disputeColumns+` FROM disputes WHERE id = $1::uuid
+	`, id), &d)
+	if errors.Is(err, sql.ErrNoRows) {
+		return d, errDisputeNotFound
+	}
+	return d, err
+}
+
+func (st *appState) getDispute(ctx context.Context, w http.ResponseWriter, d dispute) {
+	out := struct {
+		dispute
+		Evidence []disputeEvidence `json:"evidence"`
+		Events   []disputeEvent    `json:"events"`
+	}{dispute: d}
+
+	var err error
+	if out.Evidence, err = listEvidence(ctx, st.db, d.ID); err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	if out.Events, err = listDisputeEvents(ctx, st.db, d.ID); err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (st *appState) listDisputes(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	q := r.URL.Query()
+	userID := strings.TrimSpace(q.Get("user_id"))
+	if caller := callerFrom(ctx); !caller.Operator {
+		if userID != "" && userID != caller.Subject {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		userID = caller.Subject
+	}
+	paymentID := strings.TrimSpace(q.Get("payment_id"))
+	if paymentID != "" && !isUUID(paymentID) {
+		http.Error(w, "payment_id must be a payment id", http.StatusBadRequest)
+		return
+	}
+
+	out, err := queryDisputes(ctx, st.db, `
+		SELECT `+disputeColumns+`
+		FROM disputes
+		WHERE ($1 = '' OR user_id = $1) AND ($2 = '' OR status = $2) AND ($3 = '' OR payment_id = NULLIF($3, '')::uuid)
+		ORDER BY created_at DESC
+		LIMIT 200
+	`, userID, q.Get("status"), paymentID)
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// listDisputeDeadlines lists the disputes still waiting for evidence whose
+// deadline falls within the window, overdue ones included, soonest first.
+func (st *appState) listDisputeDeadlines(w http.ResponseWriter, r *http.Request) {
+	within := 7 * 24 * time.Hour
+	if s := r.URL.Query().Get("within"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			http.Error(w, "within must be a positive duration such as 72h", http.StatusBadRequest)
+			return
+		}
+		within = d
+	}
+	userID := ""
+	if caller := callerFrom(r.Context()); !caller.Operator {
+		userID = caller.Subject
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	out, err := queryDisputes(ctx, st.db, `
+		SELECT `+disputeColumns+`
+		FROM disputes
+		WHERE status IN ($1, $2) AND evidence_due_at < now() + make_interval(secs => $3) AND ($4 = '' OR user_id = $4)
+		ORDER BY evidence_due_at, id
+		LIMIT 200
+	`, disputeOpened, disputeEvidenceRequired, within.Seconds(), userID)
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func queryDisputes(ctx context.Context, db *sql.DB, query string, args ...any) ([]dispute, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []dispute{}
+	for rows.Next() {
+		var d dispute
+		if err := scanDispute(rows, &d); err != nil {
+			return nil, err
+		}
+		out = append(out, d)
+	}
+	return out, rows.Err()
+}
+
+func listDisputeEvents(ctx context.Context, db *sql.DB, disputeID string) ([]disputeEvent, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, COALESCE(from_status, ''), to_status, COALESCE(reason, ''), COALESCE(actor, ''), created_at
+		FROM dispute_events
+		WHERE dispute_id = $1::uuid
+		ORDER BY id
+	`, disputeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []disputeEvent{}
+	for rows.Next() {
+		var e disputeEvent
+		if err := rows.Scan(&e.ID, &e.FromStatus, &e.ToStatus, &e.Reason, &e.Actor, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+func listEvidence(ctx context.Context, db *sql.DB, disputeID string) ([]disputeEvidence, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+evidenceColumns+`
+		FROM dispute_evidence
+		WHERE dispute_id = $1::uuid
+		ORDER BY created_at, id
+	`, disputeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []disputeEvidence{}
+	for rows.Next() {
+		var e disputeEvidence
+		if err := scanEvidence(rows, &e); err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+// evidenceContentType sniffs the type of an evidence file from its first
+// bytes; the client's Content-Type is not trusted.
+func evidenceContentType(head []byte) (string, error) {
+	ct, _, err := mime.ParseMediaType(http.DetectContentType(head))
+	if err != nil || !evidenceContentTypes[ct] {
+		return "", fmt.Errorf("%w: %s (want pdf, png, jpeg or plain text)", errEvidenceType, http.DetectContentType(head))
+	}
+	return ct, nil
+}
+
+// evidenceFileName keeps the base name of an uploaded file for display.
+func evidenceFileName(name string) string {
+	name = path.Base(strings.ReplaceAll(strings.TrimSpace(name), `\`, "/"))
+	if name == "." || name == "/" {
+		return "evidence"
+	}
+	if len(name) > 200 {
+		name = name[:200]
+	}
+	return name
+}
+
+// uploadEvidence stores the request body as evidence for d. The file goes
+// to the blob store first and is only recorded once stored; a failed
+// insert removes it again.
+func (st *appState) uploadEvidence(w http.ResponseWriter, r *http.Request, d dispute) {
+	if st.evidence == nil {
+		writeDisputeError(w, errEvidenceDisabled)
+		return
+	}
+	if !disputeOpen(d.Status) {
+		writeDisputeError(w, fmt.Errorf("%w: dispute is %s", errDisputeClosed, d.Status))
+		return
+	}
+
+	body := bufio.NewReader(http.MaxBytesReader(w, r.Body, maxEvidenceBytes))
+	head, err := body.Peek(512)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, bufio.ErrBufferFull) {
+		writeDisputeError(w, err)
+		return
+	}
+	if len(head) == 0 {
+		http.Error(w, "empty evidence file", http.StatusBadRequest)
+		return
+	}
+	contentType, err := evidenceContentType(head)
+	if err != nil {
+		writeDisputeError(w, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 60*time.Second)
+	defer cancel()
+
+	var evidenceID string
+	if err := st.db.QueryRowContext(ctx, `SELECT uuid_generate_v4()::text`).Scan(&evidenceID); err != nil {
+		writeDisputeError(w, err)
+		return
+	}
+	key := "disputes/" + d.ID + "/" + evidenceID
+	size, sum, err := st.evidence.Put(ctx, key, body)
+	if err != nil {
+		writeDisputeError(w, err)
+		return
+	}
+
+	caller := callerFrom(ctx)
+	e, err := st.insertEvidence(ctx, disputeEvidence{
+		ID:          evidenceID,
+		DisputeID:   d.ID,
+		FileName:    evidenceFileName(r.URL.Query().Get("file_name")),
+		ContentType: contentType,
+		Size:        size,
+		SHA256:      sum,
+		UploadedBy:  caller.Subject,
+		blobKey:     key,
+	})
+	if err != nil {
+		if derr := st.evidence.Delete(context.Background(), key); derr != nil {
+			log.Printf(`{"msg":"evidence cleanup failed","key":%q,"error":%q}`, key, derr.Error())
+		}
+		writeDisputeError(w, err)
+		return
+	}
+	log.Printf(`{"msg":"dispute evidence uploaded","dispute_id":%q,"evidence_id":%q,"size":%d}`, d.ID, e.ID, e.Size)
+	writeJSON(w, http.StatusCreated, e)
+}
+
+// insertEvidence records stored evidence, re-checking under the dispute
+// row lock that the dispute still accepts it.
+func (st *appState) insertEvidence(ctx context.Context, e disputeEvidence) (disputeEvidence, error) {
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return e, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var status string
+	if err := tx.QueryRowContext(ctx, `
+		SELECT status FROM disputes WHERE id = $1::uuid FOR UPDATE
+	`, e.DisputeID).Scan(&status); err != nil {
+		return e, err
+	}
+	if !disputeOpen(status) {
+		return e, fmt.Errorf("%w: dispute is %s", errDisputeClosed, status)
+	}
+
+	err = scanEvidence(tx.QueryRowContext(ctx, `
+		INSERT INTO dispute_evidence(id, dispute_id, file_name, content_type, size, sha256, blob_key, uploaded_by)
+		VALUES ($1::uuid, $2::uuid, $3, $4, $5, $6, $7, NULLIF($8, ''))
+		RETURNING `+evidenceColumns,
+		e.ID, e.DisputeID, e.FileName, e.ContentType, e.Size, e.SHA256, e.blobKey, e.UploadedBy), &e)
+	if err != nil {
+		return e, err
+	}
+	return e, tx.Commit()
+}
+
+func (st *appState) downloadEvidence(ctx context.Context, w http.ResponseWriter, d dispute, evidenceID string) {
+	if st.evidence == nil {
+		writeDisputeError(w, errEvidenceDisabled)
+		return
+	}
+	if !isUUID(evidenceID) {
+		writeDisputeError(w, errEvidenceNotFound)
+		return
+	}
+	var e disputeEvidence
+	err := scanEvidence(st.db.QueryRowContext(ctx, `
+		SELECT `+evidenceColumns+` FROM dispute_evidence WHERE id = $1::uuid AND dispute_id = $2::uuid
+	`, evidenceID, d.ID), &e)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = errEvidenceNotFound
+	}
+	if err != nil {
+		writeDisputeError(w, err)
+		return
+	}
+
+	f, err := st.evidence.Open(ctx, e.blobKey)
+	if err != nil {
+		writeDisputeError(w, err)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", e.ContentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": e.FileName}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	_, _ = io.Copy(w, f)
+}
+
+// disputeEvidenceWindowFromEnv reads DISPUTE_EVIDENCE_WINDOW, the default
+// time given to provide evidence for a new dispute.
+func disputeEvidenceWindowFromEnv() (time.Duration, error) {
+	s := os.Getenv("DISPUTE_EVIDENCE_WINDOW")
+	if s == "" {
+		return defaultEvidenceWindow, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("DISPUTE_EVIDENCE_WINDOW must be a positive duration, got %q", s)
+	}
+	return d, nil
+}
+
+const disputesSchema = `
+	ALTER TABLE payments ADD COLUMN IF NOT EXISTS disputed_amount bigint NOT NULL DEFAULT 0;
+
+	CREATE TABLE IF NOT EXISTS disputes (
+		id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+		payment_id uuid NOT NULL REFERENCES payments(id),
+		user_id text NOT NULL,
+		amount bigint NOT NULL CHECK (amount > 0),
+		currency text NOT NULL,
+		reserved_amount bigint NOT NULL CHECK (reserved_amount >= 0),
+		reserved_currency text NOT NULL,
+		reason_code text NOT NULL,
+		status text NOT NULL,
+		evidence_due_at timestamptz NOT NULL,
+		provider_case_id text,
+		note text,
+		version bigint NOT NULL DEFAULT 1,
+		closed_at timestamptz,
+		created_at timestamptz NOT NULL DEFAULT now(),
+		updated_at timestamptz NOT NULL DEFAULT now()
+	);
+
+	CREATE UNIQUE INDEX IF NOT EXISTS disputes_payment_active_uq ON disputes(payment_id)
+		WHERE status IN ('opened', 'evidence_required', 'submitted');
+	CREATE INDEX IF NOT EXISTS disputes_due_idx ON disputes(evidence_due_at)
+		WHERE status IN ('opened', 'evidence_required');
+	CREATE INDEX IF NOT EXISTS disputes_user_idx ON disputes(user_id, created_at);
+
+	CREATE TABLE IF NOT EXISTS dispute_evidence (
+		id uuid PRIMARY KEY,
+		dispute_id uuid NOT NULL REFERENCES disputes(id),
+		file_name text NOT NULL,
+		content_type text NOT NULL,
+		size bigint NOT NULL,
+		sha256 text NOT NULL,
+		blob_key text NOT NULL,
+		uploaded_by text,
+		created_at timestamptz NOT NULL DEFAULT now()
+	);
+
+	CREATE INDEX IF NOT EXISTS dispute_evidence_dispute_idx ON dispute_evidence(dispute_id, created_at);
+
+	CREATE TABLE IF NOT EXISTS dispute_events (
+		id bigserial PRIMARY KEY,
+		dispute_id uuid NOT NULL REFERENCES disputes(id),
+		from_status text,
+		to_status text NOT NULL,
+		reason text,
+		actor text,
+		created_at timestamptz NOT NULL DEFAULT now()
+	);
+
+	CREATE INDEX IF NOT EXISTS dispute_events_dispute_idx ON dispute_events(dispute_id, id);
+
+	ALTER TABLE journal_entries ADD COLUMN IF NOT EXISTS dispute_id uuid REFERENCES disputes(id);
+`
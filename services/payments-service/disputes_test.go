@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDisputeTransitions(t *testing.T) {
+	for _, c := range []struct {
+		from, to string
+		ok       bool
+	}{
+		{disputeOpened, disputeEvidenceRequired, true},
+		{disputeOpened, disputeWon, true},
+		{disputeEvidenceRequired, disputeSubmitted, true},
+		{disputeSubmitted, disputeLost, true},
+		{disputeSubmitted, disputeEvidenceRequired, false},
+		{disputeWon, disputeLost, false},
+		{disputeLost, disputeWon, false},
+	} {
+		if got := canTransitionDispute(c.from, c.to); got != c.ok {
+			t.Errorf("%s -> %s: got %v, want %v", c.from, c.to, got, c.ok)
+		}
+	}
+}
+
+func TestOpenDisputeRequestNormalize(t *testing.T) {
+	now := time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC)
+	const paymentID = "7c9e6679-7425-40de-944b-e07fc1f90ae7"
+
+	req := openDisputeRequest{PaymentID: " " + paymentID, ReasonCode: " Fraud "}
+	if err := req.normalize(now, 48*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if req.ReasonCode != "fraud" || !req.EvidenceDueAt.Equal(now.Add(48*time.Hour)) {
+		t.Fatalf("normalized to %+v", req)
+	}
+
+	past := now.Add(-time.Minute)
+	for name, bad := range map[string]openDisputeRequest{
+		"payment id":    {PaymentID: "p1", ReasonCode: "fraud"},
+		"reason code":   {PaymentID: paymentID, ReasonCode: "bored"},
+		"amount":        {PaymentID: paymentID, ReasonCode: "fraud", Amount: -1},
+		"past due date": {PaymentID: paymentID, ReasonCode: "fraud", EvidenceDueAt: &past},
+	} {
+		if err := bad.normalize(now, time.Hour); !errors.Is(err, errInvalidDisputeReq) {
+			t.Errorf("%s: got %v, want errInvalidDisputeReq", name, err)
+		}
+	}
+}
+
+func TestDisputeAmount(t *testing.T) {
+	p := payment{Status: statusSettled, Amount: 1000, CapturedAmount: 900, RefundedAmount: 200, DisputedAmount: 100}
+	if got, err := disputeAmount(p, 0); err != nil || got != 600 {
+		t.Fatalf("whole remainder: got %d, %v", got, err)
+	}
+	if _, err := disputeAmount(p, 601); !errors.Is(err, errDisputeExceeds) {
+		t.Fatalf("over remainder: got %v", err)
+	}
+	if _, err := refundAmount(p, 601); !errors.Is(err, errRefundExceeds) {
+		t.Fatalf("refunds should count the disputed amount: got %v", err)
+	}
+	p.Status = statusAuthorized
+	if _, err := disputeAmount(p, 0); !errors.Is(err, errNotDisputable) {
+		t.Fatalf("authorized payment: got %v", err)
+	}
+}
+
+func TestLostDisputeEntry(t *testing.T) {
+	p := payment{ID: "p1", UserID: "u1", Currency: "EUR", Status: statusSettled, CapturedAmount: 1000}
+	e := lostDisputeEntry(p, dispute{ID: "d1", Amount: 400})
+	if err := validateEntry(*e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Kind != "dispute_lost" || e.DisputeID != "d1" || e.RefundID != "" {
+		t.Fatalf("unexpected entry %+v", e)
+	}
+	want := []postingLine{debit(userAccount("u1"), "EUR", 400), credit(accountCash, "EUR", 400)}
+	for i, l := range want {
+		if e.Lines[i] != l {
+			t.Fatalf("line %d = %+v, want %+v", i, e.Lines[i], l)
+		}
+	}
+	if amount, cur := reversalDebit(p, 400); amount != 400 || cur != "EUR" {
+		t.Fatalf("reserve = %d %s", amount, cur)
+	}
+}
+
+func TestEvidenceContentType(t *testing.T) {
+	for _, c := range []struct {
+		head []byte
+		want string
+	}{
+		{[]byte("%PDF-1.7\n"), "application/pdf"},
+		{[]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), "image/png"},
+		{[]byte("\xff\xd8\xff\xe0\x00\x10JFIF"), "image/jpeg"},
+		{[]byte("Tracking number 1Z999AA10123456784, delivered 3 March"), "text/plain"},
+	} {
+		got, err := evidenceContentType(c.head)
+		if err != nil || got != c.want {
+			t.Errorf("%q: got %q, %v, want %q", c.head[:4], got, err, c.want)
+		}
+	}
+	for _, head := range [][]byte{[]byte("<html><script>"), []byte("PK\x03\x04 zip")} {
+		if _, err := evidenceContentType(head); !errors.Is(err, errEvidenceType) {
+			t.Errorf("%q: got %v, want errEvidenceType", head, err)
+		}
+	}
+	if got := evidenceFileName(`C:\scans\..\receipt.pdf`); got != "receipt.pdf" {
+		t.Errorf("file name = %q", got)
+	}
+}
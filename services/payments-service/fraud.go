@@ -0,0 +1,622 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	fraudAllow  = "allow"
+	fraudReview = "review"
+	fraudBlock  = "block"
+)
+
+// fraudInput is what is known about a payment before it is created.
+type fraudInput struct {
+	UserID   string
+	Amount   int64
+	Currency string
+	Country  string
+	Ref      string
+	Now      time.Time
+}
+
+// fraudLookup answers the history questions rules ask. It runs inside the
+// creating transaction, so a velocity rule sees the same payments the
+// limits check does.
+type fraudLookup interface {
+	// FirstSeen is the time of the user's first payment, or zero for a new
+	// user.
+	FirstSeen(ctx context.Context, userID string) (time.Time, error)
+	CountSince(ctx context.Context, userID string, since time.Time) (int, error)
+}
+
+type matchedRule struct {
+	Name  string `json:"name"`
+	Score int    `json:"score"`
+}
+
+type fraudAssessment struct {
+	Score        int            `json:"score"`
+	Decision     string         `json:"decision"`
+	Matched      []matchedRule  `json:"matched"`
+	RulesVersion string         `json:"rules_version"`
+	Features     map[string]any `json:"features"`
+}
+
+// fraudEngine scores a payment. The rules engine below is the built-in
+// one; a model-backed engine can replace it behind the same interface.
+type fraudEngine interface {
+	Assess(ctx context.Context, in fraudInput, lk fraudLookup) (fraudAssessment, error)
+}
+
+// fraudRule is one declarative rule from the rules file. A matching rule
+// adds Score and, if Decision is set, raises the outcome to at least that
+// decision.
+type fraudRule struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Score    int    `json:"score"`
+	Decision string `json:"decision,omitempty"`
+
+	// amount_over: Amount (decimal, major units) in Currency, or in every
+	// currency's major units when Currency is empty
+	Currency string `json:"currency,omitempty"`
+	Amount   string `json:"amount,omitempty"`
+	// user_age_under: Duration; velocity: Count payments within Window
+	Duration string `json:"duration,omitempty"`
+	Window   string `json:"window,omitempty"`
+	Count    int    `json:"count,omitempty"`
+	// user_in, ref_prefix, country_in
+	Values []string `json:"values,omitempty"`
+
+	window time.Duration
+}
+
+type fraudRuleSet struct {
+	ReviewThreshold int         `json:"review_threshold"`
+	BlockThreshold  int         `json:"block_threshold"`
+	Rules           []fraudRule `json:"rules"`
+
+	version  string
+	loadedAt time.Time
+}
+
+var errInvalidFraudRules = errors.New("invalid fraud rules")
+
+// parseFraudRules decodes and checks a rules file.
+func parseFraudRules(data []byte) (*fraudRuleSet, error) {
+	rs := &fraudRuleSet{}
+	dec := json.NewDecoder(strings.NewReader(string(data)))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(rs); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidFraudRules, err)
+	}
+	if rs.ReviewThreshold <= 0 {
+		rs.ReviewThreshold = 50
+	}
+	if rs.BlockThreshold <= 0 {
+		rs.BlockThreshold = 90
+	}
+	if rs.BlockThreshold < rs.ReviewThreshold {
+		return nil, fmt.Errorf("%w: block_threshold below review_threshold", errInvalidFraudRules)
+	}
+
+	for i := range rs.Rules {
+		r := &rs.Rules[i]
+		bad := func(msg string) error {
+			return fmt.Errorf("%w: rule %q: %s", errInvalidFraudRules, r.Name, msg)
+		}
+		if r.Name == "" {
+			return nil, fmt.Errorf("%w: rule %d has no name", errInvalidFraudRules, i)
+		}
+		if r.Decision != "" && r.Decision != fraudReview && r.Decision != fraudBlock {
+			return nil, bad("decision must be review or block")
+		}
+		switch r.Type {
+		case "amount_over":
+			exp := 0
+			if r.Currency != "" {
+				cur, err := lookupCurrency(r.Currency)
+				if err != nil {
+					return nil, bad(err.Error())
+				}
+				r.Currency, exp = cur.Code, cur.Exponent
+			}
+			if _, err := parseDecimalAmount(r.Amount, exp); err != nil {
+				return nil, bad(err.Error())
+			}
+		case "user_age_under", "velocity":
+			s := r.Duration
+			if r.Type == "velocity" {
+				s = r.Window
+				if r.Count < 1 {
+					return nil, bad("count must be at least 1")
+				}
+			}
+			d, err := time.ParseDuration(s)
+			if err != nil || d <= 0 {
+				return nil, bad("needs a positive duration")
+			}
+			r.window = d
+		case "currency_country_mismatch":
+		case "user_in", "ref_prefix", "country_in":
+			if len(r.Values) == 0 {
+				return nil, bad("needs values")
+			}
+		default:
+			return nil, bad(fmt.Sprintf("unknown type %q", r.Type))
+		}
+	}
+
+	sum := sha256.Sum256(data)
+	rs.version = hex.EncodeToString(sum[:6])
+	return rs, nil
+}
+
+// evaluate runs every rule against in. Lookups are made lazily and cached,
+// so a rules file without history rules costs no queries.
+func (rs *fraudRuleSet) evaluate(ctx context.Context, in fraudInput, lk fraudLookup) (fraudAssessment, error) {
+	a := fraudAssessment{
+		Decision:     fraudAllow,
+		Matched:      []matchedRule{},
+		RulesVersion: rs.version,
+		Features: map[string]any{
+			"amount":   in.Amount,
+			"currency": in.Currency,
+		},
+	}
+	if in.Country != "" {
+		a.Features["country"] = in.Country
+	}
+
+	var firstSeen *time.Time
+	forced := fraudAllow
+	for _, r := range rs.Rules {
+		hit := false
+		switch r.Type {
+		case "amount_over":
+			if r.Currency != "" && r.Currency != in.Currency {
+				break
+			}
+			cur, err := lookupCurrency(in.Currency)
+			if err != nil {
+				return a, err
+			}
+			limit, err := parseDecimalAmount(r.Amount, cur.Exponent)
+			hit = err == nil && in.Amount > limit
+		case "user_age_under":
+			if firstSeen == nil {
+				t, err := lk.FirstSeen(ctx, in.UserID)
+				if err != nil {
+					return a, err
+				}
+				firstSeen = &t
+				if !t.IsZero() {
+					a.Features["user_age_seconds"] = int64(in.Now.Sub(t).Seconds())
+				}
+			}
+			hit = firstSeen.IsZero() || in.Now.Sub(*firstSeen) < r.window
+		case "velocity":
+			n, err := lk.CountSince(ctx, in.UserID, in.Now.Add(-r.window))
+			if err != nil {
+				return a, err
+			}
+			a.Features["count_"+r.Window] = n
+			hit = n >= r.Count
+		case "currency_country_mismatch":
+			if want, ok := countryCurrencies[in.Country]; ok {
+				hit = !containsString(want, in.Currency)
+			}
+		case "user_in":
+			hit = containsString(r.Values, in.UserID)
+		case "country_in":
+			hit = containsString(r.Values, in.Country)
+		case "ref_prefix":
+			for _, p := range r.Values {
+				if strings.HasPrefix(in.Ref, p) {
+					hit = true
+					break
+				}
+			}
+		}
+		if !hit {
+			continue
+		}
+		a.Score += r.Score
+		a.Matched = append(a.Matched, matchedRule{Name: r.Name, Score: r.Score})
+		forced = strongerDecision(forced, r.Decision)
+	}
+
+	switch {
+	case a.Score >= rs.BlockThreshold:
+		a.Decision = fraudBlock
+	case a.Score >= rs.ReviewThreshold:
+		a.Decision = fraudReview
+	}
+	a.Decision = strongerDecision(a.Decision, forced)
+	return a, nil
+}
+
+func strongerDecision(a, b string) string {
+	rank := map[string]int{"": 0, fraudAllow: 0, fraudReview: 1, fraudBlock: 2}
+	if rank[b] > rank[a] {
+		return b
+	}
+	return a
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// countryCurrencies is the currency expected for a billing country, for
+// the currency_country_mismatch rule. Countries not listed never mismatch.
+var countryCurrencies = map[string][]string{
+	"AE": {"AED"}, "AU": {"AUD"}, "AT": {"EUR"}, "BE": {"EUR"}, "BR": {"BRL"},
+	"CA": {"CAD"}, "CH": {"CHF"}, "CN": {"CNY"}, "CZ": {"CZK"}, "DE": {"EUR"},
+	"DK": {"DKK"}, "ES": {"EUR"}, "FI": {"EUR"}, "FR": {"EUR"}, "GB": {"GBP"},
+	"GH": {"GHS"}, "HK": {"HKD"}, "HU": {"HUF"}, "IE": {"EUR"}, "IN": {"INR"},
+	"IT": {"EUR"}, "JP": {"JPY"}, "KE": {"KES"}, "KR": {"KRW"}, "MX": {"MXN"},
+	"NG": {"NGN"}, "NL": {"EUR"}, "NO": {"NOK"}, "NZ": {"NZD"}, "PL": {"PLN"},
+	"PT": {"EUR"}, "SE": {"SEK"}, "SG": {"SGD"}, "US": {"USD"}, "ZA": {"ZAR"},
+}
+
+// rulesEngine is a fraudEngine over a rules file that is reloaded when it
+// changes. A file that fails to parse is logged and the previous rules stay
+// in force.
+type rulesEngine struct {
+	path  string
+	rules atomic.Pointer[fraudRuleSet]
+	mtime time.Time
+}
+
+func newRulesEngineFromEnv() (*rulesEngine, error) {
+	e := &rulesEngine{path: getenv("FRAUD_RULES_FILE", "")}
+	if e.path == "" {
+		// no rules: every payment is allowed, but decisions are still kept
+		rs, _ := parseFraudRules([]byte(`{"rules": []}`))
+		rs.loadedAt = time.Now()
+		e.rules.Store(rs)
+		return e, nil
+	}
+	if err := e.reload(); err != nil {
+		return nil, fmt.Errorf("FRAUD_RULES_FILE: %w", err)
+	}
+	return e, nil
+}
+
+func (e *rulesEngine) Assess(ctx context.Context, in fraudInput, lk fraudLookup) (fraudAssessment, error) {
+	return e.rules.Load().evaluate(ctx, in, lk)
+}
+
+func (e *rulesEngine) reload() error {
+	info, err := os.Stat(e.path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(e.path)
+	if err != nil {
+		return err
+	}
+	rs, err := parseFraudRules(data)
+	if err != nil {
+		return err
+	}
+	rs.loadedAt = time.Now()
+	e.rules.Store(rs)
+	e.mtime = info.ModTime()
+	log.Printf(`{"msg":"fraud rules loaded","path":%q,"version":%q,"rules":%d}`, e.path, rs.version, len(rs.Rules))
+	return nil
+}
+
+// watch polls the rules file and reloads it when its modification time
+// changes. Polling also follows ConfigMap updates, which swap a symlink.
+func (e *rulesEngine) watch(ctx context.Context, every time.Duration) {
+	if e.path == "" {
+		return
+	}
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		info, err := os.Stat(e.path)
+		if err != nil || info.ModTime().Equal(e.mtime) {
+			continue
+		}
+		if err := e.reload(); err != nil {
+			log.Printf(`{"msg":"fraud rules reload failed, keeping previous rules","path":%q,"error":%q}`, e.path, err.Error())
+			e.mtime = info.ModTime()
+		}
+	}
+}
+
+func (req createPaymentRequest) fraudInput(now time.Time) fraudInput {
+	return fraudInput{
+		UserID:   req.UserID,
+		Amount:   req.Amount,
+		Currency: req.Currency,
+		Country:  req.Country,
+		Ref:      req.Ref,
+		Now:      now,
+	}
+}
+
+// screenPayment assesses a payment about to be created and returns the
+// status to create it in. Without an engine every payment is created and
+// no decision is returned.
+func (st *appState) screenPayment(ctx context.Context, tx *sql.Tx, in fraudInput) (string, *fraudAssessment, error) {
+	if st.fraud == nil {
+		return statusCreated, nil, nil
+	}
+	a, err := st.fraud.Assess(ctx, in, txFraudLookup{q: tx})
+	if err != nil {
+		return "", nil, err
+	}
+	log.Printf(`{"msg":"fraud decision","user_id":%q,"ref":%q,"score":%d,"decision":%q}`, in.UserID, in.Ref, a.Score, a.Decision)
+	if a.Decision == fraudReview {
+		return statusInReview, &a, nil
+	}
+	return statusCreated, &a, nil
+}
+
+// txFraudLookup answers fraudLookup from the payments table.
+type txFraudLookup struct {
+	q querier
+}
+
+func (l txFraudLookup) FirstSeen(ctx context.Context, userID string) (time.Time, error) {
+	var t sql.NullTime
+	err := l.q.QueryRowContext(ctx, `SELECT MIN(created_at) FROM payments WHERE user_id = $1`, userID).Scan(&t)
+	return t.Time, err
+}
+
+func (l txFraudLookup) CountSince(ctx context.Context, userID string, since time.Time) (int, error) {
+	var n int
+	err := l.q.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM payments WHERE user_id = $1 AND created_at >= $2
+	`, userID, since).Scan(&n)
+	return n, err
+}
+
+// recordFraudDecision stores an assessment. paymentID is empty for a
+// blocked payment, which is never created.
+func recordFraudDecision(ctx context.Context, tx *sql.Tx, paymentID string, in fraudInput, a fraudAssessment) error {
+	matched, err := json.Marshal(a.Matched)
+	if err != nil {
+		return err
+	}
+	features, err := json.Marshal(a.Features)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO fraud_decisions(payment_id, user_id, ref, amount, currency, score, decision,
+			matched_rules, features, rules_version)
+		VALUES (NULLIF($1, '')::uuid, $2, $3, $4, $5, $6, $7, $8::jsonb, $9::jsonb, $10)
+	`, paymentID, in.UserID, in.Ref, in.Amount, in.Currency, a.Score, a.Decision,
+		string(matched), string(features), a.RulesVersion)
+	return err
+}
+
+type fraudDecision struct {
+	ID            int64           `json:"id"`
+	PaymentID     string          `json:"payment_id,omitempty"`
+	UserID        string          `json:"user_id"`
+	Ref           string          `json:"ref"`
+	Amount        int64           `json:"amount"`
+	Currency      string          `json:"currency"`
+	Score         int             `json:"score"`
+	Decision      string          `json:"decision"`
+	MatchedRules  json.RawMessage `json:"matched_rules"`
+	Features      json.RawMessage `json:"features"`
+	RulesVersion  string          `json:"rules_version"`
+	ReviewOutcome string          `json:"review_outcome,omitempty"`
+	Reviewer      string          `json:"reviewer,omitempty"`
+	ReviewNote    string          `json:"review_note,omitempty"`
+	ReviewedAt    *time.Time      `json:"reviewed_at,omitempty"`
+	CreatedAt     time.Time       `json:"created_at"`
+}
+
+const fraudDecisionColumns = `id, COALESCE(payment_id::text, ''), user_id, ref, amount, currency, score, decision,
+	matched_rules::text, features::text, rules_version, COALESCE(review_outcome, ''), COALESCE(reviewer, ''),
+	COALESCE(review_note, ''), reviewed_at, created_at`
+
+func scanFraudDecision(row rowScanner, d *fraudDecision) error {
+	var matched, features string
+	var reviewedAt sql.NullTime
+	if err := row.Scan(&d.ID, &d.PaymentID, &d.UserID, &d.Ref, &d.Amount, &d.Currency, &d.Score, &d.Decision,
+		&matched, &features, &d.RulesVersion, &d.ReviewOutcome, &d.Reviewer, &d.ReviewNote, &reviewedAt, &d.CreatedAt); err != nil {
+		return err
+	}
+	d.MatchedRules = json.RawMessage(matched)
+	d.Features = json.RawMessage(features)
+	if reviewedAt.Valid {
+		d.ReviewedAt = &reviewedAt.Time
+	}
+	return nil
+}
+
+type reviewRequest struct {
+	Reviewer string `json:"reviewer"`
+	Note     string `json:"note"`
+}
+
+// handleFraud serves:
+//
+//	GET  /v1/fraud/rules
+//	GET  /v1/fraud/reviews                         payments waiting for review
+//	POST /v1/fraud/reviews/{payment_id}/{approve|reject}
+//	GET  /v1/fraud/decisions?decision=&user_id=&limit=
+func (st *appState) handleFraud(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/fraud/"), "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "rules" && r.Method == http.MethodGet:
+		re, ok := st.fraud.(*rulesEngine)
+		if !ok {
+			http.Error(w, "fraud screening is not rules-based", http.StatusNotFound)
+			return
+		}
+		rs := re.rules.Load()
+		writeJSON(w, http.StatusOK, map[string]any{
+			"version":   rs.version,
+			"loaded_at": rs.loadedAt,
+			"source":    re.path,
+			"rules":     rs,
+		})
+	case len(parts) == 1 && parts[0] == "reviews" && r.Method == http.MethodGet:
+		out, err := listFraudDecisions(ctx, st.db, `
+			d.decision = 'review' AND d.review_outcome IS NULL
+			AND EXISTS (SELECT 1 FROM payments p WHERE p.id = d.payment_id AND p.status = 'in_review')`, nil, 200)
+		if err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, out)
+	case len(parts) == 3 && parts[0] == "reviews" && (parts[2] == "approve" || parts[2] == "reject"):
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		st.completeReview(ctx, w, r, parts[1], parts[2])
+	case len(parts) == 1 && parts[0] == "decisions" && r.Method == http.MethodGet:
+		q := r.URL.Query()
+		var where []string
+		var args []any
+		if v := q.Get("decision"); v != "" {
+			args = append(args, v)
+			where = append(where, fmt.Sprintf("d.decision = $%d", len(args)))
+		}
+		if v := q.Get("user_id"); v != "" {
+			args = append(args, v)
+			where = append(where, fmt.Sprintf("d.user_id = $%d", len(args)))
+		}
+		if len(where) == 0 {
+			where = append(where, "true")
+		}
+		out, err := listFraudDecisions(ctx, st.db, strings.Join(where, " AND "), args, 1000)
+		if err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, out)
+	case len(parts) == 1 && (parts[0] == "rules" || parts[0] == "reviews" || parts[0] == "decisions"):
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func listFraudDecisions(ctx context.Context, db *sql.DB, where string, args []any, limit int) ([]fraudDecision, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+fraudDecisionColumns+`
+		FROM fraud_decisions d
+		WHERE `+where+`
+		ORDER BY d.id DESC
+		LIMIT `+fmt.Sprint(limit), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []fraudDecision{}
+	for rows.Next() {
+		var d fraudDecision
+		if err := scanFraudDecision(rows, &d); err != nil {
+			return nil, err
+		}
+		out = append(out, d)
+	}
+	return out, rows.Err()
+}
+
+// completeReview records the reviewer's outcome and moves the payment out
+// of in_review: approved payments continue as created, rejected ones fail.
+func (st *appState) completeReview(ctx context.Context, w http.ResponseWriter, r *http.Request, paymentID, action string) {
+	var req reviewRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	req.Reviewer = strings.TrimSpace(req.Reviewer)
+	if caller := callerFrom(ctx); caller.Subject != "" {
+		// an authenticated reviewer is who the gateway says, not the body
+		req.Reviewer = caller.Subject
+	}
+	if req.Reviewer == "" {
+		http.Error(w, "reviewer is required", http.StatusBadRequest)
+		return
+	}
+
+	to, outcome, reason := statusCreated, "approved", "fraud review approved"
+	if action == "reject" {
+		to, outcome, reason = statusFailed, "rejected", "fraud review rejected"
+	}
+	if req.Note != "" {
+		reason += ": " + req.Note
+	}
+
+	p, err := st.applyTransition(ctx, paymentID, to, reason, 0)
+	if err != nil {
+		writeTransitionError(w, err)
+		return
+	}
+	if _, err := st.db.ExecContext(ctx, `
+		UPDATE fraud_decisions
+		SET review_outcome = $2, reviewer = $3, review_note = NULLIF($4, ''), reviewed_at = now()
+		WHERE payment_id = $1::uuid AND decision = $5
+	`, paymentID, outcome, req.Reviewer, strings.TrimSpace(req.Note), fraudReview); err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+const fraudSchema = `
+	CREATE TABLE IF NOT EXISTS fraud_decisions (
+		id bigserial PRIMARY KEY,
+		payment_id uuid REFERENCES payments(id),
+		user_id text NOT NULL,
+		ref text NOT NULL,
+		amount bigint NOT NULL,
+		currency text NOT NULL,
+		score int NOT NULL,
+		decision text NOT NULL,
+		matched_rules jsonb NOT NULL,
+		features jsonb NOT NULL,
+		rules_version text NOT NULL,
+		review_outcome text,
+		reviewer text,
+		review_note text,
+		reviewed_at timestamptz,
+		created_at timestamptz NOT NULL DEFAULT now()
+	);
+
+	CREATE INDEX IF NOT EXISTS fraud_decisions_payment_idx ON fraud_decisions(payment_id);
+	CREATE INDEX IF NOT EXISTS fraud_decisions_decision_idx ON fraud_decisions(decision, id);
+	CREATE INDEX IF NOT EXISTS fraud_decisions_user_idx ON fraud_decisions(user_id, id);
+`
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type fakeFraudLookup struct {
+	firstSeen time.Time
+	counts    int
+}
+
+func (f fakeFraudLookup) FirstSeen(context.Context, string) (time.Time, error) {
+	return f.firstSeen, nil
+}
+
+func (f fakeFraudLookup) CountSince(context.Context, string, time.Time) (int, error) {
+	return f.counts, nil
+}
+
+const testFraudRules = `{
+	"review_threshold": 50,
+	"block_threshold": 90,
+	"rules": [
+		{"name": "large_eur", "type": "amount_over", "currency": "EUR", "amount": "1000", "score": 40},
+		{"name": "new_user", "type": "user_age_under", "duration": "24h", "score": 20},
+		{"name": "burst", "type": "velocity", "window": "10m", "count": 5, "score": 30},
+		{"name": "geo", "type": "currency_country_mismatch", "score": 15},
+		{"name": "blocklist", "type": "user_in", "values": ["u-bad"], "score": 0, "decision": "block"}
+	]
+}`
+
+func TestFraudRulesScoreAndDecide(t *testing.T) {
+	rs, err := parseFraudRules([]byte(testFraudRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	old := fakeFraudLookup{firstSeen: now.AddDate(0, -1, 0)}
+
+	cases := []struct {
+		name   string
+		in     fraudInput
+		lk     fakeFraudLookup
+		score  int
+		decide string
+	}{
+		{"clean", fraudInput{UserID: "u1", Amount: 5000, Currency: "EUR", Country: "DE"}, old, 0, fraudAllow},
+		{"large", fraudInput{UserID: "u1", Amount: 100001, Currency: "EUR", Country: "DE"}, old, 40, fraudAllow},
+		{"large new user", fraudInput{UserID: "u1", Amount: 100001, Currency: "EUR"}, fakeFraudLookup{}, 60, fraudReview},
+		{"everything", fraudInput{UserID: "u1", Amount: 100001, Currency: "EUR", Country: "US"},
+			fakeFraudLookup{counts: 5}, 105, fraudBlock},
+		{"large usd is not eur", fraudInput{UserID: "u1", Amount: 100001, Currency: "USD", Country: "US"}, old, 0, fraudAllow},
+		{"blocklisted", fraudInput{UserID: "u-bad", Amount: 100, Currency: "EUR", Country: "DE"}, old, 0, fraudBlock},
+	}
+	for _, c := range cases {
+		c.in.Now = now
+		a, err := rs.evaluate(context.Background(), c.in, c.lk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.Score != c.score || a.Decision != c.decide {
+			t.Fatalf("%s: got score %d decision %s (%+v), want %d %s", c.name, a.Score, a.Decision, a.Matched, c.score, c.decide)
+		}
+	}
+}
+
+func TestParseFraudRulesRejectsBadRules(t *testing.T) {
+	bad := []string{
+		`{"rules": [{"name": "x", "type": "nope"}]}`,
+		`{"rules": [{"type": "user_in", "values": ["a"]}]}`,
+		`{"rules": [{"name": "x", "type": "velocity", "window": "10m"}]}`,
+		`{"rules": [{"name": "x", "type": "amount_over", "currency": "XXX", "amount": "1"}]}`,
+		`{"rules": [{"name": "x", "type": "user_in", "values": ["a"], "decision": "allow"}]}`,
+		`{"review_threshold": 80, "block_threshold": 60, "rules": []}`,
+		`{"rules": [], "extra": true}`,
+	}
+	for _, b := range bad {
+		if _, err := parseFraudRules([]byte(b)); !errors.Is(err, errInvalidFraudRules) {
+			t.Fatalf("%s: got %v", b, err)
+		}
+	}
+}
+
+func TestRulesEngineKeepsRulesOnBadReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	if err := os.WriteFile(path, []byte(testFraudRules), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	e := &rulesEngine{path: path}
+	if err := e.reload(); err != nil {
+		t.Fatal(err)
+	}
+	version := e.rules.Load().version
+
+	if err := os.WriteFile(path, []byte(`{"rules": [`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.reload(); err == nil {
+		t.Fatal("expected a parse error")
+	}
+	if e.rules.Load().version != version {
+		t.Fatal("bad file replaced the loaded rules")
+	}
+
+	if err := os.WriteFile(path, []byte(`{"rules": []}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if e.rules.Load().version == version || len(e.rules.Load().Rules) != 0 {
+		t.Fatal("rules were not reloaded")
+	}
+}
+
+func TestExampleFraudRulesParse(t *testing.T) {
+	data, err := os.ReadFile("fraud-rules.example.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseFraudRules(data); err != nil {
+		t.Fatal(err)
+	}
+}
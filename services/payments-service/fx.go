@@ -0,0 +1,751 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FX conversions. A quote locks a rate for a short time; a payment that
+// references it is taken in the quote's source currency and credited to the
+// user in its target currency at the locked rate.
+//
+// Rounding is fixed and always in the platform's favour:
+//   - rates are kept to fxRateScale decimal places; the customer rate is
+//     the mid rate less the spread, rounded down;
+//   - converting source to target rounds the target amount down to its
+//     currency's minor unit;
+//   - converting a fixed target back to source rounds the source amount up.
+//
+// The spread, the difference between the target amount at the mid rate and
+// at the customer rate, is booked to fx_revenue when the payment is
+// captured.
+
+const fxRateScale = 8
+
+const (
+	quoteOpen    = "open"
+	quoteUsed    = "used"
+	quoteExpired = "expired"
+)
+
+const (
+	fxFixedSource = "source"
+	fxFixedTarget = "target"
+)
+
+var (
+	errRateUnavailable  = errors.New("no rate for currency pair")
+	errInvalidRate      = errors.New("invalid rate")
+	errQuoteNotFound    = errors.New("fx quote not found")
+	errQuoteUnavailable = errors.New("fx quote is used or expired")
+	errQuoteMismatch    = errors.New("payment does not match the fx quote")
+	errManualRatesOnly  = errors.New("rates are only set through the API with FX_RATE_PROVIDER=manual")
+)
+
+// RateProvider supplies mid-market rates: how many units of quote one unit
+// of base buys.
+type RateProvider interface {
+	Name() string
+	Rate(ctx context.Context, base, quote string) (fxRate, error)
+	Rates(ctx context.Context) ([]fxRate, error)
+}
+
+type fxRate struct {
+	Base  string    `json:"base"`
+	Quote string    `json:"quote"`
+	Rate  string    `json:"rate"`
+	AsOf  time.Time `json:"as_of"`
+	rat   *big.Rat
+}
+
+var rateDecimal = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?$`)
+
+// parseRate reads a positive decimal rate, rounded down to fxRateScale
+// places.
+func parseRate(s string) (*big.Rat, error) {
+	s = strings.TrimSpace(s)
+	if !rateDecimal.MatchString(s) {
+		return nil, fmt.Errorf("%w: %q is not a decimal number", errInvalidRate, s)
+	}
+	r, _ := new(big.Rat).SetString(s)
+	r = roundRateDown(r)
+	if r.Sign() <= 0 {
+		return nil, fmt.Errorf("%w: %q rounds to zero", errInvalidRate, s)
+	}
+	return r, nil
+}
+
+func roundRateDown(r *big.Rat) *big.Rat {
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(fxRateScale), nil)
+	n := new(big.Int).Mul(r.Num(), scale)
+	n.Quo(n, r.Denom())
+	return new(big.Rat).SetFrac(n, scale)
+}
+
+func formatRate(r *big.Rat) string {
+	return r.FloatString(fxRateScale)
+}
+
+// invertRate is the rate of the opposite pair, rounded down.
+func invertRate(r *big.Rat) *big.Rat {
+	return roundRateDown(new(big.Rat).Inv(r))
+}
+
+// customerRate takes spreadBps basis points off the mid rate.
+func customerRate(mid *big.Rat, spreadBps int64) *big.Rat {
+	r := new(big.Rat).Mul(mid, big.NewRat(10000-spreadBps, 10000))
+	return roundRateDown(r)
+}
+
+// convertExact converts a source amount in minor units at rate into target
+// minor units, without rounding.
+func convertExact(amount int64, rate *big.Rat, src, tgt currencyInfo) *big.Rat {
+	v := new(big.Rat).Mul(big.NewRat(amount, 1), rate)
+	shift := tgt.Exponent - src.Exponent
+	p := new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(abs(shift))), nil))
+	if shift >= 0 {
+		return v.Mul(v, p)
+	}
+	return v.Quo(v, p)
+}
+
+func floorRat(r *big.Rat) int64 {
+	return new(big.Int).Quo(r.Num(), r.Denom()).Int64()
+}
+
+func ceilRat(r *big.Rat) int64 {
+	n := new(big.Int).Add(r.Num(), new(big.Int).Sub(r.Denom(), big.NewInt(1)))
+	return n.Quo(n, r.Denom()).Int64()
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// pairRates looks a pair up in rates, falling back to inverting the
+// opposite pair.
+func pairRates(rates map[[2]string]fxRate, base, quote string) (fxRate, error) {
+	if r, ok := rates[[2]string{base, quote}]; ok {
+		return r, nil
+	}
+	if r, ok := rates[[2]string{quote, base}]; ok {
+		inv := invertRate(r.rat)
+		return fxRate{Base: base, Quote: quote, Rate: formatRate(inv), AsOf: r.AsOf, rat: inv}, nil
+	}
+	return fxRate{}, fmt.Errorf("%w: %s/%s", errRateUnavailable, base, quote)
+}
+
+// staticRates serves rates from a JSON file read at startup:
+//
+//	{"as_of": "2026-03-01T00:00:00Z", "rates": {"EUR/USD": "1.0842"}}
+type staticRates struct {
+	asOf  time.Time
+	rates map[[2]string]fxRate
+}
+
+func loadStaticRates(path string) (*staticRates, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		AsOf  time.Time         `json:"as_of"`
+		Rates map[string]string `json:"rates"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&file); err != nil {
+		return nil, err
+	}
+	if file.AsOf.IsZero() {
+		return nil, errors.New("as_of is required")
+	}
+	s := &staticRates{asOf: file.AsOf, rates: map[[2]string]fxRate{}}
+	for pair, v := range file.Rates {
+		base, quote, err := parsePair(pair, "/")
+		if err != nil {
+			return nil, err
+		}
+		r, err := parseRate(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", pair, err)
+		}
+		s.rates[[2]string{base, quote}] = fxRate{Base: base, Quote: quote, Rate: formatRate(r), AsOf: file.AsOf, rat: r}
+	}
+	return s, nil
+}
+
+// parsePair reads "EUR/USD" (or "EUR", "USD" joined by sep) into two
+// supported currency codes.
+func parsePair(pair, sep string) (string, string, error) {
+	base, quote, ok := strings.Cut(strings.ToUpper(strings.TrimSpace(pair)), sep)
+	if !ok {
+		return "", "", fmt.Errorf("%w: pair %q", errInvalidRate, pair)
+	}
+	for _, c := range []string{base, quote} {
+		if _, err := lookupCurrency(c); err != nil {
+			return "", "", err
+		}
+	}
+	if base == quote {
+		return "", "", fmt.Errorf("%w: pair %q converts a currency to itself", errInvalidRate, pair)
+	}
+	return base, quote, nil
+}
+
+func (s *staticRates) Name() string { return "static" }
+
+func (s *staticRates) Rate(_ context.Context, base, quote string) (fxRate, error) {
+	return pairRates(s.rates, base, quote)
+}
+
+func (s *staticRates) Rates(context.Context) ([]fxRate, error) {
+	out := make([]fxRate, 0, len(s.rates))
+	for _, r := range s.rates {
+		out = append(out, r)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Base+out[i].Quote < out[j].Base+out[j].Quote
+	})
+	return out, nil
+}
+
+// manualRates serves rates operators set through PUT /v1/fx/rates.
+type manualRates struct {
+	db *sql.DB
+}
+
+func (m manualRates) Name() string { return "manual" }
+
+func (m manualRates) Rate(ctx context.Context, base, quote string) (fxRate, error) {
+	rows, err := m.db.QueryContext(ctx, `
+		SELECT base, quote, rate::text, updated_at FROM fx_rates
+		WHERE (base = $1 AND quote = $2) OR (base = $2 AND quote = $1)
+	`, base, quote)
+	if err != nil {
+		return fxRate{}, err
+	}
+	rates, err := scanRates(rows)
+	if err != nil {
+		return fxRate{}, err
+	}
+	return pairRates(rates, base, quote)
+}
+
+func (m manualRates) Rates(ctx context.Context) ([]fxRate, error) {
+	rows, err := m.db.QueryContext(ctx, `
+		SELECT base, quote, rate::text, updated_at FROM fx_rates ORDER BY base, quote
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []fxRate{}
+	for rows.Next() {
+		var r fxRate
+		if err := rows.Scan(&r.Base, &r.Quote, &r.Rate, &r.AsOf); err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+func scanRates(rows *sql.Rows) (map[[2]string]fxRate, error) {
+	defer rows.Close()
+	out := map[[2]string]fxRate{}
+	for rows.Next() {
+		var r fxRate
+		if err := rows.Scan(&r.Base, &r.Quote, &r.Rate, &r.AsOf); err != nil {
+			return nil, err
+		}
+		var err error
+		if r.rat, err = parseRate(r.Rate); err != nil {
+			return nil, err
+		}
+		out[[2]string{r.Base, r.Quote}] = r
+	}
+	return out, rows.Err()
+}
+
+// set stores the rate of base/quote, replacing any earlier one.
+func (m manualRates) set(ctx context.Context, base, quote string, rate *big.Rat, by string) (fxRate, error) {
+	r := fxRate{Base: base, Quote: quote, rat: rate}
+	err := m.db.QueryRowContext(ctx, `
+		INSERT INTO fx_rates(base, quote, rate, updated_by)
+		VALUES ($1, $2, $3::numeric, NULLIF($4, ''))
+		ON CONFLICT (base, quote) DO UPDATE
+		SET rate = EXCLUDED.rate, updated_by = EXCLUDED.updated_by, updated_at = now()
+		RETURNING rate::text, updated_at
+	`, base, quote, formatRate(rate), by).Scan(&r.Rate, &r.AsOf)
+	return r, err
+}
+
+// fxService prices quotes from a rate provider.
+type fxService struct {
+	rates     RateProvider
+	spreadBps int64
+	quoteTTL  time.Duration
+}
+
+// newFXFromEnv picks the rate provider named by FX_RATE_PROVIDER: "manual"
+// (the default) reads rates operators set through the API, "static" reads
+// FX_RATES_FILE, and "none" disables FX.
+func newFXFromEnv(db *sql.DB) (*fxService, error) {
+	fx := &fxService{}
+	switch kind := getenv("FX_RATE_PROVIDER", "manual"); kind {
+	case "none":
+		return nil, nil
+	case "manual":
+		fx.rates = manualRates{db: db}
+	case "static":
+		path := os.Getenv("FX_RATES_FILE")
+		if path == "" {
+			return nil, errors.New("FX_RATE_PROVIDER=static needs FX_RATES_FILE")
+		}
+		s, err := loadStaticRates(path)
+		if err != nil {
+			return nil, fmt.Errorf("FX_RATES_FILE: %w", err)
+		}
+		log.Printf(`{"msg":"fx rates loaded","path":%q,"as_of":%q,"pairs":%d}`, path, s.asOf.Format(time.RFC3339), len(s.rates))
+		fx.rates = s
+	default:
+		return nil, fmt.Errorf("unknown FX_RATE_PROVIDER %q (want manual, static or none)", kind)
+	}
+
+	bps, err := strconv.ParseInt(getenv("FX_SPREAD_BPS", "50"), 10, 64)
+	if err != nil || bps < 0 || bps >= 10000 {
+		return nil, errors.New("FX_SPREAD_BPS must be between 0 and 9999")
+	}
+	fx.spreadBps = bps
+	if fx.quoteTTL, err = time.ParseDuration(getenv("FX_QUOTE_TTL", "60s")); err != nil || fx.quoteTTL <= 0 {
+		return nil, errors.New("FX_QUOTE_TTL must be a positive duration")
+	}
+	return fx, nil
+}
+
+type quoteRequest struct {
+	UserID         string `json:"user_id"`
+	SourceCurrency string `json:"source_currency"`
+	TargetCurrency string `json:"target_currency"`
+	// exactly one side is fixed, in minor units or as a decimal
+	SourceAmount        int64  `json:"source_amount"`
+	SourceAmountDecimal string `json:"source_amount_decimal"`
+	TargetAmount        int64  `json:"target_amount"`
+	TargetAmountDecimal string `json:"target_amount_decimal"`
+}
+
+func (req *quoteRequest) normalize() error {
+	req.UserID = strings.TrimSpace(req.UserID)
+	req.SourceCurrency = strings.ToUpper(strings.TrimSpace(req.SourceCurrency))
+	req.TargetCurrency = strings.ToUpper(strings.TrimSpace(req.TargetCurrency))
+	if req.UserID == "" {
+		return errors.New("user_id is required")
+	}
+	if req.SourceCurrency == req.TargetCurrency {
+		return errors.New("source_currency and target_currency must differ")
+	}
+	src, err := lookupCurrency(req.SourceCurrency)
+	if err != nil {
+		return err
+	}
+	tgt, err := lookupCurrency(req.TargetCurrency)
+	if err != nil {
+		return err
+	}
+	if req.SourceAmount, err = src.resolveAmount(req.SourceAmount, req.SourceAmountDecimal); err != nil {
+		return err
+	}
+	if req.TargetAmount, err = tgt.resolveAmount(req.TargetAmount, req.TargetAmountDecimal); err != nil {
+		return err
+	}
+	if (req.SourceAmount > 0) == (req.TargetAmount > 0) || req.SourceAmount < 0 || req.TargetAmount < 0 {
+		return errors.New("exactly one of source_amount and target_amount is required")
+	}
+	return nil
+}
+
+type fxQuote struct {
+	ID                  string `json:"id"`
+	UserID              string `json:"user_id"`
+	SourceCurrency      string `json:"source_currency"`
+	SourceAmount        int64  `json:"source_amount"`
+	SourceAmountDecimal string `json:"source_amount_decimal,omitempty"`
+	TargetCurrency      string `json:"target_currency"`
+	TargetAmount        int64  `json:"target_amount"`
+	TargetAmountDecimal string `json:"target_amount_decimal,omitempty"`
+	// the side the client asked for; the other was derived from it
+	Fixed string `json:"fixed"`
+	// target units per source unit, after the spread
+	Rate      string `json:"rate"`
+	MidRate   string `json:"mid_rate"`
+	SpreadBps int64  `json:"spread_bps"`
+	// what the spread takes, in the target currency
+	SpreadAmount int64      `json:"spread_amount"`
+	Provider     string     `json:"provider"`
+	Status       string     `json:"status"`
+	PaymentID    string     `json:"payment_id,omitempty"`
+	ExpiresAt    time.Time  `json:"expires_at"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UsedAt       *time.Time `json:"used_at,omitempty"`
+}
+
+// priceQuote fills in the side of req that was not fixed, at mid less the
+// spread, rounding as described at the top of this file.
+func priceQuote(req quoteRequest, mid *big.Rat, spreadBps int64) (fxQuote, error) {
+	src, err := lookupCurrency(req.SourceCurrency)
+	if err != nil {
+		return fxQuote{}, err
+	}
+	tgt, err := lookupCurrency(req.TargetCurrency)
+	if err != nil {
+		return fxQuote{}, err
+	}
+	rate := customerRate(mid, spreadBps)
+	q := fxQuote{
+		UserID:         req.UserID,
+		SourceCurrency: src.Code,
+		TargetCurrency: tgt.Code,
+		Rate:           formatRate(rate),
+		MidRate:        formatRate(mid),
+		SpreadBps:      spreadBps,
+	}
+	if req.SourceAmount > 0 {
+		q.Fixed = fxFixedSource
+		q.SourceAmount = req.SourceAmount
+		q.TargetAmount = floorRat(convertExact(q.SourceAmount, rate, src, tgt))
+	} else {
+		q.Fixed = fxFixedTarget
+		q.TargetAmount = req.TargetAmount
+		perSourceUnit := convertExact(1, rate, src, tgt)
+		q.SourceAmount = ceilRat(new(big.Rat).Quo(big.NewRat(q.TargetAmount, 1), perSourceUnit))
+	}
+	if q.TargetAmount <= 0 {
+		return q, fmt.Errorf("%w: converts to nothing in %s", errInvalidAmount, tgt.Code)
+	}
+	if err := src.checkAmount(q.SourceAmount); err != nil {
+		return q, err
+	}
+	q.SpreadAmount = floorRat(convertExact(q.SourceAmount, mid, src, tgt)) - q.TargetAmount
+	q.finish()
+	return q, nil
+}
+
+func (q *fxQuote) finish() {
+	q.SourceAmountDecimal = formatAmount(q.SourceAmount, q.SourceCurrency)
+	q.TargetAmountDecimal = formatAmount(q.TargetAmount, q.TargetCurrency)
+}
+
+// paymentFX is the conversion locked onto a payment made with a quote.
+type paymentFX struct {
+	QuoteID             string `json:"quote_id"`
+	TargetCurrency      string `json:"target_currency"`
+	TargetAmount        int64  `json:"target_amount"`
+	TargetAmountDecimal string `json:"target_amount_decimal,omitempty"`
+	Rate                string `json:"rate"`
+	MidRate             string `json:"mid_rate"`
+}
+
+// convert returns what amount of p's source currency is worth in the
+// target currency at the customer rate and at the mid rate, both rounded
+// down. The whole payment amount converts to exactly the quoted target.
+func (fx paymentFX) convert(p payment, amount int64) (customer, mid int64) {
+	src, err1 := lookupCurrency(p.Currency)
+	tgt, err2 := lookupCurrency(fx.TargetCurrency)
+	rate, err3 := parseRate(fx.Rate)
+	midRate, err4 := parseRate(fx.MidRate)
+	if err := errors.Join(err1, err2, err3, err4); err != nil {
+		// stored with the payment, so this does not happen; an entry with
+		// zero postings is rejected by validateEntry
+		log.Printf(`{"msg":"fx conversion failed","payment_id":%q,"error":%q}`, p.ID, err.Error())
+		return 0, 0
+	}
+	customer = floorRat(convertExact(amount, rate, src, tgt))
+	if amount == p.Amount {
+		customer = fx.TargetAmount
+	}
+	return customer, floorRat(convertExact(amount, midRate, src, tgt))
+}
+
+const quoteColumns = `id::text, user_id, source_currency, source_amount, target_currency, target_amount, fixed,
+	rate::text, mid_rate::text, spread_bps, spread_amount, provider, status, COALESCE(payment_id::text, ''),
+	expires_at, created_at, used_at`
+
+func scanQuote(row rowScanner, q *fxQuote) error {
+	var usedAt sql.NullTime
+	if err := row.Scan(&q.ID, &q.UserID, &q.SourceCurrency, &q.SourceAmount, &q.TargetCurrency, &q.TargetAmount, &q.Fixed,
+		&q.Rate, &q.MidRate, &q.SpreadBps, &q.SpreadAmount, &q.Provider, &q.Status, &q.PaymentID,
+		&q.ExpiresAt, &q.CreatedAt, &usedAt); err != nil {
+		return err
+	}
+	q.UsedAt = nil
+	if usedAt.Valid {
+		q.UsedAt = &usedAt.Time
+	}
+	if q.Status == quoteOpen && !time.Now().Before(q.ExpiresAt) {
+		q.Status = quoteExpired
+	}
+	q.finish()
+	return nil
+}
+
+func (st *appState) createQuote(ctx context.Context, req quoteRequest) (fxQuote, error) {
+	rate, err := st.fx.rates.Rate(ctx, req.SourceCurrency, req.TargetCurrency)
+	if err != nil {
+		return fxQuote{}, err
+	}
+	mid := rate.rat
+	if mid == nil {
+		if mid, err = parseRate(rate.Rate); err != nil {
+			return fxQuote{}, err
+		}
+	}
+	q, err := priceQuote(req, mid, st.fx.spreadBps)
+	if err != nil {
+		return q, err
+	}
+	err = scanQuote(st.db.QueryRowContext(ctx, `
+		INSERT INTO fx_quotes(user_id, source_currency, source_amount, target_currency, target_amount, fixed,
+			rate, mid_rate, spread_bps, spread_amount, provider, status, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7::numeric, $8::numeric, $9, $10, $11, $12, now() + make_interval(secs => $13))
+		RETURNING `+quoteColumns,
+		q.UserID, q.SourceCurrency, q.SourceAmount, q.TargetCurrency, q.TargetAmount, q.Fixed,
+		q.Rate, q.MidRate, q.SpreadBps, q.SpreadAmount, st.fx.rates.Name(), quoteOpen, st.fx.quoteTTL.Seconds()), &q)
+	return q, err
+}
+
+func loadQuote(ctx context.Context, q rowQuerier, id string) (fxQuote, error) {
+	var quote fxQuote
+	err := scanQuote(q.QueryRowContext(ctx, `SELECT `+quoteColumns+` FROM fx_quotes WHERE id = $1::uuid`, id), &quote)
+	if errors.Is(err, sql.ErrNoRows) {
+		return quote, errQuoteNotFound
+	}
+	return quote, err
+}
+
+// fillFromQuote completes a payment request that references a quote: the
+// payment is taken in the quote's source currency and amount, which the
+// request may repeat but not change.
+func (st *appState) fillFromQuote(ctx context.Context, req *createPaymentRequest) error {
+	if st.fx == nil {
+		return fmt.Errorf("%w: FX is disabled", errQuoteNotFound)
+	}
+	if !isUUID(req.FXQuoteID) {
+		return errQuoteNotFound
+	}
+	q, err := loadQuote(ctx, st.db, req.FXQuoteID)
+	if err != nil {
+		return err
+	}
+	if q.UserID != strings.TrimSpace(req.UserID) {
+		return errQuoteNotFound
+	}
+	if q.Status != quoteOpen {
+		return fmt.Errorf("%w: quote is %s", errQuoteUnavailable, q.Status)
+	}
+	if c := strings.ToUpper(strings.TrimSpace(req.Currency)); c != "" && c != q.SourceCurrency {
+		return fmt.Errorf("%w: currency %s, quote is in %s", errQuoteMismatch, c, q.SourceCurrency)
+	}
+	req.Currency = q.SourceCurrency
+	if req.Amount == 0 && strings.TrimSpace(req.AmountDecimal) == "" {
+		req.Amount = q.SourceAmount
+	}
+	return nil
+}
+
+// claimQuote marks the quote used by a payment being created in tx. The
+// guarded update makes a quote good for one payment, and only while open.
+func claimQuote(ctx context.Context, tx *sql.Tx, req createPaymentRequest) (*paymentFX, error) {
+	var q fxQuote
+	err := scanQuote(tx.QueryRowContext(ctx, `
+		UPDATE fx_quotes SET status = $5, used_at = now()
+		WHERE id = $1::uuid AND user_id = $2 AND source_currency = $3 AND source_amount = $4
+		  AND status = $6 AND expires_at > now()
+		RETURNING `+quoteColumns,
+		req.FXQuoteID, req.UserID, req.Currency, req.Amount, quoteUsed, quoteOpen), &q)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w, or does not match the payment amount", errQuoteUnavailable)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &paymentFX{QuoteID: q.ID, TargetCurrency: q.TargetCurrency, TargetAmount: q.TargetAmount, Rate: q.Rate, MidRate: q.MidRate}, nil
+}
+
+// handleFX serves /v1/fx/quotes[/{id}] and /v1/fx/rates[/{base}/{quote}].
+func (st *appState) handleFX(w http.ResponseWriter, r *http.Request) {
+	if st.fx == nil {
+		http.Error(w, "fx disabled", http.StatusNotFound)
+		return
+	}
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/fx/"), "/")
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	caller := callerFrom(r.Context())
+
+	switch {
+	case rest == "quotes" && r.Method == http.MethodPost:
+		var req quoteRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		if strings.TrimSpace(req.UserID) == "" {
+			req.UserID = caller.Subject
+		}
+		if !caller.mayActFor(strings.TrimSpace(req.UserID)) {
+			http.Error(w, "user_id does not match the authenticated user", http.StatusForbidden)
+			return
+		}
+		if err := req.normalize(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		q, err := st.createQuote(ctx, req)
+		if err != nil {
+			writeFXError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, q)
+
+	case strings.HasPrefix(rest, "quotes/") && r.Method == http.MethodGet:
+		id := strings.TrimPrefix(rest, "quotes/")
+		if !isUUID(id) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		q, err := loadQuote(ctx, st.db, id)
+		if err == nil && !caller.mayActFor(q.UserID) {
+			err = errQuoteNotFound
+		}
+		if err != nil {
+			writeFXError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, q)
+
+	case rest == "rates" && r.Method == http.MethodGet:
+		rates, err := st.fx.rates.Rates(ctx)
+		if err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"provider": st.fx.rates.Name(), "spread_bps": st.fx.spreadBps, "rates": rates})
+
+	case strings.HasPrefix(rest, "rates/") && r.Method == http.MethodPut:
+		if !caller.Operator {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		manual, ok := st.fx.rates.(manualRates)
+		if !ok {
+			writeFXError(w, errManualRatesOnly)
+			return
+		}
+		base, quote, err := parsePair(strings.TrimPrefix(rest, "rates/"), "/")
+		if err != nil {
+			writeFXError(w, err)
+			return
+		}
+		var body struct {
+			Rate string `json:"rate"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		rate, err := parseRate(body.Rate)
+		if err != nil {
+			writeFXError(w, err)
+			return
+		}
+		out, err := manual.set(ctx, base, quote, rate, caller.Subject)
+		if err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf(`{"msg":"fx rate set","pair":"%s/%s","rate":%q,"by":%q}`, base, quote, out.Rate, caller.Subject)
+		writeJSON(w, http.StatusOK, out)
+
+	case rest == "quotes" || rest == "rates" || strings.HasPrefix(rest, "quotes/") || strings.HasPrefix(rest, "rates/"):
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func writeFXError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errQuoteNotFound):
+		http.Error(w, "not found", http.StatusNotFound)
+	case errors.Is(err, errRateUnavailable), errors.Is(err, errInvalidAmount):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	case errors.Is(err, errInvalidRate), errors.Is(err, errUnknownCurrency):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, errManualRatesOnly):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, "db error", http.StatusInternalServerError)
+	}
+}
+
+const fxSchema = `
+	CREATE TABLE IF NOT EXISTS fx_rates (
+		base text NOT NULL,
+		quote text NOT NULL,
+		rate numeric(24, 8) NOT NULL CHECK (rate > 0),
+		updated_by text,
+		updated_at timestamptz NOT NULL DEFAULT now(),
+		PRIMARY KEY (base, quote)
+	);
+
+	CREATE TABLE IF NOT EXISTS fx_quotes (
+		id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+		user_id text NOT NULL,
+		source_currency text NOT NULL,
+		source_amount bigint NOT NULL CHECK (source_amount > 0),
+		target_currency text NOT NULL,
+		target_amount bigint NOT NULL CHECK (target_amount > 0),
+		fixed text NOT NULL,
+		rate numeric(24, 8) NOT NULL,
+		mid_rate numeric(24, 8) NOT NULL,
+		spread_bps int NOT NULL,
+		spread_amount bigint NOT NULL,
+		provider text NOT NULL,
+		status text NOT NULL,
+		payment_id uuid REFERENCES payments(id),
+		expires_at timestamptz NOT NULL,
+		created_at timestamptz NOT NULL DEFAULT now(),
+		used_at timestamptz
+	);
+
+	CREATE INDEX IF NOT EXISTS fx_quotes_user_idx ON fx_quotes(user_id, created_at);
+
+	ALTER TABLE payments ADD COLUMN IF NOT EXISTS fx_quote_id uuid REFERENCES fx_quotes(id);
+	ALTER TABLE payments ADD COLUMN IF NOT EXISTS target_currency text;
+	ALTER TABLE payments ADD COLUMN IF NOT EXISTS target_amount bigint;
+	ALTER TABLE payments ADD COLUMN IF NOT EXISTS fx_rate numeric(24, 8);
+	ALTER TABLE payments ADD COLUMN IF NOT EXISTS fx_mid_rate numeric(24, 8);
+
+	ALTER TABLE refunds ADD COLUMN IF NOT EXISTS reserved_amount bigint;
+	ALTER TABLE refunds ADD COLUMN IF NOT EXISTS reserved_currency text;
+
+	CREATE UNIQUE INDEX IF NOT EXISTS payments_fx_quote_uq ON payments(fx_quote_id) WHERE fx_quote_id IS NOT NULL;
+`
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func mustRate(t *testing.T, s string) *big.Rat {
+	t.Helper()
+	r, err := parseRate(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestParseRate(t *testing.T) {
+	if r := mustRate(t, "1.084212345"); formatRate(r) != "1.08421234" {
+		t.Fatalf("rate not rounded down to 8 places: %s", formatRate(r))
+	}
+	for _, bad := range []string{"", "0", "0.000000001", "-1.2", "1/3", "1e3", "1,08"} {
+		if _, err := parseRate(bad); !errors.Is(err, errInvalidRate) {
+			t.Fatalf("%q: got %v", bad, err)
+		}
+	}
+}
+
+func TestPriceQuoteRounding(t *testing.T) {
+	mid := mustRate(t, "1.0842")
+
+	q, err := priceQuote(quoteRequest{UserID: "u1", SourceCurrency: "EUR", TargetCurrency: "USD", SourceAmount: 100000}, mid, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 1.0842 less 0.5% is 1.078779; 1077.879 USD rounds down
+	if q.Rate != "1.07877900" || q.TargetAmount != 107877 || q.SpreadAmount != 543 || q.Fixed != fxFixedSource {
+		t.Fatalf("source fixed: %+v", q)
+	}
+
+	q, err = priceQuote(quoteRequest{UserID: "u1", SourceCurrency: "EUR", TargetCurrency: "USD", TargetAmount: 50000}, mid, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 500 USD needs 463.4866... EUR, rounded up
+	if q.SourceAmount != 46349 || q.TargetAmount != 50000 || q.SpreadAmount != 251 || q.Fixed != fxFixedTarget {
+		t.Fatalf("target fixed: %+v", q)
+	}
+
+	// currencies with different minor units
+	q, err = priceQuote(quoteRequest{UserID: "u1", SourceCurrency: "EUR", TargetCurrency: "JPY", SourceAmount: 1234}, mustRate(t, "162.5"), 0)
+	if err != nil || q.TargetAmount != 2005 || q.SpreadAmount != 0 || q.TargetAmountDecimal != "2005" {
+		t.Fatalf("EUR to JPY: %+v, %v", q, err)
+	}
+	q, err = priceQuote(quoteRequest{UserID: "u1", SourceCurrency: "JPY", TargetCurrency: "EUR", SourceAmount: 100}, invertRate(mustRate(t, "162.5")), 0)
+	if err != nil || q.Rate != "0.00615384" || q.TargetAmount != 61 {
+		t.Fatalf("JPY to EUR: %+v, %v", q, err)
+	}
+
+	if _, err := priceQuote(quoteRequest{UserID: "u1", SourceCurrency: "JPY", TargetCurrency: "EUR", SourceAmount: 1}, mustRate(t, "0.006"), 0); !errors.Is(err, errInvalidAmount) {
+		t.Fatalf("amount converting to nothing: got %v", err)
+	}
+}
+
+func TestQuoteRequestNormalize(t *testing.T) {
+	ok := quoteRequest{UserID: "u1", SourceCurrency: "eur", TargetCurrency: "usd", SourceAmountDecimal: "10.50"}
+	if err := ok.normalize(); err != nil || ok.SourceAmount != 1050 || ok.SourceCurrency != "EUR" {
+		t.Fatalf("got %+v, %v", ok, err)
+	}
+	for _, bad := range []quoteRequest{
+		{UserID: "u1", SourceCurrency: "EUR", TargetCurrency: "EUR", SourceAmount: 100},
+		{UserID: "u1", SourceCurrency: "EUR", TargetCurrency: "USD"},
+		{UserID: "u1", SourceCurrency: "EUR", TargetCurrency: "USD", SourceAmount: 100, TargetAmount: 100},
+		{UserID: "u1", SourceCurrency: "EUR", TargetCurrency: "XXX", SourceAmount: 100},
+	} {
+		if err := bad.normalize(); err == nil {
+			t.Fatalf("%+v accepted", bad)
+		}
+	}
+}
+
+func TestStaticRates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rates.json")
+	if err := os.WriteFile(path, []byte(`{"as_of": "2026-03-01T00:00:00Z", "rates": {"EUR/USD": "1.0842", "gbp/eur": "1.1650"}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := loadStaticRates(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, err := s.Rate(context.Background(), "GBP", "EUR"); err != nil || r.Rate != "1.16500000" {
+		t.Fatalf("GBP/EUR: %+v, %v", r, err)
+	}
+	// the opposite pair is derived
+	if r, err := s.Rate(context.Background(), "USD", "EUR"); err != nil || r.Rate != "0.92233905" {
+		t.Fatalf("USD/EUR: %+v, %v", r, err)
+	}
+	if _, err := s.Rate(context.Background(), "USD", "GBP"); !errors.Is(err, errRateUnavailable) {
+		t.Fatalf("USD/GBP: got %v", err)
+	}
+
+	for _, bad := range []string{
+		`{"rates": {"EUR/USD": "1.08"}}`,
+		`{"as_of": "2026-03-01T00:00:00Z", "rates": {"EURUSD": "1.08"}}`,
+		`{"as_of": "2026-03-01T00:00:00Z", "rates": {"EUR/USD": "-1"}}`,
+	} {
+		if err := os.WriteFile(path, []byte(bad), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadStaticRates(path); err == nil {
+			t.Fatalf("%s accepted", bad)
+		}
+	}
+}
+
+func TestFXLedgerEntries(t *testing.T) {
+	p := payment{ID: "p1", UserID: "u1", Amount: 100000, Currency: "EUR", Status: statusCaptured,
+		FX: &paymentFX{QuoteID: "q1", TargetCurrency: "USD", TargetAmount: 107877, Rate: "1.07877900", MidRate: "1.08420000"}}
+
+	balances := map[[2]string]int64{}
+	post := func(e *journalEntry) {
+		t.Helper()
+		if err := validateEntry(*e); err != nil {
+			t.Fatalf("%s: %v", e.Kind, err)
+		}
+		for _, l := range e.Lines {
+			balances[[2]string{l.Account, l.Currency}] += l.Amount
+		}
+	}
+
+	post(captureEntry(p, p.Amount))
+	if got := balances[[2]string{userAccount("u1"), "USD"}]; got != -107877 {
+		t.Fatalf("user credited %d USD, want the quoted 107877", got)
+	}
+	if got := balances[[2]string{accountFXRevenue, "USD"}]; got != -543 {
+		t.Fatalf("fx revenue %d, want 543", got)
+	}
+
+	// a pending refund holds back what it will take, in the target currency
+	if amount, cur := reversalDebit(p, 40000); amount != 43151 || cur != "USD" {
+		t.Fatalf("pending refund reserves %d %s, want 43151 USD", amount, cur)
+	}
+	post(refundEntry(p, refund{ID: "r1", Amount: 40000, Currency: "EUR"}))
+	if got := balances[[2]string{userAccount("u1"), "USD"}]; got != -107877+43151 {
+		t.Fatalf("refund took %d USD back", got+107877)
+	}
+	if balances[[2]string{accountProviderClearing, "EUR"}] != 60000 {
+		t.Fatalf("clearing %d EUR", balances[[2]string{accountProviderClearing, "EUR"}])
+	}
+
+	// a partial capture converts its own amount
+	e := captureEntry(p, 40000)
+	if err := validateEntry(*e); err != nil || e.Lines[3].Amount != -43151 || e.Lines[4].Amount != -217 {
+		t.Fatalf("partial capture: %+v, %v", e.Lines, err)
+	}
+}
@@ -0,0 +1,543 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Hold statuses. A hold is opened when a payment is authorized and closed
+// by its final capture, by the payment leaving "authorized" any other way,
+// or by the sweeper once it expires.
+const (
+	holdActive   = "active"
+	holdCaptured = "captured"
+	holdReleased = "released"
+	holdExpired  = "expired"
+)
+
+// What the sweeper does with an expired hold nothing was captured from.
+const (
+	holdExpiryVoid   = "void"
+	holdExpiryExpire = "expire"
+)
+
+const defaultHoldTTL = 7 * 24 * time.Hour
+
+var (
+	errHoldNotFound       = errors.New("hold not found")
+	errCaptureExceedsHold = errors.New("capture exceeds the held amount")
+)
+
+// paymentHold reserves an authorized amount until it is captured. Amount is
+// what was authorized and Captured what has been taken from it so far.
+type paymentHold struct {
+	PaymentID    string    `json:"payment_id"`
+	UserID       string    `json:"user_id"`
+	Currency     string    `json:"currency"`
+	Amount       int64     `json:"amount"`
+	Captured     int64     `json:"captured"`
+	Captures     int       `json:"captures"`
+	MultiCapture bool      `json:"multi_capture"`
+	Status       string    `json:"status"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+func (h paymentHold) remaining() int64 {
+	return h.Amount - h.Captured
+}
+
+// legacyHold stands in for the hold of a payment authorized before holds
+// were recorded: the whole amount, captured at once.
+func legacyHold(p payment) paymentHold {
+	return paymentHold{PaymentID: p.ID, UserID: p.UserID, Currency: p.Currency, Amount: p.Amount, Status: holdActive}
+}
+
+const holdColumns = `payment_id::text, user_id, currency, amount, captured, captures, multi_capture, status,
+	expires_at, created_at, updated_at`
+
+func scanHold(row rowScanner, h *paymentHold) error {
+	return row.Scan(&h.PaymentID, &h.UserID, &h.Currency, &h.Amount, &h.Captured, &h.Captures, &h.MultiCapture, &h.Status,
+		&h.ExpiresAt, &h.CreatedAt, &h.UpdatedAt)
+}
+
+// holdPolicy is read from the environment at startup. It applies to holds
+// opened afterwards; open holds keep the expiry and capture mode they were
+// given.
+type holdPolicy struct {
+	// how long an authorization stays capturable
+	TTL time.Duration
+	// whether a hold may be captured in several parts
+	MultiCapture bool
+	// void or expire
+	OnExpiry string
+}
+
+func holdPolicyFromEnv() (holdPolicy, error) {
+	p := holdPolicy{OnExpiry: getenv("HOLD_EXPIRY_ACTION", holdExpiryVoid)}
+	var err error
+	if p.TTL, err = time.ParseDuration(getenv("HOLD_TTL", defaultHoldTTL.String())); err != nil || p.TTL <= 0 {
+		return p, fmt.Errorf("HOLD_TTL must be a positive duration")
+	}
+	if v := os.Getenv("HOLD_MULTI_CAPTURE"); v != "" {
+		if p.MultiCapture, err = strconv.ParseBool(v); err != nil {
+			return p, fmt.Errorf("HOLD_MULTI_CAPTURE: %w", err)
+		}
+	}
+	if p.OnExpiry != holdExpiryVoid && p.OnExpiry != holdExpiryExpire {
+		return p, fmt.Errorf("HOLD_EXPIRY_ACTION must be %s or %s", holdExpiryVoid, holdExpiryExpire)
+	}
+	return p, nil
+}
+
+func (p holdPolicy) ttl() time.Duration {
+	if p.TTL <= 0 {
+		return defaultHoldTTL
+	}
+	return p.TTL
+}
+
+// planCapture decides what a capture takes from h. A zero amount captures
+// whatever is left, except that final with a zero amount closes a partly
+// captured hold without taking more. A capture is final, releasing the
+// rest, unless the hold allows several captures, the request did not ask
+// for final and something is left over.
+func planCapture(h paymentHold, amount int64, final bool) (captureRequest, error) {
+	step := captureRequest{
+		ID:       h.PaymentID + "/" + strconv.Itoa(h.Captures+1),
+		Currency: h.Currency,
+	}
+	remaining := h.remaining()
+	if amount < 0 {
+		return step, fmt.Errorf("%w: capture amount must not be negative", errInvalidAmount)
+	}
+	if amount == 0 && final && h.Captured > 0 {
+		step.Final = true
+		return step, nil
+	}
+	if amount == 0 {
+		amount = remaining
+	}
+	if amount <= 0 || amount > remaining {
+		return step, fmt.Errorf("%w: %d remaining of %d", errCaptureExceedsHold, remaining, h.Amount)
+	}
+	step.Amount = amount
+	step.Final = final || !h.MultiCapture || amount == remaining
+	return step, nil
+}
+
+// captureAmount reads the amount a capture request asks for.
+func captureAmount(req transitionRequest, currency string) (int64, error) {
+	if req.AmountDecimal == "" {
+		return req.Amount, nil
+	}
+	cur, err := lookupCurrency(currency)
+	if err != nil {
+		return 0, err
+	}
+	return cur.resolveAmount(req.Amount, req.AmountDecimal)
+}
+
+// capturePayment captures all or part of an authorized payment's hold,
+// through the provider when the payment was authorized with one. A final
+// capture moves the payment to "captured"; a partial one on a
+// multi-capture hold leaves it authorized.
+func (st *appState) capturePayment(ctx context.Context, id string, req transitionRequest) (payment, error) {
+	p, err := st.loadPayment(ctx, id)
+	if err != nil {
+		return p, err
+	}
+	if req.ExpectedVersion != 0 && p.Version != req.ExpectedVersion {
+		return p, errVersionConflict
+	}
+	if p.Status != statusAuthorized {
+		return p, fmt.Errorf("%w: %s -> %s", errInvalidTransition, p.Status, statusCaptured)
+	}
+	h, err := loadHold(ctx, st.db, id)
+	if errors.Is(err, errHoldNotFound) {
+		h = legacyHold(p)
+	} else if err != nil {
+		return p, err
+	}
+	amount, err := captureAmount(req, p.Currency)
+	if err != nil {
+		return p, err
+	}
+	step, err := planCapture(h, amount, req.Final)
+	if err != nil {
+		return p, err
+	}
+
+	var res *providerResult
+	if st.provider != nil && p.ProviderRef != "" {
+		r, err := st.provider.Capture(ctx, p.ProviderRef, step)
+		if err != nil {
+			log.Printf(`{"msg":"provider call failed","payment_id":%q,"action":"capture","error":%q}`, id, err.Error())
+			return p, providerCallError(err)
+		}
+		if r.Outcome == providerDeclined {
+			if err := saveProviderResult(ctx, st.db, id, st.provider.Name(), r, &p); err != nil {
+				return p, err
+			}
+			return p, fmt.Errorf("%w: %s", errProviderDeclined, declineReason(r))
+		}
+		res = &r
+	}
+	if !step.Final {
+		return st.applyPartialCapture(ctx, id, p.Version, step, req.Reason, res)
+	}
+	return st.applyProviderTransition(ctx, id, statusCaptured, req.Reason, p.Version, res, &step)
+}
+
+// applyPartialCapture records a non-final capture: the captured amount
+// moves to the user in the ledger, and the payment stays authorized with
+// the rest still held.
+func (st *appState) applyPartialCapture(ctx context.Context, id string, expectedVersion int64, step captureRequest, reason string, res *providerResult) (payment, error) {
+	var p payment
+
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return p, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	h, err := lockHold(ctx, tx, id)
+	if err != nil {
+		return p, err
+	}
+	if h.Status != holdActive || step.Amount > h.remaining() {
+		return p, errVersionConflict
+	}
+	err = scanPayment(tx.QueryRowContext(ctx, `
+		UPDATE payments
+		SET captured_amount = captured_amount + $3, version = version + 1, updated_at = now()
+		WHERE id = $1::uuid AND version = $2 AND status = $4
+		RETURNING `+paymentColumns,
+		id, expectedVersion, step.Amount, statusAuthorized), &p)
+	if errors.Is(err, sql.ErrNoRows) {
+		return p, errVersionConflict
+	}
+	if err != nil {
+		return p, err
+	}
+	if res != nil {
+		if err := saveProviderResult(ctx, tx, id, st.provider.Name(), *res, &p); err != nil {
+			return p, err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE payment_holds
+		SET captured = captured + $2, captures = captures + 1, updated_at = now()
+		WHERE payment_id = $1::uuid
+	`, id, step.Amount); err != nil {
+		return p, err
+	}
+
+	if reason == "" {
+		reason = "partial capture of " + formatAmount(step.Amount, p.Currency)
+	}
+	if err := recordPaymentEvent(ctx, tx, id, statusAuthorized, statusAuthorized, reason); err != nil {
+		return p, err
+	}
+	if err := postEntry(ctx, tx, captureEntry(p, step.Amount)); err != nil {
+		return p, err
+	}
+	if err := enqueueEvent(ctx, tx, id, p.UserID, "payment.partially_captured", p); err != nil {
+		return p, err
+	}
+	return p, tx.Commit()
+}
+
+// captureStep is what the final capture of p takes, read under the hold's
+// row lock. A nil planned step captures whatever is left, as when a bank
+// status report or an operator confirms the capture.
+func captureStep(ctx context.Context, tx *sql.Tx, p payment, planned *captureRequest) (captureRequest, error) {
+	h, err := lockHold(ctx, tx, p.ID)
+	if errors.Is(err, errHoldNotFound) {
+		h = legacyHold(p)
+	} else if err != nil {
+		return captureRequest{}, err
+	}
+	if planned == nil {
+		return planCapture(h, 0, true)
+	}
+	if h.Status != holdActive || planned.Amount > h.remaining() {
+		return *planned, errVersionConflict
+	}
+	return *planned, nil
+}
+
+// updateHold keeps the hold in step with a payment moving from one status
+// to another within the transaction that moves it.
+func (st *appState) updateHold(ctx context.Context, tx *sql.Tx, p payment, from, to string, step captureRequest) error {
+	var err error
+	switch {
+	case to == statusAuthorized:
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO payment_holds(payment_id, user_id, currency, amount, multi_capture, status, expires_at)
+			VALUES ($1::uuid, $2, $3, $4, $5, $6, now() + make_interval(secs => $7))
+			ON CONFLICT (payment_id) DO NOTHING
+		`, p.ID, p.UserID, p.Currency, p.Amount, st.holds.MultiCapture, holdActive, st.holds.ttl().Seconds())
+	case to == statusCaptured:
+		captures := 0
+		if step.Amount > 0 {
+			captures = 1
+		}
+		_, err = tx.ExecContext(ctx, `
+			UPDATE payment_holds
+			SET captured = captured + $2, captures = captures + $3, status = $4, updated_at = now()
+			WHERE payment_id = $1::uuid AND status = $5
+		`, p.ID, step.Amount, captures, holdCaptured, holdActive)
+	case from == statusAuthorized:
+		status := holdReleased
+		if to == statusExpired {
+			status = holdExpired
+		}
+		_, err = tx.ExecContext(ctx, `
+			UPDATE payment_holds SET status = $2, updated_at = now()
+			WHERE payment_id = $1::uuid AND status = $3
+		`, p.ID, status, holdActive)
+	}
+	return err
+}
+
+func loadHold(ctx context.Context, q rowQuerier, paymentID string) (paymentHold, error) {
+	var h paymentHold
+	err := scanHold(q.QueryRowContext(ctx, `
+		SELECT `+holdColumns+` FROM payment_holds WHERE payment_id = $1::uuid
+	`, paymentID), &h)
+	if errors.Is(err, sql.ErrNoRows) {
+		return h, errHoldNotFound
+	}
+	return h, err
+}
+
+func lockHold(ctx context.Context, tx *sql.Tx, paymentID string) (paymentHold, error) {
+	var h paymentHold
+	err := scanHold(tx.QueryRowContext(ctx, `
+		SELECT `+holdColumns+` FROM payment_holds WHERE payment_id = $1::uuid FOR UPDATE
+	`, paymentID), &h)
+	if errors.Is(err, sql.ErrNoRows) {
+		return h, errHoldNotFound
+	}
+	return h, err
+}
+
+// sweepHolds closes holds that are past their expiry. A hold something was
+// captured from is finalized at what was captured; otherwise the
+// authorization is voided, or the payment expired, as the policy says.
+func (st *appState) sweepHolds(ctx context.Context, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		qctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		holds, err := st.expiredHolds(qctx)
+		cancel()
+		if err != nil {
+			log.Printf(`{"msg":"hold sweep query failed","error":%q}`, err.Error())
+			continue
+		}
+		for _, h := range holds {
+			sctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			err := st.expireHold(sctx, h)
+			cancel()
+			// losing a race to a capture or cancel is expected
+			if err != nil && !errors.Is(err, errInvalidTransition) && !errors.Is(err, errVersionConflict) {
+				log.Printf(`{"msg":"hold expiry failed","payment_id":%q,"error":%q}`, h.PaymentID, err.Error())
+			}
+		}
+	}
+}
+
+func (st *appState) expireHold(ctx context.Context, h paymentHold) error {
+	const reason = "authorization hold expired"
+	var err error
+	switch {
+	case h.Captured > 0:
+		_, err = st.capturePayment(ctx, h.PaymentID, transitionRequest{Reason: reason, Final: true})
+	case st.holds.OnExpiry == holdExpiryExpire:
+		_, err = st.applyTransition(ctx, h.PaymentID, statusExpired, reason, 0)
+	case st.provider != nil:
+		_, err = st.providerTransition(ctx, h.PaymentID, "cancel", transitionRequest{Reason: reason})
+	default:
+		_, err = st.applyTransition(ctx, h.PaymentID, statusCanceled, reason, 0)
+	}
+	if err == nil {
+		log.Printf(`{"msg":"authorization hold expired","payment_id":%q,"captured":%d,"amount":%d}`, h.PaymentID, h.Captured, h.Amount)
+	}
+	return err
+}
+
+func (st *appState) expiredHolds(ctx context.Context) ([]paymentHold, error) {
+	rows, err := st.db.QueryContext(ctx, `
+		SELECT `+holdColumns+`
+		FROM payment_holds
+		WHERE status = $1 AND expires_at <= now()
+		ORDER BY expires_at
+		LIMIT 100
+	`, holdActive)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []paymentHold
+	for rows.Next() {
+		var h paymentHold
+		if err := scanHold(rows, &h); err != nil {
+			return nil, err
+		}
+		out = append(out, h)
+	}
+	return out, rows.Err()
+}
+
+// userBalance is a user's position in one currency. The ledger balance
+// is what captures have credited them, net of refunds. Held is authorized
+// and not yet captured: it is not in the ledger and not available. Refunds
+// still pending with the provider, and what undecided disputes would take
+// back if lost, are taken off what is available.
+type userBalance struct {
+	Currency              string `json:"currency"`
+	LedgerBalance         int64  `json:"ledger_balance"`
+	LedgerBalanceDecimal  string `json:"ledger_balance_decimal,omitempty"`
+	Held                  int64  `json:"held"`
+	HeldDecimal           string `json:"held_decimal,omitempty"`
+	PendingRefunds        int64  `json:"pending_refunds"`
+	PendingRefundsDecimal string `json:"pending_refunds_decimal,omitempty"`
+	Disputed              int64  `json:"disputed"`
+	DisputedDecimal       string `json:"disputed_decimal,omitempty"`
+	Available             int64  `json:"available"`
+	AvailableDecimal      string `json:"available_decimal,omitempty"`
+}
+
+func (b *userBalance) finish() {
+	b.Available = b.LedgerBalance - b.PendingRefunds - b.Disputed
+	b.LedgerBalanceDecimal = formatAmount(b.LedgerBalance, b.Currency)
+	b.HeldDecimal = formatAmount(b.Held, b.Currency)
+	b.PendingRefundsDecimal = formatAmount(b.PendingRefunds, b.Currency)
+	b.DisputedDecimal = formatAmount(b.Disputed, b.Currency)
+	b.AvailableDecimal = formatAmount(b.Available, b.Currency)
+}
+
+// handleBalances serves GET /v1/balances/{user_id}?currency=.
+func (st *appState) handleBalances(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := strings.TrimSpace(strings.TrimPrefix(r.URL.Path, "/v1/balances/"))
+	if userID == "" || strings.Contains(userID, "/") {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if !callerFrom(r.Context()).mayActFor(userID) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	currency := strings.ToUpper(strings.TrimSpace(r.URL.Query().Get("currency")))
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	out, err := userBalances(ctx, st.db, userID, currency)
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// userBalances reads the balances of userID in every currency it has a
+// ledger account, hold, pending refund or open dispute in, or only in
+// currency.
+func userBalances(ctx context.Context, q querier, userID, currency string) ([]userBalance, error) {
+	rows, err := q.QueryContext(ctx, `
+		WITH ledger AS (
+			SELECT a.currency, -COALESCE(SUM(lp.amount), 0) AS amount
+			FROM ledger_accounts a
+			LEFT JOIN ledger_postings lp ON lp.account_id = a.id
+			WHERE a.code = $2
+			GROUP BY a.currency
+		), held AS (
+			SELECT currency, SUM(amount - captured) AS amount
+			FROM payment_holds
+			WHERE user_id = $1 AND status = $4
+			GROUP BY currency
+		), refunding AS (
+			SELECT COALESCE(r.reserved_currency, r.currency) AS currency, SUM(COALESCE(r.reserved_amount, r.amount)) AS amount
+			FROM refunds r JOIN payments p ON p.id = r.payment_id
+			WHERE p.user_id = $1 AND r.status = $5
+			GROUP BY 1
+		), disputed AS (
+			SELECT reserved_currency AS currency, SUM(reserved_amount) AS amount
+			FROM disputes
+			WHERE user_id = $1 AND status IN ($6, $7, $8)
+			GROUP BY reserved_currency
+		), currencies AS (
+			SELECT currency FROM ledger UNION SELECT currency FROM held UNION SELECT currency FROM refunding
+			UNION SELECT currency FROM disputed
+		)
+		SELECT c.currency, COALESCE(l.amount, 0), COALESCE(h.amount, 0), COALESCE(rf.amount, 0), COALESCE(d.amount, 0)
+		FROM currencies c
+		LEFT JOIN ledger l ON l.currency = c.currency
+		LEFT JOIN held h ON h.currency = c.currency
+		LEFT JOIN refunding rf ON rf.currency = c.currency
+		LEFT JOIN disputed d ON d.currency = c.currency
+		WHERE $3 = '' OR c.currency = $3
+		ORDER BY c.currency
+	`, userID, userAccount(userID), currency, holdActive, refundPending, disputeOpened, disputeEvidenceRequired, disputeSubmitted)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []userBalance{}
+	for rows.Next() {
+		var b userBalance
+		if err := rows.Scan(&b.Currency, &b.LedgerBalance, &b.Held, &b.PendingRefunds, &b.Disputed); err != nil {
+			return nil, err
+		}
+		b.finish()
+		out = append(out, b)
+	}
+	return out, rows.Err()
+}
+
+const holdsSchema = `
+	ALTER TABLE payments ADD COLUMN IF NOT EXISTS captured_amount bigint NOT NULL DEFAULT 0;
+	UPDATE payments SET captured_amount = amount
+	WHERE captured_amount = 0 AND status IN ('captured', 'settled');
+
+	CREATE TABLE IF NOT EXISTS payment_holds (
+		payment_id uuid PRIMARY KEY REFERENCES payments(id),
+		user_id text NOT NULL,
+		currency text NOT NULL,
+		amount bigint NOT NULL CHECK (amount > 0),
+		captured bigint NOT NULL DEFAULT 0 CHECK (captured >= 0 AND captured <= amount),
+		captures int NOT NULL DEFAULT 0,
+		multi_capture boolean NOT NULL DEFAULT false,
+		status text NOT NULL,
+		expires_at timestamptz NOT NULL,
+		created_at timestamptz NOT NULL DEFAULT now(),
+		updated_at timestamptz NOT NULL DEFAULT now()
+	);
+
+	CREATE INDEX IF NOT EXISTS payment_holds_expiry_idx ON payment_holds(expires_at) WHERE status = 'active';
+	CREATE INDEX IF NOT EXISTS payment_holds_user_idx ON payment_holds(user_id, currency) WHERE status = 'active';
+`
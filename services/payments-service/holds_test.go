@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestPlanCapture(t *testing.T) {
+	single := paymentHold{PaymentID: "p1", Currency: "EUR", Amount: 1000}
+	multi := paymentHold{PaymentID: "p1", Currency: "EUR", Amount: 1000, Captured: 400, Captures: 1, MultiCapture: true}
+
+	for _, c := range []struct {
+		name   string
+		h      paymentHold
+		amount int64
+		final  bool
+		want   captureRequest
+		err    error
+	}{
+		{"whole hold", single, 0, false, captureRequest{ID: "p1/1", Amount: 1000, Currency: "EUR", Final: true}, nil},
+		{"partial releases the rest", single, 600, false, captureRequest{ID: "p1/1", Amount: 600, Currency: "EUR", Final: true}, nil},
+		{"over the hold", single, 1001, false, captureRequest{}, errCaptureExceedsHold},
+		{"negative", single, -1, false, captureRequest{}, errInvalidAmount},
+		{"another part", multi, 300, false, captureRequest{ID: "p1/2", Amount: 300, Currency: "EUR"}, nil},
+		{"last part", multi, 300, true, captureRequest{ID: "p1/2", Amount: 300, Currency: "EUR", Final: true}, nil},
+		{"what is left", multi, 0, false, captureRequest{ID: "p1/2", Amount: 600, Currency: "EUR", Final: true}, nil},
+		{"close without more", multi, 0, true, captureRequest{ID: "p1/2", Currency: "EUR", Final: true}, nil},
+		{"over what is left", multi, 700, false, captureRequest{}, errCaptureExceedsHold},
+	} {
+		got, err := planCapture(c.h, c.amount, c.final)
+		if c.err != nil {
+			if !errors.Is(err, c.err) {
+				t.Fatalf("%s: got %v, want %v", c.name, err, c.err)
+			}
+			continue
+		}
+		if err != nil || got != c.want {
+			t.Fatalf("%s: got %+v, %v", c.name, got, err)
+		}
+	}
+}
+
+func TestHoldPolicyFromEnv(t *testing.T) {
+	t.Setenv("HOLD_TTL", "")
+	t.Setenv("HOLD_MULTI_CAPTURE", "")
+	t.Setenv("HOLD_EXPIRY_ACTION", "")
+	p, err := holdPolicyFromEnv()
+	if err != nil || p.TTL != defaultHoldTTL || p.MultiCapture || p.OnExpiry != holdExpiryVoid {
+		t.Fatalf("defaults: %+v, %v", p, err)
+	}
+
+	t.Setenv("HOLD_TTL", "72h")
+	t.Setenv("HOLD_MULTI_CAPTURE", "true")
+	t.Setenv("HOLD_EXPIRY_ACTION", "expire")
+	if p, err := holdPolicyFromEnv(); err != nil || p.TTL.Hours() != 72 || !p.MultiCapture || p.OnExpiry != holdExpiryExpire {
+		t.Fatalf("configured: %+v, %v", p, err)
+	}
+
+	for k, v := range map[string]string{"HOLD_TTL": "-1h", "HOLD_MULTI_CAPTURE": "sometimes", "HOLD_EXPIRY_ACTION": "capture"} {
+		t.Run(k, func(t *testing.T) {
+			t.Setenv(k, v)
+			if _, err := holdPolicyFromEnv(); err == nil {
+				t.Fatalf("%s=%s accepted", k, v)
+			}
+		})
+	}
+}
+
+func TestSimulatorMultiCapture(t *testing.T) {
+	s := newSimulatorProvider(0)
+	ctx := context.Background()
+	res, _ := s.Authorize(ctx, authorizeRequest{PaymentID: "p1", Amount: 1000, Currency: "EUR"})
+
+	if r, _ := s.Capture(ctx, res.Ref, captureRequest{ID: "p1/1", Amount: 400, Currency: "EUR"}); r.Outcome != providerApproved {
+		t.Fatalf("first capture: %+v", r)
+	}
+	// a retried capture is not taken twice
+	_, _ = s.Capture(ctx, res.Ref, captureRequest{ID: "p1/1", Amount: 400, Currency: "EUR"})
+	if r, _ := s.Capture(ctx, res.Ref, captureRequest{ID: "p1/2", Amount: 700, Currency: "EUR"}); r.Outcome != providerDeclined {
+		t.Fatalf("capture beyond the authorization: %+v", r)
+	}
+	if r, _ := s.Status(ctx, res.Ref); r.Outcome != providerApproved {
+		t.Fatalf("partly captured payment should stay authorized, got %+v", r)
+	}
+	if r, _ := s.Capture(ctx, res.Ref, captureRequest{ID: "p1/2", Amount: 200, Currency: "EUR", Final: true}); r.Outcome != providerApproved {
+		t.Fatalf("final capture: %+v", r)
+	}
+	if r, _ := s.Refund(ctx, res.Ref, "r1", 700, "EUR"); r.Outcome != providerDeclined {
+		t.Fatalf("refund beyond the 600 captured should decline, got %+v", r)
+	}
+	if r, _ := s.Void(ctx, res.Ref); r.Outcome != providerDeclined {
+		t.Fatalf("void after final capture should decline, got %+v", r)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The api-gateway verifies the caller's JWT and forwards who they are in
+// these headers, signed with the secret shared through
+// GATEWAY_IDENTITY_SECRET. See services/api-gateway/cmd/api-gateway/identity.go.
+const (
+	headerAuthSubject   = "X-Auth-Subject"
+	headerAuthRoles     = "X-Auth-Roles"
+	headerAuthTimestamp = "X-Auth-Timestamp"
+	headerAuthSignature = "X-Auth-Signature"
+)
+
+// principal is the authenticated caller. Subject is the auth-service user
+// id, which is what payments store as user_id.
+type principal struct {
+	Subject  string
+	Roles    []string
+	Operator bool
+}
+
+// mayActFor reports whether the caller may read or create payments of
+// userID: their own, or anyone's for operators.
+func (p principal) mayActFor(userID string) bool {
+	return p.Operator || (p.Subject != "" && p.Subject == userID)
+}
+
+type ctxKeyPrincipal struct{}
+
+// callerFrom returns the principal set by authenticate. Handlers only run
+// behind it, so a missing principal means a handler was wired without it;
+// it gets no rights.
+func callerFrom(ctx context.Context) principal {
+	p, _ := ctx.Value(ctxKeyPrincipal{}).(principal)
+	return p
+}
+
+var errUnauthenticated = errors.New("unauthenticated")
+
+// identityVerifier checks the gateway's identity headers.
+type identityVerifier struct {
+	secret        []byte
+	operatorRoles map[string]bool
+	maxSkew       time.Duration
+	now           func() time.Time
+}
+
+// identityVerifierFromEnv reads GATEWAY_IDENTITY_SECRET and OPERATOR_ROLES.
+// Without a secret it returns nil, which disables authentication; that is
+// only accepted in the dev environment.
+func identityVerifierFromEnv(env string) (*identityVerifier, error) {
+	secret := getenv("GATEWAY_IDENTITY_SECRET", "")
+	if secret == "" {
+		if env != "dev" {
+			return nil, fmt.Errorf("GATEWAY_IDENTITY_SECRET is required outside dev")
+		}
+		log.Printf(`{"msg":"GATEWAY_IDENTITY_SECRET not set, every caller is treated as an operator"}`)
+		return nil, nil
+	}
+	return newIdentityVerifier([]byte(secret), getenv("OPERATOR_ROLES", "operator,admin")), nil
+}
+
+func newIdentityVerifier(secret []byte, operatorRoles string) *identityVerifier {
+	v := &identityVerifier{secret: secret, operatorRoles: map[string]bool{}, maxSkew: 5 * time.Minute, now: time.Now}
+	for _, r := range strings.Split(operatorRoles, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			v.operatorRoles[r] = true
+		}
+	}
+	return v
+}
+
+func (v *identityVerifier) verify(r *http.Request) (principal, error) {
+	sub := r.Header.Get(headerAuthSubject)
+	roles := r.Header.Get(headerAuthRoles)
+	ts := r.Header.Get(headerAuthTimestamp)
+	sig := r.Header.Get(headerAuthSignature)
+	if sub == "" || ts == "" || sig == "" {
+		return principal{}, errUnauthenticated
+	}
+
+	secs, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return principal{}, errUnauthenticated
+	}
+	if d := v.now().Sub(time.Unix(secs, 0)); d > v.maxSkew || d < -v.maxSkew {
+		return principal{}, errUnauthenticated
+	}
+
+	mac := hmac.New(sha256.New, v.secret)
+	mac.Write([]byte(strings.Join([]string{"v1", ts, r.Method, r.URL.Path, sub, roles}, "\n")))
+	want := hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(sig), []byte(want)) {
+		return principal{}, errUnauthenticated
+	}
+
+	p := principal{Subject: sub}
+	if roles != "" {
+		p.Roles = strings.Split(roles, ",")
+	}
+	for _, role := range p.Roles {
+		if v.operatorRoles[role] {
+			p.Operator = true
+		}
+	}
+	return p, nil
+}
+
+// authenticate puts the caller's principal on the request context, or
+// answers 401. With authentication disabled the caller is an operator.
+func (st *appState) authenticate(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := principal{Operator: true}
+		if st.identity != nil {
+			var err error
+			if p, err = st.identity.verify(r); err != nil {
+				http.Error(w, "unauthenticated", http.StatusUnauthorized)
+				return
+			}
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), ctxKeyPrincipal{}, p)))
+	}
+}
+
+// requireOperator is authenticate for endpoints only operators may use.
+func (st *appState) requireOperator(next http.HandlerFunc) http.HandlerFunc {
+	return st.authenticate(func(w http.ResponseWriter, r *http.Request) {
+		if !callerFrom(r.Context()).Operator {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// authorizePayment answers 404 unless the caller may see payment id, so
+// other users' payment ids cannot be probed. id must already be a UUID.
+func (st *appState) authorizePayment(ctx context.Context, w http.ResponseWriter, id string) bool {
+	caller := callerFrom(ctx)
+	if caller.Operator {
+		return true
+	}
+	var owner string
+	err := st.db.QueryRowContext(ctx, `SELECT user_id FROM payments WHERE id = $1::uuid`, id).Scan(&owner)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return false
+	}
+	if err != nil || !caller.mayActFor(owner) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// operatorOnlyPaymentAction reports whether the sub-path of
+// /v1/payments/{id}/ records an outcome only the platform may decide:
+// settlement, failure, expiry and the result of a refund. Without a
+// provider (viaProvider false) nothing confirms that funds were collected,
+// so authorize and capture are operator only too. Owners may still cancel,
+// sync and request refunds.
+func operatorOnlyPaymentAction(sub string, viaProvider bool) bool {
+	switch sub {
+	case "settle", "fail", "expire":
+		return true
+	case "authorize", "capture":
+		return !viaProvider
+	}
+	rest, isRefund := strings.CutPrefix(sub, "refunds/")
+	return isRefund && rest != ""
+}
+
+// isUUID reports whether s is a UUID in its canonical textual form.
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i, c := range s {
+		switch {
+		case i == 8 || i == 13 || i == 18 || i == 23:
+			if c != '-' {
+				return false
+			}
+		case !strings.ContainsRune("0123456789abcdefABCDEF", c):
+			return false
+		}
+	}
+	return true
+}
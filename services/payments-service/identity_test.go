@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testIdentitySecret = []byte("gateway-secret")
+
+// signedRequest builds a request as the api-gateway would forward it.
+func signedRequest(method, path, body, sub, roles string, at time.Time) *http.Request {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	ts := strconv.FormatInt(at.Unix(), 10)
+	mac := hmac.New(sha256.New, testIdentitySecret)
+	mac.Write([]byte(strings.Join([]string{"v1", ts, method, r.URL.Path, sub, roles}, "\n")))
+	r.Header.Set(headerAuthSubject, sub)
+	r.Header.Set(headerAuthRoles, roles)
+	r.Header.Set(headerAuthTimestamp, ts)
+	r.Header.Set(headerAuthSignature, hex.EncodeToString(mac.Sum(nil)))
+	return r
+}
+
+func TestIdentityVerifier(t *testing.T) {
+	now := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	v := newIdentityVerifier(testIdentitySecret, "operator, admin")
+	v.now = func() time.Time { return now }
+
+	p, err := v.verify(signedRequest(http.MethodGet, "/v1/payments", "", "u1", "user", now))
+	if err != nil || p.Subject != "u1" || p.Operator {
+		t.Fatalf("user: %+v %v", p, err)
+	}
+	p, err = v.verify(signedRequest(http.MethodGet, "/v1/payments", "", "ops", "admin,user", now))
+	if err != nil || !p.Operator {
+		t.Fatalf("operator: %+v %v", p, err)
+	}
+
+	stale := signedRequest(http.MethodGet, "/v1/payments", "", "u1", "user", now.Add(-6*time.Minute))
+	tampered := signedRequest(http.MethodGet, "/v1/payments", "", "u1", "user", now)
+	tampered.Header.Set(headerAuthRoles, "operator")
+	moved := signedRequest(http.MethodGet, "/v1/payments", "", "u1", "user", now)
+	moved.URL.Path = "/v1/ledger/accounts"
+	for name, r := range map[string]*http.Request{
+		"stale": stale, "tampered": tampered, "other path": moved,
+		"unsigned": httptest.NewRequest(http.MethodGet, "/v1/payments", nil),
+	} {
+		if _, err := v.verify(r); err == nil {
+			t.Fatalf("%s request was accepted", name)
+		}
+	}
+}
+
+func TestIdentityVerifierFromEnvFailsClosed(t *testing.T) {
+	t.Setenv("GATEWAY_IDENTITY_SECRET", "")
+	for _, env := range []string{"prod", "staging", ""} {
+		if _, err := identityVerifierFromEnv(env); err == nil {
+			t.Fatalf("env %q: started without GATEWAY_IDENTITY_SECRET", env)
+		}
+	}
+	if v, err := identityVerifierFromEnv("dev"); err != nil || v != nil {
+		t.Fatalf("dev: %v %v", v, err)
+	}
+}
+
+func TestAuthenticationGuardsRoutes(t *testing.T) {
+	st := &appState{identity: newIdentityVerifier(testIdentitySecret, "operator")}
+	h := newTestMux(st, "payments-service", "test")
+	now := time.Now()
+
+	cases := []struct {
+		name string
+		req  *http.Request
+		want int
+	}{
+		{"no identity", httptest.NewRequest(http.MethodGet, "/v1/payments", nil), http.StatusUnauthorized},
+		{"user on operator route", signedRequest(http.MethodGet, "/v1/ledger/check", "", "u1", "user", now), http.StatusForbidden},
+		{"paying for someone else", signedRequest(http.MethodPost, "/v1/payments",
+			`{"user_id":"u2","amount":100,"currency":"EUR","ref":"r1"}`, "u1", "user", now), http.StatusForbidden},
+		{"user settles", signedRequest(http.MethodPost, "/v1/payments/3f1c2b9e-8a4d-4b7e-9c1a-2d3e4f5a6b7c/settle", "", "u1", "user", now),
+			http.StatusForbidden},
+		{"user completes a refund", signedRequest(http.MethodPost,
+			"/v1/payments/3f1c2b9e-8a4d-4b7e-9c1a-2d3e4f5a6b7c/refunds/9a8b7c6d-5e4f-4a3b-8c2d-1e0f9a8b7c6d/succeed", "", "u1", "user", now),
+			http.StatusForbidden},
+		{"user captures without a provider", signedRequest(http.MethodPost, "/v1/payments/3f1c2b9e-8a4d-4b7e-9c1a-2d3e4f5a6b7c/capture", "", "u1", "user", now),
+			http.StatusForbidden},
+		{"user authorizes without a provider", signedRequest(http.MethodPost, "/v1/payments/3f1c2b9e-8a4d-4b7e-9c1a-2d3e4f5a6b7c/authorize", "", "u1", "user", now),
+			http.StatusForbidden},
+		{"unknown payment id", signedRequest(http.MethodGet, "/v1/payments/not-a-uuid", "", "u1", "user", now), http.StatusNotFound},
+		{"operator with a malformed payment id", signedRequest(http.MethodPost, "/v1/payments/not-a-uuid/settle", "", "ops", "operator", now),
+			http.StatusNotFound},
+	}
+	for _, c := range cases {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, c.req)
+		if rr.Code != c.want {
+			t.Fatalf("%s: got %d, want %d (%s)", c.name, rr.Code, c.want, rr.Body.String())
+		}
+	}
+}
+
+func TestOperatorOnlyPaymentActions(t *testing.T) {
+	for sub, want := range map[string]bool{
+		"": false, "authorize": false, "capture": false, "cancel": false, "sync": false,
+		"refunds": false, "settle": true, "fail": true, "expire": true, "refunds/r1/succeed": true,
+	} {
+		if got := operatorOnlyPaymentAction(sub, true); got != want {
+			t.Fatalf("%q: got %v, want %v", sub, got, want)
+		}
+	}
+	for _, sub := range []string{"authorize", "capture"} {
+		if !operatorOnlyPaymentAction(sub, false) {
+			t.Fatalf("%q is open to owners without a provider", sub)
+		}
+	}
+}
@@ -0,0 +1,1176 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+)
+
+// Bank transfers are exchanged with partner banks as ISO 20022 messages:
+// authorized payments whose payment_method is "iban:<IBAN>" are exported
+// as a pain.001 credit transfer initiation, and the bank's pacs.002 or
+// pain.002 status reports move them on to captured, settled or failed.
+
+const pain001Namespace = "urn:iso:std:iso:20022:tech:xsd:pain.001.001.09"
+
+// ibanMethodPrefix marks a payment_method that is a bank account.
+const ibanMethodPrefix = "iban:"
+
+var (
+	errInvalidStatusReport = errors.New("invalid status report")
+	errNothingToExport     = errors.New("no authorized bank transfers to export")
+	errExportNotConfigured = errors.New("ISO 20022 export is not configured")
+)
+
+var bicPattern = regexp.MustCompile(`^[A-Z]{6}[A-Z2-9][A-NP-Z0-9]([A-Z0-9]{3})?$`)
+
+// normalizeIBAN strips spaces and upper-cases s, and checks its length,
+// country code and mod-97 check digits.
+func normalizeIBAN(s string) (string, error) {
+	iban := strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(s), " ", ""))
+	if len(iban) < 15 || len(iban) > 34 {
+		return "", fmt.Errorf("invalid IBAN %q", s)
+	}
+	for i, ch := range iban {
+		letter := ch >= 'A' && ch <= 'Z'
+		digit := ch >= '0' && ch <= '9'
+		if (i < 2 && !letter) || (i >= 2 && i < 4 && !digit) || (!letter && !digit) {
+			return "", fmt.Errorf("invalid IBAN %q", s)
+		}
+	}
+
+	// move the first four characters to the end, read letters as 10..35
+	// and take the number mod 97 a digit at a time
+	rem := 0
+	for _, ch := range iban[4:] + iban[:4] {
+		if ch >= 'A' {
+			rem = (rem*100 + int(ch-'A'+10)) % 97
+		} else {
+			rem = (rem*10 + int(ch-'0')) % 97
+		}
+	}
+	if rem != 1 {
+		return "", fmt.Errorf("invalid IBAN %q: check digits do not match", s)
+	}
+	return iban, nil
+}
+
+// normalizePaymentMethod validates the bank account of an "iban:" payment
+// method; other methods are passed to the provider as they are.
+func normalizePaymentMethod(method string) (string, error) {
+	if len(method) < len(ibanMethodPrefix) || !strings.EqualFold(method[:len(ibanMethodPrefix)], ibanMethodPrefix) {
+		return method, nil
+	}
+	iban, err := normalizeIBAN(method[len(ibanMethodPrefix):])
+	if err != nil {
+		return "", fmt.Errorf("payment_method: %w", err)
+	}
+	return ibanMethodPrefix + iban, nil
+}
+
+// isoDebtor is the platform's own account, debited by exported transfers.
+type isoDebtor struct {
+	Name string
+	IBAN string
+	BIC  string
+	// initiating party named in the group header; defaults to Name
+	InitiatingParty string
+}
+
+// isoDebtorFromEnv reads ISO20022_DEBTOR_NAME, ISO20022_DEBTOR_IBAN,
+// ISO20022_DEBTOR_BIC and ISO20022_INITIATING_PARTY. It returns nil when no
+// debtor account is configured, which disables the export.
+func isoDebtorFromEnv() (*isoDebtor, error) {
+	d := &isoDebtor{
+		Name:            strings.TrimSpace(os.Getenv("ISO20022_DEBTOR_NAME")),
+		BIC:             strings.ToUpper(strings.TrimSpace(os.Getenv("ISO20022_DEBTOR_BIC"))),
+		InitiatingParty: strings.TrimSpace(os.Getenv("ISO20022_INITIATING_PARTY")),
+	}
+	iban := os.Getenv("ISO20022_DEBTOR_IBAN")
+	if strings.TrimSpace(iban) == "" {
+		return nil, nil
+	}
+	var err error
+	if d.IBAN, err = normalizeIBAN(iban); err != nil {
+		return nil, fmt.Errorf("ISO20022_DEBTOR_IBAN: %w", err)
+	}
+	if d.Name == "" {
+		return nil, errors.New("ISO20022_DEBTOR_NAME is required with ISO20022_DEBTOR_IBAN")
+	}
+	if !bicPattern.MatchString(d.BIC) {
+		return nil, fmt.Errorf("ISO20022_DEBTOR_BIC %q is not a BIC", d.BIC)
+	}
+	if d.InitiatingParty == "" {
+		d.InitiatingParty = d.Name
+	}
+	return d, nil
+}
+
+// pain.001.001.09 document. Field order follows the schema's sequences.
+type pain001Document struct {
+	XMLName xml.Name          `xml:"urn:iso:std:iso:20022:tech:xsd:pain.001.001.09 Document"`
+	Init    pain001Initiation `xml:"CstmrCdtTrfInitn"`
+}
+
+type pain001Initiation struct {
+	GrpHdr pain001GroupHeader   `xml:"GrpHdr"`
+	PmtInf []pain001PaymentInfo `xml:"PmtInf"`
+}
+
+type pain001GroupHeader struct {
+	MsgId    string   `xml:"MsgId"`
+	CreDtTm  string   `xml:"CreDtTm"`
+	NbOfTxs  int      `xml:"NbOfTxs"`
+	CtrlSum  string   `xml:"CtrlSum"`
+	InitgPty isoParty `xml:"InitgPty"`
+}
+
+type pain001PaymentInfo struct {
+	PmtInfId    string          `xml:"PmtInfId"`
+	PmtMtd      string          `xml:"PmtMtd"`
+	NbOfTxs     int             `xml:"NbOfTxs"`
+	CtrlSum     string          `xml:"CtrlSum"`
+	PmtTpInf    *isoPaymentType `xml:"PmtTpInf,omitempty"`
+	ReqdExctnDt isoDate         `xml:"ReqdExctnDt"`
+	Dbtr        isoParty        `xml:"Dbtr"`
+	DbtrAcct    isoAccount      `xml:"DbtrAcct"`
+	DbtrAgt     isoAgent        `xml:"DbtrAgt"`
+	ChrgBr      string          `xml:"ChrgBr"`
+	CdtTrfTxInf []pain001Tx     `xml:"CdtTrfTxInf"`
+}
+
+type pain001Tx struct {
+	PmtId    isoPaymentID `xml:"PmtId"`
+	Amt      isoInstdAmt  `xml:"Amt"`
+	Cdtr     isoParty     `xml:"Cdtr"`
+	CdtrAcct isoAccount   `xml:"CdtrAcct"`
+	RmtInf   *isoRemit    `xml:"RmtInf,omitempty"`
+}
+
+type isoParty struct {
+	Nm string `xml:"Nm"`
+}
+
+type isoPaymentType struct {
+	SvcLvl struct {
+		Cd string `xml:"Cd"`
+	} `xml:"SvcLvl"`
+}
+
+type isoDate struct {
+	Dt string `xml:"Dt"`
+}
+
+type isoAccount struct {
+	Id struct {
+		IBAN string `xml:"IBAN"`
+	} `xml:"Id"`
+}
+
+type isoAgent struct {
+	FinInstnId struct {
+		BICFI string `xml:"BICFI"`
+	} `xml:"FinInstnId"`
+}
+
+type isoPaymentID struct {
+	InstrId    string `xml:"InstrId"`
+	EndToEndId string `xml:"EndToEndId"`
+}
+
+type isoInstdAmt struct {
+	InstdAmt isoAmount `xml:"InstdAmt"`
+}
+
+type isoAmount struct {
+	Ccy   string `xml:"Ccy,attr"`
+	Value string `xml:",chardata"`
+}
+
+type isoRemit struct {
+	Ustrd string `xml:"Ustrd"`
+}
+
+func newIBANAccount(iban string) isoAccount {
+	var a isoAccount
+	a.Id.IBAN = iban
+	return a
+}
+
+// endToEndID is the id a payment travels under: its uuid without dashes,
+// which fits the 35-character limit.
+func endToEndID(paymentID string) string {
+	return strings.ReplaceAll(paymentID, "-", "")
+}
+
+// truncateText cuts s to n characters, as ISO 20022 text fields are
+// limited in characters rather than bytes.
+func truncateText(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n])
+}
+
+// buildPain001 renders payments as one pain.001 message with a payment
+// information block per currency. EUR transfers are sent as SEPA credit
+// transfers with shared charges (SLEV); others with SHAR. Every payment
+// must have an iban: payment method.
+func buildPain001(d isoDebtor, msgID string, created time.Time, execDate time.Time, payments []payment) ([]byte, string, error) {
+	byCurrency := map[string][]payment{}
+	for _, p := range payments {
+		byCurrency[p.Currency] = append(byCurrency[p.Currency], p)
+	}
+	codes := make([]string, 0, len(byCurrency))
+	for c := range byCurrency {
+		codes = append(codes, c)
+	}
+	sort.Strings(codes)
+
+	doc := pain001Document{}
+	total := new(big.Rat)
+	for _, code := range codes {
+		cur, err := lookupCurrency(code)
+		if err != nil {
+			return nil, "", err
+		}
+		info := pain001PaymentInfo{
+			PmtInfId:    msgID + "-" + code,
+			PmtMtd:      "TRF",
+			NbOfTxs:     len(byCurrency[code]),
+			ReqdExctnDt: isoDate{Dt: execDate.Format("2006-01-02")},
+			Dbtr:        isoParty{Nm: truncateText(d.Name, 140)},
+			DbtrAcct:    newIBANAccount(d.IBAN),
+			ChrgBr:      "SHAR",
+		}
+		info.DbtrAgt.FinInstnId.BICFI = d.BIC
+		if code == "EUR" {
+			info.PmtTpInf = &isoPaymentType{}
+			info.PmtTpInf.SvcLvl.Cd = "SEPA"
+			info.ChrgBr = "SLEV"
+		}
+
+		var sum int64
+		for _, p := range byCurrency[code] {
+			if !strings.HasPrefix(p.PaymentMethod, ibanMethodPrefix) {
+				return nil, "", fmt.Errorf("payment %s is not a bank transfer", p.ID)
+			}
+			if p.Amount <= 0 {
+				return nil, "", fmt.Errorf("payment %s has no amount", p.ID)
+			}
+			tx := pain001Tx{
+				PmtId:    isoPaymentID{InstrId: endToEndID(p.ID), EndToEndId: endToEndID(p.ID)},
+				Amt:      isoInstdAmt{InstdAmt: isoAmount{Ccy: code, Value: formatMinorUnits(p.Amount, cur.Exponent)}},
+				Cdtr:     isoParty{Nm: truncateText(p.UserID, 140)},
+				CdtrAcct: newIBANAccount(strings.TrimPrefix(p.PaymentMethod, ibanMethodPrefix)),
+			}
+			if p.Ref != "" {
+				tx.RmtInf = &isoRemit{Ustrd: truncateText(p.Ref, 140)}
+			}
+			info.CdtTrfTxInf = append(info.CdtTrfTxInf, tx)
+			sum += p.Amount
+		}
+		info.CtrlSum = formatMinorUnits(sum, cur.Exponent)
+		total.Add(total, new(big.Rat).SetFrac64(sum, pow10(cur.Exponent)))
+		doc.Init.PmtInf = append(doc.Init.PmtInf, info)
+	}
+	if len(doc.Init.PmtInf) == 0 {
+		return nil, "", errNothingToExport
+	}
+
+	// the control sum adds amounts across currencies, as the schema defines
+	// it; keep as many decimals as the most precise currency needs
+	ctrlSum := strings.TrimRight(strings.TrimRight(total.FloatString(5), "0"), ".")
+	doc.Init.GrpHdr = pain001GroupHeader{
+		MsgId:    msgID,
+		CreDtTm:  created.UTC().Format("2006-01-02T15:04:05Z"),
+		NbOfTxs:  len(payments),
+		CtrlSum:  ctrlSum,
+		InitgPty: isoParty{Nm: truncateText(d.InitiatingParty, 140)},
+	}
+
+	out, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, "", err
+	}
+	return append([]byte(xml.Header), append(out, '\n')...), ctrlSum, nil
+}
+
+// Status reports. pacs.002 (FIToFIPmtStsRpt) lists transactions at the top
+// level; pain.002 (CstmrPmtStsRpt) nests them per payment information
+// block. Elements are matched by local name, so any message version works.
+type isoStatusDocument struct {
+	XMLName xml.Name
+	Pacs    *isoStatusBody `xml:"FIToFIPmtStsRpt"`
+	Pain    *isoStatusBody `xml:"CstmrPmtStsRpt"`
+}
+
+type isoStatusBody struct {
+	GrpHdr struct {
+		MsgId string `xml:"MsgId"`
+	} `xml:"GrpHdr"`
+	OrgnlGrpInfAndSts []struct {
+		OrgnlMsgId string      `xml:"OrgnlMsgId"`
+		GrpSts     string      `xml:"GrpSts"`
+		StsRsnInf  []isoReason `xml:"StsRsnInf"`
+	} `xml:"OrgnlGrpInfAndSts"`
+	OrgnlPmtInfAndSts []struct {
+		PmtInfSts   string        `xml:"PmtInfSts"`
+		StsRsnInf   []isoReason   `xml:"StsRsnInf"`
+		TxInfAndSts []isoTxStatus `xml:"TxInfAndSts"`
+	} `xml:"OrgnlPmtInfAndSts"`
+	TxInfAndSts []isoTxStatus `xml:"TxInfAndSts"`
+}
+
+type isoTxStatus struct {
+	OrgnlGrpInf struct {
+		OrgnlMsgId string `xml:"OrgnlMsgId"`
+	} `xml:"OrgnlGrpInf"`
+	OrgnlEndToEndId string      `xml:"OrgnlEndToEndId"`
+	TxSts           string      `xml:"TxSts"`
+	StsRsnInf       []isoReason `xml:"StsRsnInf"`
+	OrgnlTxRef      struct {
+		IntrBkSttlmAmt *isoAmount `xml:"IntrBkSttlmAmt"`
+		Amt            struct {
+			InstdAmt *isoAmount `xml:"InstdAmt"`
+		} `xml:"Amt"`
+	} `xml:"OrgnlTxRef"`
+}
+
+type isoReason struct {
+	Rsn struct {
+		Cd    string `xml:"Cd"`
+		Prtry string `xml:"Prtry"`
+	} `xml:"Rsn"`
+	AddtlInf []string `xml:"AddtlInf"`
+}
+
+func reasonText(rs []isoReason) string {
+	var parts []string
+	for _, r := range rs {
+		s := r.Rsn.Cd
+		if s == "" {
+			s = r.Rsn.Prtry
+		}
+		if len(r.AddtlInf) > 0 {
+			s = strings.TrimSpace(s + " " + strings.Join(r.AddtlInf, " "))
+		}
+		if s != "" {
+			parts = append(parts, s)
+		}
+	}
+	return strings.Join(parts, "; ")
+}
+
+// statusReport is a parsed pacs.002 or pain.002.
+type statusReport struct {
+	MsgID  string
+	Kind   string
+	Groups []groupStatus
+	Txs    []txStatus
+}
+
+// groupStatus is the status of a whole original message. It applies to
+// the message's transactions that the report does not list.
+type groupStatus struct {
+	OrgnlMsgID string
+	Status     string
+	Reason     string
+}
+
+type txStatus struct {
+	OrgnlMsgID string
+	EndToEndID string
+	Status     string
+	Reason     string
+	// amount the bank reports for the transaction, if any
+	Amount *isoAmount
+}
+
+func parseStatusReport(r io.Reader) (statusReport, error) {
+	var doc isoStatusDocument
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return statusReport{}, fmt.Errorf("%w: %v", errInvalidStatusReport, err)
+	}
+	rep := statusReport{Kind: "pacs.002"}
+	body := doc.Pacs
+	if body == nil {
+		rep.Kind, body = "pain.002", doc.Pain
+	}
+	if doc.XMLName.Local != "Document" || body == nil {
+		return rep, fmt.Errorf("%w: want a pacs.002 or pain.002 Document", errInvalidStatusReport)
+	}
+	rep.MsgID = strings.TrimSpace(body.GrpHdr.MsgId)
+	if rep.MsgID == "" {
+		return rep, fmt.Errorf("%w: missing GrpHdr/MsgId", errInvalidStatusReport)
+	}
+
+	defaultMsgID := ""
+	for _, g := range body.OrgnlGrpInfAndSts {
+		gs := groupStatus{OrgnlMsgID: strings.TrimSpace(g.OrgnlMsgId), Status: strings.TrimSpace(g.GrpSts), Reason: reasonText(g.StsRsnInf)}
+		if defaultMsgID == "" {
+			defaultMsgID = gs.OrgnlMsgID
+		}
+		rep.Groups = append(rep.Groups, gs)
+	}
+
+	add := func(t isoTxStatus, inherited, inheritedReason string) {
+		ts := txStatus{
+			OrgnlMsgID: strings.TrimSpace(t.OrgnlGrpInf.OrgnlMsgId),
+			EndToEndID: strings.TrimSpace(t.OrgnlEndToEndId),
+			Status:     strings.TrimSpace(t.TxSts),
+			Reason:     reasonText(t.StsRsnInf),
+			Amount:     t.OrgnlTxRef.Amt.InstdAmt,
+		}
+		if ts.Amount == nil {
+			ts.Amount = t.OrgnlTxRef.IntrBkSttlmAmt
+		}
+		if ts.OrgnlMsgID == "" {
+			ts.OrgnlMsgID = defaultMsgID
+		}
+		if ts.Status == "" {
+			ts.Status, ts.Reason = inherited, inheritedReason
+		}
+		rep.Txs = append(rep.Txs, ts)
+	}
+	for _, t := range body.TxInfAndSts {
+		add(t, "", "")
+	}
+	for _, pi := range body.OrgnlPmtInfAndSts {
+		for _, t := range pi.TxInfAndSts {
+			add(t, strings.TrimSpace(pi.PmtInfSts), reasonText(pi.StsRsnInf))
+		}
+	}
+	return rep, nil
+}
+
+// isoStatusTargets maps an ISO 20022 status code onto the payment status
+// it stands for, or "" for codes that change nothing (received, pending,
+// technically validated, partially accepted).
+var isoStatusTargets = map[string]string{
+	"ACCP": statusCaptured,
+	"ACSP": statusCaptured,
+	"ACWC": statusCaptured,
+	"ACSC": statusSettled,
+	"ACCC": statusSettled,
+	"RJCT": statusFailed,
+}
+
+// isoTransitionPath returns the transitions that take a payment from its
+// status to target: an authorized payment the bank reports settled is
+// captured first. Nothing is returned when the payment is already at or
+// past target.
+func isoTransitionPath(current, target string) ([]string, error) {
+	if current == target || (current == statusSettled && target == statusCaptured) {
+		return nil, nil
+	}
+	if target == statusSettled && current == statusAuthorized {
+		return []string{statusCaptured, statusSettled}, nil
+	}
+	if !canTransition(current, target) {
+		return nil, fmt.Errorf("%w: %s -> %s", errInvalidTransition, current, target)
+	}
+	return []string{target}, nil
+}
+
+// Import outcomes per transaction.
+const (
+	isoApplied   = "applied"
+	isoUnchanged = "unchanged"
+	isoUnmatched = "unmatched"
+	isoRejected  = "error"
+)
+
+type statusReportResult struct {
+	EndToEndID string `json:"end_to_end_id"`
+	PaymentID  string `json:"payment_id,omitempty"`
+	Status     string `json:"status"` // ISO 20022 code
+	Reason     string `json:"reason,omitempty"`
+	Outcome    string `json:"outcome"`
+	From       string `json:"from_status,omitempty"`
+	To         string `json:"to_status,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+type statusReportImport struct {
+	ID        string               `json:"id"`
+	MsgID     string               `json:"msg_id"`
+	Kind      string               `json:"kind"`
+	FileName  string               `json:"file_name,omitempty"`
+	Applied   int                  `json:"applied"`
+	Unchanged int                  `json:"unchanged"`
+	Unmatched int                  `json:"unmatched"`
+	Errors    int                  `json:"errors"`
+	Results   []statusReportResult `json:"results,omitempty"`
+	CreatedAt time.Time            `json:"created_at"`
+}
+
+type exportedPayment struct {
+	ExportMsgID string
+	PaymentID   string
+}
+
+// importStatusReport applies a status report to the exported payments it
+// refers to and records the outcome. Importing a report twice is harmless:
+// payments already moved are reported unchanged.
+func (st *appState) importStatusReport(ctx context.Context, r io.Reader, fileName string) (statusReportImport, error) {
+	rep, err := parseStatusReport(r)
+	if err != nil {
+		return statusReportImport{}, err
+	}
+	imp := statusReportImport{MsgID: rep.MsgID, Kind: rep.Kind, FileName: fileName, Results: []statusReportResult{}}
+
+	listed := map[string]bool{}
+	for _, t := range rep.Txs {
+		listed[t.EndToEndID] = true
+		imp.Results = append(imp.Results, st.applyTxStatus(ctx, t))
+	}
+
+	// a group status covers the original message's unlisted transactions
+	for _, g := range rep.Groups {
+		if isoStatusTargets[g.Status] == "" {
+			continue
+		}
+		members, err := exportMembers(ctx, st.db, g.OrgnlMsgID)
+		if err != nil {
+			return imp, err
+		}
+		for _, m := range members {
+			e2e := endToEndID(m.PaymentID)
+			if listed[e2e] {
+				continue
+			}
+			imp.Results = append(imp.Results, st.applyTxStatus(ctx, txStatus{
+				OrgnlMsgID: g.OrgnlMsgID, EndToEndID: e2e, Status: g.Status, Reason: g.Reason,
+			}))
+		}
+	}
+
+	for _, res := range imp.Results {
+		switch res.Outcome {
+		case isoApplied:
+			imp.Applied++
+		case isoUnchanged:
+			imp.Unchanged++
+		case isoUnmatched:
+			imp.Unmatched++
+		default:
+			imp.Errors++
+		}
+	}
+
+	results, err := json.Marshal(imp.Results)
+	if err != nil {
+		return imp, err
+	}
+	err = st.db.QueryRowContext(ctx, `
+		INSERT INTO iso20022_status_reports(msg_id, kind, file_name, applied, unchanged, unmatched, errors, results)
+		VALUES ($1, $2, NULLIF($3, ''), $4, $5, $6, $7, $8)
+		RETURNING id::text, created_at
+	`, imp.MsgID, imp.Kind, imp.FileName, imp.Applied, imp.Unchanged, imp.Unmatched, imp.Errors, results).Scan(&imp.ID, &imp.CreatedAt)
+	return imp, err
+}
+
+func (st *appState) applyTxStatus(ctx context.Context, t txStatus) statusReportResult {
+	res := statusReportResult{EndToEndID: t.EndToEndID, Status: t.Status, Reason: t.Reason, Outcome: isoRejected}
+
+	var exportMsgID string
+	err := st.db.QueryRowContext(ctx, `
+		SELECT ep.payment_id::text, e.msg_id
+		FROM iso20022_export_payments ep
+		JOIN iso20022_exports e ON e.id = ep.export_id
+		WHERE ep.end_to_end_id = $1
+	`, t.EndToEndID).Scan(&res.PaymentID, &exportMsgID)
+	if errors.Is(err, sql.ErrNoRows) {
+		res.Outcome = isoUnmatched
+		return res
+	}
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	if t.OrgnlMsgID != "" && t.OrgnlMsgID != exportMsgID {
+		res.Error = fmt.Sprintf("payment was exported in %s, not %s", exportMsgID, t.OrgnlMsgID)
+		return res
+	}
+
+	p, err := st.loadPayment(ctx, res.PaymentID)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	res.From = p.Status
+	if t.Amount != nil {
+		cur, err := lookupCurrency(p.Currency)
+		if err != nil {
+			res.Error = err.Error()
+			return res
+		}
+		amount, err := parseDecimalAmount(strings.TrimSpace(t.Amount.Value), cur.Exponent)
+		if err != nil || amount != p.Amount || !strings.EqualFold(t.Amount.Ccy, p.Currency) {
+			res.Error = fmt.Sprintf("reported amount %s %s does not match %s %s",
+				t.Amount.Value, t.Amount.Ccy, formatMinorUnits(p.Amount, cur.Exponent), p.Currency)
+			return res
+		}
+	}
+
+	target := isoStatusTargets[t.Status]
+	if target == "" {
+		res.Outcome = isoUnchanged
+		return res
+	}
+	path, err := isoTransitionPath(p.Status, target)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	if len(path) == 0 {
+		res.Outcome = isoUnchanged
+		return res
+	}
+
+	reason := "bank status " + t.Status
+	if t.Reason != "" {
+		reason += ": " + t.Reason
+	}
+	for _, to := range path {
+		if p, err = st.applyTransition(ctx, res.PaymentID, to, reason, 0); err != nil {
+			res.Error = err.Error()
+			return res
+		}
+	}
+	res.Outcome, res.To = isoApplied, p.Status
+	return res
+}
+
+func exportMembers(ctx context.Context, db *sql.DB, msgID string) ([]exportedPayment, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT e.msg_id, ep.payment_id::text
+		FROM iso20022_exports e
+		JOIN iso20022_export_payments ep ON ep.export_id = e.id
+		WHERE e.msg_id = $1
+	`, msgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []exportedPayment
+	for rows.Next() {
+		var m exportedPayment
+		if err := rows.Scan(&m.ExportMsgID, &m.PaymentID); err != nil {
+			return nil, err
+		}
+		out = append(out, m)
+	}
+	return out, rows.Err()
+}
+
+type exportRequest struct {
+	// optional filters; without them every pending bank transfer is taken
+	Currency   string   `json:"currency,omitempty"`
+	PaymentIDs []string `json:"payment_ids,omitempty"`
+	// requested execution date, YYYY-MM-DD; default today (UTC)
+	ExecutionDate string `json:"execution_date,omitempty"`
+	// at most this many payments; default and maximum 5000
+	Limit int `json:"limit,omitempty"`
+
+	execDate time.Time
+}
+
+func (req *exportRequest) normalize(now time.Time) error {
+	req.Currency = strings.ToUpper(strings.TrimSpace(req.Currency))
+	if req.Currency != "" {
+		if _, err := lookupCurrency(req.Currency); err != nil {
+			return err
+		}
+	}
+	for _, id := range req.PaymentIDs {
+		if !isUUID(id) {
+			return fmt.Errorf("payment_ids: %q is not a payment id", id)
+		}
+	}
+	today := now.UTC().Truncate(24 * time.Hour)
+	req.execDate = today
+	if req.ExecutionDate != "" {
+		d, err := time.Parse("2006-01-02", req.ExecutionDate)
+		if err != nil {
+			return errors.New("execution_date must be YYYY-MM-DD")
+		}
+		if d.Before(today) {
+			return errors.New("execution_date must not be in the past")
+		}
+		req.execDate = d
+	}
+	if req.Limit == 0 {
+		req.Limit = 5000
+	}
+	if req.Limit < 1 || req.Limit > 5000 {
+		return errors.New("limit must be between 1 and 5000")
+	}
+	return nil
+}
+
+type isoExport struct {
+	ID            string    `json:"id"`
+	MsgID         string    `json:"msg_id"`
+	ExecutionDate string    `json:"execution_date"`
+	PaymentCount  int       `json:"payment_count"`
+	CtrlSum       string    `json:"ctrl_sum"`
+	CreatedBy     string    `json:"created_by,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+	PaymentIDs    []string  `json:"payment_ids,omitempty"`
+}
+
+const isoExportColumns = `id::text, msg_id, to_char(execution_date, 'YYYY-MM-DD'), payment_count, ctrl_sum,
+	COALESCE(created_by, ''), created_at`
+
+func scanISOExport(row rowScanner, e *isoExport) error {
+	return row.Scan(&e.ID, &e.MsgID, &e.ExecutionDate, &e.PaymentCount, &e.CtrlSum, &e.CreatedBy, &e.CreatedAt)
+}
+
+// exportPain001 claims authorized bank transfers that have not been
+// exported yet and renders them as a pain.001 message. A payment is only
+// ever exported once; the document is stored with the export so it can be
+// downloaded again unchanged.
+func exportPain001(ctx context.Context, db *sql.DB, d *isoDebtor, req exportRequest, by string, now time.Time) (isoExport, []byte, error) {
+	var e isoExport
+	if d == nil {
+		return e, nil, errExportNotConfigured
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return e, nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	ids := req.PaymentIDs
+	if ids == nil {
+		ids = []string{}
+	}
+	rows, err := tx.QueryContext(ctx, `
+		SELECT `+paymentColumns+`
+		FROM payments p
+		WHERE status = $1 AND payment_method LIKE $2
+		  AND ($3 = '' OR currency = $3)
+		  AND (cardinality($4::text[]) = 0 OR id::text = ANY($4::text[]))
+		  AND NOT EXISTS (SELECT 1 FROM iso20022_export_payments ep WHERE ep.payment_id = p.id)
+		ORDER BY created_at, id
+		LIMIT $5
+		FOR UPDATE SKIP LOCKED
+	`, statusAuthorized, ibanMethodPrefix+"%", req.Currency, ids, req.Limit)
+	if err != nil {
+		return e, nil, err
+	}
+	var payments []payment
+	for rows.Next() {
+		var p payment
+		if err := scanPayment(rows, &p); err != nil {
+			rows.Close()
+			return e, nil, err
+		}
+		payments = append(payments, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return e, nil, err
+	}
+	if len(payments) == 0 {
+		return e, nil, errNothingToExport
+	}
+
+	if err := tx.QueryRowContext(ctx, `SELECT uuid_generate_v4()::text`).Scan(&e.ID); err != nil {
+		return e, nil, err
+	}
+	e.MsgID = "PS" + endToEndID(e.ID)[:24]
+	doc, ctrlSum, err := buildPain001(*d, e.MsgID, now, req.execDate, payments)
+	if err != nil {
+		return e, nil, err
+	}
+
+	err = scanISOExport(tx.QueryRowContext(ctx, `
+		INSERT INTO iso20022_exports(id, msg_id, execution_date, payment_count, ctrl_sum, document, created_by)
+		VALUES ($1::uuid, $2, $3, $4, $5, $6, NULLIF($7, ''))
+		RETURNING `+isoExportColumns,
+		e.ID, e.MsgID, req.execDate, len(payments), ctrlSum, string(doc), by), &e)
+	if err != nil {
+		return e, nil, err
+	}
+	e2e := make([]string, len(payments))
+	for i, p := range payments {
+		e.PaymentIDs = append(e.PaymentIDs, p.ID)
+		e2e[i] = endToEndID(p.ID)
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO iso20022_export_payments(export_id, payment_id, end_to_end_id)
+		SELECT $1::uuid, r.payment_id::uuid, r.e2e FROM unnest($2::text[], $3::text[]) AS r(payment_id, e2e)
+	`, e.ID, e.PaymentIDs, e2e); err != nil {
+		return e, nil, err
+	}
+	return e, doc, tx.Commit()
+}
+
+// handleISO20022 serves:
+//
+//	POST /v1/iso20022/exports                    export a pain.001
+//	GET  /v1/iso20022/exports[/{id}]
+//	GET  /v1/iso20022/exports/{id}/document      the pain.001 XML
+//	POST /v1/iso20022/status-reports?file_name=  import a pacs.002/pain.002
+//	GET  /v1/iso20022/status-reports[/{id}]
+func (st *appState) handleISO20022(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/iso20022"), "/")
+	parts := strings.Split(rest, "/")
+
+	switch {
+	case parts[0] == "exports" && len(parts) == 1 && r.Method == http.MethodPost:
+		st.createISOExport(w, r)
+	case parts[0] == "exports" && r.Method == http.MethodGet && len(parts) <= 3:
+		st.getISOExports(w, r, parts[1:])
+	case parts[0] == "status-reports" && len(parts) == 1 && r.Method == http.MethodPost:
+		st.createStatusReport(w, r)
+	case parts[0] == "status-reports" && len(parts) <= 2 && r.Method == http.MethodGet:
+		st.getStatusReports(w, r, parts[1:])
+	case parts[0] == "exports" || parts[0] == "status-reports":
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func (st *appState) createISOExport(w http.ResponseWriter, r *http.Request) {
+	var req exportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if err := req.normalize(time.Now()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	e, _, err := exportPain001(ctx, st.db, st.debtor, req, callerFrom(ctx).Subject, time.Now())
+	switch {
+	case errors.Is(err, errExportNotConfigured):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case errors.Is(err, errNothingToExport):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		http.Error(w, "db error", http.StatusInternalServerError)
+	default:
+		writeJSON(w, http.StatusCreated, e)
+	}
+}
+
+func (st *appState) getISOExports(w http.ResponseWriter, r *http.Request, path []string) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	if len(path) == 0 {
+		rows, err := st.db.QueryContext(ctx, `
+			SELECT `+isoExportColumns+` FROM iso20022_exports ORDER BY created_at DESC LIMIT 100
+		`)
+		if err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		out := []isoExport{}
+		for rows.Next() {
+			var e isoExport
+			if err := scanISOExport(rows, &e); err != nil {
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
+			}
+			out = append(out, e)
+		}
+		writeJSON(w, http.StatusOK, out)
+		return
+	}
+
+	id := path[0]
+	if !isUUID(id) || (len(path) == 2 && path[1] != "document") {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if len(path) == 2 {
+		var doc string
+		err := st.db.QueryRowContext(ctx, `SELECT document FROM iso20022_exports WHERE id = $1::uuid`, id).Scan(&doc)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="pain.001-`+id+`.xml"`)
+		_, _ = io.WriteString(w, doc)
+		return
+	}
+
+	var e isoExport
+	err := scanISOExport(st.db.QueryRowContext(ctx, `
+		SELECT `+isoExportColumns+` FROM iso20022_exports WHERE id = $1::uuid
+	`, id), &e)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	var ids string
+	if err == nil {
+		err = st.db.QueryRowContext(ctx, `
+			SELECT COALESCE(array_to_json(array_agg(payment_id::text ORDER BY payment_id)), '[]')::text
+			FROM iso20022_export_payments WHERE export_id = $1::uuid
+		`, id).Scan(&ids)
+	}
+	if err == nil {
+		err = json.Unmarshal([]byte(ids), &e.PaymentIDs)
+	}
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, e)
+}
+
+// maxStatusReportBytes bounds an uploaded status report.
+const maxStatusReportBytes = 32 << 20
+
+func (st *appState) createStatusReport(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 60*time.Second)
+	defer cancel()
+
+	imp, err := st.importStatusReport(ctx, http.MaxBytesReader(w, r.Body, maxStatusReportBytes), strings.TrimSpace(r.URL.Query().Get("file_name")))
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		http.Error(w, "status report too large", http.StatusRequestEntityTooLarge)
+	case errors.Is(err, errInvalidStatusReport):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case err != nil:
+		http.Error(w, "db error", http.StatusInternalServerError)
+	default:
+		writeJSON(w, http.StatusCreated, imp)
+	}
+}
+
+const statusReportColumns = `id::text, msg_id, kind, COALESCE(file_name, ''), applied, unchanged, unmatched, errors, created_at`
+
+func scanStatusReport(row rowScanner, imp *statusReportImport) error {
+	return row.Scan(&imp.ID, &imp.MsgID, &imp.Kind, &imp.FileName, &imp.Applied, &imp.Unchanged, &imp.Unmatched, &imp.Errors, &imp.CreatedAt)
+}
+
+func (st *appState) getStatusReports(w http.ResponseWriter, r *http.Request, path []string) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	if len(path) == 0 {
+		rows, err := st.db.QueryContext(ctx, `
+			SELECT `+statusReportColumns+` FROM iso20022_status_reports ORDER BY created_at DESC LIMIT 100
+		`)
+		if err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		out := []statusReportImport{}
+		for rows.Next() {
+			var imp statusReportImport
+			if err := scanStatusReport(rows, &imp); err != nil {
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
+			}
+			out = append(out, imp)
+		}
+		writeJSON(w, http.StatusOK, out)
+		return
+	}
+
+	if !isUUID(path[0]) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	var imp statusReportImport
+	var results string
+	err := st.db.QueryRowContext(ctx, `
+		SELECT `+statusReportColumns+`, results::text FROM iso20022_status_reports WHERE id = $1::uuid
+	`, path[0]).Scan(&imp.ID, &imp.MsgID, &imp.Kind, &imp.FileName, &imp.Applied, &imp.Unchanged, &imp.Unmatched,
+		&imp.Errors, &imp.CreatedAt, &results)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		err = json.Unmarshal([]byte(results), &imp.Results)
+	}
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, imp)
+}
+
+// iso20022Command implements
+//
+//	payments-service iso20022 export [-currency EUR] [-execution-date 2026-02-02] [-limit N] [-out file]
+//	payments-service iso20022 import -file report.xml
+//
+// It exits 2 when an import leaves transactions unmatched or in error.
+func iso20022Command(args []string, stdout io.Writer) int {
+	if len(args) == 0 || (args[0] != "export" && args[0] != "import") {
+		fmt.Fprintln(stdout, "usage: iso20022 export|import [flags]")
+		return 1
+	}
+	fs := flag.NewFlagSet("iso20022 "+args[0], flag.ContinueOnError)
+	fs.SetOutput(stdout)
+	currency := fs.String("currency", "", "export only this currency")
+	execDate := fs.String("execution-date", "", "requested execution date, YYYY-MM-DD (default today)")
+	limit := fs.Int("limit", 0, "export at most this many payments")
+	out := fs.String("out", "", "write the pain.001 here instead of stdout")
+	file := fs.String("file", "", "status report to import")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 1
+	}
+
+	dsn, err := buildPostgresDSNFromEnv()
+	if err != nil {
+		fmt.Fprintf(stdout, "iso20022: config error: %v\n", err)
+		return 1
+	}
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		fmt.Fprintf(stdout, "iso20022: db open error: %v\n", err)
+		return 1
+	}
+	defer db.Close()
+	if err := ensureSchema(db); err != nil {
+		fmt.Fprintf(stdout, "iso20022: schema init failed: %v\n", err)
+		return 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	if args[0] == "export" {
+		debtor, err := isoDebtorFromEnv()
+		if err != nil {
+			fmt.Fprintf(stdout, "iso20022: config error: %v\n", err)
+			return 1
+		}
+		req := exportRequest{Currency: *currency, ExecutionDate: *execDate, Limit: *limit}
+		if err := req.normalize(time.Now()); err != nil {
+			fmt.Fprintf(stdout, "iso20022: %v\n", err)
+			return 1
+		}
+		e, doc, err := exportPain001(ctx, db, debtor, req, "cli", time.Now())
+		if err != nil {
+			fmt.Fprintf(stdout, "iso20022: %v\n", err)
+			return 1
+		}
+		if *out == "" {
+			_, _ = stdout.Write(doc)
+			return 0
+		}
+		if err := os.WriteFile(*out, doc, 0o644); err != nil {
+			fmt.Fprintf(stdout, "iso20022: %v\n", err)
+			return 1
+		}
+		fmt.Fprintf(stdout, "export %s: %s, %d payments, control sum %s, written to %s\n",
+			e.ID, e.MsgID, e.PaymentCount, e.CtrlSum, *out)
+		return 0
+	}
+
+	if *file == "" {
+		fmt.Fprintln(stdout, "iso20022: -file is required")
+		return 1
+	}
+	f, err := os.Open(*file)
+	if err != nil {
+		fmt.Fprintf(stdout, "iso20022: %v\n", err)
+		return 1
+	}
+	defer f.Close()
+
+	st := &appState{db: db}
+	imp, err := st.importStatusReport(ctx, f, filepath.Base(*file))
+	if err != nil {
+		fmt.Fprintf(stdout, "iso20022: %v\n", err)
+		return 1
+	}
+	printStatusReportImport(stdout, imp)
+	if imp.Unmatched+imp.Errors > 0 {
+		return 2
+	}
+	return 0
+}
+
+func printStatusReportImport(w io.Writer, imp statusReportImport) {
+	fmt.Fprintf(w, "report %s (%s %s): %d applied, %d unchanged, %d unmatched, %d errors\n",
+		imp.ID, imp.Kind, imp.MsgID, imp.Applied, imp.Unchanged, imp.Unmatched, imp.Errors)
+	if imp.Unmatched+imp.Errors == 0 {
+		return
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "OUTCOME\tEND_TO_END_ID\tPAYMENT_ID\tSTATUS\tERROR")
+	for _, r := range imp.Results {
+		if r.Outcome == isoApplied || r.Outcome == isoUnchanged {
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", r.Outcome, r.EndToEndID, dashIfEmpty(r.PaymentID), r.Status, dashIfEmpty(r.Error))
+	}
+	_ = tw.Flush()
+}
+
+const iso20022Schema = `
+	CREATE TABLE IF NOT EXISTS iso20022_exports (
+		id uuid PRIMARY KEY,
+		msg_id text NOT NULL UNIQUE,
+		execution_date date NOT NULL,
+		payment_count int NOT NULL,
+		ctrl_sum text NOT NULL,
+		document text NOT NULL,
+		created_by text,
+		created_at timestamptz NOT NULL DEFAULT now()
+	);
+
+	CREATE TABLE IF NOT EXISTS iso20022_export_payments (
+		export_id uuid NOT NULL REFERENCES iso20022_exports(id),
+		payment_id uuid NOT NULL UNIQUE REFERENCES payments(id),
+		end_to_end_id text NOT NULL UNIQUE
+	);
+
+	CREATE INDEX IF NOT EXISTS iso20022_export_payments_export_idx ON iso20022_export_payments(export_id);
+
+	CREATE TABLE IF NOT EXISTS iso20022_status_reports (
+		id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+		msg_id text NOT NULL,
+		kind text NOT NULL,
+		file_name text,
+		applied int NOT NULL,
+		unchanged int NOT NULL,
+		unmatched int NOT NULL,
+		errors int NOT NULL,
+		results jsonb NOT NULL,
+		created_at timestamptz NOT NULL DEFAULT now()
+	);
+`
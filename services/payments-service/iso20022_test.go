@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormalizeIBAN(t *testing.T) {
+	got, err := normalizeIBAN(" de89 3704 0044 0532 0130 00 ")
+	if err != nil || got != "DE89370400440532013000" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+	for _, bad := range []string{"DE88370400440532013000", "DE8937040044053201300!", "D189370400440532013000", "DE89"} {
+		if _, err := normalizeIBAN(bad); err == nil {
+			t.Fatalf("%q accepted", bad)
+		}
+	}
+
+	if pm, err := normalizePaymentMethod("IBAN:gb82 west 1234 5698 7654 32"); err != nil || pm != "iban:GB82WEST12345698765432" {
+		t.Fatalf("got %q, %v", pm, err)
+	}
+	if pm, err := normalizePaymentMethod("tok_approve"); err != nil || pm != "tok_approve" {
+		t.Fatalf("card token changed: %q, %v", pm, err)
+	}
+	req := createPaymentRequest{UserID: "u1", Amount: 100, Currency: "EUR", Ref: "r1", PaymentMethod: "iban:DE00123"}
+	if err := req.normalize(); err == nil {
+		t.Fatal("payment with a bad IBAN accepted")
+	}
+}
+
+func TestBuildPain001MatchesSample(t *testing.T) {
+	debtor := isoDebtor{Name: "Fintech Platform Ltd", IBAN: "DE89370400440532013000", BIC: "COBADEFFXXX", InitiatingParty: "Fintech Platform"}
+	created := time.Date(2026, 2, 1, 18, 30, 0, 0, time.UTC)
+	exec := time.Date(2026, 2, 2, 0, 0, 0, 0, time.UTC)
+	payments := []payment{
+		{ID: "0d9c1f6a-2b7e-4e8f-9a3c-5b1d7e2f4a60", UserID: "employee-0001", Amount: 245000, Currency: "EUR",
+			Ref: "payroll-2026-02-0001", PaymentMethod: "iban:FR1420041010050500013M02606"},
+		{ID: "3c8e0a4b-6d1f-4b2a-8e7c-9f0a1b2c3d4e", UserID: "contractor-17", Amount: 120050, Currency: "GBP",
+			Ref: "invoice 2026/014", PaymentMethod: "iban:GB82WEST12345698765432"},
+		{ID: "7a3e9b1c-5d2f-4a6e-8b0c-1d3f5a7e9b12", UserID: "employee-0002", Amount: 312075, Currency: "EUR",
+			Ref: "payroll-2026-02-0002", PaymentMethod: "iban:DE89370400440532013000"},
+	}
+
+	doc, ctrlSum, err := buildPain001(debtor, "PS5b0c2f7e8d1a4c3bb9e6f0a1", created, exec, payments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctrlSum != "6771.25" {
+		t.Fatalf("ctrl sum %s", ctrlSum)
+	}
+	want, err := os.ReadFile("testdata/iso20022/pain.001.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(doc, want) {
+		t.Fatalf("pain.001 differs from testdata/iso20022/pain.001.xml:\n%s", doc)
+	}
+
+	var parsed struct {
+		XMLName xml.Name
+	}
+	if err := xml.Unmarshal(doc, &parsed); err != nil || parsed.XMLName.Space != pain001Namespace {
+		t.Fatalf("document namespace %q, %v", parsed.XMLName.Space, err)
+	}
+
+	payments[0].PaymentMethod = "tok_approve"
+	if _, _, err := buildPain001(debtor, "PS1", created, exec, payments); err == nil {
+		t.Fatal("card payment exported")
+	}
+}
+
+func TestParseStatusReports(t *testing.T) {
+	for _, c := range []struct {
+		file, kind string
+		want       []txStatus
+	}{
+		{"pacs.002.xml", "pacs.002", []txStatus{
+			{EndToEndID: "0d9c1f6a2b7e4e8f9a3c5b1d7e2f4a60", Status: "ACSC"},
+			{EndToEndID: "7a3e9b1c5d2f4a6e8b0c1d3f5a7e9b12", Status: "RJCT", Reason: "AC04 Closed account number"},
+		}},
+		{"pain.002.xml", "pain.002", []txStatus{
+			{EndToEndID: "0d9c1f6a2b7e4e8f9a3c5b1d7e2f4a60", Status: "ACSP"},
+			{EndToEndID: "7a3e9b1c5d2f4a6e8b0c1d3f5a7e9b12", Status: "RJCT", Reason: "AM04"},
+		}},
+	} {
+		f, err := os.Open("testdata/iso20022/" + c.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rep, err := parseStatusReport(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", c.file, err)
+		}
+		if rep.Kind != c.kind || len(rep.Txs) != len(c.want) || len(rep.Groups) != 1 {
+			t.Fatalf("%s: %+v", c.file, rep)
+		}
+		for i, w := range c.want {
+			got := rep.Txs[i]
+			if got.OrgnlMsgID != "PS5b0c2f7e8d1a4c3bb9e6f0a1" || got.EndToEndID != w.EndToEndID || got.Status != w.Status || got.Reason != w.Reason {
+				t.Fatalf("%s tx %d: %+v", c.file, i, got)
+			}
+		}
+		if amt := rep.Txs[0].Amount; amt == nil || amt.Ccy != "EUR" || amt.Value != "2450.00" {
+			t.Fatalf("%s: amount %+v", c.file, amt)
+		}
+	}
+
+	for _, bad := range []string{"", "<Document/>", `<Document><FIToFIPmtStsRpt><GrpHdr/></FIToFIPmtStsRpt></Document>`, "<Other><FIToFIPmtStsRpt/></Other>"} {
+		if _, err := parseStatusReport(strings.NewReader(bad)); !errors.Is(err, errInvalidStatusReport) {
+			t.Fatalf("%q: got %v", bad, err)
+		}
+	}
+}
+
+func TestISOTransitionPath(t *testing.T) {
+	for _, c := range []struct {
+		from, to string
+		want     string
+		err      bool
+	}{
+		{statusAuthorized, statusCaptured, "captured", false},
+		{statusAuthorized, statusSettled, "captured,settled", false},
+		{statusCaptured, statusSettled, "settled", false},
+		{statusSettled, statusCaptured, "", false},
+		{statusSettled, statusSettled, "", false},
+		{statusAuthorized, statusFailed, "failed", false},
+		{statusCaptured, statusFailed, "", true},
+		{statusCanceled, statusSettled, "", true},
+	} {
+		path, err := isoTransitionPath(c.from, c.to)
+		if (err != nil) != c.err || strings.Join(path, ",") != c.want {
+			t.Fatalf("%s -> %s: got %v, %v", c.from, c.to, path, err)
+		}
+	}
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// System ledger accounts. Each user also has a "user:{user_id}" account per
+// currency holding what the platform owes them.
+const (
+	accountCash             = "cash"
+	accountProviderClearing = "provider_clearing"
+	// currency bought and sold converting FX payments
+	accountFXPosition = "fx_position"
+	// the spread earned on FX payments
+	accountFXRevenue = "fx_revenue"
+	// payouts taken from users and not yet paid out by the bank
+	accountPayoutClearing = "payout_clearing"
+)
+
+// accountTypes classifies system accounts; anything else is a user
+// liability account.
+var accountTypes = map[string]string{
+	accountCash:             "asset",
+	accountProviderClearing: "asset",
+	accountFXPosition:       "asset",
+	accountFXRevenue:        "revenue",
+	accountPayoutClearing:   "liability",
+}
+
+func accountType(code string) string {
+	if t, ok := accountTypes[code]; ok {
+		return t
+	}
+	return "liability"
+}
+
+func userAccount(userID string) string {
+	return "user:" + userID
+}
+
+// postingLine is one side of a journal entry. Amount is signed: debits are
+// positive, credits negative, so every balanced entry sums to zero per
+// currency.
+type postingLine struct {
+	Account  string `json:"account"`
+	Currency string `json:"currency"`
+	Amount   int64  `json:"amount"`
+}
+
+type journalEntry struct {
+	Kind        string
+	PaymentID   string
+	RefundID    string
+	DisputeID   string
+	PayoutID    string
+	Description string
+	Lines       []postingLine
+}
+
+var errUnbalancedEntry = errors.New("journal entry does not balance")
+
+func debit(account, currency string, amount int64) postingLine {
+	return postingLine{Account: account, Currency: currency, Amount: amount}
+}
+
+func credit(account, currency string, amount int64) postingLine {
+	return postingLine{Account: account, Currency: currency, Amount: -amount}
+}
+
+// validateEntry checks that an entry has postings, none of them zero, and
+// that debits equal credits in every currency.
+func validateEntry(e journalEntry) error {
+	if len(e.Lines) < 2 {
+		return fmt.Errorf("%w: %s needs at least two postings", errUnbalancedEntry, e.Kind)
+	}
+	sums := map[string]int64{}
+	for _, l := range e.Lines {
+		if l.Amount == 0 || l.Account == "" || l.Currency == "" {
+			return fmt.Errorf("%w: %s has an empty posting", errUnbalancedEntry, e.Kind)
+		}
+		sums[l.Currency] += l.Amount
+	}
+	for cur, sum := range sums {
+		if sum != 0 {
+			return fmt.Errorf("%w: %s is off by %d %s", errUnbalancedEntry, e.Kind, sum, cur)
+		}
+	}
+	return nil
+}
+
+// transitionEntry returns the journal entry for a payment moving to status
+// to, or nil when the change moves no money. refunded is the sum of refunds
+// that have already succeeded and disputes already lost. Captures are
+// posted by captureEntry, one entry per capture.
+func transitionEntry(p payment, to string, refunded int64) *journalEntry {
+	switch to {
+	case statusSettled:
+		// the provider paid out what was captured, net of refunds and
+		// chargebacks already taken back through it
+		net := p.CapturedAmount - refunded
+		if net <= 0 {
+			return nil
+		}
+		return &journalEntry{
+			Kind:      "payment_settled",
+			PaymentID: p.ID,
+			Lines: []postingLine{
+				debit(accountCash, p.Currency, net),
+				credit(accountProviderClearing, p.Currency, net),
+			},
+		}
+	}
+	return nil
+}
+
+// captureEntry posts amount captured from p's hold: the provider now owes
+// us the funds, and we owe them to the user. A zero amount, closing a hold
+// without capturing more, moves no money.
+func captureEntry(p payment, amount int64) *journalEntry {
+	if amount <= 0 {
+		return nil
+	}
+	if p.FX != nil {
+		return fxCaptureEntry(p, amount)
+	}
+	return &journalEntry{
+		Kind:      "payment_captured",
+		PaymentID: p.ID,
+		Lines: []postingLine{
+			debit(accountProviderClearing, p.Currency, amount),
+			credit(userAccount(p.UserID), p.Currency, amount),
+		},
+	}
+}
+
+// fxCaptureEntry posts a capture of an FX payment. The source currency
+// received is sold into fx_position; the user is credited the target
+// currency at the locked rate, and the spread over the mid rate is revenue.
+func fxCaptureEntry(p payment, amount int64) *journalEntry {
+	target, mid := p.FX.convert(p, amount)
+	cur := p.FX.TargetCurrency
+	e := &journalEntry{
+		Kind:      "payment_captured",
+		PaymentID: p.ID,
+		Lines: []postingLine{
+			debit(accountProviderClearing, p.Currency, amount),
+			credit(accountFXPosition, p.Currency, amount),
+			debit(accountFXPosition, cur, mid),
+			credit(userAccount(p.UserID), cur, target),
+		},
+	}
+	if spread := mid - target; spread > 0 {
+		e.Lines = append(e.Lines, credit(accountFXRevenue, cur, spread))
+	}
+	return e
+}
+
+// refundEntry moves a succeeded refund back out of the user's account.
+func refundEntry(p payment, rf refund) *journalEntry {
+	e := reversalEntry(p, "refund_succeeded", rf.Amount)
+	e.RefundID = rf.ID
+	return e
+}
+
+// reversalEntry takes amount of p back out of the user's account, for a
+// refund or a lost dispute. On a settled payment it is paid from cash,
+// otherwise it nets against the provider clearing balance. For an FX
+// payment the target currency is taken back from the user at the locked
+// rate, rounded down; the spread already earned is kept.
+func reversalEntry(p payment, kind string, amount int64) *journalEntry {
+	source := accountProviderClearing
+	if p.Status == statusSettled {
+		source = accountCash
+	}
+	e := &journalEntry{Kind: kind, PaymentID: p.ID}
+	if p.FX == nil {
+		e.Lines = []postingLine{
+			debit(userAccount(p.UserID), p.Currency, amount),
+			credit(source, p.Currency, amount),
+		}
+		return e
+	}
+	e.Lines = []postingLine{
+		debit(accountFXPosition, p.Currency, amount),
+		credit(source, p.Currency, amount),
+	}
+	if target, _ := p.FX.convert(p, amount); target > 0 {
+		e.Lines = append(e.Lines,
+			debit(userAccount(p.UserID), p.FX.TargetCurrency, target),
+			credit(accountFXPosition, p.FX.TargetCurrency, target))
+	}
+	return e
+}
+
+// reversalDebit is what reversing amount of p takes from the user's
+// account, and in which currency: the same as reversalEntry debits. It is
+// what pending refunds and open disputes hold back from the balance.
+func reversalDebit(p payment, amount int64) (int64, string) {
+	if p.FX == nil {
+		return amount, p.Currency
+	}
+	target, _ := p.FX.convert(p, amount)
+	return target, p.FX.TargetCurrency
+}
+
+// postEntry writes e within tx. Callers pass the transaction that changes
+// the payment, so money movement and state change commit together. The
+// database re-checks the balance at commit time.
+func postEntry(ctx context.Context, tx *sql.Tx, e *journalEntry) error {
+	if e == nil {
+		return nil
+	}
+	if err := validateEntry(*e); err != nil {
+		return err
+	}
+
+	var entryID int64
+	err := tx.QueryRowContext(ctx, `
+		INSERT INTO journal_entries(kind, payment_id, refund_id, dispute_id, payout_id, description)
+		VALUES ($1, NULLIF($2, '')::uuid, NULLIF($3, '')::uuid, NULLIF($4, '')::uuid, NULLIF($5, '')::uuid, NULLIF($6, ''))
+		RETURNING id
+	`, e.Kind, e.PaymentID, e.RefundID, e.DisputeID, e.PayoutID, e.Description).Scan(&entryID)
+	if err != nil {
+		return err
+	}
+
+	for _, l := range e.Lines {
+		var accountID int64
+		err := tx.QueryRowContext(ctx, `
+			INSERT INTO ledger_accounts(code, currency, type)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (code, currency) DO UPDATE SET code = EXCLUDED.code
+			RETURNING id
+		`, l.Account, l.Currency, accountType(l.Account)).Scan(&accountID)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO ledger_postings(entry_id, account_id, currency, amount)
+			VALUES ($1, $2, $3, $4)
+		`, entryID, accountID, l.Currency, l.Amount); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type accountBalance struct {
+	Account  string    `json:"account"`
+	Type     string    `json:"type"`
+	Currency string    `json:"currency"`
+	Debits   int64     `json:"debits"`
+	Credits  int64     `json:"credits"`
+	Balance  int64     `json:"balance"`
+	AsOf     time.Time `json:"as_of"`
+}
+
+type ledgerCheck struct {
+	OK bool `json:"ok"`
+	// sum of all postings per currency; must be zero
+	Totals            map[string]int64 `json:"totals"`
+	UnbalancedEntries []int64          `json:"unbalanced_entries"`
+	CheckedAt         time.Time        `json:"checked_at"`
+}
+
+// handleLedger serves /v1/ledger/accounts, /v1/ledger/accounts/{code} and
+// /v1/ledger/check.
+func (st *appState) handleLedger(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	rest := strings.TrimPrefix(r.URL.Path, "/v1/ledger/")
+	switch {
+	case rest == "check":
+		res, err := checkLedger(ctx, st.db)
+		if err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		code := http.StatusOK
+		if !res.OK {
+			code = http.StatusInternalServerError
+		}
+		writeJSON(w, code, res)
+
+	case rest == "accounts" || strings.HasPrefix(rest, "accounts/"):
+		asOf := time.Now().UTC()
+		if at := r.URL.Query().Get("at"); at != "" {
+			t, err := time.Parse(time.RFC3339, at)
+			if err != nil {
+				http.Error(w, "at must be an RFC 3339 timestamp", http.StatusBadRequest)
+				return
+			}
+			asOf = t
+		}
+		code := strings.TrimPrefix(strings.TrimPrefix(rest, "accounts"), "/")
+		currency := strings.ToUpper(strings.TrimSpace(r.URL.Query().Get("currency")))
+
+		out, err := accountBalances(ctx, st.db, code, currency, asOf)
+		if err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		if code != "" && len(out) == 0 {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, out)
+
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+// accountBalances sums postings of entries made at or before asOf. Empty
+// code or currency match every account or currency.
+func accountBalances(ctx context.Context, db *sql.DB, code, currency string, asOf time.Time) ([]accountBalance, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT a.code, a.type, a.currency,
+		       COALESCE(SUM(p.amount) FILTER (WHERE p.amount > 0 AND e.created_at <= $3), 0),
+		       COALESCE(-SUM(p.amount) FILTER (WHERE p.amount < 0 AND e.created_at <= $3), 0)
+		FROM ledger_accounts a
+		LEFT JOIN ledger_postings p ON p.account_id = a.id
+		LEFT JOIN journal_entries e ON e.id = p.entry_id
+		WHERE ($1 = '' OR a.code = $1) AND ($2 = '' OR a.currency = $2)
+		GROUP BY a.id
+		ORDER BY a.code, a.currency
+	`, code, currency, asOf)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []accountBalance{}
+	for rows.Next() {
+		b := accountBalance{AsOf: asOf}
+		if err := rows.Scan(&b.Account, &b.Type, &b.Currency, &b.Debits, &b.Credits); err != nil {
+			return nil, err
+		}
+		b.Balance = b.Debits - b.Credits
+		out = append(out, b)
+	}
+	return out, rows.Err()
+}
+
+// checkLedger proves the ledger is consistent: every entry balances per
+// currency, and so the whole ledger sums to zero per currency.
+func checkLedger(ctx context.Context, db *sql.DB) (ledgerCheck, error) {
+	res := ledgerCheck{Totals: map[string]int64{}, UnbalancedEntries: []int64{}, CheckedAt: time.Now().UTC()}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT currency, SUM(amount) FROM ledger_postings GROUP BY currency
+	`)
+	if err != nil {
+		return res, err
+	}
+	for rows.Next() {
+		var cur string
+		var sum int64
+		if err := rows.Scan(&cur, &sum); err != nil {
+			rows.Close()
+			return res, err
+		}
+		res.Totals[cur] = sum
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return res, err
+	}
+
+	rows, err = db.QueryContext(ctx, `
+		SELECT DISTINCT entry_id
+		FROM ledger_postings
+		GROUP BY entry_id, currency
+		HAVING SUM(amount) <> 0
+		ORDER BY entry_id
+		LIMIT 100
+	`)
+	if err != nil {
+		return res, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return res, err
+		}
+		res.UnbalancedEntries = append(res.UnbalancedEntries, id)
+	}
+	if err := rows.Err(); err != nil {
+		return res, err
+	}
+
+	res.OK = ledgerTotalsBalanced(res.Totals) && len(res.UnbalancedEntries) == 0
+	return res, nil
+}
+
+func ledgerTotalsBalanced(totals map[string]int64) bool {
+	for _, sum := range totals {
+		if sum != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+const ledgerSchema = `
+	CREATE TABLE IF NOT EXISTS ledger_accounts (
+		id bigserial PRIMARY KEY,
+		code text NOT NULL,
+		currency text NOT NULL,
+		type text NOT NULL,
+		created_at timestamptz NOT NULL DEFAULT now(),
+		UNIQUE (code, currency)
+	);
+
+	CREATE TABLE IF NOT EXISTS journal_entries (
+		id bigserial PRIMARY KEY,
+		kind text NOT NULL,
+		payment_id uuid REFERENCES payments(id),
+		refund_id uuid REFERENCES refunds(id),
+		description text,
+		created_at timestamptz NOT NULL DEFAULT now()
+	);
+
+	CREATE INDEX IF NOT EXISTS journal_entries_payment_idx ON journal_entries(payment_id);
+
+	CREATE TABLE IF NOT EXISTS ledger_postings (
+		id bigserial PRIMARY KEY,
+		entry_id bigint NOT NULL REFERENCES journal_entries(id),
+		account_id bigint NOT NULL REFERENCES ledger_accounts(id),
+		currency text NOT NULL,
+		amount bigint NOT NULL CHECK (amount <> 0)
+	);
+
+	CREATE INDEX IF NOT EXISTS ledger_postings_entry_idx ON ledger_postings(entry_id);
+	CREATE INDEX IF NOT EXISTS ledger_postings_account_idx ON ledger_postings(account_id);
+
+	CREATE OR REPLACE FUNCTION ledger_check_entry_balanced() RETURNS trigger AS $$
+	BEGIN
+		IF EXISTS (
+			SELECT 1 FROM ledger_postings
+			WHERE entry_id = NEW.entry_id
+			GROUP BY currency
+			HAVING SUM(amount) <> 0
+		) THEN
+			RAISE EXCEPTION 'journal entry % does not balance', NEW.entry_id;
+		END IF;
+		RETURN NULL;
+	END;
+	$$ LANGUAGE plpgsql;
+
+	DO $$
+	BEGIN
+		IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'ledger_postings_balanced') THEN
+			CREATE CONSTRAINT TRIGGER ledger_postings_balanced
+				AFTER INSERT ON ledger_postings
+				DEFERRABLE INITIALLY DEFERRED
+				FOR EACH ROW EXECUTE FUNCTION ledger_check_entry_balanced();
+		END IF;
+	END;
+	$$;
+`
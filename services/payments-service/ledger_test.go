@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidateEntry(t *testing.T) {
+	ok := journalEntry{Kind: "test", Lines: []postingLine{
+		debit(accountCash, "EUR", 100),
+		credit(accountProviderClearing, "EUR", 100),
+		debit(accountCash, "USD", 5),
+		credit(userAccount("u1"), "USD", 5),
+	}}
+	if err := validateEntry(ok); err != nil {
+		t.Fatalf("expected balanced entry, got %v", err)
+	}
+
+	// balanced in total but not per currency
+	mixed := journalEntry{Kind: "test", Lines: []postingLine{
+		debit(accountCash, "EUR", 100),
+		credit(accountProviderClearing, "USD", 100),
+	}}
+	if err := validateEntry(mixed); !errors.Is(err, errUnbalancedEntry) {
+		t.Fatalf("expected errUnbalancedEntry for mixed currencies, got %v", err)
+	}
+
+	single := journalEntry{Kind: "test", Lines: []postingLine{debit(accountCash, "EUR", 100)}}
+	if err := validateEntry(single); !errors.Is(err, errUnbalancedEntry) {
+		t.Fatalf("expected errUnbalancedEntry for a single posting, got %v", err)
+	}
+}
+
+func TestPaymentLifecycleLedgerNetsToZero(t *testing.T) {
+	p := payment{ID: "p1", UserID: "u1", Amount: 1000, Currency: "EUR"}
+	balances := map[string]int64{}
+	post := func(e *journalEntry) {
+		t.Helper()
+		if e == nil {
+			return
+		}
+		if err := validateEntry(*e); err != nil {
+			t.Fatalf("%s: %v", e.Kind, err)
+		}
+		for _, l := range e.Lines {
+			balances[l.Account] += l.Amount
+		}
+	}
+
+	if e := transitionEntry(p, statusAuthorized, 0); e != nil {
+		t.Fatalf("authorize should not move money, got %+v", e)
+	}
+	// captured in two parts, with 100 of the authorization released
+	post(captureEntry(p, 600))
+	post(captureEntry(p, 300))
+	if e := captureEntry(p, 0); e != nil {
+		t.Fatalf("closing a hold should not move money, got %+v", e)
+	}
+
+	p.Status, p.CapturedAmount = statusCaptured, 900
+	post(refundEntry(p, refund{ID: "r1", Amount: 300, Currency: "EUR"}))
+	post(transitionEntry(p, statusSettled, 300))
+
+	p.Status = statusSettled
+	post(refundEntry(p, refund{ID: "r2", Amount: 200, Currency: "EUR"}))
+
+	want := map[string]int64{
+		accountCash:             400,
+		accountProviderClearing: 0,
+		userAccount("u1"):       -400,
+	}
+	for acc, v := range want {
+		if balances[acc] != v {
+			t.Errorf("%s balance = %d, want %d", acc, balances[acc], v)
+		}
+	}
+	if !ledgerTotalsBalanced(map[string]int64{"EUR": balances[accountCash] + balances[accountProviderClearing] + balances[userAccount("u1")]}) {
+		t.Fatal("ledger does not net to zero")
+	}
+}
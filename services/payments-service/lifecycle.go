@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	statusInReview       = "in_review"
+	statusCreated        = "created"
+	statusRequiresAction = "requires_action"
+	statusAuthorized     = "authorized"
+	statusCaptured       = "captured"
+	statusSettled        = "settled"
+	statusFailed         = "failed"
+	statusCanceled       = "canceled"
+	statusExpired        = "expired"
+)
+
+// paymentTransitions lists the statuses each status may move to. Statuses
+// without an entry are terminal.
+var paymentTransitions = map[string][]string{
+	statusInReview:       {statusCreated, statusFailed},
+	statusCreated:        {statusRequiresAction, statusAuthorized, statusFailed, statusCanceled, statusExpired},
+	statusRequiresAction: {statusAuthorized, statusFailed, statusCanceled, statusExpired},
+	statusAuthorized:     {statusCaptured, statusFailed, statusCanceled, statusExpired},
+	statusCaptured:       {statusSettled},
+}
+
+// paymentActions maps POST /v1/payments/{id}/{action} onto the target status.
+var paymentActions = map[string]string{
+	"authorize": statusAuthorized,
+	"capture":   statusCaptured,
+	"settle":    statusSettled,
+	"fail":      statusFailed,
+	"cancel":    statusCanceled,
+	"expire":    statusExpired,
+}
+
+var (
+	errPaymentNotFound   = errors.New("payment not found")
+	errInvalidTransition = errors.New("invalid status transition")
+	errVersionConflict   = errors.New("payment was modified concurrently")
+)
+
+func isPaymentStatus(s string) bool {
+	switch s {
+	case statusInReview, statusCreated, statusRequiresAction, statusAuthorized, statusCaptured, statusSettled, statusFailed, statusCanceled, statusExpired:
+		return true
+	}
+	return false
+}
+
+func canTransition(from, to string) bool {
+	for _, s := range paymentTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+type paymentEvent struct {
+	ID         int64     `json:"id"`
+	FromStatus string    `json:"from_status,omitempty"`
+	ToStatus   string    `json:"to_status"`
+	Reason     string    `json:"reason,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type transitionRequest struct {
+	Reason string `json:"reason"`
+	// when set, the transition only applies if the payment is still at
+	// this version
+	ExpectedVersion int64 `json:"expected_version"`
+
+	// capture only: how much to take from the hold (zero takes the rest),
+	// and whether this is the last capture
+	Amount        int64  `json:"amount"`
+	AmountDecimal string `json:"amount_decimal"`
+	Final         bool   `json:"final"`
+}
+
+func (st *appState) transitionPayment(w http.ResponseWriter, r *http.Request, id, action string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req transitionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	var p payment
+	var err error
+	if action == "capture" {
+		p, err = st.capturePayment(ctx, id, req)
+	} else if st.provider != nil && providerActions[action] {
+		p, err = st.providerTransition(ctx, id, action, req)
+	} else {
+		p, err = st.applyTransition(ctx, id, paymentActions[action], req.Reason, req.ExpectedVersion)
+	}
+	if err != nil {
+		writeTransitionError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+func writeTransitionError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errPaymentNotFound):
+		http.Error(w, "not found", http.StatusNotFound)
+	case errors.Is(err, errInvalidTransition), errors.Is(err, errVersionConflict):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, errUnknownCurrency), errors.Is(err, errInvalidAmount):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, errCaptureExceedsHold):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	case errors.Is(err, errProviderDeclined):
+		http.Error(w, err.Error(), http.StatusPaymentRequired)
+	case errors.Is(err, errProviderTimeout):
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+	case errors.Is(err, errProviderUnavailable):
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	default:
+		http.Error(w, "db error", http.StatusInternalServerError)
+	}
+}
+
+// applyTransition moves a payment to status to and records the change in
+// payment_events, the ledger, its hold and the outbox, in one transaction.
+// The UPDATE is guarded by the version read at the start, so of two
+// concurrent transitions only one can win.
+func (st *appState) applyTransition(ctx context.Context, id, to, reason string, expectedVersion int64) (payment, error) {
+	return st.applyProviderTransition(ctx, id, to, reason, expectedVersion, nil, nil)
+}
+
+// applyProviderTransition is applyTransition that also stores the provider
+// response that caused it on the payment. capture is the final capture
+// already made with the provider when moving to "captured"; nil captures
+// whatever the hold has left.
+func (st *appState) applyProviderTransition(ctx context.Context, id, to, reason string, expectedVersion int64, res *providerResult, capture *captureRequest) (payment, error) {
+	var p payment
+
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return p, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	err = scanPayment(tx.QueryRowContext(ctx, `
+		SELECT `+paymentColumns+`
+		FROM payments
+		WHERE id = $1::uuid
+	`, id), &p)
+	if errors.Is(err, sql.ErrNoRows) {
+		return p, errPaymentNotFound
+	}
+	if err != nil {
+		return p, err
+	}
+
+	if expectedVersion != 0 && p.Version != expectedVersion {
+		return p, errVersionConflict
+	}
+	from := p.Status
+	if !canTransition(from, to) {
+		return p, fmt.Errorf("%w: %s -> %s", errInvalidTransition, from, to)
+	}
+	var step captureRequest
+	if to == statusCaptured {
+		if step, err = captureStep(ctx, tx, p, capture); err != nil {
+			return p, err
+		}
+	}
+
+	err = scanPayment(tx.QueryRowContext(ctx, `
+		UPDATE payments
+		SET status = $2, captured_amount = captured_amount + $4, version = version + 1, updated_at = now()
+		WHERE id = $1::uuid AND version = $3
+		RETURNING `+paymentColumns,
+		id, to, p.Version, step.Amount), &p)
+	if errors.Is(err, sql.ErrNoRows) {
+		return p, errVersionConflict
+	}
+	if err != nil {
+		return p, err
+	}
+	if res != nil {
+		if err := saveProviderResult(ctx, tx, id, st.provider.Name(), *res, &p); err != nil {
+			return p, err
+		}
+	}
+
+	if err := recordPaymentEvent(ctx, tx, id, from, to, reason); err != nil {
+		return p, err
+	}
+	if err := st.updateHold(ctx, tx, p, from, to, step); err != nil {
+		return p, err
+	}
+
+	var refunded int64
+	if to == statusSettled {
+		if err := tx.QueryRowContext(ctx, `
+			SELECT (SELECT COALESCE(SUM(amount), 0) FROM refunds WHERE payment_id = $1::uuid AND status = $2)
+			     + (SELECT COALESCE(SUM(amount), 0) FROM disputes WHERE payment_id = $1::uuid AND status = $3)
+		`, id, refundSucceeded, disputeLost).Scan(&refunded); err != nil {
+			return p, err
+		}
+	}
+	entry := transitionEntry(p, to, refunded)
+	if to == statusCaptured {
+		entry = captureEntry(p, step.Amount)
+	}
+	if err := postEntry(ctx, tx, entry); err != nil {
+		return p, err
+	}
+	if err := enqueueEvent(ctx, tx, id, p.UserID, "payment."+to, p); err != nil {
+		return p, err
+	}
+	return p, tx.Commit()
+}
+
+func recordPaymentEvent(ctx context.Context, tx *sql.Tx, paymentID, from, to, reason string) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO payment_events(payment_id, from_status, to_status, reason)
+		VALUES ($1::uuid, NULLIF($2, ''), $3, NULLIF($4, ''))
+	`, paymentID, from, to, reason)
+	return err
+}
+
+func listPaymentEvents(ctx context.Context, db *sql.DB, paymentID string) ([]paymentEvent, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, COALESCE(from_status, ''), to_status, COALESCE(reason, ''), created_at
+		FROM payment_events
+		WHERE payment_id = $1::uuid
+		ORDER BY id
+	`, paymentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []paymentEvent{}
+	for rows.Next() {
+		var e paymentEvent
+		if err := rows.Scan(&e.ID, &e.FromStatus, &e.ToStatus, &e.Reason, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+// expirePayments moves payments that stayed in "created" or
+// "requires_action" for longer than after to "expired". The clock starts at
+// the last status change, so a payment released from fraud review gets the
+// full window. A zero after disables expiry.
+func (st *appState) expirePayments(ctx context.Context, after, every time.Duration) {
+	if after <= 0 {
+		return
+	}
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		qctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		ids, err := st.stalePaymentIDs(qctx, after)
+		cancel()
+		if err != nil {
+			log.Printf(`{"msg":"payment expiry query failed","error":%q}`, err.Error())
+			continue
+		}
+		for _, id := range ids {
+			tctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			_, err := st.applyTransition(tctx, id, statusExpired, "not authorized in time", 0)
+			cancel()
+			// losing a race to a concurrent authorize is expected
+			if err != nil && !errors.Is(err, errInvalidTransition) && !errors.Is(err, errVersionConflict) {
+				log.Printf(`{"msg":"payment expiry failed","payment_id":%q,"error":%q}`, id, err.Error())
+			}
+		}
+	}
+}
+
+func (st *appState) stalePaymentIDs(ctx context.Context, after time.Duration) ([]string, error) {
+	rows, err := st.db.QueryContext(ctx, `
+		SELECT id::text
+		FROM payments
+		WHERE status IN ($1, $2) AND updated_at < now() - make_interval(secs => $3)
+		ORDER BY updated_at
+		LIMIT 100
+	`, statusCreated, statusRequiresAction, after.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func paymentExpiryFromEnv() time.Duration {
+	d, err := time.ParseDuration(getenv("PAYMENT_EXPIRE_AFTER", "0"))
+	if err != nil {
+		log.Printf(`{"msg":"invalid PAYMENT_EXPIRE_AFTER, expiry disabled","error":%q}`, err.Error())
+		return 0
+	}
+	return d
+}
+
+const lifecycleSchema = `
+	ALTER TABLE payments ADD COLUMN IF NOT EXISTS version bigint NOT NULL DEFAULT 1;
+	ALTER TABLE payments ADD COLUMN IF NOT EXISTS updated_at timestamptz NOT NULL DEFAULT now();
+
+	CREATE TABLE IF NOT EXISTS payment_events (
+		id bigserial PRIMARY KEY,
+		payment_id uuid NOT NULL REFERENCES payments(id),
+		from_status text,
+		to_status text NOT NULL,
+		reason text,
+		created_at timestamptz NOT NULL DEFAULT now()
+	);
+
+	CREATE INDEX IF NOT EXISTS payment_events_payment_idx ON payment_events(payment_id, id);
+`
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPaymentTransitions(t *testing.T) {
+	cases := []struct {
+		from, to string
+		ok       bool
+	}{
+		{statusCreated, statusAuthorized, true},
+		{statusAuthorized, statusCaptured, true},
+		{statusCaptured, statusSettled, true},
+		{statusCreated, statusCaptured, false},
+		{statusCaptured, statusCanceled, false},
+		{statusSettled, statusCaptured, false},
+		{statusCanceled, statusAuthorized, false},
+		{statusExpired, statusAuthorized, false},
+		{statusInReview, statusCreated, true},
+		{statusInReview, statusAuthorized, false},
+	}
+	for _, c := range cases {
+		if got := canTransition(c.from, c.to); got != c.ok {
+			t.Errorf("canTransition(%s, %s) = %v, want %v", c.from, c.to, got, c.ok)
+		}
+	}
+}
+
+func TestPaymentActionsTargetKnownStatuses(t *testing.T) {
+	reachable := map[string]bool{}
+	for _, tos := range paymentTransitions {
+		for _, to := range tos {
+			reachable[to] = true
+		}
+	}
+	for action, to := range paymentActions {
+		if !reachable[to] {
+			t.Errorf("action %q targets unreachable status %q", action, to)
+		}
+	}
+}
+
+func TestPaymentSubResourceRouting(t *testing.T) {
+	h := newTestMux(&appState{}, "payments-service", "test")
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/payments/3f1c2b9e-8a4d-4b7e-9c1a-2d3e4f5a6b7c/capture", nil)
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405 for GET on an action, got %d", rr.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/v1/payments/3f1c2b9e-8a4d-4b7e-9c1a-2d3e4f5a6b7c/teleport", nil)
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown action, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Limit names, as reported in a breach.
+const (
+	limitMaxSingle    = "max_single"
+	limitDailyTotal   = "daily_total"
+	limitMonthlyTotal = "monthly_total"
+	limitHourlyCount  = "hourly_count"
+)
+
+// limitSet is one tier's limits for one currency. Amounts are decimal
+// strings in major units, like amount_decimal; empty or zero means no
+// limit.
+type limitSet struct {
+	MaxSingle    string `json:"max_single,omitempty"`
+	DailyTotal   string `json:"daily_total,omitempty"`
+	MonthlyTotal string `json:"monthly_total,omitempty"`
+	HourlyCount  int    `json:"hourly_count,omitempty"`
+}
+
+// limitConfig maps tier -> currency -> limits. The currency "*" applies to
+// currencies without their own entry; per-currency entries override it
+// field by field.
+type limitConfig map[string]map[string]limitSet
+
+// defaultLimitConfig is used unless PAYMENT_LIMIT_TIERS is set. Amount
+// limits are only set for the major currencies; others just get the count.
+var defaultLimitConfig = limitConfig{
+	"standard": {
+		"*":   {HourlyCount: 30},
+		"EUR": {MaxSingle: "5000", DailyTotal: "10000", MonthlyTotal: "50000"},
+		"USD": {MaxSingle: "5000", DailyTotal: "10000", MonthlyTotal: "50000"},
+		"GBP": {MaxSingle: "4000", DailyTotal: "8000", MonthlyTotal: "40000"},
+	},
+	"verified": {
+		"*":   {HourlyCount: 100},
+		"EUR": {MaxSingle: "25000", DailyTotal: "50000", MonthlyTotal: "250000"},
+		"USD": {MaxSingle: "25000", DailyTotal: "50000", MonthlyTotal: "250000"},
+		"GBP": {MaxSingle: "20000", DailyTotal: "40000", MonthlyTotal: "200000"},
+	},
+	"business": {
+		"*":   {HourlyCount: 1000},
+		"EUR": {MaxSingle: "250000", DailyTotal: "1000000", MonthlyTotal: "10000000"},
+		"USD": {MaxSingle: "250000", DailyTotal: "1000000", MonthlyTotal: "10000000"},
+		"GBP": {MaxSingle: "200000", DailyTotal: "800000", MonthlyTotal: "8000000"},
+	},
+}
+
+// paymentLimits is the limit configuration the service runs with.
+type paymentLimits struct {
+	tiers       limitConfig
+	defaultTier string
+}
+
+func paymentLimitsFromEnv() (*paymentLimits, error) {
+	l := &paymentLimits{tiers: defaultLimitConfig, defaultTier: getenv("PAYMENT_LIMIT_DEFAULT_TIER", "standard")}
+	if raw := getenv("PAYMENT_LIMIT_TIERS", ""); raw != "" {
+		var cfg limitConfig
+		if err := json.Unmarshal([]byte(raw), &cfg); err != nil {
+			return nil, fmt.Errorf("PAYMENT_LIMIT_TIERS: %w", err)
+		}
+		l.tiers = cfg
+	}
+	if err := l.tiers.validate(); err != nil {
+		return nil, err
+	}
+	if _, ok := l.tiers[l.defaultTier]; !ok {
+		return nil, fmt.Errorf("PAYMENT_LIMIT_DEFAULT_TIER %q is not a configured tier", l.defaultTier)
+	}
+	return l, nil
+}
+
+func (c limitConfig) validate() error {
+	for tier, byCurrency := range c {
+		for code, set := range byCurrency {
+			if err := set.validate(code); err != nil {
+				return fmt.Errorf("limits for tier %q, currency %q: %w", tier, code, err)
+			}
+		}
+	}
+	return nil
+}
+
+// validate checks that every amount parses in currency code. Amounts for
+// "*" must be whole major units so they parse in every currency.
+func (s limitSet) validate(code string) error {
+	exp := 0
+	if code != "*" {
+		cur, err := lookupCurrency(code)
+		if err != nil {
+			return err
+		}
+		exp = cur.Exponent
+	}
+	for _, v := range []string{s.MaxSingle, s.DailyTotal, s.MonthlyTotal} {
+		if v == "" {
+			continue
+		}
+		if _, err := parseDecimalAmount(v, exp); err != nil {
+			return err
+		}
+	}
+	if s.HourlyCount < 0 {
+		return errors.New("hourly_count must not be negative")
+	}
+	return nil
+}
+
+// merge returns s with every field that o sets taken from o.
+func (s limitSet) merge(o limitSet) limitSet {
+	if o.MaxSingle != "" {
+		s.MaxSingle = o.MaxSingle
+	}
+	if o.DailyTotal != "" {
+		s.DailyTotal = o.DailyTotal
+	}
+	if o.MonthlyTotal != "" {
+		s.MonthlyTotal = o.MonthlyTotal
+	}
+	if o.HourlyCount != 0 {
+		s.HourlyCount = o.HourlyCount
+	}
+	return s
+}
+
+// effectiveLimits resolves a user's limits for currency, most specific
+// last: tier "*", tier currency, user "*", user currency.
+func (l *paymentLimits) effectiveLimits(tier, currency string, overrides map[string]limitSet) limitSet {
+	if tier == "" {
+		tier = l.defaultTier
+	}
+	var s limitSet
+	s = s.merge(l.tiers[tier]["*"])
+	s = s.merge(l.tiers[tier][currency])
+	s = s.merge(overrides["*"])
+	s = s.merge(overrides[currency])
+	return s
+}
+
+// limitUsage is what a user has already used in one currency.
+type limitUsage struct {
+	DailyTotal   int64 `json:"daily_total"`
+	MonthlyTotal int64 `json:"monthly_total"`
+	HourlyCount  int   `json:"hourly_count"`
+}
+
+// limitWindows returns the start of the UTC day and month and the start of
+// the rolling hour that now falls in.
+func limitWindows(now time.Time) (day, month, hour time.Time) {
+	now = now.UTC()
+	day = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	month = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return day, month, now.Add(-time.Hour)
+}
+
+// limitBreach is the structured error returned when a payment would exceed
+// a limit. Amounts are minor units with decimal renderings alongside.
+type limitBreach struct {
+	Error            string `json:"error"`
+	Limit            string `json:"limit"`
+	Currency         string `json:"currency"`
+	Allowed          int64  `json:"allowed"`
+	AllowedDecimal   string `json:"allowed_decimal,omitempty"`
+	Current          int64  `json:"current"`
+	CurrentDecimal   string `json:"current_decimal,omitempty"`
+	Requested        int64  `json:"requested"`
+	RequestedDecimal string `json:"requested_decimal,omitempty"`
+}
+
+// checkLimits reports the first limit that a payment of amount would break
+// given usage, or nil.
+func checkLimits(s limitSet, currency string, amount int64, u limitUsage) (*limitBreach, error) {
+	cur, err := lookupCurrency(currency)
+	if err != nil {
+		return nil, err
+	}
+	minor := func(v string) (int64, error) {
+		if v == "" {
+			return 0, nil
+		}
+		return parseDecimalAmount(v, cur.Exponent)
+	}
+	breach := func(name string, allowed, current, requested int64, isAmount bool) *limitBreach {
+		b := &limitBreach{Error: "limit_exceeded", Limit: name, Currency: cur.Code,
+			Allowed: allowed, Current: current, Requested: requested}
+		if isAmount {
+			b.AllowedDecimal = formatMinorUnits(allowed, cur.Exponent)
+			b.CurrentDecimal = formatMinorUnits(current, cur.Exponent)
+			b.RequestedDecimal = formatMinorUnits(requested, cur.Exponent)
+		}
+		return b
+	}
+
+	maxSingle, err := minor(s.MaxSingle)
+	if err != nil {
+		return nil, err
+	}
+	if maxSingle > 0 && amount > maxSingle {
+		return breach(limitMaxSingle, maxSingle, 0, amount, true), nil
+	}
+	daily, err := minor(s.DailyTotal)
+	if err != nil {
+		return nil, err
+	}
+	if daily > 0 && u.DailyTotal+amount > daily {
+		return breach(limitDailyTotal, daily, u.DailyTotal, amount, true), nil
+	}
+	monthly, err := minor(s.MonthlyTotal)
+	if err != nil {
+		return nil, err
+	}
+	if monthly > 0 && u.MonthlyTotal+amount > monthly {
+		return breach(limitMonthlyTotal, monthly, u.MonthlyTotal, amount, true), nil
+	}
+	if s.HourlyCount > 0 && u.HourlyCount+1 > s.HourlyCount {
+		return breach(limitHourlyCount, int64(s.HourlyCount), int64(u.HourlyCount), 1, false), nil
+	}
+	return nil, nil
+}
+
+// errLimitExceeded wraps a limitBreach so it can travel as an error.
+type errLimitExceeded struct{ breach *limitBreach }
+
+func (e errLimitExceeded) Error() string {
+	return fmt.Sprintf("payment limit %s exceeded for %s", e.breach.Limit, e.breach.Currency)
+}
+
+// enforceLimits checks a new payment against the user's limits inside the
+// creating transaction. A transaction-scoped advisory lock per user
+// serializes concurrent creates for that user, so two requests cannot both
+// fit under a limit that only one of them should.
+func (l *paymentLimits) enforceLimits(ctx context.Context, tx *sql.Tx, userID, currency string, amount int64, now time.Time) error {
+	if l == nil {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtextextended('payment_limits:' || $1, 0))`, userID); err != nil {
+		return err
+	}
+
+	tier, overrides, err := loadUserLimits(ctx, tx, userID)
+	if err != nil {
+		return err
+	}
+	set := l.effectiveLimits(tier, currency, overrides)
+	if set == (limitSet{}) {
+		return nil
+	}
+
+	u, err := loadLimitUsage(ctx, tx, userID, currency, now)
+	if err != nil {
+		return err
+	}
+
+	b, err := checkLimits(set, currency, amount, u)
+	if err != nil {
+		return err
+	}
+	if b != nil {
+		log.Printf(`{"msg":"payment limit exceeded","user_id":%q,"limit":%q,"currency":%q}`, userID, b.Limit, b.Currency)
+		return errLimitExceeded{breach: b}
+	}
+	return nil
+}
+
+// querier is satisfied by both *sql.DB and *sql.Tx.
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// loadLimitUsage sums the user's live payments (not failed, canceled or
+// expired) in currency over the limit windows.
+func loadLimitUsage(ctx context.Context, q querier, userID, currency string, now time.Time) (limitUsage, error) {
+	day, month, hour := limitWindows(now)
+	var u limitUsage
+	err := q.QueryRowContext(ctx, `
+		SELECT COALESCE(SUM(amount) FILTER (WHERE created_at >= $3), 0),
+		       COALESCE(SUM(amount) FILTER (WHERE created_at >= $4), 0),
+		       COUNT(*) FILTER (WHERE created_at >= $5)
+		FROM payments
+		WHERE user_id = $1 AND currency = $2
+		  AND status NOT IN ($6, $7, $8)
+		  AND created_at >= LEAST($4::timestamptz, $5::timestamptz)
+	`, userID, currency, day, month, hour, statusFailed, statusCanceled, statusExpired,
+	).Scan(&u.DailyTotal, &u.MonthlyTotal, &u.HourlyCount)
+	return u, err
+}
+
+func loadUserLimits(ctx context.Context, q querier, userID string) (string, map[string]limitSet, error) {
+	var tier string
+	err := q.QueryRowContext(ctx, `SELECT tier FROM user_limit_tiers WHERE user_id = $1`, userID).Scan(&tier)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return "", nil, err
+	}
+
+	rows, err := q.QueryContext(ctx, `
+		SELECT currency, COALESCE(max_single, ''), COALESCE(daily_total, ''), COALESCE(monthly_total, ''), COALESCE(hourly_count, 0)
+		FROM user_limit_overrides
+		WHERE user_id = $1
+	`, userID)
+	if err != nil {
+		return "", nil, err
+	}
+	defer rows.Close()
+
+	overrides := map[string]limitSet{}
+	for rows.Next() {
+		var code string
+		var s limitSet
+		if err := rows.Scan(&code, &s.MaxSingle, &s.DailyTotal, &s.MonthlyTotal, &s.HourlyCount); err != nil {
+			return "", nil, err
+		}
+		overrides[code] = s
+	}
+	return tier, overrides, rows.Err()
+}
+
+type userLimitsView struct {
+	UserID    string              `json:"user_id"`
+	Tier      string              `json:"tier"`
+	Overrides map[string]limitSet `json:"overrides"`
+	// set when ?currency= is given
+	Effective *limitSet   `json:"effective,omitempty"`
+	Usage     *limitUsage `json:"usage,omitempty"`
+}
+
+// handleLimits serves the admin API:
+//
+//	GET    /v1/limits/tiers
+//	GET    /v1/limits/users/{user_id}[?currency=]
+//	PUT    /v1/limits/users/{user_id}              {"tier": "..."}
+//	PUT    /v1/limits/users/{user_id}/{currency}   limitSet; currency may be "*"
+//	DELETE /v1/limits/users/{user_id}/{currency}
+func (st *appState) handleLimits(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/limits/"), "/")
+	if rest == "tiers" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if st.limits == nil {
+			http.Error(w, "limits not configured", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"default_tier": st.limits.defaultTier, "tiers": st.limits.tiers})
+		return
+	}
+
+	parts := strings.Split(rest, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] != "users" || parts[1] == "" {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	userID := parts[1]
+
+	if len(parts) == 3 {
+		code := strings.ToUpper(parts[2])
+		switch r.Method {
+		case http.MethodPut:
+			st.putLimitOverride(ctx, w, r, userID, code)
+		case http.MethodDelete:
+			if _, err := st.db.ExecContext(ctx, `
+				DELETE FROM user_limit_overrides WHERE user_id = $1 AND currency = $2
+			`, userID, code); err != nil {
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		st.getUserLimits(ctx, w, userID, strings.ToUpper(strings.TrimSpace(r.URL.Query().Get("currency"))))
+	case http.MethodPut:
+		var req struct {
+			Tier string `json:"tier"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		if st.limits == nil || st.limits.tiers[req.Tier] == nil {
+			http.Error(w, "unknown tier", http.StatusBadRequest)
+			return
+		}
+		if _, err := st.db.ExecContext(ctx, `
+			INSERT INTO user_limit_tiers(user_id, tier) VALUES ($1, $2)
+			ON CONFLICT (user_id) DO UPDATE SET tier = EXCLUDED.tier, updated_at = now()
+		`, userID, req.Tier); err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		st.getUserLimits(ctx, w, userID, "")
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (st *appState) putLimitOverride(ctx context.Context, w http.ResponseWriter, r *http.Request, userID, code string) {
+	var s limitSet
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if err := s.validate(code); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := st.db.ExecContext(ctx, `
+		INSERT INTO user_limit_overrides(user_id, currency, max_single, daily_total, monthly_total, hourly_count)
+		VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, ''), NULLIF($5, ''), NULLIF($6, 0))
+		ON CONFLICT (user_id, currency) DO UPDATE
+		SET max_single = EXCLUDED.max_single, daily_total = EXCLUDED.daily_total,
+		    monthly_total = EXCLUDED.monthly_total, hourly_count = EXCLUDED.hourly_count, updated_at = now()
+	`, userID, code, s.MaxSingle, s.DailyTotal, s.MonthlyTotal, s.HourlyCount); err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	st.getUserLimits(ctx, w, userID, "")
+}
+
+func (st *appState) getUserLimits(ctx context.Context, w http.ResponseWriter, userID, currency string) {
+	tier, overrides, err := loadUserLimits(ctx, st.db, userID)
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	v := userLimitsView{UserID: userID, Tier: tier, Overrides: overrides}
+	if v.Tier == "" && st.limits != nil {
+		v.Tier = st.limits.defaultTier
+	}
+
+	if currency != "" && st.limits != nil {
+		if _, err := lookupCurrency(currency); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		eff := st.limits.effectiveLimits(tier, currency, overrides)
+		v.Effective = &eff
+
+		u, err := loadLimitUsage(ctx, st.db, userID, currency, time.Now())
+		if err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		v.Usage = &u
+	}
+	writeJSON(w, http.StatusOK, v)
+}
+
+const limitsSchema = `
+	CREATE TABLE IF NOT EXISTS user_limit_tiers (
+		user_id text PRIMARY KEY,
+		tier text NOT NULL,
+		updated_at timestamptz NOT NULL DEFAULT now()
+	);
+
+	CREATE TABLE IF NOT EXISTS user_limit_overrides (
+		user_id text NOT NULL,
+		currency text NOT NULL,
+		max_single text,
+		daily_total text,
+		monthly_total text,
+		hourly_count int,
+		updated_at timestamptz NOT NULL DEFAULT now(),
+		PRIMARY KEY (user_id, currency)
+	);
+
+	CREATE INDEX IF NOT EXISTS payments_user_currency_created_idx ON payments(user_id, currency, created_at);
+`
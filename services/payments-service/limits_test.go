@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEffectiveLimitsMostSpecificWins(t *testing.T) {
+	l := &paymentLimits{defaultTier: "standard", tiers: limitConfig{
+		"standard": {
+			"*":   {MaxSingle: "100", HourlyCount: 10},
+			"EUR": {MaxSingle: "200", DailyTotal: "500"},
+		},
+	}}
+	overrides := map[string]limitSet{
+		"*":   {HourlyCount: 3},
+		"EUR": {DailyTotal: "50"},
+	}
+
+	got := l.effectiveLimits("", "EUR", overrides)
+	want := limitSet{MaxSingle: "200", DailyTotal: "50", HourlyCount: 3}
+	if got != want {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	if got := l.effectiveLimits("", "USD", nil); got != (limitSet{MaxSingle: "100", HourlyCount: 10}) {
+		t.Fatalf("fallback: got %+v", got)
+	}
+}
+
+func TestCheckLimitsNamesTheBreach(t *testing.T) {
+	s := limitSet{MaxSingle: "100", DailyTotal: "150", MonthlyTotal: "1000", HourlyCount: 5}
+	cases := []struct {
+		amount int64
+		usage  limitUsage
+		want   string
+	}{
+		{5000, limitUsage{}, ""},
+		{10001, limitUsage{}, limitMaxSingle},
+		{6000, limitUsage{DailyTotal: 9001}, limitDailyTotal},
+		{100, limitUsage{MonthlyTotal: 99901}, limitMonthlyTotal},
+		{100, limitUsage{HourlyCount: 5}, limitHourlyCount},
+	}
+	for _, c := range cases {
+		b, err := checkLimits(s, "EUR", c.amount, c.usage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		if b != nil {
+			got = b.Limit
+		}
+		if got != c.want {
+			t.Fatalf("amount %d usage %+v: got %q, want %q", c.amount, c.usage, got, c.want)
+		}
+	}
+
+	b, _ := checkLimits(s, "EUR", 6000, limitUsage{DailyTotal: 9001})
+	if b.AllowedDecimal != "150.00" || b.CurrentDecimal != "90.01" || b.RequestedDecimal != "60.00" {
+		t.Fatalf("unexpected breach %+v", b)
+	}
+}
+
+func TestLimitWindows(t *testing.T) {
+	now := time.Date(2026, 10, 18, 13, 45, 0, 0, time.FixedZone("CEST", 2*3600))
+	day, month, hour := limitWindows(now)
+	if !day.Equal(time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)) ||
+		!month.Equal(time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)) ||
+		!hour.Equal(now.Add(-time.Hour)) {
+		t.Fatalf("unexpected windows %v %v %v", day, month, hour)
+	}
+}
+
+func TestLimitSetValidate(t *testing.T) {
+	if err := (limitSet{MaxSingle: "10.50"}).validate("EUR"); err != nil {
+		t.Fatalf("expected valid, got %v", err)
+	}
+	if err := (limitSet{MaxSingle: "10.50"}).validate("*"); err == nil {
+		t.Fatal("expected fractional wildcard amount to be rejected")
+	}
+	if err := (limitSet{MaxSingle: "10.5"}).validate("JPY"); err == nil {
+		t.Fatal("expected fractional JPY amount to be rejected")
+	}
+	if err := (limitSet{}).validate("XXX"); err == nil {
+		t.Fatal("expected unknown currency to be rejected")
+	}
+}
+
+func TestPaymentLimitsFromEnv(t *testing.T) {
+	if err := defaultLimitConfig.validate(); err != nil {
+		t.Fatalf("default config invalid: %v", err)
+	}
+
+	t.Setenv("PAYMENT_LIMIT_TIERS", `{"basic": {"*": {"hourly_count": 2}}}`)
+	t.Setenv("PAYMENT_LIMIT_DEFAULT_TIER", "basic")
+	l, err := paymentLimitsFromEnv()
+	if err != nil || l.effectiveLimits("", "EUR", nil).HourlyCount != 2 {
+		t.Fatalf("unexpected %+v, %v", l, err)
+	}
+
+	t.Setenv("PAYMENT_LIMIT_DEFAULT_TIER", "standard")
+	if _, err := paymentLimitsFromEnv(); err == nil {
+		t.Fatal("expected error for a default tier that is not configured")
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+var errInvalidFilter = errors.New("invalid filter")
+
+// paymentFilter is the parsed query string of GET /v1/payments.
+type paymentFilter struct {
+	UserID      string
+	Statuses    []string
+	Currency    string
+	AmountMin   int64
+	AmountMax   int64
+	CreatedFrom time.Time
+	CreatedTo   time.Time
+	RefPrefix   string
+	Limit       int
+	After       *paymentCursor
+}
+
+// paymentCursor is the (created_at, id) of the last row of a page. Pages
+// are ordered newest first, so the next page holds rows strictly before it.
+type paymentCursor struct {
+	CreatedAt time.Time
+	ID        string
+}
+
+func (c paymentCursor) encode() string {
+	raw := strconv.FormatInt(c.CreatedAt.UnixNano(), 10) + "|" + c.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodePaymentCursor(s string) (*paymentCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed cursor", errInvalidFilter)
+	}
+	ts, id, ok := strings.Cut(string(raw), "|")
+	nanos, err := strconv.ParseInt(ts, 10, 64)
+	if !ok || err != nil || id == "" {
+		return nil, fmt.Errorf("%w: malformed cursor", errInvalidFilter)
+	}
+	return &paymentCursor{CreatedAt: time.Unix(0, nanos).UTC(), ID: id}, nil
+}
+
+func parsePaymentFilter(q url.Values) (paymentFilter, error) {
+	f := paymentFilter{
+		UserID:    strings.TrimSpace(q.Get("user_id")),
+		Currency:  strings.ToUpper(strings.TrimSpace(q.Get("currency"))),
+		RefPrefix: strings.TrimSpace(q.Get("ref_prefix")),
+		Limit:     defaultPageSize,
+	}
+
+	if s := q.Get("status"); s != "" {
+		for _, st := range strings.Split(s, ",") {
+			st = strings.TrimSpace(st)
+			if !isPaymentStatus(st) {
+				return f, fmt.Errorf("%w: unknown status %q", errInvalidFilter, st)
+			}
+			f.Statuses = append(f.Statuses, st)
+		}
+	}
+
+	var err error
+	if f.AmountMin, err = parseIntParam(q, "amount_min"); err != nil {
+		return f, err
+	}
+	if f.AmountMax, err = parseIntParam(q, "amount_max"); err != nil {
+		return f, err
+	}
+	if f.CreatedFrom, err = parseTimeParam(q, "created_from"); err != nil {
+		return f, err
+	}
+	if f.CreatedTo, err = parseTimeParam(q, "created_to"); err != nil {
+		return f, err
+	}
+
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxPageSize {
+			return f, fmt.Errorf("%w: limit must be between 1 and %d", errInvalidFilter, maxPageSize)
+		}
+		f.Limit = n
+	}
+	if s := q.Get("cursor"); s != "" {
+		if f.After, err = decodePaymentCursor(s); err != nil {
+			return f, err
+		}
+	}
+	return f, nil
+}
+
+func parseIntParam(q url.Values, name string) (int64, error) {
+	s := q.Get(name)
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%w: %s must be a non-negative integer in minor units", errInvalidFilter, name)
+	}
+	return n, nil
+}
+
+func parseTimeParam(q url.Values, name string) (time.Time, error) {
+	s := q.Get(name)
+	if s == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: %s must be an RFC 3339 timestamp", errInvalidFilter, name)
+	}
+	return t, nil
+}
+
+// query builds the SELECT for one page. It fetches one row more than the
+// limit so the caller can tell whether another page exists.
+func (f paymentFilter) query() (string, []any) {
+	var where []string
+	var args []any
+	arg := func(v any) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	if f.UserID != "" {
+		where = append(where, "user_id = "+arg(f.UserID))
+	}
+	if len(f.Statuses) == 1 {
+		where = append(where, "status = "+arg(f.Statuses[0]))
+	} else if len(f.Statuses) > 1 {
+		where = append(where, "status = ANY("+arg(f.Statuses)+")")
+	}
+	if f.Currency != "" {
+		where = append(where, "currency = "+arg(f.Currency))
+	}
+	if f.AmountMin > 0 {
+		where = append(where, "amount >= "+arg(f.AmountMin))
+	}
+	if f.AmountMax > 0 {
+		where = append(where, "amount <= "+arg(f.AmountMax))
+	}
+	if !f.CreatedFrom.IsZero() {
+		where = append(where, "created_at >= "+arg(f.CreatedFrom))
+	}
+	if !f.CreatedTo.IsZero() {
+		where = append(where, "created_at < "+arg(f.CreatedTo))
+	}
+	if f.RefPrefix != "" {
+		where = append(where, "ref LIKE "+arg(escapeLike(f.RefPrefix)+"%"))
+	}
+	if f.After != nil {
+		where = append(where, "(created_at, id) < ("+arg(f.After.CreatedAt)+", "+arg(f.After.ID)+"::uuid)")
+	}
+
+	q := "SELECT " + paymentColumns + " FROM payments"
+	if len(where) > 0 {
+		q += " WHERE " + strings.Join(where, " AND ")
+	}
+	q += " ORDER BY created_at DESC, id DESC LIMIT " + arg(f.Limit+1)
+	return q, args
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// Indexes for the list endpoint. Equality filters (user, status, currency
+// and their common pairing) get an index ending in the (created_at, id)
+// ordering, so the planner can walk it in order and stop after one page.
+// Amount ranges and ref prefixes are selective enough to use their own
+// index and sort the few matching rows.
+const listingSchema = `
+	CREATE INDEX IF NOT EXISTS payments_created_id_idx ON payments(created_at DESC, id DESC);
+	CREATE INDEX IF NOT EXISTS payments_user_created_id_idx ON payments(user_id, created_at DESC, id DESC);
+	CREATE INDEX IF NOT EXISTS payments_status_created_id_idx ON payments(status, created_at DESC, id DESC);
+	DROP INDEX IF EXISTS payments_status_created_idx;
+	CREATE INDEX IF NOT EXISTS payments_currency_created_id_idx ON payments(currency, created_at DESC, id DESC);
+	CREATE INDEX IF NOT EXISTS payments_user_status_created_id_idx ON payments(user_id, status, created_at DESC, id DESC);
+	CREATE INDEX IF NOT EXISTS payments_amount_idx ON payments(amount);
+	CREATE INDEX IF NOT EXISTS payments_ref_prefix_idx ON payments(ref text_pattern_ops);
+	CREATE INDEX IF NOT EXISTS payments_user_ref_prefix_idx ON payments(user_id, ref text_pattern_ops);
+`
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPaymentCursorRoundTrip(t *testing.T) {
+	c := paymentCursor{CreatedAt: time.Date(2026, 3, 1, 12, 30, 0, 123456000, time.UTC), ID: "6f1c2a4e-0000-4000-8000-000000000001"}
+	got, err := decodePaymentCursor(c.encode())
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !got.CreatedAt.Equal(c.CreatedAt) || got.ID != c.ID {
+		t.Fatalf("round trip gave %+v, want %+v", got, c)
+	}
+
+	if _, err := decodePaymentCursor("not a cursor!"); !errors.Is(err, errInvalidFilter) {
+		t.Fatalf("expected errInvalidFilter, got %v", err)
+	}
+}
+
+func TestParsePaymentFilterRejectsBadInput(t *testing.T) {
+	for _, qs := range []string{
+		"limit=0",
+		"limit=500",
+		"status=pending",
+		"amount_min=-5",
+		"created_from=yesterday",
+	} {
+		q, _ := url.ParseQuery(qs)
+		if _, err := parsePaymentFilter(q); !errors.Is(err, errInvalidFilter) {
+			t.Errorf("%s: expected errInvalidFilter, got %v", qs, err)
+		}
+	}
+}
+
+func TestPaymentFilterQuery(t *testing.T) {
+	q, _ := url.ParseQuery("user_id=u1&status=captured,settled&currency=eur&amount_min=100&ref_prefix=inv_2026&limit=10")
+	f, err := parsePaymentFilter(q)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	f.After = &paymentCursor{CreatedAt: time.Unix(0, 0), ID: "x"}
+
+	sql, args := f.query()
+	for _, want := range []string{
+		"user_id = $1",
+		"status = ANY($2)",
+		"currency = $3",
+		"amount >= $4",
+		"ref LIKE $5",
+		"(created_at, id) < ($6, $7::uuid)",
+		"ORDER BY created_at DESC, id DESC LIMIT $8",
+	} {
+		if !strings.Contains(sql, want) {
+			t.Errorf("query %q missing %q", sql, want)
+		}
+	}
+	if args[2] != "EUR" || args[4] != `inv\_2026%` || args[7] != 11 {
+		t.Fatalf("unexpected args %v", args)
+	}
+
+	sql, args = paymentFilter{Limit: defaultPageSize}.query()
+	if strings.Contains(sql, "WHERE") || len(args) != 1 {
+		t.Fatalf("unfiltered query should only bind the limit: %q %v", sql, args)
+	}
+}
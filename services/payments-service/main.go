@@ -19,29 +19,155 @@ import (
 type appState struct {
 	dbReady bool
 	db      *sql.DB
+	// nil when payments are moved through their lifecycle by hand
+	provider Provider
+	// nil disables payment limits
+	limits *paymentLimits
+	// nil disables fraud screening
+	fraud fraudEngine
+	// nil disables authentication (dev only); every caller is an operator
+	identity *identityVerifier
+	// nil disables the ISO 20022 pain.001 export
+	debtor *isoDebtor
+	// expiry and capture mode of authorization holds
+	holds holdPolicy
+	// nil disables FX quotes
+	fx *fxService
+	// nil disables dispute evidence uploads
+	evidence BlobStore
+	// default time given to provide evidence for a new dispute
+	evidenceWindow time.Duration
+	// nil leaves approved payouts to be settled by operators
+	payoutProvider PayoutProvider
+	// payouts above these amounts need a second person's approval
+	payoutApproval payoutThresholds
 }
 
 type createPaymentRequest struct {
-	UserID   string `json:"user_id"`
-	Amount   int64  `json:"amount"`
-	Currency string `json:"currency"`
-	Ref      string `json:"ref"`
+	UserID string `json:"user_id"`
+	// amount in minor units; amount_decimal ("12.34") may be sent instead
+	Amount        int64  `json:"amount"`
+	AmountDecimal string `json:"amount_decimal,omitempty"`
+	Currency      string `json:"currency"`
+	Ref           string `json:"ref"`
+	// card token or other method reference passed to the provider, or
+	// "iban:<IBAN>" for a bank transfer exported as ISO 20022
+	PaymentMethod string `json:"payment_method,omitempty"`
+	// ISO 3166 billing country, used by fraud screening
+	Country string `json:"country,omitempty"`
+	// an open FX quote: the payment is taken in its source currency and
+	// credited in its target currency; currency and amount may be left out
+	FXQuoteID string `json:"fx_quote_id,omitempty"`
+}
+
+// normalize trims and validates req in place, resolving amount_decimal into
+// minor units.
+func (req *createPaymentRequest) normalize() error {
+	req.UserID = strings.TrimSpace(req.UserID)
+	req.Currency = strings.ToUpper(strings.TrimSpace(req.Currency))
+	req.Ref = strings.TrimSpace(req.Ref)
+	req.PaymentMethod = strings.TrimSpace(req.PaymentMethod)
+	req.Country = strings.ToUpper(strings.TrimSpace(req.Country))
+	req.FXQuoteID = strings.TrimSpace(req.FXQuoteID)
+
+	if req.UserID == "" || req.Currency == "" || req.Ref == "" {
+		return errors.New("user_id, amount (>0), currency, ref are required")
+	}
+	if strings.HasPrefix(req.Ref, "sched:") {
+		return errors.New(`ref prefix "sched:" is reserved for scheduled payments`)
+	}
+	pm, err := normalizePaymentMethod(req.PaymentMethod)
+	if err != nil {
+		return err
+	}
+	req.PaymentMethod = pm
+	cur, err := lookupCurrency(req.Currency)
+	if err != nil {
+		return err
+	}
+	if req.Amount, err = cur.resolveAmount(req.Amount, req.AmountDecimal); err != nil {
+		return err
+	}
+	if err := cur.checkAmount(req.Amount); err != nil {
+		return err
+	}
+	req.AmountDecimal = formatMinorUnits(req.Amount, cur.Exponent)
+	return nil
 }
 
 type payment struct {
-	ID        string    `json:"id"`
-	UserID    string    `json:"user_id"`
-	Amount    int64     `json:"amount"`
-	Currency  string    `json:"currency"`
-	Status    string    `json:"status"`
-	Ref       string    `json:"ref"`
-	CreatedAt time.Time `json:"created_at"`
+	ID     string `json:"id"`
+	UserID string `json:"user_id"`
+	Amount int64  `json:"amount"`
+	// Amount as a decimal string in the currency's major unit
+	AmountDecimal string `json:"amount_decimal,omitempty"`
+	Currency      string `json:"currency"`
+	Status        string `json:"status"`
+	Ref           string `json:"ref"`
+	// sum of the captures taken from the authorization so far
+	CapturedAmount int64 `json:"captured_amount"`
+	// sum of pending and succeeded refunds
+	RefundedAmount int64 `json:"refunded_amount"`
+	// sum of undecided and lost disputes
+	DisputedAmount int64  `json:"disputed_amount"`
+	PaymentMethod  string `json:"payment_method,omitempty"`
+	Provider       string `json:"provider,omitempty"`
+	ProviderRef    string `json:"provider_ref,omitempty"`
+	// last raw response from the provider
+	ProviderResponse json.RawMessage `json:"provider_response,omitempty"`
+	// set when the payment was made with an FX quote
+	FX        *paymentFX `json:"fx,omitempty"`
+	Version   int64      `json:"version"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// paymentColumns matches the field order expected by scanPayment.
+const paymentColumns = `id::text, user_id, amount, currency, status, ref, captured_amount, refunded_amount, disputed_amount,
+	COALESCE(payment_method, ''), COALESCE(provider, ''), COALESCE(provider_ref, ''), COALESCE(provider_response::text, ''),
+	COALESCE(fx_quote_id::text, ''), COALESCE(target_currency, ''), COALESCE(target_amount, 0),
+	COALESCE(fx_rate::text, ''), COALESCE(fx_mid_rate::text, ''),
+	version, created_at, updated_at`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanPayment(row rowScanner, p *payment) error {
+	var providerResponse string
+	var fx paymentFX
+	if err := row.Scan(&p.ID, &p.UserID, &p.Amount, &p.Currency, &p.Status, &p.Ref, &p.CapturedAmount, &p.RefundedAmount, &p.DisputedAmount,
+		&p.PaymentMethod, &p.Provider, &p.ProviderRef, &providerResponse,
+		&fx.QuoteID, &fx.TargetCurrency, &fx.TargetAmount, &fx.Rate, &fx.MidRate,
+		&p.Version, &p.CreatedAt, &p.UpdatedAt); err != nil {
+		return err
+	}
+	p.FX = nil
+	if fx.QuoteID != "" {
+		fx.TargetAmountDecimal = formatAmount(fx.TargetAmount, fx.TargetCurrency)
+		p.FX = &fx
+	}
+	p.AmountDecimal = formatAmount(p.Amount, p.Currency)
+	p.ProviderResponse = nil
+	if providerResponse != "" {
+		p.ProviderResponse = json.RawMessage(providerResponse)
+	}
+	return nil
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "reconcile" {
+		os.Exit(reconcileCommand(os.Args[2:], os.Stdout))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "iso20022" {
+		os.Exit(iso20022Command(os.Args[2:], os.Stdout))
+	}
+
 	port := getenv("PORT", "8083")
 	app := getenv("APP_NAME", "payments-service")
-	env := getenv("ENVIRONMENT", "dev")
+	// Unset means prod: the dev-only fallbacks (no caller authentication,
+	// simulated providers) must be asked for explicitly.
+	env := getenv("ENVIRONMENT", "prod")
 
 	// ---- OpenTelemetry (minimal init) ----
 	ctx := context.Background()
@@ -66,7 +192,52 @@ func main() {
 	db.SetMaxIdleConns(5)
 	db.SetConnMaxLifetime(30 * time.Minute)
 
-	st := &appState{db: db, dbReady: false}
+	provider, err := newProviderFromEnv(env)
+	if err != nil {
+		log.Fatalf("config error: %v", err)
+	}
+	limits, err := paymentLimitsFromEnv()
+	if err != nil {
+		log.Fatalf("config error: %v", err)
+	}
+	fraud, err := newRulesEngineFromEnv()
+	if err != nil {
+		log.Fatalf("config error: %v", err)
+	}
+	identity, err := identityVerifierFromEnv(env)
+	if err != nil {
+		log.Fatalf("config error: %v", err)
+	}
+	debtor, err := isoDebtorFromEnv()
+	if err != nil {
+		log.Fatalf("config error: %v", err)
+	}
+	holds, err := holdPolicyFromEnv()
+	if err != nil {
+		log.Fatalf("config error: %v", err)
+	}
+	fx, err := newFXFromEnv(db)
+	if err != nil {
+		log.Fatalf("config error: %v", err)
+	}
+	evidence, err := newBlobStoreFromEnv()
+	if err != nil {
+		log.Fatalf("config error: %v", err)
+	}
+	evidenceWindow, err := disputeEvidenceWindowFromEnv()
+	if err != nil {
+		log.Fatalf("config error: %v", err)
+	}
+	payoutProvider, err := newPayoutProviderFromEnv(env)
+	if err != nil {
+		log.Fatalf("config error: %v", err)
+	}
+	payoutApproval, err := payoutThresholdsFromEnv()
+	if err != nil {
+		log.Fatalf("config error: %v", err)
+	}
+	st := &appState{db: db, dbReady: false, provider: provider, limits: limits, fraud: fraud, identity: identity, debtor: debtor, holds: holds, fx: fx,
+		evidence: evidence, evidenceWindow: evidenceWindow, payoutProvider: payoutProvider, payoutApproval: payoutApproval}
 
 	go func() {
 		t := time.NewTicker(5 * time.Second)
@@ -83,6 +254,25 @@ func main() {
 		log.Fatalf("schema init failed: %v", err)
 	}
 
+	go st.expirePayments(ctx, paymentExpiryFromEnv(), time.Minute)
+	go st.syncProviderPayments(ctx, time.Minute)
+	go fraud.watch(ctx, 10*time.Second)
+	go st.runScheduler(ctx, 15*time.Second)
+	go st.runBatchWorker(ctx, 2*time.Second)
+	go st.sweepHolds(ctx, time.Minute)
+	go st.runPayoutWorker(ctx, 5*time.Second)
+
+	pub, err := newPublisherFromEnv()
+	if err != nil {
+		log.Fatalf("config error: %v", err)
+	}
+	// merchant webhooks are fanned out first; the fanout is idempotent, so a
+	// broker failure that makes the relay retry does not duplicate them
+	pub = multiPublisher{webhookFanout{db: db}, pub}
+	relay := newOutboxRelay(pgOutboxStore{db: db}, pub, outboxMaxAttemptsFromEnv())
+	go relay.run(ctx, time.Second)
+	go newWebhookDispatcherFromEnv(db).run(ctx, time.Second)
+
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
@@ -101,8 +291,28 @@ func main() {
 		writeText(w, http.StatusOK, fmt.Sprintf("%s running (%s)", app, env))
 	})
 
-	mux.HandleFunc("/v1/payments", st.handlePayments)
-	mux.HandleFunc("/v1/payments/", st.handlePaymentByID)
+	mux.HandleFunc("/v1/payments", st.authenticate(st.handlePayments))
+	mux.HandleFunc("/v1/payments/", st.authenticate(st.handlePaymentByID))
+	mux.HandleFunc("/v1/schedules", st.authenticate(st.handleSchedules))
+	mux.HandleFunc("/v1/schedules/", st.authenticate(st.handleSchedules))
+	mux.HandleFunc("/v1/batches", st.authenticate(st.handleBatches))
+	mux.HandleFunc("/v1/batches/", st.authenticate(st.handleBatches))
+	mux.HandleFunc("/v1/balances/", st.authenticate(st.handleBalances))
+	mux.HandleFunc("/v1/fx/", st.authenticate(st.handleFX))
+	mux.HandleFunc("/v1/disputes", st.authenticate(st.handleDisputes))
+	mux.HandleFunc("/v1/disputes/", st.authenticate(st.handleDisputes))
+	mux.HandleFunc("/v1/beneficiaries", st.authenticate(st.handleBeneficiaries))
+	mux.HandleFunc("/v1/beneficiaries/", st.authenticate(st.handleBeneficiaries))
+	mux.HandleFunc("/v1/payouts", st.authenticate(st.handlePayouts))
+	mux.HandleFunc("/v1/payouts/", st.authenticate(st.handlePayouts))
+	mux.HandleFunc("/v1/ledger/", st.requireOperator(st.handleLedger))
+	mux.HandleFunc("/v1/outbox/", st.requireOperator(st.handleOutbox))
+	mux.HandleFunc("/v1/webhooks/", st.requireOperator(st.handleWebhooks))
+	mux.HandleFunc("/v1/reconciliation/runs", st.requireOperator(st.handleReconciliation))
+	mux.HandleFunc("/v1/reconciliation/runs/", st.requireOperator(st.handleReconciliation))
+	mux.HandleFunc("/v1/limits/", st.requireOperator(st.handleLimits))
+	mux.HandleFunc("/v1/fraud/", st.requireOperator(st.handleFraud))
+	mux.HandleFunc("/v1/iso20022/", st.requireOperator(st.handleISO20022))
 
 	addr := ":" + port
 	log.Printf("starting %s on %s (env=%s)", app, addr, env)
@@ -139,105 +349,275 @@ func (st *appState) createPayment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	req.UserID = strings.TrimSpace(req.UserID)
-	req.Currency = strings.ToUpper(strings.TrimSpace(req.Currency))
-	req.Ref = strings.TrimSpace(req.Ref)
-
-	if req.UserID == "" || req.Amount <= 0 || req.Currency == "" || req.Ref == "" {
-		http.Error(w, "user_id, amount (>0), currency, ref are required", http.StatusBadRequest)
+	// payments belong to the caller; only operators create them for others
+	caller := callerFrom(r.Context())
+	if strings.TrimSpace(req.UserID) == "" {
+		req.UserID = caller.Subject
+	}
+	if !caller.mayActFor(strings.TrimSpace(req.UserID)) {
+		http.Error(w, "user_id does not match the authenticated user", http.StatusForbidden)
 		return
 	}
 
 	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
 
+	if strings.TrimSpace(req.FXQuoteID) != "" {
+		err := st.fillFromQuote(ctx, &req)
+		switch {
+		case errors.Is(err, errQuoteMismatch):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, errQuoteNotFound), errors.Is(err, errQuoteUnavailable):
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		case err != nil:
+			http.Error(w, "db error", http.StatusInternalServerError)
+		}
+		if err != nil {
+			return
+		}
+	}
+	if err := req.normalize(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	p, err := st.insertPayment(ctx, req)
+	var exceeded errLimitExceeded
+	var blocked errPaymentBlocked
+	switch {
+	case err == nil:
+		writeJSON(w, http.StatusCreated, p)
+	case errors.As(err, &exceeded):
+		writeJSON(w, http.StatusUnprocessableEntity, exceeded.breach)
+	case errors.As(err, &blocked):
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]any{
+			"error": "payment_blocked",
+			"score": blocked.assessment.Score,
+		})
+	case errors.Is(err, errDuplicateRef):
+		http.Error(w, "duplicate ref", http.StatusConflict)
+	case errors.Is(err, errQuoteUnavailable):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	default:
+		http.Error(w, "db error", http.StatusInternalServerError)
+	}
+}
+
+var errDuplicateRef = errors.New("duplicate ref")
+
+// errPaymentBlocked is returned by insertPayment when fraud screening
+// blocks the payment.
+type errPaymentBlocked struct {
+	assessment fraudAssessment
+}
+
+func (e errPaymentBlocked) Error() string {
+	return fmt.Sprintf("payment blocked by fraud screening (score %d)", e.assessment.Score)
+}
+
+// insertPayment creates a payment from a normalized request: it enforces
+// limits, screens it for fraud and records it with its first event, in one
+// transaction.
+func (st *appState) insertPayment(ctx context.Context, req createPaymentRequest) (payment, error) {
 	var p payment
-	err := st.db.QueryRowContext(ctx, `
-		INSERT INTO payments(user_id, amount, currency, status, ref)
-		VALUES ($1, $2, $3, 'created', $4)
-		RETURNING id::text, user_id, amount, currency, status, ref, created_at
-	`, req.UserID, req.Amount, req.Currency, req.Ref).Scan(
-		&p.ID, &p.UserID, &p.Amount, &p.Currency, &p.Status, &p.Ref, &p.CreatedAt,
-	)
+
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return p, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err := st.limits.enforceLimits(ctx, tx, req.UserID, req.Currency, req.Amount, time.Now()); err != nil {
+		return p, err
+	}
+
+	screening := req.fraudInput(time.Now())
+	status, assessment, err := st.screenPayment(ctx, tx, screening)
+	if err != nil {
+		return p, err
+	}
+	if assessment != nil && assessment.Decision == fraudBlock {
+		// a blocked payment is never created, but the decision is kept
+		if err := recordFraudDecision(ctx, tx, "", screening, *assessment); err != nil {
+			return p, err
+		}
+		if err := tx.Commit(); err != nil {
+			return p, err
+		}
+		return p, errPaymentBlocked{assessment: *assessment}
+	}
+
+	fx := &paymentFX{}
+	if req.FXQuoteID != "" {
+		if fx, err = claimQuote(ctx, tx, req); err != nil {
+			return p, err
+		}
+	}
+
+	err = scanPayment(tx.QueryRowContext(ctx, `
+		INSERT INTO payments(user_id, amount, currency, status, ref, payment_method,
+			fx_quote_id, target_currency, target_amount, fx_rate, fx_mid_rate)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''),
+			NULLIF($7, '')::uuid, NULLIF($8, ''), NULLIF($9::bigint, 0), NULLIF($10, '')::numeric, NULLIF($11, '')::numeric)
+		RETURNING `+paymentColumns,
+		req.UserID, req.Amount, req.Currency, status, req.Ref, req.PaymentMethod,
+		fx.QuoteID, fx.TargetCurrency, fx.TargetAmount, fx.Rate, fx.MidRate), &p)
 	if err != nil {
 		if strings.Contains(strings.ToLower(err.Error()), "duplicate") {
-			http.Error(w, "duplicate ref", http.StatusConflict)
-			return
+			return p, errDuplicateRef
 		}
-		http.Error(w, "db error", http.StatusInternalServerError)
-		return
+		return p, err
 	}
+	if fx.QuoteID != "" {
+		if _, err := tx.ExecContext(ctx, `UPDATE fx_quotes SET payment_id = $2::uuid WHERE id = $1::uuid`, fx.QuoteID, p.ID); err != nil {
+			return p, err
+		}
+	}
+
+	if assessment != nil {
+		if err := recordFraudDecision(ctx, tx, p.ID, screening, *assessment); err != nil {
+			return p, err
+		}
+	}
+	if err := recordPaymentEvent(ctx, tx, p.ID, "", status, "payment created"); err != nil {
+		return p, err
+	}
+	if err := enqueueEvent(ctx, tx, p.ID, p.UserID, "payment."+status, p); err != nil {
+		return p, err
+	}
+	return p, tx.Commit()
+}
 
-	writeJSON(w, http.StatusCreated, p)
+// paymentByRef loads the payment a user created with ref.
+func (st *appState) paymentByRef(ctx context.Context, userID, ref string) (payment, error) {
+	var p payment
+	err := scanPayment(st.db.QueryRowContext(ctx, `
+		SELECT `+paymentColumns+` FROM payments WHERE user_id = $1 AND ref = $2
+	`, userID, ref), &p)
+	return p, err
+}
+
+type paymentPage struct {
+	Data       []payment `json:"data"`
+	NextCursor string    `json:"next_cursor,omitempty"`
 }
 
 func (st *appState) listPayments(w http.ResponseWriter, r *http.Request) {
-	userID := strings.TrimSpace(r.URL.Query().Get("user_id"))
+	f, err := parsePaymentFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if caller := callerFrom(r.Context()); !caller.Operator {
+		if f.UserID != "" && f.UserID != caller.Subject {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		f.UserID = caller.Subject
+	}
 
 	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
 
-	var rows *sql.Rows
-	var err error
-
-	if userID == "" {
-		rows, err = st.db.QueryContext(ctx, `
-			SELECT id::text, user_id, amount, currency, status, ref, created_at
-			FROM payments
-			ORDER BY created_at DESC
-			LIMIT 50
-		`)
-	} else {
-		rows, err = st.db.QueryContext(ctx, `
-			SELECT id::text, user_id, amount, currency, status, ref, created_at
-			FROM payments
-			WHERE user_id = $1
-			ORDER BY created_at DESC
-			LIMIT 50
-		`, userID)
-	}
-
+	q, args := f.query()
+	rows, err := st.db.QueryContext(ctx, q, args...)
 	if err != nil {
 		http.Error(w, "db error", http.StatusInternalServerError)
 		return
 	}
 	defer rows.Close()
 
-	out := []payment{}
+	page := paymentPage{Data: []payment{}}
 	for rows.Next() {
 		var p payment
-		if err := rows.Scan(&p.ID, &p.UserID, &p.Amount, &p.Currency, &p.Status, &p.Ref, &p.CreatedAt); err != nil {
+		if err := scanPayment(rows, &p); err != nil {
 			http.Error(w, "db scan error", http.StatusInternalServerError)
 			return
 		}
-		out = append(out, p)
+		page.Data = append(page.Data, p)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
 	}
 
-	writeJSON(w, http.StatusOK, out)
+	if len(page.Data) > f.Limit {
+		page.Data = page.Data[:f.Limit]
+		last := page.Data[f.Limit-1]
+		page.NextCursor = paymentCursor{CreatedAt: last.CreatedAt, ID: last.ID}.encode()
+	}
+
+	writeJSON(w, http.StatusOK, page)
 }
 
+// handlePaymentByID serves /v1/payments/{id} and its sub-resources.
 func (st *appState) handlePaymentByID(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	id := strings.TrimPrefix(r.URL.Path, "/v1/payments/")
+	rest := strings.TrimPrefix(r.URL.Path, "/v1/payments/")
+	id, sub, _ := strings.Cut(rest, "/")
 	id = strings.TrimSpace(id)
 	if id == "" {
 		http.Error(w, "missing id", http.StatusBadRequest)
 		return
 	}
+	if !isUUID(id) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if operatorOnlyPaymentAction(sub, st.provider != nil) && !callerFrom(r.Context()).Operator {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	ok := st.authorizePayment(ctx, w, id)
+	cancel()
+	if !ok {
+		return
+	}
+
+	if sub == "refunds" || strings.HasPrefix(sub, "refunds/") {
+		st.handleRefunds(w, r, id, strings.TrimPrefix(strings.TrimPrefix(sub, "refunds"), "/"))
+		return
+	}
+	if sub == "sync" {
+		st.syncPaymentHandler(w, r, id)
+		return
+	}
+	if sub != "" {
+		if _, ok := paymentActions[sub]; ok {
+			st.transitionPayment(w, r, id, sub)
+			return
+		}
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	st.getPayment(w, r, id)
+}
+
+type paymentDetail struct {
+	payment
+	RemainingAmount        int64          `json:"remaining_amount"`
+	RemainingAmountDecimal string         `json:"remaining_amount_decimal,omitempty"`
+	Events                 []paymentEvent `json:"events"`
+	Refunds                []refund       `json:"refunds"`
+	Hold                   *paymentHold   `json:"hold,omitempty"`
+	Disputes               []dispute      `json:"disputes"`
+}
 
+func (st *appState) getPayment(w http.ResponseWriter, r *http.Request, id string) {
 	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
 
-	var p payment
-	err := st.db.QueryRowContext(ctx, `
-		SELECT id::text, user_id, amount, currency, status, ref, created_at
+	var d paymentDetail
+	err := scanPayment(st.db.QueryRowContext(ctx, `
+		SELECT `+paymentColumns+`
 		FROM payments
 		WHERE id = $1::uuid
-	`, id).Scan(&p.ID, &p.UserID, &p.Amount, &p.Currency, &p.Status, &p.Ref, &p.CreatedAt)
+	`, id), &d.payment)
 
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -248,31 +628,66 @@ func (st *appState) handlePaymentByID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	writeJSON(w, http.StatusOK, p)
+	d.RemainingAmount = d.CapturedAmount - d.RefundedAmount - d.DisputedAmount
+	d.RemainingAmountDecimal = formatAmount(d.RemainingAmount, d.Currency)
+	d.Events, err = listPaymentEvents(ctx, st.db, id)
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	d.Refunds, err = listRefunds(ctx, st.db, id)
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	d.Disputes, err = queryDisputes(ctx, st.db, `
+		SELECT `+disputeColumns+` FROM disputes WHERE payment_id = $1::uuid ORDER BY created_at
+	`, id)
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	if h, err := loadHold(ctx, st.db, id); err == nil {
+		d.Hold = &h
+	} else if !errors.Is(err, errHoldNotFound) {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, d)
 }
 
+// schemaStatements run in order on startup; each must be idempotent.
+var schemaStatements = []string{paymentsSchema, lifecycleSchema, refundsSchema, ledgerSchema, listingSchema, outboxSchema, webhooksSchema, providerSchema, reconciliationSchema, limitsSchema, fraudSchema, schedulesSchema, batchesSchema, iso20022Schema, holdsSchema, fxSchema, disputesSchema, payoutsSchema}
+
 func ensureSchema(db *sql.DB) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	_, err := db.ExecContext(ctx, `
-		CREATE EXTENSION IF NOT EXISTS "uuid-ossp";
-
-		CREATE TABLE IF NOT EXISTS payments (
-			id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
-			user_id text NOT NULL,
-			amount bigint NOT NULL,
-			currency text NOT NULL,
-			status text NOT NULL,
-			ref text NOT NULL,
-			created_at timestamptz NOT NULL DEFAULT now()
-		);
-
-		CREATE UNIQUE INDEX IF NOT EXISTS payments_user_ref_uq ON payments(user_id, ref);
-	`)
-	return err
+	for _, stmt := range schemaStatements {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
+const paymentsSchema = `
+	CREATE EXTENSION IF NOT EXISTS "uuid-ossp";
+
+	CREATE TABLE IF NOT EXISTS payments (
+		id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+		user_id text NOT NULL,
+		amount bigint NOT NULL,
+		currency text NOT NULL,
+		status text NOT NULL,
+		ref text NOT NULL,
+		created_at timestamptz NOT NULL DEFAULT now()
+	);
+
+	CREATE UNIQUE INDEX IF NOT EXISTS payments_user_ref_uq ON payments(user_id, ref);
+`
+
 func buildPostgresDSNFromEnv() (string, error) {
 	host := os.Getenv("DB_HOST")
 	port := getenv("DB_PORT", "5432")
@@ -27,8 +27,28 @@ func newTestMux(st *appState, app, env string) http.Handler {
 	})
 
 	// keep API routes (we won’t exercise DB in these tests)
-	mux.HandleFunc("/v1/payments", st.handlePayments)
-	mux.HandleFunc("/v1/payments/", st.handlePaymentByID)
+	mux.HandleFunc("/v1/payments", st.authenticate(st.handlePayments))
+	mux.HandleFunc("/v1/payments/", st.authenticate(st.handlePaymentByID))
+	mux.HandleFunc("/v1/schedules", st.authenticate(st.handleSchedules))
+	mux.HandleFunc("/v1/schedules/", st.authenticate(st.handleSchedules))
+	mux.HandleFunc("/v1/batches", st.authenticate(st.handleBatches))
+	mux.HandleFunc("/v1/batches/", st.authenticate(st.handleBatches))
+	mux.HandleFunc("/v1/balances/", st.authenticate(st.handleBalances))
+	mux.HandleFunc("/v1/fx/", st.authenticate(st.handleFX))
+	mux.HandleFunc("/v1/disputes", st.authenticate(st.handleDisputes))
+	mux.HandleFunc("/v1/disputes/", st.authenticate(st.handleDisputes))
+	mux.HandleFunc("/v1/beneficiaries", st.authenticate(st.handleBeneficiaries))
+	mux.HandleFunc("/v1/beneficiaries/", st.authenticate(st.handleBeneficiaries))
+	mux.HandleFunc("/v1/payouts", st.authenticate(st.handlePayouts))
+	mux.HandleFunc("/v1/payouts/", st.authenticate(st.handlePayouts))
+	mux.HandleFunc("/v1/ledger/", st.requireOperator(st.handleLedger))
+	mux.HandleFunc("/v1/outbox/", st.requireOperator(st.handleOutbox))
+	mux.HandleFunc("/v1/webhooks/", st.requireOperator(st.handleWebhooks))
+	mux.HandleFunc("/v1/reconciliation/runs", st.requireOperator(st.handleReconciliation))
+	mux.HandleFunc("/v1/reconciliation/runs/", st.requireOperator(st.handleReconciliation))
+	mux.HandleFunc("/v1/limits/", st.requireOperator(st.handleLimits))
+	mux.HandleFunc("/v1/fraud/", st.requireOperator(st.handleFraud))
+	mux.HandleFunc("/v1/iso20022/", st.requireOperator(st.handleISO20022))
 
 	return mux
 }
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// outboxEvent is a domain event waiting in (or read from) the outbox table.
+// It is also the envelope publishers send.
+type outboxEvent struct {
+	ID          int64           `json:"id"`
+	Type        string          `json:"type"`
+	AggregateID string          `json:"aggregate_id"`
+	MerchantID  string          `json:"merchant_id,omitempty"`
+	OccurredAt  time.Time       `json:"occurred_at"`
+	Data        json.RawMessage `json:"data"`
+	Attempts    int             `json:"-"`
+}
+
+// enqueueEvent adds an event to the outbox inside tx, so it is committed
+// together with the change it describes. aggregateID is the payment id:
+// events of one payment are published in the order they were enqueued.
+// merchantID (the payment's user) selects the webhook endpoints to notify.
+func enqueueEvent(ctx context.Context, tx *sql.Tx, aggregateID, merchantID, eventType string, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO outbox(aggregate_id, merchant_id, event_type, payload)
+		VALUES ($1, NULLIF($2, ''), $3, $4::jsonb)
+	`, aggregateID, merchantID, eventType, string(payload))
+	return err
+}
+
+// outboxStore is what the relay needs from storage. claim leases due
+// events for lease; it only returns the oldest pending event of each
+// aggregate, so a later event is never published before an earlier one.
+type outboxStore interface {
+	claim(ctx context.Context, limit int, lease time.Duration) ([]outboxEvent, error)
+	markPublished(ctx context.Context, id int64) error
+	markFailed(ctx context.Context, id int64, errMsg string, retryAt time.Time, dead bool) error
+}
+
+// outboxRelay publishes outbox events at least once. An event that keeps
+// failing is dead-lettered after maxAttempts, which unblocks the events
+// queued behind it for the same payment.
+type outboxRelay struct {
+	store     outboxStore
+	pub       Publisher
+	batchSize int
+	lease     time.Duration
+	// how long one publish may take; the relay only starts a publish while
+	// this much of the lease is left
+	publishTimeout time.Duration
+	maxAttempts    int
+	maxBackoff     time.Duration
+	now            func() time.Time
+}
+
+func newOutboxRelay(store outboxStore, pub Publisher, maxAttempts int) *outboxRelay {
+	return &outboxRelay{
+		store:          store,
+		pub:            pub,
+		batchSize:      100,
+		lease:          30 * time.Second,
+		publishTimeout: 10 * time.Second,
+		maxAttempts:    maxAttempts,
+		maxBackoff:     5 * time.Minute,
+		now:            time.Now,
+	}
+}
+
+// runOnce publishes one batch and reports how many events it handled. It
+// stops early once what is left of the lease could not cover another
+// publish, since another replica may claim those events when it runs out;
+// they are claimed again after the lease.
+func (r *outboxRelay) runOnce(ctx context.Context) (int, error) {
+	leaseEnd := r.now().Add(r.lease)
+	events, err := r.store.claim(ctx, r.batchSize, r.lease)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, e := range events {
+		if r.now().Add(r.publishTimeout).After(leaseEnd) {
+			return i, nil
+		}
+		pctx, cancel := context.WithTimeout(ctx, r.publishTimeout)
+		err := r.pub.Publish(pctx, e)
+		cancel()
+
+		if err == nil {
+			if err := r.store.markPublished(ctx, e.ID); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		attempts := e.Attempts + 1
+		dead := attempts >= r.maxAttempts
+		if dead {
+			log.Printf(`{"msg":"outbox event dead-lettered","id":%d,"type":%q,"aggregate_id":%q,"attempts":%d,"error":%q}`,
+				e.ID, e.Type, e.AggregateID, attempts, err.Error())
+		}
+		if err := r.store.markFailed(ctx, e.ID, err.Error(), r.now().Add(r.backoff(attempts)), dead); err != nil {
+			return 0, err
+		}
+	}
+	return len(events), nil
+}
+
+func (r *outboxRelay) backoff(attempts int) time.Duration {
+	d := time.Second << min(attempts-1, 20)
+	if d > r.maxBackoff {
+		d = r.maxBackoff
+	}
+	return d
+}
+
+// run polls the outbox until ctx is done. A full batch is followed
+// immediately by the next one so a backlog drains quickly.
+func (r *outboxRelay) run(ctx context.Context, every time.Duration) {
+	for {
+		n, err := r.runOnce(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf(`{"msg":"outbox relay failed","error":%q}`, err.Error())
+		}
+		if n == r.batchSize && err == nil {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(every):
+		}
+	}
+}
+
+type pgOutboxStore struct {
+	db *sql.DB
+}
+
+func (s pgOutboxStore) claim(ctx context.Context, limit int, lease time.Duration) ([]outboxEvent, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		UPDATE outbox SET locked_until = now() + make_interval(secs => $2)
+		WHERE id IN (
+			SELECT o.id FROM outbox o
+			WHERE o.published_at IS NULL AND o.dead_at IS NULL
+			  AND o.next_attempt_at <= now()
+			  AND (o.locked_until IS NULL OR o.locked_until < now())
+			  AND NOT EXISTS (
+				SELECT 1 FROM outbox p
+				WHERE p.aggregate_id = o.aggregate_id
+				  AND p.published_at IS NULL AND p.dead_at IS NULL
+				  AND p.id < o.id
+			  )
+			ORDER BY o.id
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, event_type, aggregate_id, COALESCE(merchant_id, ''), created_at, payload::text, attempts
+	`, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []outboxEvent
+	for rows.Next() {
+		var e outboxEvent
+		var payload string
+		if err := rows.Scan(&e.ID, &e.Type, &e.AggregateID, &e.MerchantID, &e.OccurredAt, &payload, &e.Attempts); err != nil {
+			return nil, err
+		}
+		e.Data = json.RawMessage(payload)
+		out = append(out, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// RETURNING does not keep the subquery's order
+	sortEventsByID(out)
+	return out, nil
+}
+
+func (s pgOutboxStore) markPublished(ctx context.Context, id int64) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE outbox SET published_at = now(), locked_until = NULL WHERE id = $1
+	`, id)
+	return err
+}
+
+func (s pgOutboxStore) markFailed(ctx context.Context, id int64, errMsg string, retryAt time.Time, dead bool) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE outbox
+		SET attempts = attempts + 1, last_error = $2, next_attempt_at = $3, locked_until = NULL,
+		    dead_at = CASE WHEN $4 THEN now() END
+		WHERE id = $1
+	`, id, errMsg, retryAt, dead)
+	return err
+}
+
+func sortEventsByID(events []outboxEvent) {
+	sort.Slice(events, func(i, j int) bool { return events[i].ID < events[j].ID })
+}
+
+type deadEvent struct {
+	outboxEvent
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error"`
+	DeadAt    time.Time `json:"dead_at"`
+}
+
+// handleOutbox serves GET /v1/outbox/dead and POST /v1/outbox/{id}/retry,
+// which puts a dead-lettered event back in the queue.
+func (st *appState) handleOutbox(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	rest := strings.TrimPrefix(r.URL.Path, "/v1/outbox/")
+	if rest == "dead" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		out, err := listDeadEvents(ctx, st.db)
+		if err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, out)
+		return
+	}
+
+	idStr, action, _ := strings.Cut(rest, "/")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil || action != "retry" {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	res, err := st.db.ExecContext(ctx, `
+		UPDATE outbox SET dead_at = NULL, attempts = 0, next_attempt_at = now()
+		WHERE id = $1 AND dead_at IS NOT NULL
+	`, id)
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]any{"id": id, "status": "requeued"})
+}
+
+func listDeadEvents(ctx context.Context, db *sql.DB) ([]deadEvent, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, event_type, aggregate_id, created_at, payload::text, attempts, COALESCE(last_error, ''), dead_at
+		FROM outbox
+		WHERE dead_at IS NOT NULL
+		ORDER BY id
+		LIMIT 200
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []deadEvent{}
+	for rows.Next() {
+		var e deadEvent
+		var payload string
+		if err := rows.Scan(&e.ID, &e.Type, &e.AggregateID, &e.OccurredAt, &payload, &e.Attempts, &e.LastError, &e.DeadAt); err != nil {
+			return nil, err
+		}
+		e.Data = json.RawMessage(payload)
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+func outboxMaxAttemptsFromEnv() int {
+	n, err := strconv.Atoi(getenv("OUTBOX_MAX_ATTEMPTS", "10"))
+	if err != nil || n < 1 {
+		return 10
+	}
+	return n
+}
+
+const outboxSchema = `
+	CREATE TABLE IF NOT EXISTS outbox (
+		id bigserial PRIMARY KEY,
+		aggregate_id text NOT NULL,
+		event_type text NOT NULL,
+		payload jsonb NOT NULL,
+		created_at timestamptz NOT NULL DEFAULT now(),
+		attempts int NOT NULL DEFAULT 0,
+		next_attempt_at timestamptz NOT NULL DEFAULT now(),
+		locked_until timestamptz,
+		last_error text,
+		published_at timestamptz,
+		dead_at timestamptz
+	);
+
+	ALTER TABLE outbox ADD COLUMN IF NOT EXISTS merchant_id text;
+
+	CREATE INDEX IF NOT EXISTS outbox_pending_idx ON outbox(id)
+		WHERE published_at IS NULL AND dead_at IS NULL;
+	CREATE INDEX IF NOT EXISTS outbox_pending_aggregate_idx ON outbox(aggregate_id, id)
+		WHERE published_at IS NULL AND dead_at IS NULL;
+`
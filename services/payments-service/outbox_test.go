@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryOutboxStore mirrors pgOutboxStore's claim rules in memory.
+type memoryOutboxStore struct {
+	mu     sync.Mutex
+	events []*memoryOutboxRow
+	now    func() time.Time
+}
+
+type memoryOutboxRow struct {
+	outboxEvent
+	nextAttempt time.Time
+	lockedUntil time.Time
+	published   bool
+	dead        bool
+	lastError   string
+}
+
+func (s *memoryOutboxStore) add(aggregateID, eventType string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, &memoryOutboxRow{outboxEvent: outboxEvent{
+		ID:          int64(len(s.events) + 1),
+		Type:        eventType,
+		AggregateID: aggregateID,
+		Data:        json.RawMessage(`{}`),
+	}})
+}
+
+func (s *memoryOutboxStore) claim(_ context.Context, limit int, lease time.Duration) ([]outboxEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	blocked := map[string]bool{}
+	var out []outboxEvent
+	for _, e := range s.events {
+		if e.published || e.dead {
+			continue
+		}
+		head := !blocked[e.AggregateID]
+		blocked[e.AggregateID] = true
+		if !head || now.Before(e.nextAttempt) || now.Before(e.lockedUntil) || len(out) == limit {
+			continue
+		}
+		e.lockedUntil = now.Add(lease)
+		out = append(out, e.outboxEvent)
+	}
+	return out, nil
+}
+
+func (s *memoryOutboxStore) markPublished(_ context.Context, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events[id-1].published = true
+	s.events[id-1].lockedUntil = time.Time{}
+	return nil
+}
+
+func (s *memoryOutboxStore) markFailed(_ context.Context, id int64, errMsg string, retryAt time.Time, dead bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.events[id-1]
+	e.Attempts++
+	e.lastError = errMsg
+	e.nextAttempt = retryAt
+	e.lockedUntil = time.Time{}
+	e.dead = dead
+	return nil
+}
+
+// memoryPublisher records published events and fails those whose type is
+// in failTypes.
+type memoryPublisher struct {
+	mu        sync.Mutex
+	published []outboxEvent
+	failTypes map[string]bool
+}
+
+func (p *memoryPublisher) Publish(_ context.Context, e outboxEvent) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.failTypes[e.Type] {
+		return errors.New("broker unavailable")
+	}
+	p.published = append(p.published, e)
+	return nil
+}
+
+func (p *memoryPublisher) types() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var out []string
+	for _, e := range p.published {
+		out = append(out, e.AggregateID+":"+e.Type)
+	}
+	return out
+}
+
+func newTestRelay(store *memoryOutboxStore, pub Publisher, now *time.Time) *outboxRelay {
+	store.now = func() time.Time { return *now }
+	r := newOutboxRelay(store, pub, 3)
+	r.now = store.now
+	return r
+}
+
+func TestOutboxRelayKeepsPerAggregateOrder(t *testing.T) {
+	now := time.Unix(1000, 0)
+	store := &memoryOutboxStore{}
+	store.add("p1", "payment.created")
+	store.add("p2", "payment.created")
+	store.add("p1", "payment.authorized")
+	store.add("p1", "payment.captured")
+
+	pub := &memoryPublisher{}
+	relay := newTestRelay(store, pub, &now)
+
+	// each pass can only take the head event of every payment
+	for i := 0; i < 3; i++ {
+		if _, err := relay.runOnce(context.Background()); err != nil {
+			t.Fatalf("runOnce: %v", err)
+		}
+	}
+
+	got := strings.Join(pub.types(), ",")
+	want := "p1:payment.created,p2:payment.created,p1:payment.authorized,p1:payment.captured"
+	if got != want {
+		t.Fatalf("published %s, want %s", got, want)
+	}
+}
+
+func TestOutboxRelayRetriesThenDeadLetters(t *testing.T) {
+	now := time.Unix(1000, 0)
+	store := &memoryOutboxStore{}
+	store.add("p1", "payment.created")
+	store.add("p1", "payment.authorized")
+
+	pub := &memoryPublisher{failTypes: map[string]bool{"payment.created": true}}
+	relay := newTestRelay(store, pub, &now)
+
+	for i := 0; i < 3; i++ {
+		if _, err := relay.runOnce(context.Background()); err != nil {
+			t.Fatalf("runOnce: %v", err)
+		}
+		if len(pub.types()) != 0 {
+			t.Fatalf("later event published while the first one is still retrying: %v", pub.types())
+		}
+		// skip past the backoff
+		now = now.Add(10 * time.Minute)
+	}
+
+	if !store.events[0].dead || store.events[0].Attempts != 3 {
+		t.Fatalf("expected first event dead-lettered after 3 attempts, got %+v", store.events[0])
+	}
+
+	if _, err := relay.runOnce(context.Background()); err != nil {
+		t.Fatalf("runOnce: %v", err)
+	}
+	if got := pub.types(); len(got) != 1 || got[0] != "p1:payment.authorized" {
+		t.Fatalf("expected dead letter to unblock the next event, got %v", got)
+	}
+}
+
+// slowPublisher moves the clock on by step for every publish.
+type slowPublisher struct {
+	memoryPublisher
+	now  *time.Time
+	step time.Duration
+}
+
+func (p *slowPublisher) Publish(ctx context.Context, e outboxEvent) error {
+	*p.now = p.now.Add(p.step)
+	return p.memoryPublisher.Publish(ctx, e)
+}
+
+func TestOutboxRelayStopsBeforeLeaseRunsOut(t *testing.T) {
+	now := time.Unix(1000, 0)
+	store := &memoryOutboxStore{}
+	for i := 0; i < 10; i++ {
+		store.add(fmt.Sprintf("p%d", i), "payment.created")
+	}
+
+	pub := &slowPublisher{now: &now, step: 8 * time.Second}
+	relay := newTestRelay(store, pub, &now)
+
+	n, err := relay.runOnce(context.Background())
+	if err != nil {
+		t.Fatalf("runOnce: %v", err)
+	}
+	// 30s lease, 10s publish timeout: publishes start at 0s, 8s and 16s
+	if n != 3 || len(pub.types()) != 3 {
+		t.Fatalf("expected 3 events published within the lease, got %d (%v)", n, pub.types())
+	}
+	if _, err := relay.runOnce(context.Background()); err != nil {
+		t.Fatalf("runOnce: %v", err)
+	}
+	if len(pub.types()) != 3 {
+		t.Fatalf("expected unpublished events to stay leased, got %v", pub.types())
+	}
+	now = now.Add(30 * time.Second)
+	if _, err := relay.runOnce(context.Background()); err != nil {
+		t.Fatalf("runOnce: %v", err)
+	}
+	if len(pub.types()) != 6 {
+		t.Fatalf("expected the rest to be claimed again after the lease, got %v", pub.types())
+	}
+}
+
+func TestOutboxBackoffIsCapped(t *testing.T) {
+	r := newOutboxRelay(nil, nil, 10)
+	if r.backoff(1) != time.Second || r.backoff(3) != 4*time.Second {
+		t.Fatalf("unexpected backoff %v %v", r.backoff(1), r.backoff(3))
+	}
+	if r.backoff(30) != r.maxBackoff {
+		t.Fatalf("backoff not capped: %v", r.backoff(30))
+	}
+}
+
+func TestWebhookPublisherRequires2xx(t *testing.T) {
+	status := http.StatusNoContent
+	var gotType string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotType = r.Header.Get("X-Event-Type")
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	p := &webhookPublisher{url: srv.URL, client: srv.Client()}
+	e := outboxEvent{ID: 7, Type: "payment.captured", AggregateID: "p1", Data: json.RawMessage(`{}`)}
+	if err := p.Publish(context.Background(), e); err != nil || gotType != "payment.captured" {
+		t.Fatalf("expected success, got %v (type %q)", err, gotType)
+	}
+
+	status = http.StatusInternalServerError
+	if err := p.Publish(context.Background(), e); err == nil {
+		t.Fatal("expected error on 500")
+	}
+}
+
+func TestNatsPublisherWaitsForPong(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.WriteString(conn, "INFO {\"server_id\":\"test\"}\r\n")
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch {
+			case strings.HasPrefix(line, "PUB "):
+				var subject string
+				var n int
+				_, _ = fmt.Sscanf(line, "PUB %s %d", &subject, &n)
+				buf := make([]byte, n+2)
+				_, _ = io.ReadFull(r, buf)
+				received <- subject
+			case strings.HasPrefix(line, "PING"):
+				_, _ = io.WriteString(conn, "PONG\r\n")
+			}
+		}
+	}()
+
+	p := &natsPublisher{addr: ln.Addr().String(), subjectPrefix: "payments"}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := p.Publish(ctx, outboxEvent{ID: 1, Type: "payment.created", Data: json.RawMessage(`{}`)}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if subject := <-received; subject != "payments.payment.created" {
+		t.Fatalf("published to %q", subject)
+	}
+}
@@ -0,0 +1,1205 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Payouts send money from a user's balance to one of their beneficiary
+// bank accounts. The amount is taken from the balance when the payout is
+// created, so two payouts can never spend the same funds; a payout that
+// does not reach the bank gives it back.
+const (
+	payoutPendingApproval = "pending_approval"
+	payoutApproved        = "approved"
+	payoutSubmitting      = "submitting"
+	payoutSubmitted       = "submitted"
+	payoutPaid            = "paid"
+	payoutFailed          = "failed"
+	payoutReturned        = "returned"
+	payoutRejected        = "rejected"
+	payoutCanceled        = "canceled"
+)
+
+// payoutTransitions lists the statuses each payout status may move to.
+// The worker claims an approved payout as submitting before it calls the
+// provider, so it can no longer be canceled while it may be on its way.
+// A payout can be returned by the beneficiary's bank after it was paid.
+var payoutTransitions = map[string][]string{
+	payoutPendingApproval: {payoutApproved, payoutRejected, payoutCanceled},
+	payoutApproved:        {payoutSubmitting, payoutPaid, payoutFailed, payoutCanceled},
+	payoutSubmitting:      {payoutSubmitted, payoutPaid, payoutFailed},
+	payoutSubmitted:       {payoutPaid, payoutFailed, payoutReturned},
+	payoutPaid:            {payoutReturned},
+}
+
+// payoutActions maps POST /v1/payouts/{id}/{action} onto the target status.
+// paid, fail and return record outcomes learned outside the provider, such
+// as from a bank statement, and are operator only, as are approve and
+// reject.
+var payoutActions = map[string]string{
+	"approve": payoutApproved,
+	"reject":  payoutRejected,
+	"cancel":  payoutCanceled,
+	"paid":    payoutPaid,
+	"fail":    payoutFailed,
+	"return":  payoutReturned,
+}
+
+// Beneficiary account types.
+const (
+	accountTypeIBAN     = "iban"
+	accountTypeSortCode = "sort_code"
+)
+
+var (
+	errBeneficiaryNotFound = errors.New("beneficiary not found")
+	errInvalidBeneficiary  = errors.New("invalid beneficiary")
+	errBeneficiaryDisabled = errors.New("beneficiary is disabled")
+	errPayoutNotFound      = errors.New("payout not found")
+	errInvalidPayout       = errors.New("invalid payout")
+	errInsufficientFunds   = errors.New("insufficient available balance")
+	errPayoutRefReused     = errors.New("payout ref already used with a different amount or beneficiary")
+	errSelfApproval        = errors.New("a payout must be approved by someone other than its creator")
+)
+
+func canTransitionPayout(from, to string) bool {
+	for _, s := range payoutTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeSortCode accepts a UK sort code as "12-34-56", "12 34 56" or
+// "123456" and returns its six digits.
+func normalizeSortCode(s string) (string, error) {
+	code := strings.NewReplacer("-", "", " ", "").Replace(strings.TrimSpace(s))
+	if len(code) != 6 || !allDigits(code) {
+		return "", fmt.Errorf("%w: sort code %q must be six digits", errInvalidBeneficiary, s)
+	}
+	return code, nil
+}
+
+// normalizeAccountNumber accepts an eight-digit UK account number.
+func normalizeAccountNumber(s string) (string, error) {
+	n := strings.ReplaceAll(strings.TrimSpace(s), " ", "")
+	if len(n) != 8 || !allDigits(n) {
+		return "", fmt.Errorf("%w: account number must be eight digits", errInvalidBeneficiary)
+	}
+	return n, nil
+}
+
+// maskIBAN keeps the country, check digits and last four characters, and
+// hides the length of the rest.
+func maskIBAN(iban string) string {
+	if len(iban) < 8 {
+		return "****"
+	}
+	return iban[:4] + " **** " + iban[len(iban)-4:]
+}
+
+// maskAccountNumber keeps the last four digits.
+func maskAccountNumber(n string) string {
+	if len(n) < 4 {
+		return "****"
+	}
+	return "****" + n[len(n)-4:]
+}
+
+func formatSortCode(code string) string {
+	if len(code) != 6 {
+		return code
+	}
+	return code[:2] + "-" + code[2:4] + "-" + code[4:]
+}
+
+// beneficiary is a bank account a user may pay out to. Account numbers are
+// only ever returned masked.
+type beneficiary struct {
+	ID          string `json:"id"`
+	UserID      string `json:"user_id"`
+	Name        string `json:"name"`
+	Currency    string `json:"currency"`
+	AccountType string `json:"account_type"`
+	// masked IBAN or account number
+	Account    string     `json:"account"`
+	SortCode   string     `json:"sort_code,omitempty"`
+	DisabledAt *time.Time `json:"disabled_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+
+	iban          string
+	sortCode      string
+	accountNumber string
+}
+
+const beneficiaryColumns = `id::text, user_id, name, currency, account_type, COALESCE(iban, ''), COALESCE(sort_code, ''),
+	COALESCE(account_number, ''), disabled_at, created_at`
+
+func scanBeneficiary(row rowScanner, b *beneficiary) error {
+	var disabledAt sql.NullTime
+	if err := row.Scan(&b.ID, &b.UserID, &b.Name, &b.Currency, &b.AccountType, &b.iban, &b.sortCode,
+		&b.accountNumber, &disabledAt, &b.CreatedAt); err != nil {
+		return err
+	}
+	b.DisabledAt = nil
+	if disabledAt.Valid {
+		b.DisabledAt = &disabledAt.Time
+	}
+	b.mask()
+	return nil
+}
+
+func (b *beneficiary) mask() {
+	switch b.AccountType {
+	case accountTypeIBAN:
+		b.Account = maskIBAN(b.iban)
+	case accountTypeSortCode:
+		b.Account = maskAccountNumber(b.accountNumber)
+		b.SortCode = formatSortCode(b.sortCode)
+	}
+}
+
+type createBeneficiaryRequest struct {
+	UserID   string `json:"user_id"`
+	Name     string `json:"name"`
+	Currency string `json:"currency"`
+	// either iban, or sort_code with account_number (GBP only)
+	IBAN          string `json:"iban"`
+	SortCode      string `json:"sort_code"`
+	AccountNumber string `json:"account_number"`
+}
+
+// normalize validates req and returns the beneficiary it describes, with
+// its account details in canonical form.
+func (req createBeneficiaryRequest) normalize() (beneficiary, error) {
+	b := beneficiary{
+		UserID:   strings.TrimSpace(req.UserID),
+		Name:     strings.Join(strings.Fields(req.Name), " "),
+		Currency: strings.ToUpper(strings.TrimSpace(req.Currency)),
+	}
+	if b.UserID == "" {
+		return b, fmt.Errorf("%w: user_id is required", errInvalidBeneficiary)
+	}
+	if b.Name == "" || len(b.Name) > 140 {
+		return b, fmt.Errorf("%w: name is required, at most 140 characters", errInvalidBeneficiary)
+	}
+	if _, err := lookupCurrency(b.Currency); err != nil {
+		return b, err
+	}
+
+	hasIBAN := strings.TrimSpace(req.IBAN) != ""
+	hasSortCode := strings.TrimSpace(req.SortCode) != "" || strings.TrimSpace(req.AccountNumber) != ""
+	var err error
+	switch {
+	case hasIBAN && hasSortCode:
+		return b, fmt.Errorf("%w: give either iban or sort_code and account_number, not both", errInvalidBeneficiary)
+	case hasIBAN:
+		b.AccountType = accountTypeIBAN
+		if b.iban, err = normalizeIBAN(req.IBAN); err != nil {
+			return b, fmt.Errorf("%w: %v", errInvalidBeneficiary, err)
+		}
+	case hasSortCode:
+		if b.Currency != "GBP" {
+			return b, fmt.Errorf("%w: sort code accounts take GBP only", errInvalidBeneficiary)
+		}
+		b.AccountType = accountTypeSortCode
+		if b.sortCode, err = normalizeSortCode(req.SortCode); err != nil {
+			return b, err
+		}
+		if b.accountNumber, err = normalizeAccountNumber(req.AccountNumber); err != nil {
+			return b, err
+		}
+	default:
+		return b, fmt.Errorf("%w: iban, or sort_code and account_number, is required", errInvalidBeneficiary)
+	}
+	b.mask()
+	return b, nil
+}
+
+// payoutThresholds maps currency to the amount, in minor units, above
+// which a payout needs a second person's approval. Payouts in currencies
+// without a threshold always need it.
+type payoutThresholds map[string]int64
+
+// defaultPayoutThresholds is used unless PAYOUT_APPROVAL_THRESHOLDS is set.
+var defaultPayoutThresholds = map[string]string{"EUR": "1000", "USD": "1000", "GBP": "1000"}
+
+// payoutThresholdsFromEnv reads PAYOUT_APPROVAL_THRESHOLDS, a JSON object
+// of currency to decimal amount such as {"EUR": "1000.00"}.
+func payoutThresholdsFromEnv() (payoutThresholds, error) {
+	raw := defaultPayoutThresholds
+	if s := getenv("PAYOUT_APPROVAL_THRESHOLDS", ""); s != "" {
+		raw = nil
+		if err := json.Unmarshal([]byte(s), &raw); err != nil {
+			return nil, fmt.Errorf("PAYOUT_APPROVAL_THRESHOLDS: %w", err)
+		}
+	}
+	out := payoutThresholds{}
+	for code, amount := range raw {
+		cur, err := lookupCurrency(strings.ToUpper(code))
+		if err != nil {
+			return nil, fmt.Errorf("PAYOUT_APPROVAL_THRESHOLDS: %w", err)
+		}
+		minor, err := parseDecimalAmount(amount, cur.Exponent)
+		if err != nil {
+			return nil, fmt.Errorf("PAYOUT_APPROVAL_THRESHOLDS %s: %w", cur.Code, err)
+		}
+		out[cur.Code] = minor
+	}
+	return out, nil
+}
+
+func (t payoutThresholds) requiresApproval(currency string, amount int64) bool {
+	limit, ok := t[currency]
+	return !ok || amount > limit
+}
+
+type payout struct {
+	ID            string `json:"id"`
+	UserID        string `json:"user_id"`
+	BeneficiaryID string `json:"beneficiary_id"`
+	Amount        int64  `json:"amount"`
+	AmountDecimal string `json:"amount_decimal,omitempty"`
+	Currency      string `json:"currency"`
+	Ref           string `json:"ref"`
+	// shown on the beneficiary's bank statement
+	Reference        string     `json:"reference,omitempty"`
+	Status           string     `json:"status"`
+	RequiresApproval bool       `json:"requires_approval"`
+	CreatedBy        string     `json:"created_by,omitempty"`
+	ApprovedBy       string     `json:"approved_by,omitempty"`
+	ApprovedAt       *time.Time `json:"approved_at,omitempty"`
+	Provider         string     `json:"provider,omitempty"`
+	ProviderRef      string     `json:"provider_ref,omitempty"`
+	// last raw response from the provider
+	ProviderResponse json.RawMessage `json:"provider_response,omitempty"`
+	// why the payout failed or was returned, as reported by the bank
+	FailureCode string     `json:"failure_code,omitempty"`
+	PaidAt      *time.Time `json:"paid_at,omitempty"`
+	Version     int64      `json:"version"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
+const payoutColumns = `id::text, user_id, beneficiary_id::text, amount, currency, ref, COALESCE(reference, ''), status,
+	requires_approval, COALESCE(created_by, ''), COALESCE(approved_by, ''), approved_at,
+	COALESCE(provider, ''), COALESCE(provider_ref, ''), COALESCE(provider_response::text, ''), COALESCE(failure_code, ''),
+	paid_at, version, created_at, updated_at`
+
+func scanPayout(row rowScanner, po *payout) error {
+	var approvedAt, paidAt sql.NullTime
+	var providerResponse string
+	if err := row.Scan(&po.ID, &po.UserID, &po.BeneficiaryID, &po.Amount, &po.Currency, &po.Ref, &po.Reference, &po.Status,
+		&po.RequiresApproval, &po.CreatedBy, &po.ApprovedBy, &approvedAt,
+		&po.Provider, &po.ProviderRef, &providerResponse, &po.FailureCode,
+		&paidAt, &po.Version, &po.CreatedAt, &po.UpdatedAt); err != nil {
+		return err
+	}
+	po.ApprovedAt, po.PaidAt = nil, nil
+	if approvedAt.Valid {
+		po.ApprovedAt = &approvedAt.Time
+	}
+	if paidAt.Valid {
+		po.PaidAt = &paidAt.Time
+	}
+	po.ProviderResponse = nil
+	if providerResponse != "" {
+		po.ProviderResponse = json.RawMessage(providerResponse)
+	}
+	po.AmountDecimal = formatAmount(po.Amount, po.Currency)
+	return nil
+}
+
+type createPayoutRequest struct {
+	BeneficiaryID string `json:"beneficiary_id"`
+	Amount        int64  `json:"amount"`
+	AmountDecimal string `json:"amount_decimal"`
+	// idempotency key, unique per user
+	Ref       string `json:"ref"`
+	Reference string `json:"reference"`
+}
+
+func (req *createPayoutRequest) normalize() error {
+	req.BeneficiaryID = strings.TrimSpace(req.BeneficiaryID)
+	req.Ref = strings.TrimSpace(req.Ref)
+	req.Reference = strings.TrimSpace(req.Reference)
+	if !isUUID(req.BeneficiaryID) || req.Ref == "" {
+		return fmt.Errorf("%w: beneficiary_id and ref are required", errInvalidPayout)
+	}
+	if req.Amount < 0 {
+		return fmt.Errorf("%w: amount must not be negative", errInvalidPayout)
+	}
+	// the ISO 20022 unstructured remittance limit
+	if len(req.Reference) > 140 {
+		return fmt.Errorf("%w: reference is at most 140 characters", errInvalidPayout)
+	}
+	return nil
+}
+
+type payoutEvent struct {
+	ID         int64     `json:"id"`
+	FromStatus string    `json:"from_status,omitempty"`
+	ToStatus   string    `json:"to_status"`
+	Reason     string    `json:"reason,omitempty"`
+	Actor      string    `json:"actor,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type payoutTransitionRequest struct {
+	Reason string `json:"reason"`
+	// fail and return: the bank's reason code
+	Code string `json:"code"`
+}
+
+// handleBeneficiaries serves:
+//
+//	POST   /v1/beneficiaries
+//	GET    /v1/beneficiaries?user_id=
+//	GET    /v1/beneficiaries/{id}
+//	DELETE /v1/beneficiaries/{id}    disables it
+func (st *appState) handleBeneficiaries(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/beneficiaries"), "/")
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	caller := callerFrom(ctx)
+
+	if id == "" {
+		switch r.Method {
+		case http.MethodPost:
+			var req createBeneficiaryRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "invalid json", http.StatusBadRequest)
+				return
+			}
+			if strings.TrimSpace(req.UserID) == "" {
+				req.UserID = caller.Subject
+			}
+			if !caller.mayActFor(strings.TrimSpace(req.UserID)) {
+				http.Error(w, "user_id does not match the authenticated user", http.StatusForbidden)
+				return
+			}
+			b, err := req.normalize()
+			if err == nil {
+				b, err = insertBeneficiary(ctx, st.db, b)
+			}
+			if err != nil {
+				writePayoutError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusCreated, b)
+		case http.MethodGet:
+			userID := strings.TrimSpace(r.URL.Query().Get("user_id"))
+			if !caller.Operator {
+				if userID != "" && userID != caller.Subject {
+					http.Error(w, "forbidden", http.StatusForbidden)
+					return
+				}
+				userID = caller.Subject
+			}
+			out, err := listBeneficiaries(ctx, st.db, userID)
+			if err != nil {
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, http.StatusOK, out)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	b, err := loadBeneficiary(ctx, st.db, id)
+	if err == nil && !caller.mayActFor(b.UserID) {
+		err = errBeneficiaryNotFound
+	}
+	if err != nil {
+		writePayoutError(w, err)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, b)
+	case http.MethodDelete:
+		err := scanBeneficiary(st.db.QueryRowContext(ctx, `
+			UPDATE beneficiaries SET disabled_at = COALESCE(disabled_at, now())
+			WHERE id = $1::uuid
+			RETURNING `+beneficiaryColumns, b.ID), &b)
+		if err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, b)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func insertBeneficiary(ctx context.Context, db *sql.DB, b beneficiary) (beneficiary, error) {
+	err := scanBeneficiary(db.QueryRowContext(ctx, `
+		INSERT INTO beneficiaries(user_id, name, currency, account_type, iban, sort_code, account_number)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), NULLIF($6, ''), NULLIF($7, ''))
+		RETURNING `+beneficiaryColumns,
+		b.UserID, b.Name, b.Currency, b.AccountType, b.iban, b.sortCode, b.accountNumber), &b)
+	return b, err
+}
+
+func loadBeneficiary(ctx context.Context, q rowQuerier, id string) (beneficiary, error) {
+	var b beneficiary
+	if !isUUID(id) {
+		return b, errBeneficiaryNotFound
+	}
+	err := scanBeneficiary(q.QueryRowContext(ctx, `
+		SELECT `+beneficiaryColumns+` FROM beneficiaries WHERE id = $1::uuid
+	`, id), &b)
+	if errors.Is(err, sql.ErrNoRows) {
+		return b, errBeneficiaryNotFound
+	}
+	return b, err
+}
+
+func listBeneficiaries(ctx context.Context, db *sql.DB, userID string) ([]beneficiary, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+beneficiaryColumns+`
+		FROM beneficiaries
+		WHERE $1 = '' OR user_id = $1
+		ORDER BY created_at DESC
+		LIMIT 200
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []beneficiary{}
+	for rows.Next() {
+		var b beneficiary
+		if err := scanBeneficiary(rows, &b); err != nil {
+			return nil, err
+		}
+		out = append(out, b)
+	}
+	return out, rows.Err()
+}
+
+// handlePayouts serves:
+//
+//	POST /v1/payouts
+//	GET  /v1/payouts?user_id=&status=
+//	GET  /v1/payouts/{id}                payout plus its events
+//	POST /v1/payouts/{id}/sync
+//	POST /v1/payouts/{id}/{approve|reject|cancel|paid|fail|return}
+func (st *appState) handlePayouts(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/payouts"), "/")
+	if rest == "" {
+		switch r.Method {
+		case http.MethodPost:
+			st.createPayout(w, r)
+		case http.MethodGet:
+			st.listPayouts(w, r)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	caller := callerFrom(ctx)
+
+	id, action, _ := strings.Cut(rest, "/")
+	po, err := loadPayout(ctx, st.db, id)
+	if err == nil && !caller.mayActFor(po.UserID) {
+		err = errPayoutNotFound
+	}
+	if err != nil {
+		writePayoutError(w, err)
+		return
+	}
+
+	if action == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		out := struct {
+			payout
+			Events []payoutEvent `json:"events"`
+		}{payout: po}
+		if out.Events, err = listPayoutEvents(ctx, st.db, po.ID); err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, out)
+		return
+	}
+
+	to, ok := payoutActions[action]
+	if !ok && action != "sync" {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if action != "cancel" && action != "sync" && !caller.Operator {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	var req payoutTransitionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case action == "sync":
+		po, err = st.syncPayout(ctx, po.ID)
+	case to == payoutApproved && po.CreatedBy != "" && po.CreatedBy == caller.Subject:
+		err = errSelfApproval
+	default:
+		reason := strings.TrimSpace(req.Reason)
+		if reason == "" {
+			reason = strings.TrimSpace(req.Code)
+		}
+		po, err = st.applyPayoutTransition(ctx, po.ID, to, reason, strings.TrimSpace(req.Code), caller.Subject, 0, nil)
+	}
+	if err != nil {
+		writePayoutError(w, err)
+		return
+	}
+	log.Printf(`{"msg":"payout %s","payout_id":%q,"by":%q}`, po.Status, po.ID, caller.Subject)
+	writeJSON(w, http.StatusOK, po)
+}
+
+func writePayoutError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errPayoutNotFound), errors.Is(err, errBeneficiaryNotFound):
+		http.Error(w, "not found", http.StatusNotFound)
+	case errors.Is(err, errInvalidPayout), errors.Is(err, errInvalidBeneficiary),
+		errors.Is(err, errUnknownCurrency), errors.Is(err, errInvalidAmount):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, errSelfApproval):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, errInsufficientFunds), errors.Is(err, errBeneficiaryDisabled):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	case errors.Is(err, errInvalidTransition), errors.Is(err, errVersionConflict), errors.Is(err, errPayoutRefReused):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, errProviderTimeout):
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+	case errors.Is(err, errProviderUnavailable):
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	default:
+		http.Error(w, "db error", http.StatusInternalServerError)
+	}
+}
+
+func (st *appState) createPayout(w http.ResponseWriter, r *http.Request) {
+	var req createPayoutRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if err := req.normalize(); err != nil {
+		writePayoutError(w, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	po, created, err := st.insertPayout(ctx, req, callerFrom(ctx))
+	if err != nil {
+		writePayoutError(w, err)
+		return
+	}
+	if !created {
+		writeJSON(w, http.StatusOK, po)
+		return
+	}
+	log.Printf(`{"msg":"payout created","payout_id":%q,"status":%q}`, po.ID, po.Status)
+	writeJSON(w, http.StatusCreated, po)
+}
+
+// insertPayout creates a payout and takes its amount from the user's
+// balance. A per-user, per-currency advisory lock serialises payouts, so
+// the available balance checked is the one the payout spends. Repeating a
+// ref returns the existing payout.
+func (st *appState) insertPayout(ctx context.Context, req createPayoutRequest, caller principal) (payout, bool, error) {
+	var po payout
+
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return po, false, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	b, err := loadBeneficiary(ctx, tx, req.BeneficiaryID)
+	if err == nil && !caller.mayActFor(b.UserID) {
+		err = errBeneficiaryNotFound
+	}
+	if err != nil {
+		return po, false, err
+	}
+	cur, err := lookupCurrency(b.Currency)
+	if err != nil {
+		return po, false, err
+	}
+	if req.Amount, err = cur.resolveAmount(req.Amount, req.AmountDecimal); err != nil {
+		return po, false, err
+	}
+	if req.Amount <= 0 {
+		return po, false, fmt.Errorf("%w: amount must be positive", errInvalidPayout)
+	}
+
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtextextended('payouts:' || $1 || ':' || $2, 0))`, b.UserID, b.Currency); err != nil {
+		return po, false, err
+	}
+
+	err = scanPayout(tx.QueryRowContext(ctx, `
+		SELECT `+payoutColumns+` FROM payouts WHERE user_id = $1 AND ref = $2
+	`, b.UserID, req.Ref), &po)
+	if err == nil {
+		if po.BeneficiaryID != b.ID || po.Amount != req.Amount {
+			return po, false, errPayoutRefReused
+		}
+		return po, false, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return po, false, err
+	}
+	if b.DisabledAt != nil {
+		return po, false, errBeneficiaryDisabled
+	}
+
+	balances, err := userBalances(ctx, tx, b.UserID, b.Currency)
+	if err != nil {
+		return po, false, err
+	}
+	var available int64
+	if len(balances) > 0 {
+		available = balances[0].Available
+	}
+	if req.Amount > available {
+		return po, false, fmt.Errorf("%w: %s %s available", errInsufficientFunds, formatAmount(max(available, 0), b.Currency), b.Currency)
+	}
+
+	unconfirmed, err := hasUnconfirmedCaptures(ctx, tx, b.UserID)
+	if err != nil {
+		return po, false, err
+	}
+	status := payoutApproved
+	needsApproval := unconfirmed || st.payoutApproval.requiresApproval(b.Currency, req.Amount)
+	if needsApproval {
+		status = payoutPendingApproval
+	}
+	err = scanPayout(tx.QueryRowContext(ctx, `
+		INSERT INTO payouts(user_id, beneficiary_id, amount, currency, ref, reference, status, requires_approval, created_by)
+		VALUES ($1, $2::uuid, $3, $4, $5, NULLIF($6, ''), $7, $8, NULLIF($9, ''))
+		RETURNING `+payoutColumns,
+		b.UserID, b.ID, req.Amount, b.Currency, req.Ref, req.Reference, status, needsApproval, caller.Subject), &po)
+	if err != nil {
+		return po, false, err
+	}
+	if err := recordPayoutEvent(ctx, tx, po.ID, "", status, "payout created", caller.Subject); err != nil {
+		return po, false, err
+	}
+	if err := postEntry(ctx, tx, payoutEntry(po, "", status)); err != nil {
+		return po, false, err
+	}
+	if err := enqueueEvent(ctx, tx, po.ID, po.UserID, "payout."+status, po); err != nil {
+		return po, false, err
+	}
+	return po, true, tx.Commit()
+}
+
+// hasUnconfirmedCaptures reports whether userID was credited for a payment
+// captured without a provider, which only the platform's own records
+// vouch for. Before capture was limited to operators in that case, owners
+// could record such captures themselves, so payouts from these balances
+// always go through approval.
+func hasUnconfirmedCaptures(ctx context.Context, tx *sql.Tx, userID string) (bool, error) {
+	var found bool
+	err := tx.QueryRowContext(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM payments
+			WHERE user_id = $1 AND captured_amount > 0 AND COALESCE(provider_ref, '') = ''
+		)
+	`, userID).Scan(&found)
+	return found, err
+}
+
+// payoutEntry returns the journal entry for a payout moving from one
+// status to another, or nil when no money moves. Creating a payout moves
+// its amount from the user into payout_clearing; paying it settles the
+// clearing balance from cash, and a payout that ends without reaching the
+// bank, or is returned by it, gives the amount back to the user.
+func payoutEntry(po payout, from, to string) *journalEntry {
+	e := &journalEntry{PayoutID: po.ID}
+	user := userAccount(po.UserID)
+	switch {
+	case from == "":
+		e.Kind = "payout_created"
+		e.Lines = []postingLine{debit(user, po.Currency, po.Amount), credit(accountPayoutClearing, po.Currency, po.Amount)}
+	case to == payoutPaid:
+		e.Kind = "payout_paid"
+		e.Lines = []postingLine{debit(accountPayoutClearing, po.Currency, po.Amount), credit(accountCash, po.Currency, po.Amount)}
+	case to == payoutReturned && from == payoutPaid:
+		e.Kind = "payout_returned"
+		e.Lines = []postingLine{debit(accountCash, po.Currency, po.Amount), credit(user, po.Currency, po.Amount)}
+	case to == payoutReturned, to == payoutFailed, to == payoutRejected, to == payoutCanceled:
+		e.Kind = "payout_" + to
+		e.Lines = []postingLine{debit(accountPayoutClearing, po.Currency, po.Amount), credit(user, po.Currency, po.Amount)}
+	default:
+		return nil
+	}
+	return e
+}
+
+// applyPayoutTransition moves a payout to status to and records the change
+// in payout_events, the ledger and the outbox, in one transaction. A
+// non-zero expectedVersion guards against a concurrent change; res is the
+// provider answer that caused the change, if any.
+func (st *appState) applyPayoutTransition(ctx context.Context, id, to, reason, code, actor string, expectedVersion int64, res *payoutResult) (payout, error) {
+	var po payout
+
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return po, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	err = scanPayout(tx.QueryRowContext(ctx, `
+		SELECT `+payoutColumns+` FROM payouts WHERE id = $1::uuid FOR UPDATE
+	`, id), &po)
+	if errors.Is(err, sql.ErrNoRows) {
+		return po, errPayoutNotFound
+	}
+	if err != nil {
+		return po, err
+	}
+	if expectedVersion != 0 && po.Version != expectedVersion {
+		return po, errVersionConflict
+	}
+	from := po.Status
+	if from == to {
+		return po, nil
+	}
+	if !canTransitionPayout(from, to) {
+		return po, fmt.Errorf("%w: %s -> %s", errInvalidTransition, from, to)
+	}
+
+	var provider, ref string
+	var raw sql.NullString
+	if res != nil {
+		provider, ref, raw = st.payoutProvider.Name(), res.Ref, rawOrNull(res.Raw)
+		if code == "" {
+			code = res.Code
+		}
+	}
+	err = scanPayout(tx.QueryRowContext(ctx, `
+		UPDATE payouts
+		SET status = $2,
+		    approved_by = CASE WHEN $2 = $3 THEN NULLIF($4, '') ELSE approved_by END,
+		    approved_at = CASE WHEN $2 = $3 THEN now() ELSE approved_at END,
+		    paid_at = CASE WHEN $2 = $5 THEN now() ELSE paid_at END,
+		    failure_code = COALESCE(NULLIF($6, ''), failure_code),
+		    provider = COALESCE(NULLIF($7, ''), provider),
+		    provider_ref = COALESCE(NULLIF($8, ''), provider_ref),
+		    provider_response = COALESCE($9::jsonb, provider_response),
+		    version = version + 1, updated_at = now()
+		WHERE id = $1::uuid
+		RETURNING `+payoutColumns,
+		id, to, payoutApproved, actor, payoutPaid, code, provider, ref, raw), &po)
+	if err != nil {
+		return po, err
+	}
+	if err := recordPayoutEvent(ctx, tx, id, from, to, reason, actor); err != nil {
+		return po, err
+	}
+	if err := postEntry(ctx, tx, payoutEntry(po, from, to)); err != nil {
+		return po, err
+	}
+	if err := enqueueEvent(ctx, tx, po.ID, po.UserID, "payout."+to, po); err != nil {
+		return po, err
+	}
+	return po, tx.Commit()
+}
+
+func recordPayoutEvent(ctx context.Context, tx *sql.Tx, payoutID, from, to, reason, actor string) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO payout_events(payout_id, from_status, to_status, reason, actor)
+		VALUES ($1::uuid, NULLIF($2, ''), $3, NULLIF($4, ''), NULLIF($5, ''))
+	`, payoutID, from, to, reason, actor)
+	return err
+}
+
+func loadPayout(ctx context.Context, db *sql.DB, id string) (payout, error) {
+	var po payout
+	if !isUUID(id) {
+		return po, errPayoutNotFound
+	}
+	err := scanPayout(db.QueryRowContext(ctx, `
+		SELECT `+payoutColumns+` FROM payouts WHERE id = $1::uuid
+	`, id), &po)
+	if errors.Is(err, sql.ErrNoRows) {
+		return po, errPayoutNotFound
+	}
+	return po, err
+}
+
+func (st *appState) listPayouts(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	userID := strings.TrimSpace(r.URL.Query().Get("user_id"))
+	if caller := callerFrom(ctx); !caller.Operator {
+		if userID != "" && userID != caller.Subject {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		userID = caller.Subject
+	}
+
+	rows, err := st.db.QueryContext(ctx, `
+		SELECT `+payoutColumns+`
+		FROM payouts
+		WHERE ($1 = '' OR user_id = $1) AND ($2 = '' OR status = $2)
+		ORDER BY created_at DESC
+		LIMIT 200
+	`, userID, r.URL.Query().Get("status"))
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	out := []payout{}
+	for rows.Next() {
+		var po payout
+		if err := scanPayout(rows, &po); err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		out = append(out, po)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func listPayoutEvents(ctx context.Context, db *sql.DB, payoutID string) ([]payoutEvent, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, COALESCE(from_status, ''), to_status, COALESCE(reason, ''), COALESCE(actor, ''), created_at
+		FROM payout_events
+		WHERE payout_id = $1::uuid
+		ORDER BY id
+	`, payoutID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []payoutEvent{}
+	for rows.Next() {
+		var e payoutEvent
+		if err := rows.Scan(&e.ID, &e.FromStatus, &e.ToStatus, &e.Reason, &e.Actor, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+// PayoutProvider sends payouts to beneficiary banks. As with Provider, an
+// error means the outcome is unknown, and Submit must be idempotent per
+// payout id so that it can be retried.
+type PayoutProvider interface {
+	Name() string
+	Submit(ctx context.Context, req payoutRequest) (payoutResult, error)
+	Status(ctx context.Context, ref string) (payoutResult, error)
+}
+
+type payoutRequest struct {
+	PayoutID  string
+	Amount    int64
+	Currency  string
+	Reference string
+	// the beneficiary, with its full account details
+	Name          string
+	IBAN          string
+	SortCode      string
+	AccountNumber string
+}
+
+// Payout provider outcomes. accepted means the bank has the payout but has
+// not yet confirmed it.
+const (
+	payoutOutcomeAccepted = "accepted"
+	payoutOutcomePaid     = "paid"
+	payoutOutcomeFailed   = "failed"
+	payoutOutcomeReturned = "returned"
+)
+
+type payoutResult struct {
+	Ref     string
+	Outcome string
+	// failure or return reason from the bank
+	Code string
+	Raw  json.RawMessage
+}
+
+// payoutTarget maps a provider answer onto the payout status. ok is false
+// when the answer changes nothing.
+func payoutTarget(from string, res payoutResult) (string, bool) {
+	to := ""
+	switch res.Outcome {
+	case payoutOutcomeAccepted:
+		to = payoutSubmitted
+	case payoutOutcomePaid:
+		to = payoutPaid
+	case payoutOutcomeFailed:
+		to = payoutFailed
+	case payoutOutcomeReturned:
+		to = payoutReturned
+	}
+	if to == "" || to == from || !canTransitionPayout(from, to) {
+		return "", false
+	}
+	return to, true
+}
+
+// newPayoutProviderFromEnv picks the provider named by PAYOUT_PROVIDER.
+// "manual", the default, leaves approved payouts for operators to settle
+// through the paid, fail and return actions. The simulator pays out
+// nothing real and keeps its state in memory, so like the payment
+// simulator it is only accepted in the dev environment.
+func newPayoutProviderFromEnv(env string) (PayoutProvider, error) {
+	switch kind := getenv("PAYOUT_PROVIDER", "manual"); kind {
+	case "manual":
+		return nil, nil
+	case "simulator":
+		if env != "dev" {
+			return nil, fmt.Errorf("PAYOUT_PROVIDER=simulator is only allowed in dev")
+		}
+		return newSimulatorPayouts(), nil
+	default:
+		return nil, fmt.Errorf("unknown PAYOUT_PROVIDER %q (want simulator or manual)", kind)
+	}
+}
+
+// submitPayout claims an approved payout as submitting, sends it to the
+// provider and applies its answer. The claim commits before the call, so
+// a cancel racing it fails instead of giving back money that is being
+// sent. An unknown outcome leaves the payout submitting, and the worker
+// submits it again once payoutSubmitRetry has passed.
+func (st *appState) submitPayout(ctx context.Context, id string) (payout, error) {
+	po, err := loadPayout(ctx, st.db, id)
+	if err != nil || st.payoutProvider == nil {
+		return po, err
+	}
+	switch po.Status {
+	case payoutApproved:
+		po, err = st.applyPayoutTransition(ctx, po.ID, payoutSubmitting, "claimed for submission", "", "", po.Version, nil)
+		if errors.Is(err, errVersionConflict) {
+			// changed meanwhile, or claimed by another replica
+			return po, nil
+		}
+		if err != nil {
+			return po, err
+		}
+	case payoutSubmitting:
+	default:
+		return po, nil
+	}
+	b, err := loadBeneficiary(ctx, st.db, po.BeneficiaryID)
+	if err != nil {
+		return po, err
+	}
+	res, err := st.payoutProvider.Submit(ctx, payoutRequest{
+		PayoutID:      po.ID,
+		Amount:        po.Amount,
+		Currency:      po.Currency,
+		Reference:     po.Reference,
+		Name:          b.Name,
+		IBAN:          b.iban,
+		SortCode:      b.sortCode,
+		AccountNumber: b.accountNumber,
+	})
+	if err != nil {
+		return po, providerCallError(err)
+	}
+	to, ok := payoutTarget(po.Status, res)
+	if !ok {
+		return po, nil
+	}
+	return st.applyPayoutTransition(ctx, po.ID, to, "provider "+res.Outcome, "", "", po.Version, &res)
+}
+
+// syncPayout asks the provider for a submitted or paid payout's state and
+// applies any change, including a return after payment.
+func (st *appState) syncPayout(ctx context.Context, id string) (payout, error) {
+	po, err := loadPayout(ctx, st.db, id)
+	if err != nil || st.payoutProvider == nil || po.ProviderRef == "" {
+		return po, err
+	}
+	res, err := st.payoutProvider.Status(ctx, po.ProviderRef)
+	if err != nil {
+		return po, providerCallError(err)
+	}
+	to, ok := payoutTarget(po.Status, res)
+	if !ok {
+		return po, nil
+	}
+	return st.applyPayoutTransition(ctx, po.ID, to, "provider "+res.Outcome, "", "", po.Version, &res)
+}
+
+// payoutReturnWindow is how long after payment a payout is still polled
+// for a return.
+const payoutReturnWindow = 5 * 24 * time.Hour
+
+// payoutSubmitRetry is how long a payout stays submitting before the
+// worker submits it again. It is well above a submission's timeout, so a
+// payout still being submitted by another replica is left alone.
+const payoutSubmitRetry = time.Minute
+
+// runPayoutWorker submits approved payouts and polls submitted and recently
+// paid ones. Every replica runs it; claims and transitions are
+// version-guarded and provider calls idempotent, so overlapping work is
+// harmless. A conflict after a provider call means the payout changed
+// while it was being sent and is logged for an operator to look at.
+func (st *appState) runPayoutWorker(ctx context.Context, every time.Duration) {
+	if st.payoutProvider == nil {
+		return
+	}
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		for _, step := range []struct {
+			name  string
+			query string
+			args  []any
+			run   func(context.Context, string) (payout, error)
+		}{
+			{"submit", `status = $1 OR (status = $2 AND updated_at < now() - make_interval(secs => $3))`,
+				[]any{payoutApproved, payoutSubmitting, payoutSubmitRetry.Seconds()}, st.submitPayout},
+			{"sync", `status = $1 OR (status = $2 AND paid_at > now() - make_interval(secs => $3))`,
+				[]any{payoutSubmitted, payoutPaid, payoutReturnWindow.Seconds()}, st.syncPayout},
+		} {
+			qctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			ids, err := st.payoutIDs(qctx, step.query, step.args...)
+			cancel()
+			if err != nil {
+				log.Printf(`{"msg":"payout %s query failed","error":%q}`, step.name, err.Error())
+				continue
+			}
+			for _, id := range ids {
+				sctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+				_, err := step.run(sctx, id)
+				cancel()
+				if err != nil {
+					log.Printf(`{"msg":"payout %s failed","payout_id":%q,"error":%q}`, step.name, id, err.Error())
+				}
+			}
+		}
+	}
+}
+
+func (st *appState) payoutIDs(ctx context.Context, where string, args ...any) ([]string, error) {
+	rows, err := st.db.QueryContext(ctx, `
+		SELECT id::text FROM payouts WHERE `+where+` ORDER BY updated_at LIMIT 100
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+const payoutsSchema = `
+	CREATE TABLE IF NOT EXISTS beneficiaries (
+		id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+		user_id text NOT NULL,
+		name text NOT NULL,
+		currency text NOT NULL,
+		account_type text NOT NULL,
+		iban text,
+		sort_code text,
+		account_number text,
+		disabled_at timestamptz,
+		created_at timestamptz NOT NULL DEFAULT now(),
+		CHECK ((account_type = 'iban' AND iban IS NOT NULL)
+			OR (account_type = 'sort_code' AND sort_code IS NOT NULL AND account_number IS NOT NULL))
+	);
+
+	CREATE INDEX IF NOT EXISTS beneficiaries_user_idx ON beneficiaries(user_id, created_at);
+
+	CREATE TABLE IF NOT EXISTS payouts (
+		id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+		user_id text NOT NULL,
+		beneficiary_id uuid NOT NULL REFERENCES beneficiaries(id),
+		amount bigint NOT NULL CHECK (amount > 0),
+		currency text NOT NULL,
+		ref text NOT NULL,
+		reference text,
+		status text NOT NULL,
+		requires_approval boolean NOT NULL DEFAULT false,
+		created_by text,
+		approved_by text,
+		approved_at timestamptz,
+		provider text,
+		provider_ref text,
+		provider_response jsonb,
+		failure_code text,
+		paid_at timestamptz,
+		version bigint NOT NULL DEFAULT 1,
+		created_at timestamptz NOT NULL DEFAULT now(),
+		updated_at timestamptz NOT NULL DEFAULT now()
+	);
+
+	CREATE UNIQUE INDEX IF NOT EXISTS payouts_user_ref_uq ON payouts(user_id, ref);
+	CREATE INDEX IF NOT EXISTS payouts_user_idx ON payouts(user_id, created_at);
+	CREATE INDEX IF NOT EXISTS payouts_work_idx ON payouts(updated_at)
+		WHERE status IN ('approved', 'submitted', 'paid');
+
+	CREATE TABLE IF NOT EXISTS payout_events (
+		id bigserial PRIMARY KEY,
+		payout_id uuid NOT NULL REFERENCES payouts(id),
+		from_status text,
+		to_status text NOT NULL,
+		reason text,
+		actor text,
+		created_at timestamptz NOT NULL DEFAULT now()
+	);
+
+	CREATE INDEX IF NOT EXISTS payout_events_payout_idx ON payout_events(payout_id, id);
+
+	ALTER TABLE journal_entries ADD COLUMN IF NOT EXISTS payout_id uuid REFERENCES payouts(id);
+`
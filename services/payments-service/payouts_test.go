@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestBeneficiaryRequestNormalize(t *testing.T) {
+	b, err := createBeneficiaryRequest{UserID: "u1", Name: "  Ada   Lovelace ", Currency: "eur", IBAN: "gb29 nwbk 6016 1331 9268 19"}.normalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Name != "Ada Lovelace" || b.Currency != "EUR" || b.AccountType != accountTypeIBAN ||
+		b.iban != "GB29NWBK60161331926819" || b.Account != "GB29 **** 6819" {
+		t.Fatalf("iban beneficiary: %+v", b)
+	}
+
+	b, err = createBeneficiaryRequest{UserID: "u1", Name: "Ada", Currency: "GBP", SortCode: "60-16-13", AccountNumber: "31926819"}.normalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.sortCode != "601613" || b.SortCode != "60-16-13" || b.Account != "****6819" {
+		t.Fatalf("sort code beneficiary: %+v", b)
+	}
+
+	for name, bad := range map[string]createBeneficiaryRequest{
+		"no account":       {UserID: "u1", Name: "Ada", Currency: "EUR"},
+		"both":             {UserID: "u1", Name: "Ada", Currency: "GBP", IBAN: "GB29NWBK60161331926819", SortCode: "601613", AccountNumber: "31926819"},
+		"check digits":     {UserID: "u1", Name: "Ada", Currency: "EUR", IBAN: "GB28NWBK60161331926819"},
+		"sort code in EUR": {UserID: "u1", Name: "Ada", Currency: "EUR", SortCode: "601613", AccountNumber: "31926819"},
+		"short sort code":  {UserID: "u1", Name: "Ada", Currency: "GBP", SortCode: "60-16", AccountNumber: "31926819"},
+		"short account":    {UserID: "u1", Name: "Ada", Currency: "GBP", SortCode: "601613", AccountNumber: "3192681"},
+		"missing name":     {UserID: "u1", Currency: "EUR", IBAN: "GB29NWBK60161331926819"},
+	} {
+		if _, err := bad.normalize(); !errors.Is(err, errInvalidBeneficiary) {
+			t.Errorf("%s: got %v, want errInvalidBeneficiary", name, err)
+		}
+	}
+}
+
+func TestPayoutThresholds(t *testing.T) {
+	t.Setenv("PAYOUT_APPROVAL_THRESHOLDS", `{"eur": "1000.50", "JPY": "100000"}`)
+	th, err := payoutThresholdsFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if th["EUR"] != 100050 || th["JPY"] != 100000 {
+		t.Fatalf("thresholds = %v", th)
+	}
+	if th.requiresApproval("EUR", 100050) || !th.requiresApproval("EUR", 100051) {
+		t.Fatal("approval should start above the threshold")
+	}
+	if !th.requiresApproval("USD", 1) {
+		t.Fatal("currencies without a threshold always need approval")
+	}
+
+	t.Setenv("PAYOUT_APPROVAL_THRESHOLDS", `{"EUR": "10.001"}`)
+	if _, err := payoutThresholdsFromEnv(); err == nil {
+		t.Fatal("expected an error for too many decimals")
+	}
+}
+
+func TestPayoutLedgerEntries(t *testing.T) {
+	po := payout{ID: "po1", UserID: "u1", Amount: 2500, Currency: "EUR"}
+	for _, path := range [][]string{
+		{payoutApproved, payoutSubmitting, payoutSubmitted, payoutPaid},
+		{payoutApproved, payoutSubmitting, payoutSubmitted, payoutPaid, payoutReturned},
+		{payoutApproved, payoutSubmitting, payoutSubmitted, payoutReturned},
+		{payoutApproved, payoutSubmitting, payoutFailed},
+		{payoutPendingApproval, payoutRejected},
+		{payoutApproved, payoutFailed},
+	} {
+		balances := map[string]int64{}
+		from := ""
+		for _, to := range path {
+			if from != "" && !canTransitionPayout(from, to) {
+				t.Fatalf("%v: %s -> %s not allowed", path, from, to)
+			}
+			if e := payoutEntry(po, from, to); e != nil {
+				if err := validateEntry(*e); err != nil {
+					t.Fatalf("%v: %v", path, err)
+				}
+				if e.PayoutID != "po1" {
+					t.Fatalf("%v: entry not linked to the payout", path)
+				}
+				for _, l := range e.Lines {
+					balances[l.Account] += l.Amount
+				}
+			}
+			from = to
+		}
+
+		// a paid payout leaves cash and the user's balance; anything else
+		// gives the user everything back
+		want := map[string]int64{accountPayoutClearing: 0, accountCash: 0, userAccount("u1"): 0}
+		if from == payoutPaid {
+			want[accountCash], want[userAccount("u1")] = -2500, 2500
+		}
+		for acc, v := range want {
+			if balances[acc] != v {
+				t.Errorf("%v: %s = %d, want %d", path, acc, balances[acc], v)
+			}
+		}
+	}
+}
+
+func TestSubmittingPayoutCannotBeCanceled(t *testing.T) {
+	if !canTransitionPayout(payoutApproved, payoutCanceled) {
+		t.Fatal("an approved payout should still be cancelable")
+	}
+	if canTransitionPayout(payoutSubmitting, payoutCanceled) {
+		t.Fatal("a payout being submitted must not be cancelable")
+	}
+	if canTransitionPayout(payoutApproved, payoutSubmitted) {
+		t.Fatal("payouts reach the provider only through submitting")
+	}
+}
+
+func TestSimulatorPayouts(t *testing.T) {
+	ctx := context.Background()
+	s := newSimulatorPayouts()
+	step := func(from string, res payoutResult) string {
+		t.Helper()
+		to, ok := payoutTarget(from, res)
+		if !ok {
+			t.Fatalf("%s: no transition for %+v", from, res)
+		}
+		return to
+	}
+
+	res, err := s.Submit(ctx, payoutRequest{PayoutID: "po-1", Amount: 1000, Currency: "EUR"})
+	if err != nil || step(payoutSubmitting, res) != payoutSubmitted {
+		t.Fatalf("submit: %+v, %v", res, err)
+	}
+	res, _ = s.Status(ctx, res.Ref)
+	if step(payoutSubmitted, res) != payoutPaid {
+		t.Fatalf("status: %+v", res)
+	}
+	if _, ok := payoutTarget(payoutPaid, res); ok {
+		t.Fatal("a repeated paid answer should change nothing")
+	}
+
+	res, _ = s.Submit(ctx, payoutRequest{PayoutID: "po-2", Amount: 50002, Currency: "EUR"})
+	if step(payoutSubmitting, res) != payoutFailed || res.Code != "invalid_account" {
+		t.Fatalf("fail scenario: %+v", res)
+	}
+
+	res, _ = s.Submit(ctx, payoutRequest{PayoutID: "po-3", Amount: 50004, Currency: "EUR"})
+	res, _ = s.Status(ctx, res.Ref)
+	res, _ = s.Status(ctx, res.Ref)
+	if step(payoutPaid, res) != payoutReturned || res.Code != "account_closed" {
+		t.Fatalf("return scenario: %+v", res)
+	}
+
+	req := payoutRequest{PayoutID: "po-4", Amount: 50008, Currency: "EUR"}
+	if _, err := s.Submit(ctx, req); !errors.Is(err, errProviderTimeout) {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+	if res, err := s.Submit(ctx, req); err != nil || res.Outcome != payoutOutcomeAccepted {
+		t.Fatalf("retry: %+v, %v", res, err)
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Provider is a payment processor. The payment state machine drives it:
+// authorize, capture and cancel call it before the status changes, and
+// Status is polled to learn about settlement and asynchronous outcomes.
+//
+// A returned error means the outcome is unknown (timeout, network error),
+// not that the provider said no; a refusal is a result with Outcome
+// "declined". Calls must be idempotent per payment, since an unknown
+// outcome is resolved by retrying.
+type Provider interface {
+	Name() string
+	Authorize(ctx context.Context, req authorizeRequest) (providerResult, error)
+	Capture(ctx context.Context, ref string, req captureRequest) (providerResult, error)
+	Void(ctx context.Context, ref string) (providerResult, error)
+	Refund(ctx context.Context, ref, refundID string, amount int64, currency string) (providerResult, error)
+	Status(ctx context.Context, ref string) (providerResult, error)
+}
+
+type authorizeRequest struct {
+	PaymentID     string
+	Amount        int64
+	Currency      string
+	PaymentMethod string
+	// set when continuing an authorization that required customer action
+	Ref string
+}
+
+// captureRequest takes Amount from an authorization. ID identifies the
+// capture, so a retried one is not taken twice. Final closes the
+// authorization and releases whatever was not captured; a non-final
+// capture leaves it open for more.
+type captureRequest struct {
+	ID       string
+	Amount   int64
+	Currency string
+	Final    bool
+}
+
+const (
+	providerApproved       = "approved"
+	providerDeclined       = "declined"
+	providerActionRequired = "action_required"
+	providerPending        = "pending"
+	providerSettled        = "settled"
+)
+
+type providerResult struct {
+	Ref     string
+	Outcome string
+	// decline or error code from the provider
+	Code string
+	// where the customer completes authentication when Outcome is
+	// action_required
+	NextAction string
+	Raw        json.RawMessage
+}
+
+var (
+	errProviderDeclined    = errors.New("provider declined")
+	errProviderTimeout     = errors.New("provider timed out, outcome unknown")
+	errProviderUnavailable = errors.New("provider unavailable")
+)
+
+// providerActions are the payment actions that go through the provider when
+// one is configured. The others (settle, fail, expire) only change our
+// record.
+var providerActions = map[string]bool{
+	"authorize": true,
+	"capture":   true,
+	"cancel":    true,
+}
+
+// newProviderFromEnv picks the provider named by PAYMENT_PROVIDER.
+// "manual", the default, keeps the old behaviour of moving payments only
+// through the API. The simulator approves whatever it is sent and keeps its
+// state in memory, so it is only accepted in the dev environment.
+func newProviderFromEnv(env string) (Provider, error) {
+	switch kind := getenv("PAYMENT_PROVIDER", "manual"); kind {
+	case "manual":
+		return nil, nil
+	case "simulator":
+		if env != "dev" {
+			return nil, fmt.Errorf("PAYMENT_PROVIDER=simulator is only allowed in dev")
+		}
+		delay, err := time.ParseDuration(getenv("SIMULATOR_SETTLEMENT_DELAY", "1h"))
+		if err != nil {
+			return nil, fmt.Errorf("SIMULATOR_SETTLEMENT_DELAY: %w", err)
+		}
+		return newSimulatorProvider(delay), nil
+	default:
+		return nil, fmt.Errorf("unknown PAYMENT_PROVIDER %q (want simulator or manual)", kind)
+	}
+}
+
+// providerCallError turns a transport-level error into one of ours.
+func providerCallError(err error) error {
+	if errors.Is(err, errProviderTimeout) || errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %v", errProviderTimeout, err)
+	}
+	return fmt.Errorf("%w: %v", errProviderUnavailable, err)
+}
+
+// authorizeTarget maps an authorization result onto the payment status.
+// ok is false when the status stays as it is (a repeated action_required).
+func authorizeTarget(from string, res providerResult) (string, bool) {
+	switch res.Outcome {
+	case providerApproved:
+		return statusAuthorized, true
+	case providerDeclined:
+		return statusFailed, true
+	case providerActionRequired:
+		return statusRequiresAction, from != statusRequiresAction
+	}
+	return "", false
+}
+
+// syncTarget maps a status query onto the payment status, for outcomes
+// that happen after our call returned: settlement, or an authentication
+// the customer completed or abandoned.
+func syncTarget(from string, res providerResult) (string, bool) {
+	switch {
+	case from == statusCaptured && res.Outcome == providerSettled:
+		return statusSettled, true
+	case from == statusRequiresAction && res.Outcome == providerApproved:
+		return statusAuthorized, true
+	case (from == statusRequiresAction || from == statusAuthorized) && res.Outcome == providerDeclined:
+		return statusFailed, true
+	}
+	return "", false
+}
+
+func declineReason(res providerResult) string {
+	if res.Code == "" {
+		return "provider declined"
+	}
+	return "provider declined: " + res.Code
+}
+
+// providerTransition calls the provider for action and applies the status
+// it results in. The transition is guarded by the version read before the
+// call, so a payment changed meanwhile is not overwritten.
+func (st *appState) providerTransition(ctx context.Context, id, action string, req transitionRequest) (payment, error) {
+	if action == "capture" {
+		return st.capturePayment(ctx, id, req)
+	}
+	p, err := st.loadPayment(ctx, id)
+	if err != nil {
+		return p, err
+	}
+	if req.ExpectedVersion != 0 && p.Version != req.ExpectedVersion {
+		return p, errVersionConflict
+	}
+	to := paymentActions[action]
+	if p.ProviderRef == "" && action != "authorize" {
+		// created before the provider was configured, or never authorized
+		// with it: nothing to tell the provider
+		return st.applyTransition(ctx, id, to, req.Reason, p.Version)
+	}
+	if !canTransition(p.Status, to) {
+		return p, fmt.Errorf("%w: %s -> %s", errInvalidTransition, p.Status, to)
+	}
+
+	var res providerResult
+	switch action {
+	case "authorize":
+		res, err = st.provider.Authorize(ctx, authorizeRequest{
+			PaymentID:     p.ID,
+			Amount:        p.Amount,
+			Currency:      p.Currency,
+			PaymentMethod: p.PaymentMethod,
+			Ref:           p.ProviderRef,
+		})
+	case "cancel":
+		res, err = st.provider.Void(ctx, p.ProviderRef)
+	}
+	if err != nil {
+		log.Printf(`{"msg":"provider call failed","payment_id":%q,"action":%q,"error":%q}`, id, action, err.Error())
+		return p, providerCallError(err)
+	}
+
+	reason := req.Reason
+	if action == "authorize" {
+		target, ok := authorizeTarget(p.Status, res)
+		if !ok {
+			return p, saveProviderResult(ctx, st.db, id, st.provider.Name(), res, &p)
+		}
+		to = target
+		if to == statusFailed {
+			reason = declineReason(res)
+		}
+	} else if res.Outcome == providerDeclined {
+		if err := saveProviderResult(ctx, st.db, id, st.provider.Name(), res, &p); err != nil {
+			return p, err
+		}
+		return p, fmt.Errorf("%w: %s", errProviderDeclined, declineReason(res))
+	}
+	return st.applyProviderTransition(ctx, id, to, reason, p.Version, &res, nil)
+}
+
+// syncPayment asks the provider for the payment's current state and applies
+// any change it implies.
+func (st *appState) syncPayment(ctx context.Context, id string) (payment, error) {
+	p, err := st.loadPayment(ctx, id)
+	if err != nil || st.provider == nil || p.ProviderRef == "" {
+		return p, err
+	}
+	res, err := st.provider.Status(ctx, p.ProviderRef)
+	if err != nil {
+		return p, providerCallError(err)
+	}
+	to, ok := syncTarget(p.Status, res)
+	if !ok {
+		return p, nil
+	}
+	reason := "provider status " + res.Outcome
+	if to == statusFailed {
+		reason = declineReason(res)
+	}
+	return st.applyProviderTransition(ctx, id, to, reason, p.Version, &res, nil)
+}
+
+func (st *appState) syncPaymentHandler(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	p, err := st.syncPayment(ctx, id)
+	if err != nil {
+		writeTransitionError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+// syncProviderPayments polls the provider for payments waiting on it:
+// captured ones until they settle, and those waiting for customer action.
+func (st *appState) syncProviderPayments(ctx context.Context, every time.Duration) {
+	if st.provider == nil {
+		return
+	}
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		qctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		ids, err := st.paymentsAwaitingProvider(qctx)
+		cancel()
+		if err != nil {
+			log.Printf(`{"msg":"provider sync query failed","error":%q}`, err.Error())
+			continue
+		}
+		for _, id := range ids {
+			sctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			_, err := st.syncPayment(sctx, id)
+			cancel()
+			if err != nil && !errors.Is(err, errVersionConflict) && !errors.Is(err, errInvalidTransition) {
+				log.Printf(`{"msg":"provider sync failed","payment_id":%q,"error":%q}`, id, err.Error())
+			}
+		}
+	}
+}
+
+func (st *appState) paymentsAwaitingProvider(ctx context.Context) ([]string, error) {
+	rows, err := st.db.QueryContext(ctx, `
+		SELECT id::text
+		FROM payments
+		WHERE status IN ($1, $2) AND provider_ref IS NOT NULL
+		ORDER BY updated_at
+		LIMIT 100
+	`, statusCaptured, statusRequiresAction)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// submitRefund sends a newly reserved refund to the provider and completes
+// it when the provider answers definitively. A pending or unknown outcome
+// leaves the refund pending, to be completed through the refund actions.
+func (st *appState) submitRefund(ctx context.Context, paymentID string, rf refund) (refund, error) {
+	p, err := st.loadPayment(ctx, paymentID)
+	if err != nil || st.provider == nil || p.ProviderRef == "" {
+		return rf, err
+	}
+	res, err := st.provider.Refund(ctx, p.ProviderRef, rf.ID, rf.Amount, rf.Currency)
+	if err != nil {
+		log.Printf(`{"msg":"provider refund failed","refund_id":%q,"error":%q}`, rf.ID, err.Error())
+		return rf, nil
+	}
+	if _, err := st.db.ExecContext(ctx, `
+		UPDATE refunds SET provider_ref = NULLIF($2, ''), provider_response = $3::jsonb
+		WHERE id = $1::uuid
+	`, rf.ID, res.Ref, rawOrNull(res.Raw)); err != nil {
+		return rf, err
+	}
+	switch res.Outcome {
+	case providerApproved, providerSettled:
+		return st.completeRefund(ctx, paymentID, rf.ID, refundSucceeded)
+	case providerDeclined:
+		return st.completeRefund(ctx, paymentID, rf.ID, refundFailed)
+	}
+	return rf, nil
+}
+
+func (st *appState) loadPayment(ctx context.Context, id string) (payment, error) {
+	var p payment
+	err := scanPayment(st.db.QueryRowContext(ctx, `
+		SELECT `+paymentColumns+`
+		FROM payments
+		WHERE id = $1::uuid
+	`, id), &p)
+	if errors.Is(err, sql.ErrNoRows) {
+		return p, errPaymentNotFound
+	}
+	return p, err
+}
+
+type rowQuerier interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// saveProviderResult stores the provider, its reference and the raw
+// response on the payment and rescans it into p. It does not bump the
+// version: the provider fields are a record of calls, not a state change.
+func saveProviderResult(ctx context.Context, q rowQuerier, id, provider string, res providerResult, p *payment) error {
+	return scanPayment(q.QueryRowContext(ctx, `
+		UPDATE payments
+		SET provider = $2, provider_ref = COALESCE(NULLIF($3, ''), provider_ref),
+		    provider_response = COALESCE($4::jsonb, provider_response)
+		WHERE id = $1::uuid
+		RETURNING `+paymentColumns,
+		id, provider, res.Ref, rawOrNull(res.Raw)), p)
+}
+
+func rawOrNull(raw json.RawMessage) sql.NullString {
+	return sql.NullString{String: string(raw), Valid: len(raw) > 0}
+}
+
+const providerSchema = `
+	ALTER TABLE payments ADD COLUMN IF NOT EXISTS payment_method text;
+	ALTER TABLE payments ADD COLUMN IF NOT EXISTS provider text;
+	ALTER TABLE payments ADD COLUMN IF NOT EXISTS provider_ref text;
+	ALTER TABLE payments ADD COLUMN IF NOT EXISTS provider_response jsonb;
+
+	ALTER TABLE refunds ADD COLUMN IF NOT EXISTS provider_ref text;
+	ALTER TABLE refunds ADD COLUMN IF NOT EXISTS provider_response jsonb;
+
+	CREATE INDEX IF NOT EXISTS payments_provider_ref_idx ON payments(provider, provider_ref);
+	CREATE INDEX IF NOT EXISTS payments_awaiting_provider_idx ON payments(updated_at)
+		WHERE status IN ('captured', 'requires_action') AND provider_ref IS NOT NULL;
+`
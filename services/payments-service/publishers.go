@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Publisher delivers one outbox event to a broker or endpoint. Publish must
+// return nil only once the event has been accepted; the relay retries on
+// any error, so subscribers must tolerate duplicates (dedupe on event id).
+type Publisher interface {
+	Publish(ctx context.Context, e outboxEvent) error
+}
+
+// newPublisherFromEnv picks the publisher named by OUTBOX_PUBLISHER.
+func newPublisherFromEnv() (Publisher, error) {
+	switch kind := getenv("OUTBOX_PUBLISHER", "log"); kind {
+	case "log":
+		return logPublisher{}, nil
+	case "webhook":
+		u := getenv("OUTBOX_WEBHOOK_URL", "")
+		if _, err := url.ParseRequestURI(u); err != nil {
+			return nil, fmt.Errorf("OUTBOX_WEBHOOK_URL: %w", err)
+		}
+		return &webhookPublisher{url: u, client: &http.Client{Timeout: 10 * time.Second}}, nil
+	case "nats":
+		return &natsPublisher{
+			addr:          strings.TrimPrefix(getenv("OUTBOX_NATS_URL", "nats://nats:4222"), "nats://"),
+			subjectPrefix: getenv("OUTBOX_NATS_SUBJECT_PREFIX", "payments"),
+		}, nil
+	case "kafka":
+		u := getenv("OUTBOX_KAFKA_REST_URL", "")
+		if _, err := url.ParseRequestURI(u); err != nil {
+			return nil, fmt.Errorf("OUTBOX_KAFKA_REST_URL: %w", err)
+		}
+		return &kafkaRESTPublisher{
+			baseURL: strings.TrimSuffix(u, "/"),
+			topic:   getenv("OUTBOX_KAFKA_TOPIC", "payments.events"),
+			client:  &http.Client{Timeout: 10 * time.Second},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown OUTBOX_PUBLISHER %q (want log, webhook, nats or kafka)", kind)
+	}
+}
+
+// multiPublisher publishes to each publisher in turn and stops at the first
+// error, so the relay retries the event against all of them. Every
+// publisher must therefore be idempotent or tolerate duplicates.
+type multiPublisher []Publisher
+
+func (m multiPublisher) Publish(ctx context.Context, e outboxEvent) error {
+	for _, p := range m {
+		if err := p.Publish(ctx, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// logPublisher writes events to the service log. It is the default, so
+// events are at least visible before a broker is wired up.
+type logPublisher struct{}
+
+func (logPublisher) Publish(_ context.Context, e outboxEvent) error {
+	log.Printf(`{"msg":"domain event","id":%d,"type":%q,"aggregate_id":%q,"data":%s}`,
+		e.ID, e.Type, e.AggregateID, e.Data)
+	return nil
+}
+
+// webhookPublisher POSTs each event as JSON; any 2xx is success.
+type webhookPublisher struct {
+	url    string
+	client *http.Client
+}
+
+func (p *webhookPublisher) Publish(ctx context.Context, e outboxEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Event-Id", fmt.Sprint(e.ID))
+	req.Header.Set("X-Event-Type", e.Type)
+	return doAccepted(p.client, req)
+}
+
+// kafkaRESTPublisher produces to a topic through a Kafka REST proxy (v2
+// API), keyed by payment id so one payment's events share a partition.
+type kafkaRESTPublisher struct {
+	baseURL string
+	topic   string
+	client  *http.Client
+}
+
+func (p *kafkaRESTPublisher) Publish(ctx context.Context, e outboxEvent) error {
+	body, err := json.Marshal(map[string]any{
+		"records": []map[string]any{{"key": e.AggregateID, "value": e}},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		p.baseURL+"/topics/"+url.PathEscape(p.topic), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+	return doAccepted(p.client, req)
+}
+
+func doAccepted(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s %s: status %d", req.Method, req.URL.Redacted(), resp.StatusCode)
+	}
+	return nil
+}
+
+// natsPublisher speaks just enough of the NATS text protocol to publish:
+// CONNECT once, then PUB followed by PING, waiting for PONG so we know the
+// server has processed the message. The connection is reopened after any
+// error.
+type natsPublisher struct {
+	addr          string
+	subjectPrefix string
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (p *natsPublisher) Publish(ctx context.Context, e outboxEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conn == nil {
+		if err := p.connect(ctx); err != nil {
+			return err
+		}
+	}
+	if err := p.publish(ctx, p.subjectPrefix+"."+e.Type, body); err != nil {
+		_ = p.conn.Close()
+		p.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (p *natsPublisher) connect(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", p.addr)
+	if err != nil {
+		return err
+	}
+	p.conn = conn
+	p.r = bufio.NewReader(conn)
+	p.setDeadline(ctx)
+
+	// the server greets with INFO before anything else
+	line, err := p.r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "INFO ") {
+		_ = conn.Close()
+		p.conn = nil
+		return fmt.Errorf("nats: unexpected greeting %q: %v", strings.TrimSpace(line), err)
+	}
+	if _, err := io.WriteString(conn, "CONNECT {\"verbose\":false,\"pedantic\":false,\"name\":\"payments-service\"}\r\n"); err != nil {
+		_ = conn.Close()
+		p.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (p *natsPublisher) publish(ctx context.Context, subject string, body []byte) error {
+	p.setDeadline(ctx)
+	msg := fmt.Sprintf("PUB %s %d\r\n%s\r\nPING\r\n", subject, len(body), body)
+	if _, err := io.WriteString(p.conn, msg); err != nil {
+		return err
+	}
+	for {
+		line, err := p.r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		switch line = strings.TrimSpace(line); {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err := io.WriteString(p.conn, "PONG\r\n"); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("nats: %s", line)
+		}
+		// +OK and INFO updates need no action
+	}
+}
+
+func (p *natsPublisher) setDeadline(ctx context.Context) {
+	if dl, ok := ctx.Deadline(); ok {
+		_ = p.conn.SetDeadline(dl)
+	} else {
+		_ = p.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	}
+}
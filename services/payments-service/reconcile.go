@@ -0,0 +1,696 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Reconciliation result classes.
+const (
+	reconMatched           = "matched"
+	reconMissingInternally = "missing_internally"
+	reconMissingExternally = "missing_externally"
+	reconAmountMismatch    = "amount_mismatch"
+)
+
+var errInvalidSettlementFile = errors.New("invalid settlement file")
+
+// settlementLine is one row of a processor's settlement report.
+type settlementLine struct {
+	LineNo      int
+	ProviderRef string
+	Amount      int64
+	Currency    string
+}
+
+// settlementParser reads one report format. Parsers are registered by name
+// in settlementParsers and chosen with the format parameter.
+type settlementParser interface {
+	Parse(r io.Reader) ([]settlementLine, error)
+}
+
+var settlementParsers = map[string]settlementParser{
+	"csv": csvSettlementParser{},
+}
+
+// csvSettlementParser reads a CSV report with a header row. Columns are
+// found by name, case-insensitively, so extra columns and any order are
+// fine:
+//
+//	provider_ref (or reference)  required
+//	currency                     required
+//	amount_minor                 amount in minor units, or
+//	amount                       decimal amount in major units
+type csvSettlementParser struct{}
+
+func (csvSettlementParser) Parse(r io.Reader) ([]settlementLine, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+	cr.FieldsPerRecord = -1
+
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%w: missing header: %v", errInvalidSettlementFile, err)
+	}
+	col := map[string]int{}
+	for i, h := range header {
+		col[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(h, "\ufeff")))] = i
+	}
+	refCol, ok := col["provider_ref"]
+	if !ok {
+		refCol, ok = col["reference"]
+	}
+	curCol, hasCur := col["currency"]
+	minorCol, hasMinor := col["amount_minor"]
+	decCol, hasDec := col["amount"]
+	if !ok || !hasCur || (!hasMinor && !hasDec) {
+		return nil, fmt.Errorf("%w: header needs provider_ref, currency and amount or amount_minor", errInvalidSettlementFile)
+	}
+
+	field := func(rec []string, i int) string {
+		if i < len(rec) {
+			return strings.TrimSpace(rec[i])
+		}
+		return ""
+	}
+
+	var out []settlementLine
+	for {
+		rec, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return out, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errInvalidSettlementFile, err)
+		}
+		// blank lines are skipped by the reader, so ask it where we are
+		lineNo, _ := cr.FieldPos(0)
+
+		line := settlementLine{
+			LineNo:      lineNo,
+			ProviderRef: field(rec, refCol),
+			Currency:    strings.ToUpper(field(rec, curCol)),
+		}
+		if line.ProviderRef == "" {
+			return nil, fmt.Errorf("%w: line %d: empty provider_ref", errInvalidSettlementFile, lineNo)
+		}
+		if hasMinor && field(rec, minorCol) != "" {
+			line.Amount, err = strconv.ParseInt(field(rec, minorCol), 10, 64)
+		} else {
+			line.Amount, err = parseSignedDecimal(field(rec, decCol), line.Currency)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: line %d: %v", errInvalidSettlementFile, lineNo, err)
+		}
+		out = append(out, line)
+	}
+}
+
+// parseSignedDecimal parses a report amount, which may be negative for
+// reversals, using the currency's exponent.
+func parseSignedDecimal(s, currency string) (int64, error) {
+	cur, err := lookupCurrency(currency)
+	if err != nil {
+		return 0, err
+	}
+	neg := strings.HasPrefix(s, "-")
+	v, err := parseDecimalAmount(strings.TrimPrefix(s, "-"), cur.Exponent)
+	if neg {
+		v = -v
+	}
+	return v, err
+}
+
+// reconPayment is what reconciliation needs to know about one of our
+// payments. InPeriod is set for payments captured in the report's period,
+// which the report is expected to contain.
+type reconPayment struct {
+	ID          string
+	ProviderRef string
+	Amount      int64
+	Currency    string
+	InPeriod    bool
+}
+
+type reconResult struct {
+	Status         string `json:"status"`
+	ProviderRef    string `json:"provider_ref"`
+	PaymentID      string `json:"payment_id,omitempty"`
+	LineNumbers    []int  `json:"line_numbers,omitempty"`
+	ExpectedAmount *int64 `json:"expected_amount,omitempty"`
+	ReportedAmount *int64 `json:"reported_amount,omitempty"`
+	Currency       string `json:"currency"`
+}
+
+// reconcile matches report lines to payments by provider reference. Lines
+// with the same reference are summed first, since processors may split a
+// payment across lines. The result is ordered by reference.
+func reconcile(lines []settlementLine, payments []reconPayment) []reconResult {
+	type reported struct {
+		amount   int64
+		currency string
+		lineNos  []int
+	}
+	byRef := map[string]*reported{}
+	for _, l := range lines {
+		r, ok := byRef[l.ProviderRef]
+		if !ok {
+			r = &reported{currency: l.Currency}
+			byRef[l.ProviderRef] = r
+		}
+		r.amount += l.Amount
+		r.lineNos = append(r.lineNos, l.LineNo)
+		if r.currency != l.Currency {
+			// a mixed-currency reference can never match
+			r.currency = ""
+		}
+	}
+
+	known := map[string]reconPayment{}
+	for _, p := range payments {
+		known[p.ProviderRef] = p
+	}
+
+	var out []reconResult
+	for ref, r := range byRef {
+		rep := r.amount
+		res := reconResult{ProviderRef: ref, LineNumbers: r.lineNos, ReportedAmount: &rep, Currency: r.currency}
+		p, ok := known[ref]
+		switch {
+		case !ok:
+			res.Status = reconMissingInternally
+		case p.Amount != r.amount || p.Currency != r.currency:
+			exp := p.Amount
+			res.Status, res.PaymentID, res.ExpectedAmount, res.Currency = reconAmountMismatch, p.ID, &exp, p.Currency
+		default:
+			exp := p.Amount
+			res.Status, res.PaymentID, res.ExpectedAmount = reconMatched, p.ID, &exp
+		}
+		out = append(out, res)
+	}
+	for _, p := range payments {
+		if _, ok := byRef[p.ProviderRef]; ok || !p.InPeriod {
+			continue
+		}
+		exp := p.Amount
+		out = append(out, reconResult{
+			Status: reconMissingExternally, ProviderRef: p.ProviderRef, PaymentID: p.ID,
+			ExpectedAmount: &exp, Currency: p.Currency,
+		})
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].ProviderRef < out[j].ProviderRef })
+	return out
+}
+
+type reconRun struct {
+	ID                string    `json:"id"`
+	Provider          string    `json:"provider"`
+	Format            string    `json:"format"`
+	FileName          string    `json:"file_name,omitempty"`
+	PeriodStart       time.Time `json:"period_start"`
+	PeriodEnd         time.Time `json:"period_end"`
+	LineCount         int       `json:"line_count"`
+	Matched           int       `json:"matched"`
+	MissingInternally int       `json:"missing_internally"`
+	MissingExternally int       `json:"missing_externally"`
+	AmountMismatch    int       `json:"amount_mismatch"`
+	CreatedAt         time.Time `json:"created_at"`
+}
+
+func (run reconRun) discrepancies() int {
+	return run.MissingInternally + run.MissingExternally + run.AmountMismatch
+}
+
+type reconRequest struct {
+	Provider    string
+	Format      string
+	FileName    string
+	PeriodStart time.Time
+	PeriodEnd   time.Time
+}
+
+// runReconciliation parses a report, reconciles it against the payments of
+// req.Provider and stores the run and its results. The API and the
+// reconcile command both go through it.
+func runReconciliation(ctx context.Context, db *sql.DB, req reconRequest, file io.Reader) (reconRun, []reconResult, error) {
+	run := reconRun{
+		Provider: req.Provider, Format: req.Format, FileName: req.FileName,
+		PeriodStart: req.PeriodStart, PeriodEnd: req.PeriodEnd,
+	}
+	parser, ok := settlementParsers[req.Format]
+	if !ok {
+		return run, nil, fmt.Errorf("%w: unknown format %q", errInvalidSettlementFile, req.Format)
+	}
+	lines, err := parser.Parse(file)
+	if err != nil {
+		return run, nil, err
+	}
+
+	refs := make([]string, 0, len(lines))
+	for _, l := range lines {
+		refs = append(refs, l.ProviderRef)
+	}
+	payments, err := reconCandidates(ctx, db, req, refs)
+	if err != nil {
+		return run, nil, err
+	}
+	results := reconcile(lines, payments)
+
+	run.LineCount = len(lines)
+	for _, r := range results {
+		switch r.Status {
+		case reconMatched:
+			run.Matched++
+		case reconMissingInternally:
+			run.MissingInternally++
+		case reconMissingExternally:
+			run.MissingExternally++
+		case reconAmountMismatch:
+			run.AmountMismatch++
+		}
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return run, nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err := tx.QueryRowContext(ctx, `
+		INSERT INTO reconciliation_runs(provider, format, file_name, period_start, period_end,
+			line_count, matched, missing_internally, missing_externally, amount_mismatch)
+		VALUES ($1, $2, NULLIF($3, ''), $4, $5, $6, $7, $8, $9, $10)
+		RETURNING id::text, created_at
+	`, run.Provider, run.Format, run.FileName, run.PeriodStart, run.PeriodEnd,
+		run.LineCount, run.Matched, run.MissingInternally, run.MissingExternally, run.AmountMismatch,
+	).Scan(&run.ID, &run.CreatedAt); err != nil {
+		return run, nil, err
+	}
+	for _, r := range results {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO reconciliation_results(run_id, status, provider_ref, payment_id, line_numbers,
+				expected_amount, reported_amount, currency)
+			VALUES ($1::uuid, $2, $3, NULLIF($4, '')::uuid, $5, $6, $7, $8)
+		`, run.ID, r.Status, r.ProviderRef, r.PaymentID, joinInts(r.LineNumbers),
+			r.ExpectedAmount, r.ReportedAmount, r.Currency); err != nil {
+			return run, nil, err
+		}
+	}
+	return run, results, tx.Commit()
+}
+
+// reconCandidates loads the provider's payments that were captured in the
+// period, plus any payment the report references from outside it.
+func reconCandidates(ctx context.Context, db *sql.DB, req reconRequest, refs []string) ([]reconPayment, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT p.id::text, p.provider_ref, p.captured_amount, p.currency,
+		       EXISTS (
+		           SELECT 1 FROM payment_events e
+		           WHERE e.payment_id = p.id AND e.to_status = $2
+		             AND e.created_at >= $3 AND e.created_at < $4
+		       ) AS in_period
+		FROM payments p
+		WHERE p.provider = $1 AND p.provider_ref IS NOT NULL
+		  AND (
+		      p.provider_ref = ANY($5)
+		      OR (p.status IN ($2, $6) AND EXISTS (
+		          SELECT 1 FROM payment_events e
+		          WHERE e.payment_id = p.id AND e.to_status = $2
+		            AND e.created_at >= $3 AND e.created_at < $4
+		      ))
+		  )
+	`, req.Provider, statusCaptured, req.PeriodStart, req.PeriodEnd, refs, statusSettled)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []reconPayment
+	for rows.Next() {
+		var p reconPayment
+		if err := rows.Scan(&p.ID, &p.ProviderRef, &p.Amount, &p.Currency, &p.InPeriod); err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+func joinInts(ns []int) string {
+	parts := make([]string, len(ns))
+	for i, n := range ns {
+		parts[i] = strconv.Itoa(n)
+	}
+	return strings.Join(parts, ",")
+}
+
+func splitInts(s string) []int {
+	var out []int
+	for _, p := range strings.Split(s, ",") {
+		if n, err := strconv.Atoi(p); err == nil {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+// parsePeriodBound accepts an RFC 3339 timestamp or a date, which means
+// midnight UTC.
+func parsePeriodBound(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", s)
+}
+
+func parseReconRequest(provider, format, fileName, from, to string) (reconRequest, error) {
+	req := reconRequest{
+		Provider: strings.TrimSpace(provider),
+		Format:   strings.ToLower(strings.TrimSpace(format)),
+		FileName: strings.TrimSpace(fileName),
+	}
+	if req.Format == "" {
+		req.Format = "csv"
+	}
+	if req.Provider == "" {
+		return req, errors.New("provider is required")
+	}
+	var err error
+	if req.PeriodStart, err = parsePeriodBound(from); err != nil {
+		return req, errors.New("from must be a date or RFC 3339 timestamp")
+	}
+	if req.PeriodEnd, err = parsePeriodBound(to); err != nil {
+		return req, errors.New("to must be a date or RFC 3339 timestamp")
+	}
+	if !req.PeriodEnd.After(req.PeriodStart) {
+		return req, errors.New("to must be after from")
+	}
+	return req, nil
+}
+
+// maxSettlementFileBytes bounds an uploaded report.
+const maxSettlementFileBytes = 32 << 20
+
+// handleReconciliation serves:
+//
+//	POST /v1/reconciliation/runs?provider=&from=&to=[&format=csv][&file_name=]  (body: the report)
+//	GET  /v1/reconciliation/runs
+//	GET  /v1/reconciliation/runs/{id}
+//	GET  /v1/reconciliation/runs/{id}/results[?status=]
+func (st *appState) handleReconciliation(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/reconciliation/runs"), "/")
+	id, sub, _ := strings.Cut(rest, "/")
+
+	switch {
+	case id == "":
+		switch r.Method {
+		case http.MethodPost:
+			st.createReconRun(w, r)
+		case http.MethodGet:
+			st.listReconRuns(w, r)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	case sub == "" || sub == "results":
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if sub == "" {
+			st.getReconRun(w, r, id)
+		} else {
+			st.listReconResults(w, r, id)
+		}
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func (st *appState) createReconRun(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	req, err := parseReconRequest(q.Get("provider"), q.Get("format"), q.Get("file_name"), q.Get("from"), q.Get("to"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 60*time.Second)
+	defer cancel()
+
+	run, _, err := runReconciliation(ctx, st.db, req, http.MaxBytesReader(w, r.Body, maxSettlementFileBytes))
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		http.Error(w, "settlement file too large", http.StatusRequestEntityTooLarge)
+	case errors.Is(err, errInvalidSettlementFile):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case err != nil:
+		http.Error(w, "db error", http.StatusInternalServerError)
+	default:
+		writeJSON(w, http.StatusCreated, run)
+	}
+}
+
+const reconRunColumns = `id::text, provider, format, COALESCE(file_name, ''), period_start, period_end,
+	line_count, matched, missing_internally, missing_externally, amount_mismatch, created_at`
+
+func scanReconRun(row rowScanner, run *reconRun) error {
+	return row.Scan(&run.ID, &run.Provider, &run.Format, &run.FileName, &run.PeriodStart, &run.PeriodEnd,
+		&run.LineCount, &run.Matched, &run.MissingInternally, &run.MissingExternally, &run.AmountMismatch, &run.CreatedAt)
+}
+
+func (st *appState) listReconRuns(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	rows, err := st.db.QueryContext(ctx, `
+		SELECT `+reconRunColumns+`
+		FROM reconciliation_runs
+		ORDER BY created_at DESC
+		LIMIT 100
+	`)
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	out := []reconRun{}
+	for rows.Next() {
+		var run reconRun
+		if err := scanReconRun(rows, &run); err != nil {
+			http.Error(w, "db scan error", http.StatusInternalServerError)
+			return
+		}
+		out = append(out, run)
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (st *appState) getReconRun(w http.ResponseWriter, r *http.Request, id string) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	var run reconRun
+	err := scanReconRun(st.db.QueryRowContext(ctx, `
+		SELECT `+reconRunColumns+` FROM reconciliation_runs WHERE id = $1::uuid
+	`, id), &run)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, run)
+}
+
+func (st *appState) listReconResults(w http.ResponseWriter, r *http.Request, runID string) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	out, err := listReconResults(ctx, st.db, runID, strings.TrimSpace(r.URL.Query().Get("status")))
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func listReconResults(ctx context.Context, db *sql.DB, runID, status string) ([]reconResult, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT status, provider_ref, COALESCE(payment_id::text, ''), line_numbers,
+		       expected_amount, reported_amount, currency
+		FROM reconciliation_results
+		WHERE run_id = $1::uuid AND ($2 = '' OR status = $2)
+		ORDER BY provider_ref
+	`, runID, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []reconResult{}
+	for rows.Next() {
+		var res reconResult
+		var lineNos string
+		var expected, reported sql.NullInt64
+		if err := rows.Scan(&res.Status, &res.ProviderRef, &res.PaymentID, &lineNos, &expected, &reported, &res.Currency); err != nil {
+			return nil, err
+		}
+		res.LineNumbers = splitInts(lineNos)
+		if expected.Valid {
+			res.ExpectedAmount = &expected.Int64
+		}
+		if reported.Valid {
+			res.ReportedAmount = &reported.Int64
+		}
+		out = append(out, res)
+	}
+	return out, rows.Err()
+}
+
+// reconcileCommand implements `payments-service reconcile`, for finance ops
+// to run a report from a shell or a scheduled job. It exits 0 when
+// everything matched, 2 when there are discrepancies and 1 on error.
+func reconcileCommand(args []string, stdout io.Writer) int {
+	fs := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	fs.SetOutput(stdout)
+	file := fs.String("file", "", "settlement report to import (required)")
+	provider := fs.String("provider", "simulator", "provider the report comes from")
+	format := fs.String("format", "csv", "report format")
+	from := fs.String("from", "", "start of the settlement period, date or RFC 3339 (required)")
+	to := fs.String("to", "", "end of the settlement period, exclusive (required)")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if *file == "" {
+		fmt.Fprintln(stdout, "reconcile: -file is required")
+		return 1
+	}
+
+	req, err := parseReconRequest(*provider, *format, filepath.Base(*file), *from, *to)
+	if err != nil {
+		fmt.Fprintf(stdout, "reconcile: %v\n", err)
+		return 1
+	}
+	f, err := os.Open(*file)
+	if err != nil {
+		fmt.Fprintf(stdout, "reconcile: %v\n", err)
+		return 1
+	}
+	defer f.Close()
+
+	dsn, err := buildPostgresDSNFromEnv()
+	if err != nil {
+		fmt.Fprintf(stdout, "reconcile: config error: %v\n", err)
+		return 1
+	}
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		fmt.Fprintf(stdout, "reconcile: db open error: %v\n", err)
+		return 1
+	}
+	defer db.Close()
+	if err := ensureSchema(db); err != nil {
+		fmt.Fprintf(stdout, "reconcile: schema init failed: %v\n", err)
+		return 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	run, results, err := runReconciliation(ctx, db, req, f)
+	if err != nil {
+		fmt.Fprintf(stdout, "reconcile: %v\n", err)
+		return 1
+	}
+
+	printReconReport(stdout, run, results)
+	if run.discrepancies() > 0 {
+		return 2
+	}
+	return 0
+}
+
+func printReconReport(w io.Writer, run reconRun, results []reconResult) {
+	fmt.Fprintf(w, "run %s: %d lines, %d matched, %d missing internally, %d missing externally, %d amount mismatches\n",
+		run.ID, run.LineCount, run.Matched, run.MissingInternally, run.MissingExternally, run.AmountMismatch)
+	if run.discrepancies() == 0 {
+		return
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "STATUS\tPROVIDER_REF\tPAYMENT_ID\tEXPECTED\tREPORTED\tCURRENCY\tLINES")
+	for _, r := range results {
+		if r.Status == reconMatched {
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.Status, r.ProviderRef, dashIfEmpty(r.PaymentID),
+			formatOptionalAmount(r.ExpectedAmount, r.Currency), formatOptionalAmount(r.ReportedAmount, r.Currency),
+			dashIfEmpty(r.Currency), dashIfEmpty(joinInts(r.LineNumbers)))
+	}
+	_ = tw.Flush()
+}
+
+func formatOptionalAmount(v *int64, currency string) string {
+	if v == nil {
+		return "-"
+	}
+	if s := formatAmount(*v, currency); s != "" {
+		return s
+	}
+	return strconv.FormatInt(*v, 10)
+}
+
+func dashIfEmpty(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+const reconciliationSchema = `
+	CREATE TABLE IF NOT EXISTS reconciliation_runs (
+		id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+		provider text NOT NULL,
+		format text NOT NULL,
+		file_name text,
+		period_start timestamptz NOT NULL,
+		period_end timestamptz NOT NULL,
+		line_count int NOT NULL,
+		matched int NOT NULL,
+		missing_internally int NOT NULL,
+		missing_externally int NOT NULL,
+		amount_mismatch int NOT NULL,
+		created_at timestamptz NOT NULL DEFAULT now()
+	);
+
+	CREATE TABLE IF NOT EXISTS reconciliation_results (
+		id bigserial PRIMARY KEY,
+		run_id uuid NOT NULL REFERENCES reconciliation_runs(id),
+		status text NOT NULL,
+		provider_ref text NOT NULL,
+		payment_id uuid REFERENCES payments(id),
+		line_numbers text NOT NULL DEFAULT '',
+		expected_amount bigint,
+		reported_amount bigint,
+		currency text NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS reconciliation_results_run_idx ON reconciliation_results(run_id, status);
+	CREATE INDEX IF NOT EXISTS payment_events_status_created_idx ON payment_events(to_status, created_at);
+`
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCSVSettlementParser(t *testing.T) {
+	in := "\ufeffReference,Currency,Amount,Fee\n" +
+		"sim_pay_a, eur ,12.34,0.10\n" +
+		"\n" +
+		"sim_pay_b,JPY,500,0\n" +
+		"sim_pay_c,USD,-1.50,0\n"
+	lines, err := csvSettlementParser{}.Parse(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []settlementLine{
+		{LineNo: 2, ProviderRef: "sim_pay_a", Amount: 1234, Currency: "EUR"},
+		{LineNo: 4, ProviderRef: "sim_pay_b", Amount: 500, Currency: "JPY"},
+		{LineNo: 5, ProviderRef: "sim_pay_c", Amount: -150, Currency: "USD"},
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("got %+v", lines)
+	}
+	for i := range want {
+		if lines[i] != want[i] {
+			t.Fatalf("line %d: got %+v, want %+v", i, lines[i], want[i])
+		}
+	}
+}
+
+func TestCSVSettlementParserRejectsBadInput(t *testing.T) {
+	for _, in := range []string{
+		"",
+		"ref,currency,amount\nx,EUR,1\n",
+		"provider_ref,currency,amount_minor\nx,EUR,1.5\n",
+		"provider_ref,currency,amount\nx,EUR,1.234\n",
+		"provider_ref,currency,amount\n,EUR,1\n",
+	} {
+		if _, err := (csvSettlementParser{}).Parse(strings.NewReader(in)); !errors.Is(err, errInvalidSettlementFile) {
+			t.Fatalf("%q: expected errInvalidSettlementFile, got %v", in, err)
+		}
+	}
+}
+
+func TestReconcileClassifies(t *testing.T) {
+	lines := []settlementLine{
+		{LineNo: 2, ProviderRef: "a", Amount: 1000, Currency: "EUR"},
+		{LineNo: 3, ProviderRef: "b", Amount: 600, Currency: "EUR"},
+		{LineNo: 4, ProviderRef: "b", Amount: 400, Currency: "EUR"},
+		{LineNo: 5, ProviderRef: "c", Amount: 999, Currency: "EUR"},
+		{LineNo: 6, ProviderRef: "x", Amount: 10, Currency: "EUR"},
+	}
+	payments := []reconPayment{
+		{ID: "pa", ProviderRef: "a", Amount: 1000, Currency: "EUR", InPeriod: true},
+		{ID: "pb", ProviderRef: "b", Amount: 1000, Currency: "EUR", InPeriod: true},
+		{ID: "pc", ProviderRef: "c", Amount: 1000, Currency: "EUR", InPeriod: false},
+		{ID: "pd", ProviderRef: "d", Amount: 1000, Currency: "EUR", InPeriod: true},
+		// captured outside the period and not reported: not expected
+		{ID: "pe", ProviderRef: "e", Amount: 1000, Currency: "EUR", InPeriod: false},
+	}
+
+	got := map[string]string{}
+	for _, r := range reconcile(lines, payments) {
+		got[r.ProviderRef] = r.Status
+	}
+	want := map[string]string{
+		"a": reconMatched,
+		"b": reconMatched,
+		"c": reconAmountMismatch,
+		"d": reconMissingExternally,
+		"x": reconMissingInternally,
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %v", got)
+	}
+	for ref, status := range want {
+		if got[ref] != status {
+			t.Fatalf("%s: got %q, want %q", ref, got[ref], status)
+		}
+	}
+}
+
+func TestParseReconRequest(t *testing.T) {
+	req, err := parseReconRequest("simulator", "", "", "2026-10-01", "2026-10-02T00:00:00Z")
+	if err != nil || req.Format != "csv" || req.PeriodEnd.Sub(req.PeriodStart).Hours() != 24 {
+		t.Fatalf("unexpected %+v, %v", req, err)
+	}
+	if _, err := parseReconRequest("simulator", "csv", "", "2026-10-02", "2026-10-01"); err == nil {
+		t.Fatal("expected error for an inverted period")
+	}
+	if _, err := parseReconRequest("", "csv", "", "2026-10-01", "2026-10-02"); err == nil {
+		t.Fatal("expected error without provider")
+	}
+}
+
+func TestPrintReconReportListsDiscrepancies(t *testing.T) {
+	exp := int64(1000)
+	run := reconRun{ID: "r1", LineCount: 1, MissingExternally: 1}
+	var buf bytes.Buffer
+	printReconReport(&buf, run, []reconResult{
+		{Status: reconMissingExternally, ProviderRef: "sim_pay_d", PaymentID: "pd", ExpectedAmount: &exp, Currency: "EUR"},
+	})
+	if out := buf.String(); !strings.Contains(out, "missing_externally") || !strings.Contains(out, "10.00") {
+		t.Fatalf("unexpected report:\n%s", out)
+	}
+}
+
+func TestReconciliationRejectsUnknownMethod(t *testing.T) {
+	h := newTestMux(&appState{}, "payments-service", "test")
+	req := httptest.NewRequest(http.MethodDelete, "/v1/reconciliation/runs", nil)
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	refundPending   = "pending"
+	refundSucceeded = "succeeded"
+	refundFailed    = "failed"
+)
+
+// refundActions maps POST /v1/payments/{id}/refunds/{refund_id}/{action}
+// onto the refund's final status. Only pending refunds can move.
+var refundActions = map[string]string{
+	"succeed": refundSucceeded,
+	"fail":    refundFailed,
+}
+
+var (
+	errNotRefundable   = errors.New("payment is not refundable")
+	errRefundExceeds   = errors.New("refund exceeds remaining amount")
+	errRefundRefReused = errors.New("refund ref already used with a different amount")
+	errRefundNotFound  = errors.New("refund not found")
+)
+
+type refund struct {
+	ID            string `json:"id"`
+	PaymentID     string `json:"payment_id"`
+	Amount        int64  `json:"amount"`
+	AmountDecimal string `json:"amount_decimal,omitempty"`
+	Currency      string `json:"currency"`
+	// what the refund takes from the user's balance; for an FX payment in
+	// the target currency
+	ReservedAmount   int64     `json:"reserved_amount"`
+	ReservedCurrency string    `json:"reserved_currency"`
+	Status           string    `json:"status"`
+	Ref              string    `json:"ref"`
+	Reason           string    `json:"reason,omitempty"`
+	CreatedAt        time.Time `json:"created_at"`
+	UpdatedAt        time.Time `json:"updated_at"`
+}
+
+const refundColumns = `id::text, payment_id::text, amount, currency, COALESCE(reserved_amount, amount),
+	COALESCE(reserved_currency, currency), status, ref, COALESCE(reason, ''), created_at, updated_at`
+
+func scanRefund(row rowScanner, rf *refund) error {
+	if err := row.Scan(&rf.ID, &rf.PaymentID, &rf.Amount, &rf.Currency, &rf.ReservedAmount, &rf.ReservedCurrency,
+		&rf.Status, &rf.Ref, &rf.Reason, &rf.CreatedAt, &rf.UpdatedAt); err != nil {
+		return err
+	}
+	rf.AmountDecimal = formatAmount(rf.Amount, rf.Currency)
+	return nil
+}
+
+type createRefundRequest struct {
+	// zero refunds whatever is left; amount_decimal may be sent instead
+	Amount        int64  `json:"amount"`
+	AmountDecimal string `json:"amount_decimal"`
+	Ref           string `json:"ref"`
+	Reason        string `json:"reason"`
+}
+
+// refundAmount decides how much a new refund may take from p. Pending
+// refunds count against the remaining amount so two in-flight refunds can
+// never add up to more than was captured, and so do disputes.
+func refundAmount(p payment, requested int64) (int64, error) {
+	if p.Status != statusCaptured && p.Status != statusSettled {
+		return 0, fmt.Errorf("%w: status is %s", errNotRefundable, p.Status)
+	}
+	remaining := p.CapturedAmount - p.RefundedAmount - p.DisputedAmount
+	if requested == 0 {
+		requested = remaining
+	}
+	if requested <= 0 || requested > remaining {
+		return 0, fmt.Errorf("%w: %d remaining", errRefundExceeds, remaining)
+	}
+	return requested, nil
+}
+
+func (st *appState) handleRefunds(w http.ResponseWriter, r *http.Request, paymentID, rest string) {
+	if rest == "" {
+		switch r.Method {
+		case http.MethodPost:
+			st.createRefund(w, r, paymentID)
+		case http.MethodGet:
+			ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+			defer cancel()
+			out, err := listRefunds(ctx, st.db, paymentID)
+			if err != nil {
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, http.StatusOK, out)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	refundID, action, _ := strings.Cut(rest, "/")
+	to, ok := refundActions[action]
+	if !ok {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	rf, err := st.completeRefund(ctx, paymentID, refundID, to)
+	if err != nil {
+		writeRefundError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, rf)
+}
+
+func (st *appState) createRefund(w http.ResponseWriter, r *http.Request, paymentID string) {
+	var req createRefundRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	req.Ref = strings.TrimSpace(req.Ref)
+	if req.Ref == "" || req.Amount < 0 {
+		http.Error(w, "ref and a non-negative amount are required", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	rf, created, err := st.reserveRefund(ctx, paymentID, req)
+	if err != nil {
+		writeRefundError(w, err)
+		return
+	}
+	if !created {
+		writeJSON(w, http.StatusOK, rf)
+		return
+	}
+	if rf, err = st.submitRefund(ctx, paymentID, rf); err != nil {
+		writeRefundError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, rf)
+}
+
+func writeRefundError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errPaymentNotFound), errors.Is(err, errRefundNotFound):
+		http.Error(w, "not found", http.StatusNotFound)
+	case errors.Is(err, errUnknownCurrency), errors.Is(err, errInvalidAmount):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, errRefundExceeds):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	case errors.Is(err, errNotRefundable), errors.Is(err, errRefundRefReused), errors.Is(err, errInvalidTransition):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, "db error", http.StatusInternalServerError)
+	}
+}
+
+// reserveRefund creates a pending refund and adds it to the payment's
+// refunded_amount while holding the payment row lock. Repeating a ref with
+// the same amount returns the existing refund.
+func (st *appState) reserveRefund(ctx context.Context, paymentID string, req createRefundRequest) (refund, bool, error) {
+	var rf refund
+
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return rf, false, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var p payment
+	err = scanPayment(tx.QueryRowContext(ctx, `
+		SELECT `+paymentColumns+`
+		FROM payments
+		WHERE id = $1::uuid
+		FOR UPDATE
+	`, paymentID), &p)
+	if errors.Is(err, sql.ErrNoRows) {
+		return rf, false, errPaymentNotFound
+	}
+	if err != nil {
+		return rf, false, err
+	}
+
+	// resolved before the ref lookup so a retry with a different
+	// amount_decimal is caught as a reused ref
+	if req.AmountDecimal != "" {
+		cur, err := lookupCurrency(p.Currency)
+		if err != nil {
+			return rf, false, err
+		}
+		if req.Amount, err = cur.resolveAmount(req.Amount, req.AmountDecimal); err != nil {
+			return rf, false, err
+		}
+	}
+
+	err = scanRefund(tx.QueryRowContext(ctx, `
+		SELECT `+refundColumns+`
+		FROM refunds
+		WHERE payment_id = $1::uuid AND ref = $2
+	`, paymentID, req.Ref), &rf)
+	if err == nil {
+		if req.Amount != 0 && req.Amount != rf.Amount {
+			return rf, false, errRefundRefReused
+		}
+		return rf, false, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return rf, false, err
+	}
+
+	amount, err := refundAmount(p, req.Amount)
+	if err != nil {
+		return rf, false, err
+	}
+	reserved, reservedCurrency := reversalDebit(p, amount)
+
+	err = scanRefund(tx.QueryRowContext(ctx, `
+		INSERT INTO refunds(payment_id, amount, currency, reserved_amount, reserved_currency, status, ref, reason)
+		VALUES ($1::uuid, $2, $3, $4, $5, $6, $7, NULLIF($8, ''))
+		RETURNING `+refundColumns,
+		paymentID, amount, p.Currency, reserved, reservedCurrency, refundPending, req.Ref, strings.TrimSpace(req.Reason)), &rf)
+	if err != nil {
+		return rf, false, err
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE payments
+		SET refunded_amount = refunded_amount + $2, version = version + 1, updated_at = now()
+		WHERE id = $1::uuid
+	`, paymentID, amount); err != nil {
+		return rf, false, err
+	}
+	if err := enqueueEvent(ctx, tx, paymentID, p.UserID, "refund.created", rf); err != nil {
+		return rf, false, err
+	}
+
+	return rf, true, tx.Commit()
+}
+
+// completeRefund moves a pending refund to succeeded or failed. A succeeded
+// refund is posted to the ledger; a failed one gives its amount back to the
+// payment.
+func (st *appState) completeRefund(ctx context.Context, paymentID, refundID, to string) (refund, error) {
+	var rf refund
+
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return rf, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// lock order is payment then refund, the same as reserveRefund
+	var p payment
+	err = scanPayment(tx.QueryRowContext(ctx, `
+		SELECT `+paymentColumns+`
+		FROM payments
+		WHERE id = $1::uuid
+		FOR UPDATE
+	`, paymentID), &p)
+	if errors.Is(err, sql.ErrNoRows) {
+		return rf, errPaymentNotFound
+	}
+	if err != nil {
+		return rf, err
+	}
+
+	err = scanRefund(tx.QueryRowContext(ctx, `
+		SELECT `+refundColumns+`
+		FROM refunds
+		WHERE id = $1::uuid AND payment_id = $2::uuid
+		FOR UPDATE
+	`, refundID, paymentID), &rf)
+	if errors.Is(err, sql.ErrNoRows) {
+		return rf, errRefundNotFound
+	}
+	if err != nil {
+		return rf, err
+	}
+	if rf.Status == to {
+		return rf, nil
+	}
+	if rf.Status != refundPending {
+		return rf, fmt.Errorf("%w: refund is %s", errInvalidTransition, rf.Status)
+	}
+
+	err = scanRefund(tx.QueryRowContext(ctx, `
+		UPDATE refunds SET status = $2, updated_at = now()
+		WHERE id = $1::uuid
+		RETURNING `+refundColumns,
+		refundID, to), &rf)
+	if err != nil {
+		return rf, err
+	}
+
+	if err := enqueueEvent(ctx, tx, paymentID, p.UserID, "refund."+to, rf); err != nil {
+		return rf, err
+	}
+	if to == refundSucceeded {
+		if err := postEntry(ctx, tx, refundEntry(p, rf)); err != nil {
+			return rf, err
+		}
+	}
+	if to == refundFailed {
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE payments
+			SET refunded_amount = refunded_amount - $2, version = version + 1, updated_at = now()
+			WHERE id = $1::uuid
+		`, paymentID, rf.Amount); err != nil {
+			return rf, err
+		}
+	}
+
+	return rf, tx.Commit()
+}
+
+func listRefunds(ctx context.Context, db *sql.DB, paymentID string) ([]refund, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+refundColumns+`
+		FROM refunds
+		WHERE payment_id = $1::uuid
+		ORDER BY created_at
+	`, paymentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []refund{}
+	for rows.Next() {
+		var rf refund
+		if err := scanRefund(rows, &rf); err != nil {
+			return nil, err
+		}
+		out = append(out, rf)
+	}
+	return out, rows.Err()
+}
+
+const refundsSchema = `
+	ALTER TABLE payments ADD COLUMN IF NOT EXISTS refunded_amount bigint NOT NULL DEFAULT 0;
+
+	CREATE TABLE IF NOT EXISTS refunds (
+		id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+		payment_id uuid NOT NULL REFERENCES payments(id),
+		amount bigint NOT NULL CHECK (amount > 0),
+		currency text NOT NULL,
+		status text NOT NULL,
+		ref text NOT NULL,
+		reason text,
+		created_at timestamptz NOT NULL DEFAULT now(),
+		updated_at timestamptz NOT NULL DEFAULT now()
+	);
+
+	CREATE UNIQUE INDEX IF NOT EXISTS refunds_payment_ref_uq ON refunds(payment_id, ref);
+`
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRefundAmount(t *testing.T) {
+	captured := payment{Amount: 1000, CapturedAmount: 1000, RefundedAmount: 300, Status: statusCaptured}
+
+	if got, err := refundAmount(captured, 200); err != nil || got != 200 {
+		t.Fatalf("partial refund: got %d, %v", got, err)
+	}
+	if got, err := refundAmount(captured, 0); err != nil || got != 700 {
+		t.Fatalf("zero amount should refund the remainder, got %d, %v", got, err)
+	}
+	if _, err := refundAmount(captured, 701); !errors.Is(err, errRefundExceeds) {
+		t.Fatalf("expected errRefundExceeds, got %v", err)
+	}
+
+	fully := payment{Amount: 1000, CapturedAmount: 1000, RefundedAmount: 1000, Status: statusSettled}
+	if _, err := refundAmount(fully, 0); !errors.Is(err, errRefundExceeds) {
+		t.Fatalf("expected errRefundExceeds for fully refunded payment, got %v", err)
+	}
+
+	partly := payment{Amount: 1000, CapturedAmount: 400, Status: statusCaptured}
+	if _, err := refundAmount(partly, 401); !errors.Is(err, errRefundExceeds) {
+		t.Fatalf("refund beyond the captured amount: got %v", err)
+	}
+
+	authorized := payment{Amount: 1000, Status: statusAuthorized}
+	if _, err := refundAmount(authorized, 100); !errors.Is(err, errNotRefundable) {
+		t.Fatalf("expected errNotRefundable before capture, got %v", err)
+	}
+}
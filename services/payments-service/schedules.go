@@ -0,0 +1,872 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	scheduleActive    = "active"
+	schedulePaused    = "paused"
+	scheduleCanceled  = "canceled"
+	scheduleCompleted = "completed"
+)
+
+// Occurrence statuses. A pending occurrence waits for next_attempt_at; a
+// submitted one has a payment that has not finished yet.
+const (
+	occurrencePending   = "pending"
+	occurrenceSubmitted = "submitted"
+	occurrenceSucceeded = "succeeded"
+	occurrenceFailed    = "failed"
+	occurrenceCanceled  = "canceled"
+)
+
+var (
+	errScheduleNotFound = errors.New("schedule not found")
+	errScheduleState    = errors.New("schedule cannot do that in its current status")
+)
+
+type retryPolicy struct {
+	// attempts per occurrence, including the first; 1 disables retries
+	MaxAttempts int `json:"max_attempts"`
+	// delay before the first retry, doubled for each further one
+	Backoff string `json:"backoff"`
+}
+
+type createScheduleRequest struct {
+	UserID        string `json:"user_id"`
+	Amount        int64  `json:"amount"`
+	AmountDecimal string `json:"amount_decimal,omitempty"`
+	Currency      string `json:"currency"`
+	PaymentMethod string `json:"payment_method,omitempty"`
+	Description   string `json:"description,omitempty"`
+	// exactly one of Cron and Interval
+	Cron     string `json:"cron,omitempty"`
+	Interval string `json:"interval,omitempty"`
+	// IANA zone the rule is evaluated in; default UTC
+	Timezone       string      `json:"timezone,omitempty"`
+	StartAt        time.Time   `json:"start_at"`
+	EndAt          *time.Time  `json:"end_at,omitempty"`
+	MaxOccurrences int         `json:"max_occurrences,omitempty"`
+	Retry          retryPolicy `json:"retry"`
+
+	ruleKind, rule string
+	backoff        time.Duration
+}
+
+// normalize validates req in place. The amount goes through the same
+// checks as a single payment.
+func (req *createScheduleRequest) normalize(now time.Time) error {
+	pr := createPaymentRequest{
+		UserID:        req.UserID,
+		Amount:        req.Amount,
+		AmountDecimal: req.AmountDecimal,
+		Currency:      req.Currency,
+		Ref:           "schedule",
+		PaymentMethod: req.PaymentMethod,
+	}
+	if err := pr.normalize(); err != nil {
+		return err
+	}
+	req.UserID, req.Amount, req.AmountDecimal, req.Currency, req.PaymentMethod =
+		pr.UserID, pr.Amount, pr.AmountDecimal, pr.Currency, pr.PaymentMethod
+	req.Description = strings.TrimSpace(req.Description)
+
+	switch {
+	case req.Cron != "" && req.Interval == "":
+		req.ruleKind, req.rule = "cron", strings.TrimSpace(req.Cron)
+	case req.Interval != "" && req.Cron == "":
+		req.ruleKind, req.rule = "interval", strings.TrimSpace(req.Interval)
+	default:
+		return errors.New("exactly one of cron and interval is required")
+	}
+	if _, err := parseScheduleRule(req.ruleKind, req.rule); err != nil {
+		return err
+	}
+
+	if req.Timezone == "" {
+		req.Timezone = "UTC"
+	}
+	if _, err := time.LoadLocation(req.Timezone); err != nil {
+		return fmt.Errorf("unknown timezone %q", req.Timezone)
+	}
+	if req.StartAt.IsZero() {
+		req.StartAt = now
+	}
+	if req.EndAt != nil && !req.EndAt.After(req.StartAt) {
+		return errors.New("end_at must be after start_at")
+	}
+	if req.MaxOccurrences < 0 {
+		return errors.New("max_occurrences must not be negative")
+	}
+
+	if req.Retry.MaxAttempts == 0 {
+		req.Retry.MaxAttempts = 1
+	}
+	if req.Retry.MaxAttempts < 1 || req.Retry.MaxAttempts > 10 {
+		return errors.New("retry.max_attempts must be between 1 and 10")
+	}
+	if req.Retry.Backoff == "" {
+		req.Retry.Backoff = "1h"
+	}
+	d, err := time.ParseDuration(req.Retry.Backoff)
+	if err != nil || d < time.Minute {
+		return errors.New("retry.backoff must be a duration of at least 1m")
+	}
+	req.backoff = d
+	return nil
+}
+
+type schedule struct {
+	ID             string      `json:"id"`
+	UserID         string      `json:"user_id"`
+	Amount         int64       `json:"amount"`
+	AmountDecimal  string      `json:"amount_decimal,omitempty"`
+	Currency       string      `json:"currency"`
+	PaymentMethod  string      `json:"payment_method,omitempty"`
+	Description    string      `json:"description,omitempty"`
+	RuleKind       string      `json:"rule_kind"`
+	Rule           string      `json:"rule"`
+	Timezone       string      `json:"timezone"`
+	StartAt        time.Time   `json:"start_at"`
+	EndAt          *time.Time  `json:"end_at,omitempty"`
+	MaxOccurrences int         `json:"max_occurrences,omitempty"`
+	Occurrences    int         `json:"occurrences"`
+	Retry          retryPolicy `json:"retry"`
+	Status         string      `json:"status"`
+	NextRunAt      *time.Time  `json:"next_run_at,omitempty"`
+	CreatedAt      time.Time   `json:"created_at"`
+	UpdatedAt      time.Time   `json:"updated_at"`
+}
+
+const scheduleColumns = `id, user_id, amount, currency, COALESCE(payment_method, ''), COALESCE(description, ''),
+	rule_kind, rule, timezone, start_at, end_at, COALESCE(max_occurrences, 0), occurrences,
+	retry_max_attempts, retry_backoff_seconds, status, next_run_at, created_at, updated_at`
+
+func scanSchedule(row rowScanner, s *schedule) error {
+	var endAt, nextRun sql.NullTime
+	var backoff int64
+	if err := row.Scan(&s.ID, &s.UserID, &s.Amount, &s.Currency, &s.PaymentMethod, &s.Description,
+		&s.RuleKind, &s.Rule, &s.Timezone, &s.StartAt, &endAt, &s.MaxOccurrences, &s.Occurrences,
+		&s.Retry.MaxAttempts, &backoff, &s.Status, &nextRun, &s.CreatedAt, &s.UpdatedAt); err != nil {
+		return err
+	}
+	s.AmountDecimal = formatAmount(s.Amount, s.Currency)
+	s.Retry.Backoff = (time.Duration(backoff) * time.Second).String()
+	s.EndAt, s.NextRunAt = nil, nil
+	if endAt.Valid {
+		s.EndAt = &endAt.Time
+	}
+	if nextRun.Valid {
+		s.NextRunAt = &nextRun.Time
+	}
+	return nil
+}
+
+// nextRun returns the schedule's first fire time after after, or nil once
+// the schedule has reached its end date or occurrence limit.
+func (s schedule) nextRun(after time.Time) (*time.Time, error) {
+	if s.MaxOccurrences > 0 && s.Occurrences >= s.MaxOccurrences {
+		return nil, nil
+	}
+	rule, err := parseScheduleRule(s.RuleKind, s.Rule)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return nil, err
+	}
+	t := rule.next(s.StartAt.In(loc), after.In(loc))
+	if t.IsZero() || (s.EndAt != nil && t.After(*s.EndAt)) {
+		return nil, nil
+	}
+	t = t.UTC()
+	return &t, nil
+}
+
+// occurrenceRef is the ref of the payment for one attempt at an
+// occurrence. Payment refs are unique per user, so each attempt creates at
+// most one payment however often the scheduler runs.
+func occurrenceRef(scheduleID string, seq, attempt int) string {
+	ref := fmt.Sprintf("sched:%s:%d", scheduleID, seq)
+	if attempt > 1 {
+		ref += fmt.Sprintf(":%d", attempt)
+	}
+	return ref
+}
+
+// retryDelay is the wait before attempt (2 or later) of an occurrence.
+func retryDelay(backoff time.Duration, attempt int) time.Duration {
+	return backoff << min(attempt-2, 16)
+}
+
+type scheduleOccurrence struct {
+	ID            int64      `json:"id"`
+	Seq           int        `json:"seq"`
+	ScheduledFor  time.Time  `json:"scheduled_for"`
+	Attempts      int        `json:"attempts"`
+	Status        string     `json:"status"`
+	PaymentID     string     `json:"payment_id,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+// scheduler creates the payments of due schedules. Every replica runs
+// one, but only the holder of a session-level advisory lock does any work,
+// so occurrences are processed by one replica at a time; if the leader
+// dies its connection closes, the lock is released and another replica
+// takes over on its next tick.
+type scheduler struct {
+	st   *appState
+	conn *sql.Conn // held while leader
+}
+
+// schedulerLockKey is the advisory lock key of the scheduler leader.
+const schedulerLockKey = 0x7363686564 // "sched"
+
+func (st *appState) runScheduler(ctx context.Context, every time.Duration) {
+	s := &scheduler{st: st}
+	defer s.resign()
+
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if !s.lead(ctx) {
+			continue
+		}
+		s.tick(ctx, time.Now())
+	}
+}
+
+// lead reports whether this replica is the leader, trying to become it if
+// it is not.
+func (s *scheduler) lead(ctx context.Context) bool {
+	lctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if s.conn != nil {
+		if err := s.conn.PingContext(lctx); err == nil {
+			return true
+		}
+		log.Printf(`{"msg":"scheduler lost its leader connection"}`)
+		s.resign()
+	}
+
+	conn, err := s.st.db.Conn(lctx)
+	if err != nil {
+		return false
+	}
+	var ok bool
+	if err := conn.QueryRowContext(lctx, `SELECT pg_try_advisory_lock($1)`, schedulerLockKey).Scan(&ok); err != nil || !ok {
+		_ = conn.Close()
+		return false
+	}
+	s.conn = conn
+	log.Printf(`{"msg":"scheduler became leader"}`)
+	return true
+}
+
+func (s *scheduler) resign() {
+	if s.conn == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	_, _ = s.conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, schedulerLockKey)
+	cancel()
+	_ = s.conn.Close()
+	s.conn = nil
+}
+
+func (s *scheduler) tick(ctx context.Context, now time.Time) {
+	if err := s.st.materializeOccurrences(ctx, now); err != nil {
+		log.Printf(`{"msg":"scheduler materialize failed","error":%q}`, err.Error())
+	}
+	if err := s.st.followSubmittedOccurrences(ctx); err != nil {
+		log.Printf(`{"msg":"scheduler follow-up failed","error":%q}`, err.Error())
+	}
+	if err := s.st.attemptDueOccurrences(ctx, now); err != nil {
+		log.Printf(`{"msg":"scheduler attempts failed","error":%q}`, err.Error())
+	}
+}
+
+// materializeOccurrences records an occurrence for every active schedule
+// whose next run is due and moves next_run_at on. Runs missed while the
+// scheduler was down are caught up one per tick, oldest first.
+func (st *appState) materializeOccurrences(ctx context.Context, now time.Time) error {
+	qctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	rows, err := st.db.QueryContext(qctx, `
+		SELECT `+scheduleColumns+`
+		FROM payment_schedules
+		WHERE status = $1 AND next_run_at <= $2
+		ORDER BY next_run_at
+		LIMIT 100
+	`, scheduleActive, now)
+	if err != nil {
+		return err
+	}
+	var due []schedule
+	for rows.Next() {
+		var s schedule
+		if err := scanSchedule(rows, &s); err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, s := range due {
+		if err := st.materializeOccurrence(qctx, s, now); err != nil {
+			log.Printf(`{"msg":"schedule occurrence failed","schedule_id":%q,"error":%q}`, s.ID, err.Error())
+		}
+	}
+	return nil
+}
+
+func (st *appState) materializeOccurrence(ctx context.Context, s schedule, now time.Time) error {
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	seq := s.Occurrences + 1
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO schedule_occurrences(schedule_id, seq, scheduled_for, status, next_attempt_at)
+		VALUES ($1::uuid, $2, $3, $4, $3)
+		ON CONFLICT (schedule_id, seq) DO NOTHING
+	`, s.ID, seq, *s.NextRunAt, occurrencePending); err != nil {
+		return err
+	}
+
+	s.Occurrences = seq
+	next, err := s.nextRun(*s.NextRunAt)
+	if err != nil {
+		return err
+	}
+	status := scheduleActive
+	if next == nil {
+		status = scheduleCompleted
+	}
+	res, err := tx.ExecContext(ctx, `
+		UPDATE payment_schedules
+		SET occurrences = $2, next_run_at = $3, status = $4, updated_at = now()
+		WHERE id = $1::uuid AND occurrences = $5 AND status = $6
+	`, s.ID, seq, next, status, seq-1, scheduleActive)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		// paused or canceled meanwhile
+		return nil
+	}
+	return tx.Commit()
+}
+
+type dueOccurrence struct {
+	scheduleOccurrence
+	sched schedule
+}
+
+// attemptDueOccurrences creates the payment for every pending occurrence
+// whose attempt is due and that belongs to an active or completed
+// schedule. Occurrences of paused schedules wait.
+func (st *appState) attemptDueOccurrences(ctx context.Context, now time.Time) error {
+	due, err := st.loadOccurrences(ctx, `
+		o.status = $1 AND o.next_attempt_at <= $2 AND s.status IN ($3, $4)
+		ORDER BY o.next_attempt_at
+	`, occurrencePending, now, scheduleActive, scheduleCompleted)
+	if err != nil {
+		return err
+	}
+	for _, d := range due {
+		actx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		st.attemptOccurrence(actx, d, now)
+		cancel()
+	}
+	return nil
+}
+
+// loadOccurrences returns up to 100 occurrences matching where, which may
+// refer to the occurrence as o, its schedule as s and its payment as p,
+// each with its schedule.
+func (st *appState) loadOccurrences(ctx context.Context, where string, args ...any) ([]dueOccurrence, error) {
+	qctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	rows, err := st.db.QueryContext(qctx, `
+		SELECT o.id, o.schedule_id::text, o.seq, o.scheduled_for, o.attempts, COALESCE(o.payment_id::text, '')
+		FROM schedule_occurrences o
+		JOIN payment_schedules s ON s.id = o.schedule_id
+		LEFT JOIN payments p ON p.id = o.payment_id
+		WHERE `+where+`
+		LIMIT 100
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	var out []dueOccurrence
+	var scheduleIDs []string
+	for rows.Next() {
+		var d dueOccurrence
+		var scheduleID string
+		if err := rows.Scan(&d.ID, &scheduleID, &d.Seq, &d.ScheduledFor, &d.Attempts, &d.PaymentID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		out = append(out, d)
+		scheduleIDs = append(scheduleIDs, scheduleID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	schedules := map[string]schedule{}
+	for i, id := range scheduleIDs {
+		s, ok := schedules[id]
+		if !ok {
+			if s, err = st.loadSchedule(qctx, id); err != nil {
+				return nil, err
+			}
+			schedules[id] = s
+		}
+		out[i].sched = s
+	}
+	return out, nil
+}
+
+// attemptOccurrence makes one attempt at an occurrence: it creates the
+// payment and, with a provider configured, authorizes and captures it.
+func (st *appState) attemptOccurrence(ctx context.Context, d dueOccurrence, now time.Time) {
+	attempt := d.Attempts + 1
+	req := createPaymentRequest{
+		UserID:        d.sched.UserID,
+		Amount:        d.sched.Amount,
+		Currency:      d.sched.Currency,
+		Ref:           occurrenceRef(d.sched.ID, d.Seq, attempt),
+		PaymentMethod: d.sched.PaymentMethod,
+	}
+
+	p, err := st.insertPayment(ctx, req)
+	if errors.Is(err, errDuplicateRef) {
+		// created by an earlier run that did not get to record it
+		p, err = st.paymentByRef(ctx, req.UserID, req.Ref)
+	}
+	if err != nil {
+		st.finishAttempt(ctx, d, attempt, "", err.Error(), now)
+		return
+	}
+
+	p = st.collectPayment(ctx, p, "scheduled payment")
+	if p.Status == statusFailed {
+		st.finishAttempt(ctx, d, attempt, p.ID, "payment failed", now)
+		return
+	}
+	if _, err := st.db.ExecContext(ctx, `
+		UPDATE schedule_occurrences
+		SET attempts = $2, status = $3, payment_id = $4::uuid, next_attempt_at = NULL, updated_at = now()
+		WHERE id = $1
+	`, d.ID, attempt, occurrenceSubmitted, p.ID); err != nil {
+		log.Printf(`{"msg":"schedule occurrence update failed","occurrence_id":%d,"error":%q}`, d.ID, err.Error())
+	}
+}
+
+// collectPayment authorizes and captures a payment created on the
+// customer's behalf when a provider is configured. Provider errors are
+// logged and the payment is returned as last stored.
+func (st *appState) collectPayment(ctx context.Context, p payment, reason string) payment {
+	if st.provider == nil || p.Status != statusCreated {
+		return p
+	}
+	created := p
+	for _, action := range []string{"authorize", "capture"} {
+		next, err := st.providerTransition(ctx, p.ID, action, transitionRequest{Reason: reason})
+		if err != nil {
+			log.Printf(`{"msg":"payment provider call failed","payment_id":%q,"reason":%q,"error":%q}`, created.ID, reason, err.Error())
+			if latest, lerr := st.loadPayment(ctx, created.ID); lerr == nil {
+				return latest
+			}
+			return p
+		}
+		if p = next; p.Status != statusAuthorized {
+			break
+		}
+	}
+	return p
+}
+
+// finishAttempt records a failed attempt and schedules the next one if the
+// retry policy allows it.
+func (st *appState) finishAttempt(ctx context.Context, d dueOccurrence, attempt int, paymentID, reason string, now time.Time) {
+	status := occurrenceFailed
+	var next *time.Time
+	if attempt < d.sched.Retry.MaxAttempts {
+		backoff, _ := time.ParseDuration(d.sched.Retry.Backoff)
+		t := now.Add(retryDelay(backoff, attempt+1))
+		status, next = occurrencePending, &t
+	}
+	if _, err := st.db.ExecContext(ctx, `
+		UPDATE schedule_occurrences
+		SET attempts = $2, status = $3, payment_id = NULLIF($4, '')::uuid, last_error = $5,
+		    next_attempt_at = $6, updated_at = now()
+		WHERE id = $1
+	`, d.ID, attempt, status, paymentID, reason, next); err != nil {
+		log.Printf(`{"msg":"schedule occurrence update failed","occurrence_id":%d,"error":%q}`, d.ID, err.Error())
+		return
+	}
+	log.Printf(`{"msg":"scheduled payment attempt failed","schedule_id":%q,"seq":%d,"attempt":%d,"retry":%t,"error":%q}`,
+		d.sched.ID, d.Seq, attempt, next != nil, reason)
+}
+
+// followSubmittedOccurrences settles occurrences whose payment has since
+// finished: captured or settled payments succeed, failed or expired ones
+// count as a failed attempt, and a payment canceled by its owner cancels
+// the occurrence.
+func (st *appState) followSubmittedOccurrences(ctx context.Context) error {
+	qctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if _, err := st.db.ExecContext(qctx, `
+		UPDATE schedule_occurrences o
+		SET status = CASE WHEN p.status = $2 THEN $3 ELSE $4 END, updated_at = now()
+		FROM payments p
+		WHERE p.id = o.payment_id AND o.status = $1 AND p.status IN ($2, $5, $6)
+	`, occurrenceSubmitted, statusCanceled, occurrenceCanceled, occurrenceSucceeded, statusCaptured, statusSettled); err != nil {
+		return err
+	}
+
+	failed, err := st.loadOccurrences(qctx, `o.status = $1 AND p.status IN ($2, $3)`,
+		occurrenceSubmitted, statusFailed, statusExpired)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, d := range failed {
+		// the attempt was counted when the payment was submitted
+		st.finishAttempt(qctx, d, d.Attempts, d.PaymentID, "payment failed", now)
+	}
+	return nil
+}
+
+// handleSchedules serves:
+//
+//	POST /v1/schedules
+//	GET  /v1/schedules?user_id=&status=
+//	GET  /v1/schedules/{id}                       schedule plus its occurrences
+//	POST /v1/schedules/{id}/{pause|resume|cancel}
+func (st *appState) handleSchedules(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/schedules"), "/")
+	if rest == "" {
+		switch r.Method {
+		case http.MethodPost:
+			st.createSchedule(ctx, w, r)
+		case http.MethodGet:
+			st.listSchedules(ctx, w, r)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	id, action, _ := strings.Cut(rest, "/")
+	s, err := st.loadSchedule(ctx, id)
+	if errors.Is(err, errScheduleNotFound) || (err == nil && !callerFrom(ctx).mayActFor(s.UserID)) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		occ, err := listOccurrences(ctx, st.db, id)
+		if err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"schedule": s, "occurrences": occ})
+	case action == "pause" || action == "resume" || action == "cancel":
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s, err := st.changeScheduleStatus(ctx, s, action, time.Now())
+		if errors.Is(err, errScheduleState) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, s)
+	case action == "":
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func (st *appState) createSchedule(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	var req createScheduleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	caller := callerFrom(ctx)
+	if strings.TrimSpace(req.UserID) == "" {
+		req.UserID = caller.Subject
+	}
+	if !caller.mayActFor(strings.TrimSpace(req.UserID)) {
+		http.Error(w, "user_id does not match the authenticated user", http.StatusForbidden)
+		return
+	}
+	now := time.Now()
+	if err := req.normalize(now); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	draft := schedule{
+		RuleKind: req.ruleKind, Rule: req.rule, Timezone: req.Timezone,
+		StartAt: req.StartAt, EndAt: req.EndAt, MaxOccurrences: req.MaxOccurrences,
+	}
+	next, err := draft.nextRun(req.StartAt.Add(-time.Nanosecond))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if next == nil {
+		http.Error(w, "the rule never fires between start_at and end_at", http.StatusBadRequest)
+		return
+	}
+
+	var s schedule
+	err = scanSchedule(st.db.QueryRowContext(ctx, `
+		INSERT INTO payment_schedules(user_id, amount, currency, payment_method, description, rule_kind, rule,
+			timezone, start_at, end_at, max_occurrences, retry_max_attempts, retry_backoff_seconds, status, next_run_at)
+		VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, ''), $6, $7, $8, $9, $10, NULLIF($11, 0), $12, $13, $14, $15)
+		RETURNING `+scheduleColumns,
+		req.UserID, req.Amount, req.Currency, req.PaymentMethod, req.Description, req.ruleKind, req.rule,
+		req.Timezone, req.StartAt, req.EndAt, req.MaxOccurrences, req.Retry.MaxAttempts, int64(req.backoff/time.Second),
+		scheduleActive, next), &s)
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusCreated, s)
+}
+
+func (st *appState) listSchedules(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := strings.TrimSpace(r.URL.Query().Get("user_id"))
+	if caller := callerFrom(ctx); !caller.Operator {
+		if userID != "" && userID != caller.Subject {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		userID = caller.Subject
+	}
+
+	rows, err := st.db.QueryContext(ctx, `
+		SELECT `+scheduleColumns+`
+		FROM payment_schedules
+		WHERE ($1 = '' OR user_id = $1) AND ($2 = '' OR status = $2)
+		ORDER BY created_at DESC
+		LIMIT 200
+	`, userID, r.URL.Query().Get("status"))
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	out := []schedule{}
+	for rows.Next() {
+		var s schedule
+		if err := scanSchedule(rows, &s); err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		out = append(out, s)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (st *appState) loadSchedule(ctx context.Context, id string) (schedule, error) {
+	var s schedule
+	if !isUUID(id) {
+		return s, errScheduleNotFound
+	}
+	err := scanSchedule(st.db.QueryRowContext(ctx, `
+		SELECT `+scheduleColumns+` FROM payment_schedules WHERE id = $1::uuid
+	`, id), &s)
+	if errors.Is(err, sql.ErrNoRows) {
+		return s, errScheduleNotFound
+	}
+	return s, err
+}
+
+// changeScheduleStatus pauses, resumes or cancels a schedule. Resuming
+// skips the runs that fell into the pause; canceling also cancels
+// occurrences still waiting for an attempt.
+func (st *appState) changeScheduleStatus(ctx context.Context, s schedule, action string, now time.Time) (schedule, error) {
+	from := map[string]string{"pause": scheduleActive, "resume": schedulePaused}[action]
+	to := map[string]string{"pause": schedulePaused, "resume": scheduleActive, "cancel": scheduleCanceled}[action]
+	if (from != "" && s.Status != from) || (action == "cancel" && (s.Status == scheduleCanceled || s.Status == scheduleCompleted)) {
+		return s, fmt.Errorf("%w: %s is %s", errScheduleState, s.ID, s.Status)
+	}
+
+	next := s.NextRunAt
+	switch action {
+	case "resume":
+		after := now
+		if s.StartAt.After(now) {
+			after = s.StartAt.Add(-time.Nanosecond)
+		}
+		var err error
+		if next, err = s.nextRun(after); err != nil {
+			return s, err
+		}
+		if next == nil {
+			to = scheduleCompleted
+		}
+	case "cancel":
+		next = nil
+	}
+
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return s, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	err = scanSchedule(tx.QueryRowContext(ctx, `
+		UPDATE payment_schedules
+		SET status = $2, next_run_at = $3, updated_at = now()
+		WHERE id = $1::uuid AND status = $4
+		RETURNING `+scheduleColumns,
+		s.ID, to, next, s.Status), &s)
+	if errors.Is(err, sql.ErrNoRows) {
+		return s, fmt.Errorf("%w: %s changed concurrently", errScheduleState, s.ID)
+	}
+	if err != nil {
+		return s, err
+	}
+	if action == "cancel" {
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE schedule_occurrences
+			SET status = $2, next_attempt_at = NULL, updated_at = now()
+			WHERE schedule_id = $1::uuid AND status = $3
+		`, s.ID, occurrenceCanceled, occurrencePending); err != nil {
+			return s, err
+		}
+	}
+	return s, tx.Commit()
+}
+
+func listOccurrences(ctx context.Context, db *sql.DB, scheduleID string) ([]scheduleOccurrence, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, seq, scheduled_for, attempts, status, COALESCE(payment_id::text, ''), COALESCE(last_error, ''),
+		       next_attempt_at, created_at, updated_at
+		FROM schedule_occurrences
+		WHERE schedule_id = $1::uuid
+		ORDER BY seq DESC
+		LIMIT 500
+	`, scheduleID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []scheduleOccurrence{}
+	for rows.Next() {
+		var o scheduleOccurrence
+		var next sql.NullTime
+		if err := rows.Scan(&o.ID, &o.Seq, &o.ScheduledFor, &o.Attempts, &o.Status, &o.PaymentID, &o.LastError,
+			&next, &o.CreatedAt, &o.UpdatedAt); err != nil {
+			return nil, err
+		}
+		if next.Valid {
+			o.NextAttemptAt = &next.Time
+		}
+		out = append(out, o)
+	}
+	return out, rows.Err()
+}
+
+const schedulesSchema = `
+	CREATE TABLE IF NOT EXISTS payment_schedules (
+		id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+		user_id text NOT NULL,
+		amount bigint NOT NULL,
+		currency text NOT NULL,
+		payment_method text,
+		description text,
+		rule_kind text NOT NULL,
+		rule text NOT NULL,
+		timezone text NOT NULL,
+		start_at timestamptz NOT NULL,
+		end_at timestamptz,
+		max_occurrences int,
+		occurrences int NOT NULL DEFAULT 0,
+		retry_max_attempts int NOT NULL DEFAULT 1,
+		retry_backoff_seconds bigint NOT NULL DEFAULT 3600,
+		status text NOT NULL,
+		next_run_at timestamptz,
+		created_at timestamptz NOT NULL DEFAULT now(),
+		updated_at timestamptz NOT NULL DEFAULT now()
+	);
+
+	CREATE INDEX IF NOT EXISTS payment_schedules_due_idx ON payment_schedules(next_run_at) WHERE status = 'active';
+	CREATE INDEX IF NOT EXISTS payment_schedules_user_idx ON payment_schedules(user_id, created_at DESC);
+
+	CREATE TABLE IF NOT EXISTS schedule_occurrences (
+		id bigserial PRIMARY KEY,
+		schedule_id uuid NOT NULL REFERENCES payment_schedules(id),
+		seq int NOT NULL,
+		scheduled_for timestamptz NOT NULL,
+		attempts int NOT NULL DEFAULT 0,
+		status text NOT NULL,
+		payment_id uuid REFERENCES payments(id),
+		last_error text,
+		next_attempt_at timestamptz,
+		created_at timestamptz NOT NULL DEFAULT now(),
+		updated_at timestamptz NOT NULL DEFAULT now(),
+		UNIQUE (schedule_id, seq)
+	);
+
+	CREATE INDEX IF NOT EXISTS schedule_occurrences_due_idx ON schedule_occurrences(next_attempt_at) WHERE status = 'pending';
+	CREATE INDEX IF NOT EXISTS schedule_occurrences_submitted_idx ON schedule_occurrences(payment_id) WHERE status = 'submitted';
+`
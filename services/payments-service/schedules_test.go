@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleRequestValidation(t *testing.T) {
+	now := time.Date(2026, 1, 10, 0, 0, 0, 0, time.UTC)
+	ok := createScheduleRequest{UserID: "u1", AmountDecimal: "950.00", Currency: "eur", Interval: "1mo", Timezone: "Europe/Berlin"}
+	if err := ok.normalize(now); err != nil {
+		t.Fatal(err)
+	}
+	if ok.Amount != 95000 || ok.Currency != "EUR" || !ok.StartAt.Equal(now) || ok.Retry.MaxAttempts != 1 || ok.backoff != time.Hour {
+		t.Fatalf("unexpected defaults %+v", ok)
+	}
+
+	end := now.Add(-time.Hour)
+	bad := []createScheduleRequest{
+		{UserID: "u1", Amount: 100, Currency: "EUR"},
+		{UserID: "u1", Amount: 100, Currency: "EUR", Cron: "@daily", Interval: "1d"},
+		{UserID: "u1", Amount: 100, Currency: "EUR", Cron: "61 * * * *"},
+		{UserID: "u1", Amount: 100, Currency: "EUR", Interval: "1d", Timezone: "Mars/Olympus"},
+		{UserID: "u1", Amount: 100, Currency: "EUR", Interval: "1d", EndAt: &end},
+		{UserID: "u1", Amount: 100, Currency: "EUR", Interval: "1d", Retry: retryPolicy{MaxAttempts: 11}},
+		{UserID: "u1", Amount: 100, Currency: "EUR", Interval: "1d", Retry: retryPolicy{Backoff: "5s"}},
+		{UserID: "u1", Amount: 0, Currency: "EUR", Interval: "1d"},
+	}
+	for i, req := range bad {
+		if err := req.normalize(now); err == nil {
+			t.Fatalf("case %d was accepted", i)
+		}
+	}
+}
+
+func TestScheduleNextRunHonoursLimits(t *testing.T) {
+	start := time.Date(2026, 1, 1, 8, 0, 0, 0, time.UTC)
+	end := time.Date(2026, 1, 3, 8, 0, 0, 0, time.UTC)
+	s := schedule{RuleKind: "interval", Rule: "1d", Timezone: "UTC", StartAt: start, EndAt: &end}
+
+	next, err := s.nextRun(start.Add(-time.Nanosecond))
+	if err != nil || next == nil || !next.Equal(start) {
+		t.Fatalf("first run: %v %v", next, err)
+	}
+	if next, _ := s.nextRun(end.Add(-time.Hour)); next == nil || !next.Equal(end) {
+		t.Fatalf("the end date itself still runs: %v", next)
+	}
+	if next, _ := s.nextRun(end); next != nil {
+		t.Fatalf("ran after end_at: %v", next)
+	}
+
+	s.EndAt, s.MaxOccurrences, s.Occurrences = nil, 3, 3
+	if next, _ := s.nextRun(start); next != nil {
+		t.Fatalf("ran past max_occurrences: %v", next)
+	}
+}
+
+func TestOccurrenceRefsAndRetryDelay(t *testing.T) {
+	id := "3f1c2b9e-8a4d-4b7e-9c1a-2d3e4f5a6b7c"
+	if occurrenceRef(id, 4, 1) != "sched:"+id+":4" || occurrenceRef(id, 4, 3) != "sched:"+id+":4:3" {
+		t.Fatal("unexpected refs")
+	}
+	if retryDelay(time.Hour, 2) != time.Hour || retryDelay(time.Hour, 4) != 4*time.Hour {
+		t.Fatal("backoff does not double")
+	}
+}
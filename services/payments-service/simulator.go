@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Simulator scenarios. The card token (payment_method) picks one; failing
+// that, a magic amount in minor units does; anything else is approved.
+const (
+	simApprove           = "approve"
+	simDecline           = "decline"
+	simInsufficientFunds = "insufficient_funds"
+	simTimeout           = "timeout"
+	simThreeDS           = "3ds_required"
+	simDelayedSettlement = "delayed_settlement"
+)
+
+var simTokens = map[string]string{
+	"tok_approve":            simApprove,
+	"tok_decline":            simDecline,
+	"tok_insufficient_funds": simInsufficientFunds,
+	"tok_timeout":            simTimeout,
+	"tok_3ds":                simThreeDS,
+	"tok_delayed_settlement": simDelayedSettlement,
+}
+
+var simAmounts = map[int64]string{
+	40002: simDecline,
+	40051: simInsufficientFunds,
+	40008: simTimeout,
+	40003: simThreeDS,
+	40009: simDelayedSettlement,
+}
+
+func simScenario(token string, amount int64) string {
+	if sc, ok := simTokens[token]; ok {
+		return sc
+	}
+	if sc, ok := simAmounts[amount]; ok {
+		return sc
+	}
+	return simApprove
+}
+
+// simulatorProvider is a deterministic in-process Provider for development
+// and tests. Its state lives in memory; after a restart an unknown
+// reference behaves like an approved authorization.
+type simulatorProvider struct {
+	settleAfter time.Duration
+	now         func() time.Time
+
+	mu       sync.Mutex
+	payments map[string]*simPayment
+}
+
+type simPayment struct {
+	ref      string
+	scenario string
+	state    string
+	amount   int64
+	currency string
+	refunded int64
+	attempts int
+	// captured so far, and the capture ids already applied
+	captured   int64
+	captureIDs map[string]bool
+	capturedAt time.Time
+}
+
+// simulator payment states
+const (
+	simStateActionRequired = "requires_action"
+	simStateAuthorized     = "authorized"
+	simStateDeclined       = "declined"
+	simStateCaptured       = "captured"
+	simStateSettled        = "settled"
+	simStateVoided         = "voided"
+)
+
+func newSimulatorProvider(settleAfter time.Duration) *simulatorProvider {
+	return &simulatorProvider{
+		settleAfter: settleAfter,
+		now:         time.Now,
+		payments:    map[string]*simPayment{},
+	}
+}
+
+func (s *simulatorProvider) Name() string { return "simulator" }
+
+// simRef derives the reference from our payment id, which makes Authorize
+// idempotent across retries.
+func simRef(paymentID string) string {
+	return "sim_pay_" + strings.ReplaceAll(paymentID, "-", "")
+}
+
+func (s *simulatorProvider) Authorize(_ context.Context, req authorizeRequest) (providerResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ref := simRef(req.PaymentID)
+	sp, ok := s.payments[ref]
+	if !ok {
+		sp = &simPayment{
+			ref:      ref,
+			scenario: simScenario(req.PaymentMethod, req.Amount),
+			amount:   req.Amount,
+			currency: req.Currency,
+		}
+		s.payments[ref] = sp
+		switch sp.scenario {
+		case simDecline, simInsufficientFunds:
+			sp.state = simStateDeclined
+		case simThreeDS:
+			sp.state = simStateActionRequired
+		default:
+			sp.state = simStateAuthorized
+		}
+	} else if sp.state == simStateActionRequired && req.Ref != "" {
+		// the customer completed the challenge
+		sp.state = simStateAuthorized
+	}
+
+	sp.attempts++
+	if sp.scenario == simTimeout && sp.attempts == 1 {
+		// the authorization went through, but the answer is lost; a retry
+		// returns it
+		return providerResult{}, errProviderTimeout
+	}
+	return s.result(sp, "authorization"), nil
+}
+
+// Capture takes req.Amount from the authorization. The payment counts as
+// captured, for the captured total, once a final capture arrives; until
+// then it stays authorized and accepts more captures.
+func (s *simulatorProvider) Capture(_ context.Context, ref string, req captureRequest) (providerResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sp := s.lookup(ref, req.Amount, req.Currency)
+	switch {
+	case sp.state == simStateCaptured || sp.state == simStateSettled || sp.captureIDs[req.ID]:
+		// idempotent replay
+	case sp.state != simStateAuthorized:
+		return s.declined(sp, "capture", "invalid_state"), nil
+	case sp.captured+req.Amount > sp.amount:
+		return s.declined(sp, "capture", "amount_too_large"), nil
+	default:
+		if sp.captureIDs == nil {
+			sp.captureIDs = map[string]bool{}
+		}
+		sp.captureIDs[req.ID] = true
+		sp.captured += req.Amount
+		if req.Final {
+			sp.state = simStateCaptured
+			sp.amount = sp.captured
+			sp.capturedAt = s.now()
+		}
+	}
+	return s.result(sp, "capture"), nil
+}
+
+func (s *simulatorProvider) Void(_ context.Context, ref string) (providerResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sp := s.lookup(ref, 0, "")
+	switch sp.state {
+	case simStateAuthorized, simStateActionRequired, simStateVoided:
+		sp.state = simStateVoided
+		return s.result(sp, "void"), nil
+	}
+	return s.declined(sp, "void", "already_captured"), nil
+}
+
+func (s *simulatorProvider) Refund(_ context.Context, ref, refundID string, amount int64, currency string) (providerResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sp := s.lookup(ref, amount, currency)
+	if sp.state != simStateCaptured && sp.state != simStateSettled {
+		return s.declined(sp, "refund", "not_captured"), nil
+	}
+	if sp.refunded+amount > sp.amount {
+		return s.declined(sp, "refund", "amount_too_large"), nil
+	}
+	sp.refunded += amount
+	res := providerResult{
+		Ref:     "sim_re_" + strings.ReplaceAll(refundID, "-", ""),
+		Outcome: providerApproved,
+	}
+	res.Raw, _ = json.Marshal(map[string]any{
+		"id":       res.Ref,
+		"object":   "refund",
+		"payment":  sp.ref,
+		"status":   "succeeded",
+		"amount":   amount,
+		"currency": currency,
+	})
+	return res, nil
+}
+
+func (s *simulatorProvider) Status(_ context.Context, ref string) (providerResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sp := s.lookup(ref, 0, "")
+	if sp.state == simStateCaptured {
+		delay := time.Duration(0)
+		if sp.scenario == simDelayedSettlement {
+			delay = s.settleAfter
+		}
+		if !s.now().Before(sp.capturedAt.Add(delay)) {
+			sp.state = simStateSettled
+		}
+	}
+	return s.result(sp, "payment"), nil
+}
+
+// lookup returns the simulated payment for ref, recreating an approved
+// authorization if the simulator does not know it.
+func (s *simulatorProvider) lookup(ref string, amount int64, currency string) *simPayment {
+	sp, ok := s.payments[ref]
+	if !ok {
+		sp = &simPayment{ref: ref, scenario: simApprove, state: simStateAuthorized, amount: amount, currency: currency}
+		s.payments[ref] = sp
+	}
+	return sp
+}
+
+func (s *simulatorProvider) result(sp *simPayment, object string) providerResult {
+	res := providerResult{Ref: sp.ref}
+	raw := map[string]any{
+		"id":       sp.ref,
+		"object":   object,
+		"status":   sp.state,
+		"amount":   sp.amount,
+		"captured": sp.captured,
+		"currency": sp.currency,
+	}
+	switch sp.state {
+	case simStateAuthorized, simStateCaptured, simStateVoided:
+		res.Outcome = providerApproved
+		if object == "payment" && sp.state == simStateCaptured {
+			res.Outcome = providerPending
+		}
+	case simStateSettled:
+		res.Outcome = providerSettled
+	case simStateActionRequired:
+		res.Outcome = providerActionRequired
+		res.NextAction = "https://simulator.invalid/3ds/" + sp.ref
+		raw["next_action"] = map[string]string{"type": "redirect_to_url", "url": res.NextAction}
+	case simStateDeclined:
+		res.Outcome = providerDeclined
+		res.Code = "card_declined"
+		if sp.scenario == simInsufficientFunds {
+			res.Code = "insufficient_funds"
+		}
+		raw["decline_code"] = res.Code
+	}
+	res.Raw, _ = json.Marshal(raw)
+	return res
+}
+
+func (s *simulatorProvider) declined(sp *simPayment, object, code string) providerResult {
+	res := providerResult{Ref: sp.ref, Outcome: providerDeclined, Code: code}
+	res.Raw, _ = json.Marshal(map[string]any{
+		"id":           sp.ref,
+		"object":       object,
+		"status":       "failed",
+		"decline_code": code,
+	})
+	return res
+}
+
+// Payout simulator scenarios, selected by the amount in minor units;
+// anything else is accepted and paid on the next status poll.
+const (
+	simPayoutFail    = "fail"
+	simPayoutReturn  = "return"
+	simPayoutTimeout = "timeout"
+)
+
+var simPayoutAmounts = map[int64]string{
+	50002: simPayoutFail,
+	50004: simPayoutReturn,
+	50008: simPayoutTimeout,
+}
+
+// simulatorPayouts is a deterministic in-process PayoutProvider. Like
+// simulatorProvider it keeps its state in memory.
+type simulatorPayouts struct {
+	mu      sync.Mutex
+	payouts map[string]*simPayout
+}
+
+type simPayout struct {
+	ref      string
+	scenario string
+	state    string
+	amount   int64
+	currency string
+	attempts int
+}
+
+func newSimulatorPayouts() *simulatorPayouts {
+	return &simulatorPayouts{payouts: map[string]*simPayout{}}
+}
+
+func (s *simulatorPayouts) Name() string { return "simulator" }
+
+// Submit accepts a payout, or fails it for the fail scenario. The
+// reference derives from the payout id, so a retry finds the same payout.
+func (s *simulatorPayouts) Submit(_ context.Context, req payoutRequest) (payoutResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ref := "sim_po_" + strings.ReplaceAll(req.PayoutID, "-", "")
+	sp, ok := s.payouts[ref]
+	if !ok {
+		sp = &simPayout{ref: ref, scenario: simPayoutAmounts[req.Amount], state: payoutOutcomeAccepted, amount: req.Amount, currency: req.Currency}
+		if sp.scenario == simPayoutFail {
+			sp.state = payoutOutcomeFailed
+		}
+		s.payouts[ref] = sp
+	}
+	sp.attempts++
+	if sp.scenario == simPayoutTimeout && sp.attempts == 1 {
+		return payoutResult{}, errProviderTimeout
+	}
+	return sp.result(), nil
+}
+
+// Status moves an accepted payout to paid, and a paid payout of the return
+// scenario to returned, one step per call.
+func (s *simulatorPayouts) Status(_ context.Context, ref string) (payoutResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sp, ok := s.payouts[ref]
+	if !ok {
+		// lost in a restart: assume it went through
+		sp = &simPayout{ref: ref, state: payoutOutcomePaid}
+		s.payouts[ref] = sp
+	}
+	switch {
+	case sp.state == payoutOutcomeAccepted:
+		sp.state = payoutOutcomePaid
+	case sp.state == payoutOutcomePaid && sp.scenario == simPayoutReturn:
+		sp.state = payoutOutcomeReturned
+	}
+	return sp.result(), nil
+}
+
+func (sp *simPayout) result() payoutResult {
+	res := payoutResult{Ref: sp.ref, Outcome: sp.state}
+	switch sp.state {
+	case payoutOutcomeFailed:
+		res.Code = "invalid_account"
+	case payoutOutcomeReturned:
+		res.Code = "account_closed"
+	}
+	raw := map[string]any{
+		"id":       sp.ref,
+		"object":   "payout",
+		"status":   sp.state,
+		"amount":   sp.amount,
+		"currency": sp.currency,
+	}
+	if res.Code != "" {
+		raw["failure_code"] = res.Code
+	}
+	res.Raw, _ = json.Marshal(raw)
+	return res
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSimulatorScenarios(t *testing.T) {
+	cases := []struct {
+		token   string
+		amount  int64
+		outcome string
+		code    string
+	}{
+		{"", 1000, providerApproved, ""},
+		{"tok_decline", 1000, providerDeclined, "card_declined"},
+		{"", 40051, providerDeclined, "insufficient_funds"},
+		{"tok_3ds", 1000, providerActionRequired, ""},
+		{"tok_approve", 40002, providerApproved, ""},
+	}
+	for i, c := range cases {
+		s := newSimulatorProvider(time.Hour)
+		res, err := s.Authorize(context.Background(), authorizeRequest{
+			PaymentID: "p" + string(rune('a'+i)), Amount: c.amount, Currency: "USD", PaymentMethod: c.token,
+		})
+		if err != nil || res.Outcome != c.outcome || res.Code != c.code {
+			t.Fatalf("case %d: got %+v, %v", i, res, err)
+		}
+		if len(res.Raw) == 0 || res.Ref == "" {
+			t.Fatalf("case %d: missing ref or raw response", i)
+		}
+	}
+}
+
+func TestSimulatorTimeoutResolvesOnRetry(t *testing.T) {
+	s := newSimulatorProvider(time.Hour)
+	req := authorizeRequest{PaymentID: "p1", Amount: 40008, Currency: "USD"}
+
+	if _, err := s.Authorize(context.Background(), req); !errors.Is(err, errProviderTimeout) {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+	res, err := s.Authorize(context.Background(), req)
+	if err != nil || res.Outcome != providerApproved {
+		t.Fatalf("expected approval on retry, got %+v, %v", res, err)
+	}
+}
+
+func TestSimulatorThreeDSThenCapture(t *testing.T) {
+	s := newSimulatorProvider(time.Hour)
+	req := authorizeRequest{PaymentID: "p1", Amount: 1000, Currency: "EUR", PaymentMethod: "tok_3ds"}
+
+	res, _ := s.Authorize(context.Background(), req)
+	if res.Outcome != providerActionRequired || res.NextAction == "" {
+		t.Fatalf("expected action required, got %+v", res)
+	}
+	if to, ok := authorizeTarget(statusCreated, res); !ok || to != statusRequiresAction {
+		t.Fatalf("unexpected target %q %v", to, ok)
+	}
+
+	req.Ref = res.Ref
+	res, _ = s.Authorize(context.Background(), req)
+	if res.Outcome != providerApproved {
+		t.Fatalf("expected approval after challenge, got %+v", res)
+	}
+	if res, _ := s.Capture(context.Background(), res.Ref, captureRequest{ID: "c1", Amount: 1000, Currency: "EUR", Final: true}); res.Outcome != providerApproved {
+		t.Fatalf("capture: %+v", res)
+	}
+	if res, _ := s.Void(context.Background(), res.Ref); res.Outcome != providerDeclined {
+		t.Fatalf("void after capture should decline, got %+v", res)
+	}
+}
+
+func TestSimulatorDelayedSettlement(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	s := newSimulatorProvider(time.Hour)
+	s.now = func() time.Time { return now }
+
+	res, _ := s.Authorize(context.Background(), authorizeRequest{PaymentID: "p1", Amount: 1000, Currency: "USD", PaymentMethod: "tok_delayed_settlement"})
+	_, _ = s.Capture(context.Background(), res.Ref, captureRequest{ID: "c1", Amount: 1000, Currency: "USD", Final: true})
+
+	res, _ = s.Status(context.Background(), res.Ref)
+	if _, ok := syncTarget(statusCaptured, res); ok || res.Outcome != providerPending {
+		t.Fatalf("settled too early: %+v", res)
+	}
+	now = now.Add(time.Hour)
+	res, _ = s.Status(context.Background(), res.Ref)
+	if to, ok := syncTarget(statusCaptured, res); !ok || to != statusSettled {
+		t.Fatalf("expected settlement, got %+v", res)
+	}
+}
+
+func TestSimulatorRefundLimitedToCaptured(t *testing.T) {
+	s := newSimulatorProvider(0)
+	res, _ := s.Authorize(context.Background(), authorizeRequest{PaymentID: "p1", Amount: 1000, Currency: "USD"})
+	if r, _ := s.Refund(context.Background(), res.Ref, "r1", 100, "USD"); r.Outcome != providerDeclined {
+		t.Fatalf("refund before capture should decline, got %+v", r)
+	}
+	_, _ = s.Capture(context.Background(), res.Ref, captureRequest{ID: "c1", Amount: 1000, Currency: "USD", Final: true})
+	if r, _ := s.Refund(context.Background(), res.Ref, "r1", 600, "USD"); r.Outcome != providerApproved {
+		t.Fatalf("refund: %+v", r)
+	}
+	if r, _ := s.Refund(context.Background(), res.Ref, "r2", 600, "USD"); r.Outcome != providerDeclined {
+		t.Fatalf("over-refund should decline, got %+v", r)
+	}
+}
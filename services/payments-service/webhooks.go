@@ -0,0 +1,761 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	webhookSignatureHeader = "Payments-Signature"
+
+	deliveryPending   = "pending"
+	deliverySucceeded = "succeeded"
+	deliveryFailed    = "failed"
+
+	endpointActive   = "active"
+	endpointDisabled = "disabled"
+)
+
+// webhookRetrySchedule is the wait before each retry. A delivery that still
+// fails after the last one (about three and a half days in) is marked
+// failed and can only be redelivered by hand.
+var webhookRetrySchedule = []time.Duration{
+	time.Minute,
+	5 * time.Minute,
+	30 * time.Minute,
+	2 * time.Hour,
+	6 * time.Hour,
+	12 * time.Hour,
+	24 * time.Hour,
+	24 * time.Hour,
+	24 * time.Hour,
+}
+
+// nextWebhookAttempt returns when to retry after the given number of failed
+// attempts, or false once the schedule is exhausted.
+func nextWebhookAttempt(now time.Time, attempts int) (time.Time, bool) {
+	if attempts < 1 || attempts > len(webhookRetrySchedule) {
+		return time.Time{}, false
+	}
+	return now.Add(webhookRetrySchedule[attempts-1]), true
+}
+
+// signWebhook computes the v1 signature: hex HMAC-SHA256 over
+// "{timestamp}.{body}".
+func signWebhook(secret string, ts int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = io.WriteString(mac, strconv.FormatInt(ts, 10)+".")
+	_, _ = mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookSignature builds the Payments-Signature header value. During a
+// secret rotation both the new and the previous secret sign the payload, so
+// merchants can switch over at any point in the grace period.
+func webhookSignature(ts int64, body []byte, secrets ...string) string {
+	parts := []string{"t=" + strconv.FormatInt(ts, 10)}
+	for _, s := range secrets {
+		if s != "" {
+			parts = append(parts, "v1="+signWebhook(s, ts, body))
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+var errBadWebhookSignature = errors.New("webhook signature mismatch")
+
+// verifyWebhookSignature is the check merchants are expected to run: any v1
+// signature must match and the timestamp must be within tolerance.
+func verifyWebhookSignature(header, secret string, body []byte, now time.Time, tolerance time.Duration) error {
+	var ts int64
+	var sigs []string
+	for _, part := range strings.Split(header, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch k {
+		case "t":
+			ts, _ = strconv.ParseInt(v, 10, 64)
+		case "v1":
+			sigs = append(sigs, v)
+		}
+	}
+	if ts == 0 || len(sigs) == 0 {
+		return fmt.Errorf("%w: malformed header", errBadWebhookSignature)
+	}
+	if d := now.Sub(time.Unix(ts, 0)); d > tolerance || d < -tolerance {
+		return fmt.Errorf("%w: timestamp outside tolerance", errBadWebhookSignature)
+	}
+	want := signWebhook(secret, ts, body)
+	for _, s := range sigs {
+		if hmac.Equal([]byte(s), []byte(want)) {
+			return nil
+		}
+	}
+	return errBadWebhookSignature
+}
+
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+// webhookFanout is an outbox Publisher that turns each event into one
+// pending delivery per matching endpoint of the event's merchant. It is
+// idempotent, so outbox redelivery does not duplicate webhooks.
+type webhookFanout struct {
+	db *sql.DB
+}
+
+func (f webhookFanout) Publish(ctx context.Context, e outboxEvent) error {
+	if e.MerchantID == "" {
+		return nil
+	}
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = f.db.ExecContext(ctx, `
+		INSERT INTO webhook_deliveries(endpoint_id, event_id, event_type, payload)
+		SELECT id, $2, $3, $4::jsonb
+		FROM webhook_endpoints
+		WHERE merchant_id = $1 AND status = $5
+		  AND (cardinality(event_types) = 0 OR $3 = ANY(event_types))
+		ON CONFLICT (endpoint_id, event_id) DO NOTHING
+	`, e.MerchantID, e.ID, e.Type, string(body), endpointActive)
+	return err
+}
+
+// webhookJob is a claimed delivery together with the endpoint it goes to.
+type webhookJob struct {
+	DeliveryID       string
+	EventID          int64
+	EventType        string
+	Payload          []byte
+	Attempts         int
+	EndpointID       string
+	URL              string
+	Secret           string
+	PreviousSecret   string
+	PreviousSecretTo sql.NullTime
+}
+
+type webhookResult struct {
+	StatusCode int
+	Err        error
+	Duration   time.Duration
+}
+
+func (r webhookResult) ok() bool {
+	return r.Err == nil && r.StatusCode >= 200 && r.StatusCode <= 299
+}
+
+// sendWebhook performs one delivery attempt.
+func sendWebhook(ctx context.Context, client *http.Client, job webhookJob, now time.Time) webhookResult {
+	secrets := []string{job.Secret}
+	if job.PreviousSecret != "" && job.PreviousSecretTo.Valid && now.Before(job.PreviousSecretTo.Time) {
+		secrets = append(secrets, job.PreviousSecret)
+	}
+
+	start := time.Now()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, job.URL, bytes.NewReader(job.Payload))
+	if err != nil {
+		return webhookResult{Err: err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "payments-service-webhooks/1")
+	req.Header.Set("Payments-Event-Id", strconv.FormatInt(job.EventID, 10))
+	req.Header.Set("Payments-Event-Type", job.EventType)
+	req.Header.Set("Payments-Delivery-Id", job.DeliveryID)
+	req.Header.Set(webhookSignatureHeader, webhookSignature(now.Unix(), job.Payload, secrets...))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return webhookResult{Err: err, Duration: time.Since(start)}
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	return webhookResult{StatusCode: resp.StatusCode, Duration: time.Since(start)}
+}
+
+// webhookDispatcher claims due deliveries and hands them to a fixed pool of
+// workers, so at most `workers` requests to merchants are in flight per
+// replica.
+type webhookDispatcher struct {
+	db           *sql.DB
+	client       *http.Client
+	workers      int
+	disableAfter int
+}
+
+func newWebhookDispatcherFromEnv(db *sql.DB) *webhookDispatcher {
+	workers, err := strconv.Atoi(getenv("WEBHOOK_WORKERS", "4"))
+	if err != nil || workers < 1 {
+		workers = 4
+	}
+	disableAfter, err := strconv.Atoi(getenv("WEBHOOK_DISABLE_AFTER", "25"))
+	if err != nil || disableAfter < 1 {
+		disableAfter = 25
+	}
+	return &webhookDispatcher{
+		db: db,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+			// a merchant redirect is treated as a failure, not followed
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		workers:      workers,
+		disableAfter: disableAfter,
+	}
+}
+
+func (d *webhookDispatcher) run(ctx context.Context, every time.Duration) {
+	jobs := make(chan webhookJob)
+	var wg sync.WaitGroup
+	for i := 0; i < d.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				d.deliver(ctx, job)
+			}
+		}()
+	}
+	defer func() {
+		close(jobs)
+		wg.Wait()
+	}()
+
+	for {
+		cctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		batch, err := d.claim(cctx, d.workers*4)
+		cancel()
+		if err != nil && ctx.Err() == nil {
+			log.Printf(`{"msg":"webhook claim failed","error":%q}`, err.Error())
+		}
+		for _, job := range batch {
+			select {
+			case jobs <- job:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if len(batch) > 0 {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(every):
+		}
+	}
+}
+
+func (d *webhookDispatcher) deliver(ctx context.Context, job webhookJob) {
+	sctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	res := sendWebhook(sctx, d.client, job, time.Now())
+	cancel()
+
+	rctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := d.record(rctx, job, res); err != nil {
+		log.Printf(`{"msg":"webhook result not recorded","delivery_id":%q,"error":%q}`, job.DeliveryID, err.Error())
+	}
+}
+
+// claim leases up to limit due deliveries whose endpoint is active.
+func (d *webhookDispatcher) claim(ctx context.Context, limit int) ([]webhookJob, error) {
+	rows, err := d.db.QueryContext(ctx, `
+		WITH due AS (
+			SELECT wd.id FROM webhook_deliveries wd
+			JOIN webhook_endpoints we ON we.id = wd.endpoint_id
+			WHERE wd.status = $2 AND we.status = $3
+			  AND wd.next_attempt_at <= now()
+			  AND (wd.locked_until IS NULL OR wd.locked_until < now())
+			ORDER BY wd.next_attempt_at
+			LIMIT $1
+			FOR UPDATE OF wd SKIP LOCKED
+		)
+		UPDATE webhook_deliveries wd SET locked_until = now() + interval '60 seconds'
+		FROM due, webhook_endpoints we
+		WHERE wd.id = due.id AND we.id = wd.endpoint_id
+		RETURNING wd.id::text, wd.event_id, wd.event_type, wd.payload::text, wd.attempts,
+		          we.id::text, we.url, we.secret, COALESCE(we.previous_secret, ''), we.previous_secret_expires_at
+	`, limit, deliveryPending, endpointActive)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []webhookJob
+	for rows.Next() {
+		var j webhookJob
+		var payload string
+		if err := rows.Scan(&j.DeliveryID, &j.EventID, &j.EventType, &payload, &j.Attempts,
+			&j.EndpointID, &j.URL, &j.Secret, &j.PreviousSecret, &j.PreviousSecretTo); err != nil {
+			return nil, err
+		}
+		j.Payload = []byte(payload)
+		out = append(out, j)
+	}
+	return out, rows.Err()
+}
+
+// record logs the attempt and schedules what happens next: success,
+// another retry, or giving up. Endpoints that fail disableAfter attempts in
+// a row are disabled.
+func (d *webhookDispatcher) record(ctx context.Context, job webhookJob, res webhookResult) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	errMsg := ""
+	if res.Err != nil {
+		errMsg = res.Err.Error()
+	} else if !res.ok() {
+		errMsg = fmt.Sprintf("status %d", res.StatusCode)
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO webhook_attempts(delivery_id, status_code, error, duration_ms)
+		VALUES ($1::uuid, NULLIF($2, 0), NULLIF($3, ''), $4)
+	`, job.DeliveryID, res.StatusCode, errMsg, res.Duration.Milliseconds()); err != nil {
+		return err
+	}
+
+	attempts := job.Attempts + 1
+	if res.ok() {
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE webhook_deliveries
+			SET status = $2, attempts = $3, delivered_at = now(), locked_until = NULL,
+			    last_status_code = $4, last_error = NULL
+			WHERE id = $1::uuid
+		`, job.DeliveryID, deliverySucceeded, attempts, res.StatusCode); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE webhook_endpoints SET consecutive_failures = 0 WHERE id = $1::uuid
+		`, job.EndpointID); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+
+	status := deliveryPending
+	next, retry := nextWebhookAttempt(time.Now(), attempts)
+	if !retry {
+		status = deliveryFailed
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE webhook_deliveries
+		SET status = $2, attempts = $3, next_attempt_at = COALESCE($4, next_attempt_at), locked_until = NULL,
+		    last_status_code = NULLIF($5, 0), last_error = $6
+		WHERE id = $1::uuid
+	`, job.DeliveryID, status, attempts, nullTime(next, retry), res.StatusCode, errMsg); err != nil {
+		return err
+	}
+
+	var failures int
+	var endpointStatus string
+	if err := tx.QueryRowContext(ctx, `
+		UPDATE webhook_endpoints
+		SET consecutive_failures = consecutive_failures + 1,
+		    status = CASE WHEN consecutive_failures + 1 >= $2 THEN $3 ELSE status END,
+		    disabled_at = CASE WHEN consecutive_failures + 1 >= $2 AND status <> $3 THEN now() ELSE disabled_at END
+		WHERE id = $1::uuid
+		RETURNING consecutive_failures, status
+	`, job.EndpointID, d.disableAfter, endpointDisabled).Scan(&failures, &endpointStatus); err != nil {
+		return err
+	}
+	if endpointStatus == endpointDisabled && failures == d.disableAfter {
+		log.Printf(`{"msg":"webhook endpoint disabled","endpoint_id":%q,"consecutive_failures":%d}`, job.EndpointID, failures)
+	}
+	return tx.Commit()
+}
+
+func nullTime(t time.Time, valid bool) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: valid}
+}
+
+type webhookEndpoint struct {
+	ID                  string     `json:"id"`
+	MerchantID          string     `json:"merchant_id"`
+	URL                 string     `json:"url"`
+	EventTypes          []string   `json:"event_types"`
+	Status              string     `json:"status"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	DisabledAt          *time.Time `json:"disabled_at,omitempty"`
+	CreatedAt           time.Time  `json:"created_at"`
+	// only returned when the secret is created or rotated
+	Secret string `json:"secret,omitempty"`
+}
+
+const webhookEndpointColumns = `id::text, merchant_id, url, array_to_json(event_types)::text, status, consecutive_failures, disabled_at, created_at`
+
+func scanWebhookEndpoint(row rowScanner, e *webhookEndpoint) error {
+	var eventTypes string
+	var disabledAt sql.NullTime
+	if err := row.Scan(&e.ID, &e.MerchantID, &e.URL, &eventTypes, &e.Status, &e.ConsecutiveFailures, &disabledAt, &e.CreatedAt); err != nil {
+		return err
+	}
+	if err := json.Unmarshal([]byte(eventTypes), &e.EventTypes); err != nil {
+		return err
+	}
+	if disabledAt.Valid {
+		e.DisabledAt = &disabledAt.Time
+	}
+	return nil
+}
+
+type webhookDelivery struct {
+	ID             string           `json:"id"`
+	EndpointID     string           `json:"endpoint_id"`
+	EventID        int64            `json:"event_id"`
+	EventType      string           `json:"event_type"`
+	Status         string           `json:"status"`
+	Attempts       int              `json:"attempts"`
+	NextAttemptAt  *time.Time       `json:"next_attempt_at,omitempty"`
+	LastStatusCode int              `json:"last_status_code,omitempty"`
+	LastError      string           `json:"last_error,omitempty"`
+	DeliveredAt    *time.Time       `json:"delivered_at,omitempty"`
+	CreatedAt      time.Time        `json:"created_at"`
+	AttemptLog     []webhookAttempt `json:"attempt_log,omitempty"`
+}
+
+type webhookAttempt struct {
+	AttemptedAt time.Time `json:"attempted_at"`
+	StatusCode  int       `json:"status_code,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	DurationMS  int64     `json:"duration_ms"`
+}
+
+const webhookDeliveryColumns = `id::text, endpoint_id::text, event_id, event_type, status, attempts,
+	next_attempt_at, COALESCE(last_status_code, 0), COALESCE(last_error, ''), delivered_at, created_at`
+
+func scanWebhookDelivery(row rowScanner, d *webhookDelivery) error {
+	var next, delivered sql.NullTime
+	if err := row.Scan(&d.ID, &d.EndpointID, &d.EventID, &d.EventType, &d.Status, &d.Attempts,
+		&next, &d.LastStatusCode, &d.LastError, &delivered, &d.CreatedAt); err != nil {
+		return err
+	}
+	if next.Valid && d.Status == deliveryPending {
+		d.NextAttemptAt = &next.Time
+	}
+	if delivered.Valid {
+		d.DeliveredAt = &delivered.Time
+	}
+	return nil
+}
+
+type createWebhookEndpointRequest struct {
+	MerchantID string   `json:"merchant_id"`
+	URL        string   `json:"url"`
+	EventTypes []string `json:"event_types"`
+}
+
+// handleWebhooks serves the endpoint and delivery management API under
+// /v1/webhooks/.
+func (st *appState) handleWebhooks(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/webhooks/"), "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "endpoints":
+		switch r.Method {
+		case http.MethodPost:
+			st.createWebhookEndpoint(ctx, w, r)
+		case http.MethodGet:
+			st.listWebhookEndpoints(ctx, w, r.URL.Query().Get("merchant_id"))
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	case len(parts) == 3 && parts[0] == "endpoints":
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		st.updateWebhookEndpoint(ctx, w, parts[1], parts[2])
+	case len(parts) == 1 && parts[0] == "deliveries":
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		st.listWebhookDeliveries(ctx, w, r.URL.Query().Get("endpoint_id"), r.URL.Query().Get("status"))
+	case len(parts) == 2 && parts[0] == "deliveries":
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		st.getWebhookDelivery(ctx, w, parts[1])
+	case len(parts) == 3 && parts[0] == "deliveries" && parts[2] == "redeliver":
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		st.redeliverWebhook(ctx, w, parts[1])
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func (st *appState) createWebhookEndpoint(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	var req createWebhookEndpointRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	req.MerchantID = strings.TrimSpace(req.MerchantID)
+	u, err := url.Parse(strings.TrimSpace(req.URL))
+	if req.MerchantID == "" || err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		http.Error(w, "merchant_id and an absolute http(s) url are required", http.StatusBadRequest)
+		return
+	}
+	if req.EventTypes == nil {
+		req.EventTypes = []string{}
+	}
+
+	secret, err := newWebhookSecret()
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	var e webhookEndpoint
+	err = scanWebhookEndpoint(st.db.QueryRowContext(ctx, `
+		INSERT INTO webhook_endpoints(merchant_id, url, event_types, secret, status)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING `+webhookEndpointColumns,
+		req.MerchantID, u.String(), req.EventTypes, secret, endpointActive), &e)
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	e.Secret = secret
+	writeJSON(w, http.StatusCreated, e)
+}
+
+func (st *appState) listWebhookEndpoints(ctx context.Context, w http.ResponseWriter, merchantID string) {
+	rows, err := st.db.QueryContext(ctx, `
+		SELECT `+webhookEndpointColumns+`
+		FROM webhook_endpoints
+		WHERE $1 = '' OR merchant_id = $1
+		ORDER BY created_at
+		LIMIT 200
+	`, strings.TrimSpace(merchantID))
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	out := []webhookEndpoint{}
+	for rows.Next() {
+		var e webhookEndpoint
+		if err := scanWebhookEndpoint(rows, &e); err != nil {
+			http.Error(w, "db scan error", http.StatusInternalServerError)
+			return
+		}
+		out = append(out, e)
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// updateWebhookEndpoint handles enable, disable and rotate-secret. A
+// rotated-out secret keeps signing alongside the new one for
+// WEBHOOK_SECRET_GRACE (default 24h).
+func (st *appState) updateWebhookEndpoint(ctx context.Context, w http.ResponseWriter, id, action string) {
+	var e webhookEndpoint
+	var err error
+	switch action {
+	case "enable":
+		err = scanWebhookEndpoint(st.db.QueryRowContext(ctx, `
+			UPDATE webhook_endpoints SET status = $2, consecutive_failures = 0, disabled_at = NULL
+			WHERE id = $1::uuid
+			RETURNING `+webhookEndpointColumns, id, endpointActive), &e)
+	case "disable":
+		err = scanWebhookEndpoint(st.db.QueryRowContext(ctx, `
+			UPDATE webhook_endpoints SET status = $2, disabled_at = now()
+			WHERE id = $1::uuid
+			RETURNING `+webhookEndpointColumns, id, endpointDisabled), &e)
+	case "rotate-secret":
+		grace, perr := time.ParseDuration(getenv("WEBHOOK_SECRET_GRACE", "24h"))
+		if perr != nil {
+			grace = 24 * time.Hour
+		}
+		secret, serr := newWebhookSecret()
+		if serr != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		err = scanWebhookEndpoint(st.db.QueryRowContext(ctx, `
+			UPDATE webhook_endpoints
+			SET previous_secret = secret, previous_secret_expires_at = now() + make_interval(secs => $3), secret = $2
+			WHERE id = $1::uuid
+			RETURNING `+webhookEndpointColumns, id, secret, grace.Seconds()), &e)
+		e.Secret = secret
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, e)
+}
+
+func (st *appState) listWebhookDeliveries(ctx context.Context, w http.ResponseWriter, endpointID, status string) {
+	rows, err := st.db.QueryContext(ctx, `
+		SELECT `+webhookDeliveryColumns+`
+		FROM webhook_deliveries
+		WHERE ($1 = '' OR endpoint_id = NULLIF($1, '')::uuid) AND ($2 = '' OR status = $2)
+		ORDER BY created_at DESC
+		LIMIT 200
+	`, strings.TrimSpace(endpointID), strings.TrimSpace(status))
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	out := []webhookDelivery{}
+	for rows.Next() {
+		var d webhookDelivery
+		if err := scanWebhookDelivery(rows, &d); err != nil {
+			http.Error(w, "db scan error", http.StatusInternalServerError)
+			return
+		}
+		out = append(out, d)
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (st *appState) getWebhookDelivery(ctx context.Context, w http.ResponseWriter, id string) {
+	var d webhookDelivery
+	err := scanWebhookDelivery(st.db.QueryRowContext(ctx, `
+		SELECT `+webhookDeliveryColumns+` FROM webhook_deliveries WHERE id = $1::uuid
+	`, id), &d)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := st.db.QueryContext(ctx, `
+		SELECT attempted_at, COALESCE(status_code, 0), COALESCE(error, ''), duration_ms
+		FROM webhook_attempts
+		WHERE delivery_id = $1::uuid
+		ORDER BY id
+	`, id)
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	d.AttemptLog = []webhookAttempt{}
+	for rows.Next() {
+		var a webhookAttempt
+		if err := rows.Scan(&a.AttemptedAt, &a.StatusCode, &a.Error, &a.DurationMS); err != nil {
+			http.Error(w, "db scan error", http.StatusInternalServerError)
+			return
+		}
+		d.AttemptLog = append(d.AttemptLog, a)
+	}
+	writeJSON(w, http.StatusOK, d)
+}
+
+// redeliverWebhook queues a delivery again with a fresh retry schedule,
+// whatever its current status.
+func (st *appState) redeliverWebhook(ctx context.Context, w http.ResponseWriter, id string) {
+	var d webhookDelivery
+	err := scanWebhookDelivery(st.db.QueryRowContext(ctx, `
+		UPDATE webhook_deliveries
+		SET status = $2, attempts = 0, next_attempt_at = now(), locked_until = NULL
+		WHERE id = $1::uuid
+		RETURNING `+webhookDeliveryColumns, id, deliveryPending), &d)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, d)
+}
+
+const webhooksSchema = `
+	CREATE TABLE IF NOT EXISTS webhook_endpoints (
+		id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+		merchant_id text NOT NULL,
+		url text NOT NULL,
+		event_types text[] NOT NULL DEFAULT '{}',
+		secret text NOT NULL,
+		previous_secret text,
+		previous_secret_expires_at timestamptz,
+		status text NOT NULL,
+		consecutive_failures int NOT NULL DEFAULT 0,
+		disabled_at timestamptz,
+		created_at timestamptz NOT NULL DEFAULT now()
+	);
+
+	CREATE INDEX IF NOT EXISTS webhook_endpoints_merchant_idx ON webhook_endpoints(merchant_id);
+
+	CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+		endpoint_id uuid NOT NULL REFERENCES webhook_endpoints(id),
+		event_id bigint NOT NULL,
+		event_type text NOT NULL,
+		payload jsonb NOT NULL,
+		status text NOT NULL DEFAULT 'pending',
+		attempts int NOT NULL DEFAULT 0,
+		next_attempt_at timestamptz NOT NULL DEFAULT now(),
+		locked_until timestamptz,
+		last_status_code int,
+		last_error text,
+		delivered_at timestamptz,
+		created_at timestamptz NOT NULL DEFAULT now(),
+		UNIQUE (endpoint_id, event_id)
+	);
+
+	CREATE INDEX IF NOT EXISTS webhook_deliveries_due_idx ON webhook_deliveries(next_attempt_at)
+		WHERE status = 'pending';
+
+	CREATE TABLE IF NOT EXISTS webhook_attempts (
+		id bigserial PRIMARY KEY,
+		delivery_id uuid NOT NULL REFERENCES webhook_deliveries(id),
+		attempted_at timestamptz NOT NULL DEFAULT now(),
+		status_code int,
+		error text,
+		duration_ms bigint NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS webhook_attempts_delivery_idx ON webhook_attempts(delivery_id, id);
+`
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebhookSignatureVerifies(t *testing.T) {
+	body := []byte(`{"id":1,"type":"payment.captured"}`)
+	now := time.Unix(1_700_000_000, 0)
+	header := webhookSignature(now.Unix(), body, "whsec_new")
+
+	if err := verifyWebhookSignature(header, "whsec_new", body, now, 5*time.Minute); err != nil {
+		t.Fatalf("expected valid signature, got %v", err)
+	}
+	if err := verifyWebhookSignature(header, "whsec_other", body, now, 5*time.Minute); !errors.Is(err, errBadWebhookSignature) {
+		t.Fatalf("expected mismatch for wrong secret, got %v", err)
+	}
+	if err := verifyWebhookSignature(header, "whsec_new", []byte(`{"id":2}`), now, 5*time.Minute); err == nil {
+		t.Fatal("expected mismatch for tampered body")
+	}
+	if err := verifyWebhookSignature(header, "whsec_new", body, now.Add(10*time.Minute), 5*time.Minute); err == nil {
+		t.Fatal("expected stale timestamp to be rejected")
+	}
+}
+
+func TestWebhookSignatureDuringRotation(t *testing.T) {
+	body := []byte(`{}`)
+	now := time.Unix(1_700_000_000, 0)
+	header := webhookSignature(now.Unix(), body, "whsec_new", "whsec_old")
+
+	if strings.Count(header, "v1=") != 2 {
+		t.Fatalf("expected two signatures, got %q", header)
+	}
+	for _, secret := range []string{"whsec_new", "whsec_old"} {
+		if err := verifyWebhookSignature(header, secret, body, now, time.Minute); err != nil {
+			t.Fatalf("%s: %v", secret, err)
+		}
+	}
+}
+
+func TestWebhookRetryScheduleSpansDays(t *testing.T) {
+	now := time.Unix(0, 0)
+	var total time.Duration
+	for attempts := 1; ; attempts++ {
+		next, ok := nextWebhookAttempt(now, attempts)
+		if !ok {
+			if attempts != len(webhookRetrySchedule)+1 {
+				t.Fatalf("gave up after %d attempts", attempts-1)
+			}
+			break
+		}
+		total += next.Sub(now)
+	}
+	if total < 72*time.Hour {
+		t.Fatalf("retries span only %v", total)
+	}
+}
+
+func TestSendWebhookSignsAndRequires2xx(t *testing.T) {
+	status := http.StatusOK
+	var gotSig, gotBody string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotSig = r.Header.Get(webhookSignatureHeader)
+		b, _ := io.ReadAll(r.Body)
+		gotBody = string(b)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	now := time.Now()
+	job := webhookJob{
+		DeliveryID:       "d1",
+		EventID:          9,
+		EventType:        "refund.succeeded",
+		Payload:          []byte(`{"id":9}`),
+		URL:              srv.URL,
+		Secret:           "whsec_new",
+		PreviousSecret:   "whsec_old",
+		PreviousSecretTo: sql.NullTime{Time: now.Add(-time.Hour), Valid: true},
+	}
+
+	res := sendWebhook(context.Background(), srv.Client(), job, now)
+	if !res.ok() {
+		t.Fatalf("expected success, got %+v", res)
+	}
+	if err := verifyWebhookSignature(gotSig, "whsec_new", []byte(gotBody), now, time.Minute); err != nil {
+		t.Fatalf("signature does not verify: %v", err)
+	}
+	if strings.Count(gotSig, "v1=") != 1 {
+		t.Fatalf("expired previous secret still signs: %q", gotSig)
+	}
+
+	status = http.StatusBadGateway
+	if res := sendWebhook(context.Background(), srv.Client(), job, now); res.ok() || res.StatusCode != http.StatusBadGateway {
+		t.Fatalf("expected failure on 502, got %+v", res)
+	}
+}
+
+func TestWebhooksUnknownPathReturns404(t *testing.T) {
+	st := &appState{}
+	h := newTestMux(st, "payments-service", "test")
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/webhooks/nope", nil)
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", rr.Code)
+	}
+}